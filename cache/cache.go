@@ -0,0 +1,242 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultShards = 16
+	// minShardCapacity keeps small caches in fewer shards, so each shard can keep a reasonable number of blocks
+	minShardCapacity = 512 * 1024
+)
+
+type (
+	// Key identifies a block: table file number, kind of the file within the table and offset of the block
+	Key struct {
+		FileNum uint64
+		Kind    uint8
+		Offset  int64
+	}
+
+	// Stats keeps counters of the cache
+	Stats struct {
+		Hits         uint64
+		Misses       uint64
+		Evictions    uint64
+		Blocks       int
+		PinnedBlocks int
+		Size         int64 // bytes kept in evictable blocks
+		PinnedSize   int64 // bytes kept in pinned blocks
+	}
+
+	// Cache is sharded, size-bounded LRU cache of table blocks.
+	// Blocks can be pinned (i.e. index blocks) so they are never evicted till they are unpinned. Pinned blocks
+	// are kept outside of the capacity, see Stats.PinnedSize. Cache is thread-safe.
+	Cache struct {
+		shards []*shard
+
+		hits      atomic.Uint64
+		misses    atomic.Uint64
+		evictions atomic.Uint64
+	}
+
+	shard struct {
+		mu       sync.Mutex
+		capacity int64
+		size     int64
+		pinned   int64
+		entries  map[Key]*entry
+		lru      *list.List // evictable entries only, most recently used first
+	}
+
+	entry struct {
+		key   Key
+		value []byte
+		pins  int
+		elem  *list.Element
+	}
+)
+
+// New creates a cache which keeps up to capacity bytes of evictable blocks, pinned blocks are not counted
+func New(capacity int64) *Cache {
+	return NewSharded(capacity, defaultShards)
+}
+
+// NewSharded creates a cache split into given number of shards, each with its own lock. Capacity is split
+// between shards, so small cache is split into fewer shards.
+func NewSharded(capacity int64, shards int) *Cache {
+	shards = int(min(int64(shards), capacity/minShardCapacity))
+	if shards < 1 {
+		shards = 1
+	}
+	c := &Cache{
+		shards: make([]*shard, shards),
+	}
+	for i := range c.shards {
+		shardCapacity := capacity / int64(shards)
+		if int64(i) < capacity%int64(shards) {
+			shardCapacity++
+		}
+		c.shards[i] = &shard{
+			capacity: shardCapacity,
+			entries:  make(map[Key]*entry),
+			lru:      list.New(),
+		}
+	}
+	return c
+}
+
+// Get returns cached block and marks it as recently used
+func (c *Cache) Get(key Key) ([]byte, bool) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	if e.elem != nil {
+		s.lru.MoveToFront(e.elem)
+	}
+	return e.value, true
+}
+
+// Set puts block into the cache evicting the least recently used blocks if needed.
+// Block must not be modified once it's cached.
+func (c *Cache) Set(key Key, value []byte) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[key]; ok {
+		// blocks are immutable so there is nothing to update
+		if e.elem != nil {
+			s.lru.MoveToFront(e.elem)
+		}
+		return
+	}
+	if int64(len(value)) > s.capacity {
+		return
+	}
+
+	e := &entry{key: key, value: value}
+	e.elem = s.lru.PushFront(e)
+	s.entries[key] = e
+	s.size += int64(len(value))
+	c.evict(s)
+}
+
+// Pin puts block into the cache (if it's not there yet) and protects it from eviction.
+// Returned value is cached block which should be used instead of passed one.
+// Each Pin must be followed by Unpin.
+func (c *Cache) Pin(key Key, value []byte) []byte {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		e = &entry{key: key, value: value}
+		s.entries[key] = e
+	} else if e.elem != nil {
+		s.lru.Remove(e.elem)
+		e.elem = nil
+		s.size -= int64(len(e.value))
+	}
+	if e.pins == 0 {
+		s.pinned += int64(len(e.value))
+	}
+	e.pins++
+	return e.value
+}
+
+// Unpin releases the block pinned before. Once it's no longer pinned it can be evicted like any other block.
+func (c *Cache) Unpin(key Key) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok || e.pins == 0 {
+		return
+	}
+	e.pins--
+	if e.pins > 0 {
+		return
+	}
+	s.pinned -= int64(len(e.value))
+	e.elem = s.lru.PushFront(e)
+	s.size += int64(len(e.value))
+	c.evict(s)
+}
+
+// EvictFile drops all blocks of given file, i.e. when table has been deleted. Pinned blocks are still used,
+// so they are kept till they are unpinned and evicted like any other block afterwards.
+func (c *Cache) EvictFile(fileNum uint64) {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for key, e := range s.entries {
+			if key.FileNum != fileNum || e.pins > 0 {
+				continue
+			}
+			c.remove(s, e)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Stats returns current counters of the cache
+func (c *Cache) Stats() Stats {
+	stats := Stats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		stats.Size += s.size
+		stats.PinnedSize += s.pinned
+		stats.Blocks += len(s.entries)
+		stats.PinnedBlocks += len(s.entries) - s.lru.Len()
+		s.mu.Unlock()
+	}
+	return stats
+}
+
+func (c *Cache) shard(key Key) *shard {
+	// FNV-1a over the key fields
+	h := uint64(14695981039346656037)
+	for _, v := range [...]uint64{key.FileNum, uint64(key.Kind), uint64(key.Offset)} {
+		h ^= v
+		h *= 1099511628211
+	}
+	return c.shards[h%uint64(len(c.shards))]
+}
+
+// evict drops the least recently used blocks till shard fits its capacity. Shard must be locked.
+func (c *Cache) evict(s *shard) {
+	for s.size > s.capacity {
+		last := s.lru.Back()
+		if last == nil {
+			return
+		}
+		c.remove(s, last.Value.(*entry))
+		c.evictions.Add(1)
+	}
+}
+
+// remove drops the entry from the shard. Shard must be locked.
+func (c *Cache) remove(s *shard, e *entry) {
+	delete(s.entries, e.key)
+	if e.elem != nil {
+		s.lru.Remove(e.elem)
+		s.size -= int64(len(e.value))
+	} else {
+		s.pinned -= int64(len(e.value))
+	}
+}
@@ -0,0 +1,203 @@
+package cache_test
+
+import (
+	"challenge-lsm-store/cache"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func Test_Cache_GetSet(t *testing.T) {
+	t.Parallel()
+
+	c := cache.NewSharded(100, 1)
+	key := cache.Key{FileNum: 1, Kind: 2, Offset: 3}
+
+	_, ok := c.Get(key)
+	assert.False(t, ok, "block must not be cached yet")
+
+	c.Set(key, []byte("block"))
+	v, ok := c.Get(key)
+	assert.True(t, ok, "block not cached")
+	assert.Equal(t, []byte("block"), v, "unexpected block")
+
+	_, ok = c.Get(cache.Key{FileNum: 2, Kind: 2, Offset: 3})
+	assert.False(t, ok, "block of other file must not be found")
+
+	stats := c.Stats()
+	assert.Equal(t, uint64(1), stats.Hits, "unexpected hits")
+	assert.Equal(t, uint64(2), stats.Misses, "unexpected misses")
+	assert.Equal(t, int64(5), stats.Size, "unexpected size")
+	assert.Equal(t, 1, stats.Blocks, "unexpected blocks")
+}
+
+func Test_Cache_EvictLeastRecentlyUsed(t *testing.T) {
+	t.Parallel()
+
+	c := cache.NewSharded(10, 1)
+	key1 := cache.Key{FileNum: 1}
+	key2 := cache.Key{FileNum: 2}
+	key3 := cache.Key{FileNum: 3}
+
+	c.Set(key1, []byte("1111"))
+	c.Set(key2, []byte("2222"))
+	_, _ = c.Get(key1) // key2 becomes the least recently used one
+	c.Set(key3, []byte("3333"))
+
+	_, ok := c.Get(key1)
+	assert.True(t, ok, "recently used block must be kept")
+	_, ok = c.Get(key2)
+	assert.False(t, ok, "least recently used block must be evicted")
+	_, ok = c.Get(key3)
+	assert.True(t, ok, "new block must be kept")
+
+	stats := c.Stats()
+	assert.Equal(t, uint64(1), stats.Evictions, "unexpected evictions")
+	assert.Equal(t, int64(8), stats.Size, "unexpected size")
+}
+
+func Test_Cache_SkipBlocksBiggerThanCapacity(t *testing.T) {
+	t.Parallel()
+
+	c := cache.NewSharded(4, 1)
+	c.Set(cache.Key{}, []byte("too big"))
+
+	_, ok := c.Get(cache.Key{})
+	assert.False(t, ok, "block bigger than capacity must not be cached")
+}
+
+func Test_Cache_SmallCapacity(t *testing.T) {
+	t.Parallel()
+
+	//GIVEN cache smaller than its default number of shards
+	c := cache.New(10)
+
+	//WHEN blocks of its whole capacity are cached
+	c.Set(cache.Key{FileNum: 1}, []byte("12345"))
+	c.Set(cache.Key{FileNum: 2}, []byte("12345"))
+
+	//THEN all of them are kept
+	for _, num := range []uint64{1, 2} {
+		_, ok := c.Get(cache.Key{FileNum: num})
+		assert.True(t, ok, "block of file %d must be cached", num)
+	}
+	assert.Equal(t, uint64(0), c.Stats().Evictions, "no eviction expected")
+}
+
+func Test_Cache_CapacityOfShards(t *testing.T) {
+	t.Parallel()
+
+	//GIVEN sharded cache whose capacity can't be split evenly
+	const capacity = 4*1024*1024 + 3
+	c := cache.New(capacity)
+
+	//WHEN many more blocks than it can keep are cached
+	block := make([]byte, 1024)
+	for i := 0; i < 2*capacity/len(block); i++ {
+		c.Set(cache.Key{FileNum: 1, Offset: int64(i)}, block)
+	}
+
+	//THEN the cache keeps nearly its whole capacity
+	size := c.Stats().Size
+	assert.LessOrEqual(t, size, int64(capacity), "cache exceeds its capacity")
+	assert.Greater(t, size, int64(capacity*9/10), "cache must use most of its capacity")
+}
+
+func Test_Cache_PinnedBlocksAreNotEvicted(t *testing.T) {
+	t.Parallel()
+
+	c := cache.NewSharded(4, 1)
+	pinned := cache.Key{FileNum: 1}
+
+	v := c.Pin(pinned, []byte("pinned block"))
+	assert.Equal(t, []byte("pinned block"), v, "unexpected pinned block")
+	for i := 0; i < 10; i++ {
+		c.Set(cache.Key{FileNum: 2, Offset: int64(i)}, []byte("1234"))
+	}
+
+	v, ok := c.Get(pinned)
+	assert.True(t, ok, "pinned block must not be evicted")
+	assert.Equal(t, []byte("pinned block"), v, "unexpected pinned block")
+	stats := c.Stats()
+	assert.Equal(t, 1, stats.PinnedBlocks, "unexpected pinned blocks")
+	assert.Equal(t, int64(12), stats.PinnedSize, "unexpected pinned size")
+
+	// once unpinned it's bigger than capacity so it's evicted at once
+	c.Unpin(pinned)
+	_, ok = c.Get(pinned)
+	assert.False(t, ok, "unpinned block must be evicted")
+	assert.Equal(t, int64(0), c.Stats().PinnedSize, "unexpected pinned size")
+}
+
+func Test_Cache_PinReturnsCachedBlock(t *testing.T) {
+	t.Parallel()
+
+	c := cache.NewSharded(100, 1)
+	key := cache.Key{FileNum: 1}
+
+	c.Set(key, []byte("cached"))
+	v := c.Pin(key, []byte("new"))
+	assert.Equal(t, []byte("cached"), v, "already cached block must be returned")
+
+	c.Unpin(key)
+	v, ok := c.Get(key)
+	assert.True(t, ok, "unpinned block must stay in the cache")
+	assert.Equal(t, []byte("cached"), v, "unexpected block")
+}
+
+func Test_Cache_EvictFile(t *testing.T) {
+	t.Parallel()
+
+	c := cache.New(1000)
+	for i := 0; i < 10; i++ {
+		c.Set(cache.Key{FileNum: 1, Offset: int64(i)}, []byte("block"))
+		c.Set(cache.Key{FileNum: 2, Offset: int64(i)}, []byte("block"))
+	}
+	c.Pin(cache.Key{FileNum: 1, Kind: 1}, []byte("index"))
+
+	c.EvictFile(1)
+
+	for i := 0; i < 10; i++ {
+		_, ok := c.Get(cache.Key{FileNum: 1, Offset: int64(i)})
+		assert.Falsef(t, ok, "block of evicted file found: %d", i)
+		_, ok = c.Get(cache.Key{FileNum: 2, Offset: int64(i)})
+		assert.Truef(t, ok, "block of other file not found: %d", i)
+	}
+	stats := c.Stats()
+	assert.Equal(t, 11, stats.Blocks, "unexpected blocks")
+	assert.Equal(t, int64(5), stats.PinnedSize, "pinned block must be kept")
+
+	c.Unpin(cache.Key{FileNum: 1, Kind: 1})
+	stats = c.Stats()
+	assert.Equal(t, int64(0), stats.PinnedSize, "unexpected pinned size")
+	assert.Equal(t, int64(10*5+5), stats.Size, "unpinned block must be evictable")
+}
+
+func Test_Cache_ConcurrentAccess(t *testing.T) {
+	t.Parallel()
+
+	const routines = 10
+
+	c := cache.New(1000)
+	var wg sync.WaitGroup
+	wg.Add(routines)
+	for r := 0; r < routines; r++ {
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 100; i++ {
+				key := cache.Key{FileNum: uint64(i % 7), Offset: int64(i)}
+				c.Set(key, []byte(fmt.Sprintf("block-%d", i)))
+				if v, ok := c.Get(key); ok {
+					assert.Equal(t, []byte(fmt.Sprintf("block-%d", i)), v, "unexpected block")
+				}
+				c.Pin(key, nil)
+				c.Unpin(key)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.LessOrEqual(t, c.Stats().Size, int64(1000), "cache exceeds its capacity")
+}
@@ -0,0 +1,95 @@
+package kv
+
+import "bytes"
+
+// Comparer orders keys. Tables record name of their comparer, so they are never read using a different order.
+type Comparer interface {
+	// Compare returns -1, 0 or +1 when a is smaller than, equal to or bigger than b
+	Compare(a, b []byte) int
+	// Name identifies the order, it must change whenever the order changes
+	Name() string
+	// Separator returns a short key k such that a <= k < b, a < b. It's used to shorten index keys.
+	Separator(a, b []byte) []byte
+	// Successor returns a short key k such that a <= k. It's used to shorten the last index key.
+	Successor(a []byte) []byte
+}
+
+var (
+	// BytewiseComparer orders keys lexicographically, it's the default order
+	BytewiseComparer Comparer = bytewiseComparer{}
+	// LittleEndianComparer orders keys as little-endian unsigned integers, i.e. compares their bytes
+	// from the last one. Keys of the same length (e.g. encoded uint64) are ordered by their numeric value.
+	LittleEndianComparer Comparer = littleEndianComparer{}
+)
+
+type (
+	bytewiseComparer     struct{}
+	littleEndianComparer struct{}
+)
+
+func (bytewiseComparer) Compare(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+func (bytewiseComparer) Name() string {
+	return "kv.BytewiseComparer"
+}
+
+// Separator returns the common prefix followed by the first differing byte of a incremented, when it's possible
+func (bytewiseComparer) Separator(a, b []byte) []byte {
+	n := min(len(a), len(b))
+	i := 0
+	for i < n && a[i] == b[i] {
+		i++
+	}
+	if i < n && a[i] < 0xff && a[i]+1 < b[i] {
+		k := bytes.Clone(a[:i+1])
+		k[i]++
+		return k
+	}
+	return bytes.Clone(a)
+}
+
+// Successor increments the first byte which can be incremented and drops the rest
+func (bytewiseComparer) Successor(a []byte) []byte {
+	for i, c := range a {
+		if c != 0xff {
+			k := bytes.Clone(a[:i+1])
+			k[i]++
+			return k
+		}
+	}
+	return bytes.Clone(a)
+}
+
+func (littleEndianComparer) Compare(a, b []byte) int {
+	for i, j := len(a)-1, len(b)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if a[i] != b[j] {
+			if a[i] < b[j] {
+				return -1
+			}
+			return +1
+		}
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return +1
+	}
+	return 0
+}
+
+func (littleEndianComparer) Name() string {
+	return "kv.LittleEndianComparer"
+}
+
+// Separator doesn't shorten keys, numeric keys are short already
+func (littleEndianComparer) Separator(a, _ []byte) []byte {
+	return bytes.Clone(a)
+}
+
+// Successor doesn't shorten keys, numeric keys are short already
+func (littleEndianComparer) Successor(a []byte) []byte {
+	return bytes.Clone(a)
+}
@@ -0,0 +1,50 @@
+package kv_test
+
+import (
+	"challenge-lsm-store/kv"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_KV_BytewiseComparerShortensKeys(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		a, b []byte
+		exp  []byte
+	}{
+		{name: "shortened", a: []byte("abcdef"), b: []byte("abzz"), exp: []byte("abd")},
+		{name: "adjacent bytes", a: []byte("abc"), b: []byte("abd"), exp: []byte("abc")},
+		{name: "prefix", a: []byte("ab"), b: []byte("abc"), exp: []byte("ab")},
+		{name: "max byte", a: []byte{'a', 0xff, 1}, b: []byte{'b'}, exp: []byte{'a', 0xff, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := kv.BytewiseComparer.Separator(tt.a, tt.b)
+			assert.Equal(t, tt.exp, k, "unexpected separator")
+			assert.True(t, kv.BytewiseComparer.Compare(tt.a, k) <= 0, "separator must not be smaller than a")
+			assert.True(t, kv.BytewiseComparer.Compare(k, tt.b) < 0, "separator must be smaller than b")
+		})
+	}
+
+	assert.Equal(t, []byte("b"), kv.BytewiseComparer.Successor([]byte("abc")), "unexpected successor")
+	assert.Equal(t, []byte{0xff, 0xff}, kv.BytewiseComparer.Successor([]byte{0xff, 0xff}), "unexpected successor")
+}
+
+func Test_KV_LittleEndianComparerOrdersNumbers(t *testing.T) {
+	t.Parallel()
+
+	key := func(n uint64) []byte {
+		return binary.LittleEndian.AppendUint64(nil, n)
+	}
+	numbers := []uint64{0, 1, 255, 256, 1 << 32, 1<<64 - 1}
+	for i := 1; i < len(numbers); i++ {
+		a, b := key(numbers[i-1]), key(numbers[i])
+		assert.Equalf(t, -1, kv.LittleEndianComparer.Compare(a, b), "%d must be smaller than %d", numbers[i-1], numbers[i])
+		assert.Equalf(t, +1, kv.LittleEndianComparer.Compare(b, a), "%d must be bigger than %d", numbers[i], numbers[i-1])
+		assert.Equalf(t, 0, kv.LittleEndianComparer.Compare(a, a), "%d must be equal to itself", numbers[i-1])
+	}
+	assert.NotEqual(t, kv.BytewiseComparer.Name(), kv.LittleEndianComparer.Name(), "orders must have different names")
+}
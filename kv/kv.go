@@ -0,0 +1,116 @@
+package kv
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+type (
+	// Kind marks type of stored entry
+	Kind uint8
+
+	// SeqNum orders changes, entry with higher sequence number is newer
+	SeqNum = uint64
+
+	// Value is an envelope of value kept in WAL, memory and tables
+	Value struct {
+		Kind      Kind
+		Seq       SeqNum
+		ExpiresAt int64 // unix time (nanoseconds) once the value expires, 0 means it never expires
+		Payload   []byte
+	}
+)
+
+const (
+	KindDelete Kind = 0 // tombstone
+	KindSet    Kind = 1
+	KindMerge  Kind = 2 // operand combined with older values of the key by a merge operator
+
+	// kindExpiringSet is KindSet whose header is followed by expiry time
+	kindExpiringSet Kind = 3
+	// KindRangeDelete deletes keys of a range, the key of the change is the start of the range (inclusive)
+	// and its payload is the end of the range (exclusive). It's kept in WAL and memory only.
+	KindRangeDelete Kind = 4
+
+	headerSize = 1 + 8
+	expirySize = 8
+)
+
+var ErrInvalidValue = errors.New("invalid value envelope")
+
+// EncodeValue wraps payload into an envelope
+func EncodeValue(kind Kind, seq SeqNum, payload []byte) []byte {
+	encoded := make([]byte, headerSize+len(payload))
+	encoded[0] = byte(kind)
+	binary.BigEndian.PutUint64(encoded[1:headerSize], seq)
+	copy(encoded[headerSize:], payload)
+	return encoded
+}
+
+// EncodeExpiringValue wraps payload of a value expiring at given unix time (nanoseconds) into an envelope
+func EncodeExpiringValue(seq SeqNum, expiresAt int64, payload []byte) []byte {
+	if expiresAt == 0 {
+		return EncodeValue(KindSet, seq, payload)
+	}
+	encoded := make([]byte, headerSize+expirySize+len(payload))
+	encoded[0] = byte(kindExpiringSet)
+	binary.BigEndian.PutUint64(encoded[1:headerSize], seq)
+	binary.BigEndian.PutUint64(encoded[headerSize:headerSize+expirySize], uint64(expiresAt))
+	copy(encoded[headerSize+expirySize:], payload)
+	return encoded
+}
+
+// WithSeq returns copy of the envelope whose sequence number is replaced by given one
+func WithSeq(encoded []byte, seq SeqNum) ([]byte, error) {
+	if len(encoded) < headerSize {
+		return nil, ErrInvalidValue
+	}
+	stamped := append([]byte(nil), encoded...)
+	binary.BigEndian.PutUint64(stamped[1:headerSize], seq)
+	return stamped, nil
+}
+
+// DecodeValue unwraps envelope. Payload points at encoded bytes.
+func DecodeValue(encoded []byte) (Value, error) {
+	if len(encoded) < headerSize {
+		return Value{}, ErrInvalidValue
+	}
+	v := Value{
+		Kind:    Kind(encoded[0]),
+		Seq:     binary.BigEndian.Uint64(encoded[1:headerSize]),
+		Payload: encoded[headerSize:],
+	}
+	switch v.Kind {
+	case KindDelete, KindSet, KindMerge, KindRangeDelete:
+		return v, nil
+	case kindExpiringSet:
+		if len(v.Payload) < expirySize {
+			return Value{}, ErrInvalidValue
+		}
+		v.Kind, v.ExpiresAt = KindSet, int64(binary.BigEndian.Uint64(v.Payload))
+		v.Payload = v.Payload[expirySize:]
+		return v, nil
+	default:
+		return Value{}, ErrInvalidValue
+	}
+}
+
+// IsTombstone tells whether value marks deleted key
+func (v Value) IsTombstone() bool {
+	return v.Kind == KindDelete
+}
+
+// IsMerge tells whether value is a merge operand
+func (v Value) IsMerge() bool {
+	return v.Kind == KindMerge
+}
+
+// IsRangeDelete tells whether value deletes a range of keys
+func (v Value) IsRangeDelete() bool {
+	return v.Kind == KindRangeDelete
+}
+
+// IsExpired tells whether value has expired at given unix time (nanoseconds)
+func (v Value) IsExpired(now int64) bool {
+	return v.ExpiresAt != 0 && v.ExpiresAt <= now
+}
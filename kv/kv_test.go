@@ -0,0 +1,92 @@
+package kv_test
+
+import (
+	"challenge-lsm-store/kv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_KV_EncodeDecodeValue(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		value kv.Value
+	}{
+		{
+			name:  "set",
+			value: kv.Value{Kind: kv.KindSet, Seq: 123, Payload: []byte("value")},
+		},
+		{
+			name:  "set empty value",
+			value: kv.Value{Kind: kv.KindSet, Seq: 1, Payload: []byte{}},
+		},
+		{
+			name:  "delete",
+			value: kv.Value{Kind: kv.KindDelete, Seq: 1 << 60, Payload: []byte{}},
+		},
+		{
+			name:  "merge",
+			value: kv.Value{Kind: kv.KindMerge, Seq: 7, Payload: []byte("operand")},
+		},
+		{
+			name:  "range delete",
+			value: kv.Value{Kind: kv.KindRangeDelete, Seq: 9, Payload: []byte("end")},
+		},
+		{
+			name:  "set expiring value",
+			value: kv.Value{Kind: kv.KindSet, Seq: 8, ExpiresAt: 1700000000e9, Payload: []byte("value")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := kv.EncodeValue(tt.value.Kind, tt.value.Seq, tt.value.Payload)
+			if tt.value.ExpiresAt != 0 {
+				encoded = kv.EncodeExpiringValue(tt.value.Seq, tt.value.ExpiresAt, tt.value.Payload)
+			}
+			v, err := kv.DecodeValue(encoded)
+			require.NoError(t, err, "decode error")
+			assert.Equal(t, tt.value, v, "unexpected value")
+		})
+	}
+}
+
+func Test_KV_DecodeInvalidValue(t *testing.T) {
+	t.Parallel()
+
+	_, err := kv.DecodeValue([]byte("short"))
+	assert.Equal(t, kv.ErrInvalidValue, err, "unexpected error for too short value")
+
+	_, err = kv.DecodeValue(append([]byte{0xff}, make([]byte, 8)...))
+	assert.Equal(t, kv.ErrInvalidValue, err, "unexpected error for unknown kind")
+}
+
+func Test_KV_ExpiredValue(t *testing.T) {
+	t.Parallel()
+
+	v, err := kv.DecodeValue(kv.EncodeExpiringValue(1, 100, []byte("value")))
+	require.NoError(t, err, "decode error")
+	assert.False(t, v.IsExpired(99), "value must not expire before its time")
+	assert.True(t, v.IsExpired(100), "value must expire at its time")
+
+	v, err = kv.DecodeValue(kv.EncodeValue(kv.KindSet, 1, []byte("value")))
+	require.NoError(t, err, "decode error")
+	assert.False(t, v.IsExpired(1<<62), "value without expiry must never expire")
+}
+
+func Test_KV_WithSeq(t *testing.T) {
+	t.Parallel()
+
+	encoded := kv.EncodeExpiringValue(0, 100, []byte("value"))
+	stamped, err := kv.WithSeq(encoded, 42)
+	require.NoError(t, err, "stamp error")
+
+	v, err := kv.DecodeValue(stamped)
+	require.NoError(t, err, "decode error")
+	assert.Equal(t, kv.Value{Kind: kv.KindSet, Seq: 42, ExpiresAt: 100, Payload: []byte("value")}, v, "unexpected value")
+	assert.Equal(t, kv.EncodeExpiringValue(0, 100, []byte("value")), encoded, "given envelope must not be changed")
+
+	_, err = kv.WithSeq([]byte("short"), 42)
+	assert.Equal(t, kv.ErrInvalidValue, err, "unexpected error for too short value")
+}
@@ -0,0 +1,55 @@
+package kv
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// PrefixExtractor extracts prefixes of keys, tables keep bloom filters of prefixes of their keys.
+// Prefix must be extracted from all keys starting with it, so it can be looked up by its own prefix.
+// Tables record name of their extractor, so filters are never checked using a different one.
+type PrefixExtractor interface {
+	// Name identifies the extractor, it must change whenever extracted prefixes change
+	Name() string
+	// Prefix returns prefix of the key, false is returned when the key has no prefix
+	Prefix(key []byte) ([]byte, bool)
+}
+
+type (
+	fixedPrefix     int
+	separatorPrefix byte
+)
+
+// FixedPrefix extracts first n bytes of keys, shorter keys have no prefix
+func FixedPrefix(n int) PrefixExtractor {
+	return fixedPrefix(n)
+}
+
+// SeparatorPrefix extracts keys up to the first separator (inclusive), i.e. term of `term\x00docID`.
+// Keys without separator have no prefix.
+func SeparatorPrefix(sep byte) PrefixExtractor {
+	return separatorPrefix(sep)
+}
+
+func (p fixedPrefix) Name() string {
+	return fmt.Sprintf("kv.FixedPrefix(%d)", int(p))
+}
+
+func (p fixedPrefix) Prefix(key []byte) ([]byte, bool) {
+	if len(key) < int(p) {
+		return nil, false
+	}
+	return key[:p], true
+}
+
+func (p separatorPrefix) Name() string {
+	return fmt.Sprintf("kv.SeparatorPrefix(%#x)", byte(p))
+}
+
+func (p separatorPrefix) Prefix(key []byte) ([]byte, bool) {
+	i := bytes.IndexByte(key, byte(p))
+	if i < 0 {
+		return nil, false
+	}
+	return key[:i+1], true
+}
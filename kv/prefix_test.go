@@ -0,0 +1,36 @@
+package kv_test
+
+import (
+	"challenge-lsm-store/kv"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_KV_PrefixExtractors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		extractor kv.PrefixExtractor
+		key       string
+		exp       string
+		ok        bool
+	}{
+		{name: "fixed", extractor: kv.FixedPrefix(3), key: "user42", exp: "use", ok: true},
+		{name: "fixed of prefix", extractor: kv.FixedPrefix(3), key: "use", exp: "use", ok: true},
+		{name: "fixed of short key", extractor: kv.FixedPrefix(3), key: "us"},
+		{name: "separator", extractor: kv.SeparatorPrefix(0), key: "term\x00doc1", exp: "term\x00", ok: true},
+		{name: "separator of prefix", extractor: kv.SeparatorPrefix(0), key: "term\x00", exp: "term\x00", ok: true},
+		{name: "no separator", extractor: kv.SeparatorPrefix(0), key: "term"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefix, ok := tt.extractor.Prefix([]byte(tt.key))
+			assert.Equal(t, tt.ok, ok, "unexpected domain of %s", tt.key)
+			assert.Equal(t, tt.exp, string(prefix), "unexpected prefix of %s", tt.key)
+		})
+	}
+
+	assert.Equal(t, "kv.FixedPrefix(3)", kv.FixedPrefix(3).Name(), "unexpected name")
+	assert.Equal(t, "kv.SeparatorPrefix(0x0)", kv.SeparatorPrefix(0).Name(), "unexpected name")
+}
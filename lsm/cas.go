@@ -0,0 +1,61 @@
+package lsm
+
+import (
+	"bytes"
+	"challenge-lsm-store/kv"
+)
+
+// CompareAndSwap sets value of the key in the default column family only when its current value equals expected one,
+// nil expected value means that the key doesn't exist. It tells whether the value has been set.
+func (t *Tree) CompareAndSwap(key, expected, value []byte) (bool, error) {
+	swapped := false
+	err := t.update(key, func(old []byte) ([]byte, bool) {
+		if (old == nil) != (expected == nil) || !bytes.Equal(old, expected) {
+			return nil, false
+		}
+		swapped = true
+		return value, true
+	})
+	return swapped, err
+}
+
+// PutIfAbsent sets value of the key in the default column family only when the key doesn't exist.
+// It tells whether the value has been set.
+func (t *Tree) PutIfAbsent(key, value []byte) (bool, error) {
+	return t.CompareAndSwap(key, nil, value)
+}
+
+// Update replaces value of the key in the default column family by the value returned by fn for the current one.
+// Current value is nil when the key doesn't exist, the key is deleted when fn returns nil.
+// No other change is written while fn runs, so it must be fast.
+func (t *Tree) Update(key []byte, fn func(old []byte) []byte) error {
+	return t.update(key, func(old []byte) ([]byte, bool) {
+		return fn(old), true
+	})
+}
+
+// update changes the key by fn under the lock of current memory, fn tells whether the key should be changed
+func (t *Tree) update(key []byte, fn func(old []byte) ([]byte, bool)) error {
+	return t.write(func() error {
+		// value may be kept in memory or tables, any of them is read under the lock
+		encoded, found, err := t.latest(defaultColumnFamilyID, key)
+		if err != nil {
+			return err
+		}
+		var old []byte
+		if found {
+			if old, err = payloadOf(encoded); err != nil {
+				return err
+			}
+		}
+
+		value, ok := fn(old)
+		if !ok {
+			return nil
+		}
+		if value == nil {
+			return t.current.Put(key, kv.EncodeValue(kv.KindDelete, t.seq.Add(1), nil))
+		}
+		return t.current.Put(key, kv.EncodeValue(kv.KindSet, t.seq.Add(1), value))
+	})
+}
@@ -0,0 +1,114 @@
+package lsm
+
+import (
+	"challenge-lsm-store/vfs"
+	"context"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+func Test_LSM_CAS_CompareAndSwap(t *testing.T) {
+	//GIVEN a tree with a key kept in a table
+	tree, err := Open(testDir, WithFS(vfs.NewMemFS()))
+	require.Nil(t, err, "open error")
+	require.Nil(t, tree.Put([]byte("key"), []byte("v1")), "put error")
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+
+	//WHEN the value is swapped with a wrong expected value
+	swapped, err := tree.CompareAndSwap([]byte("key"), []byte("v0"), []byte("v2"))
+
+	//THEN it's kept
+	require.Nil(t, err, "cas error")
+	assert.False(t, swapped, "value must not be swapped")
+	v, err := tree.Get([]byte("key"))
+	assert.Nil(t, err, "get error")
+	assert.Equal(t, []byte("v1"), v, "old value expected")
+
+	//WHEN the value is swapped with the current value
+	swapped, err = tree.CompareAndSwap([]byte("key"), []byte("v1"), []byte("v2"))
+
+	//THEN it's changed
+	require.Nil(t, err, "cas error")
+	assert.True(t, swapped, "value must be swapped")
+	v, err = tree.Get([]byte("key"))
+	assert.Nil(t, err, "get error")
+	assert.Equal(t, []byte("v2"), v, "new value expected")
+
+	//AND missing key is expected as nil only
+	swapped, err = tree.CompareAndSwap([]byte("missing"), []byte{}, []byte("v"))
+	assert.Nil(t, err, "cas error")
+	assert.False(t, swapped, "empty value must not match missing key")
+	swapped, err = tree.CompareAndSwap([]byte("missing"), nil, []byte("v"))
+	assert.Nil(t, err, "cas error")
+	assert.True(t, swapped, "missing key must be set")
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_CAS_PutIfAbsent(t *testing.T) {
+	//GIVEN a tree with a deleted key
+	tree, err := Open(testDir, WithFS(vfs.NewMemFS()))
+	require.Nil(t, err, "open error")
+	require.Nil(t, tree.Put([]byte("deleted"), []byte("old")), "put error")
+	require.Nil(t, tree.Delete([]byte("deleted")), "delete error")
+
+	//WHEN keys are put if absent
+	inserted, err := tree.PutIfAbsent([]byte("deleted"), []byte("v1"))
+	require.Nil(t, err, "put error")
+	assert.True(t, inserted, "deleted key must be set")
+	inserted, err = tree.PutIfAbsent([]byte("deleted"), []byte("v2"))
+	require.Nil(t, err, "put error")
+
+	//THEN the existing key is kept
+	assert.False(t, inserted, "existing key must not be set")
+	v, err := tree.Get([]byte("deleted"))
+	assert.Nil(t, err, "get error")
+	assert.Equal(t, []byte("v1"), v, "first value expected")
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_CAS_Update(t *testing.T) {
+	//GIVEN a tree rotating memory often
+	tree, err := Open(testDir, WithFS(vfs.NewMemFS()), WithMemtableSize(100))
+	require.Nil(t, err, "open error")
+	key := []byte("count")
+
+	//WHEN the counter is incremented by many goroutines
+	const goroutines, increments = 8, 100
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < increments; n++ {
+				err := tree.Update(key, func(old []byte) []byte {
+					var count uint64
+					if old != nil {
+						count = binary.BigEndian.Uint64(old)
+					}
+					return binary.BigEndian.AppendUint64(nil, count+1)
+				})
+				if !assert.Nil(t, err, "update error") {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	//THEN no increment is lost
+	v, err := tree.Get(key)
+	require.Nil(t, err, "get error")
+	assert.Equal(t, uint64(goroutines*increments), binary.BigEndian.Uint64(v), "unexpected count")
+
+	//WHEN nil value is returned
+	require.Nil(t, tree.Update(key, func([]byte) []byte { return nil }), "update error")
+
+	//THEN the key is deleted
+	v, err = tree.Get(key)
+	assert.Nil(t, err, "get error")
+	assert.Nil(t, v, "key must be deleted")
+	require.Nil(t, tree.Close(), "close error")
+}
@@ -0,0 +1,343 @@
+package lsm
+
+import (
+	"bytes"
+	"challenge-lsm-store/kv"
+	"challenge-lsm-store/sstable"
+	"errors"
+)
+
+const levelSizeMultiplier = 10
+
+type (
+	compactionOptions struct {
+		l0Trigger      int         // number of L0 tables
+		baseLevelSize  int         // target size of L1
+		targetFileSize int         // size of output tables
+		comparer       kv.Comparer // order of table keys
+	}
+
+	// compaction merges tables of a level with overlapping tables of the next level
+	compaction struct {
+		level          int
+		inputs         []*fileStorage // tables of the level
+		overlapping    []*fileStorage // tables of the next level
+		dropTombstones bool           // no deeper level keeps given keys, so deleted keys can be forgotten
+	}
+)
+
+// pickCompaction chooses level exceeding its limits the most. Nil is returned when all levels are within limits.
+// L0 is scored by number of tables since each of them is searched on lookup, deeper levels by size of their data.
+func pickCompaction(levels [][]*fileStorage, opts compactionOptions) *compaction {
+	best, bestScore := -1, 0.0
+	for level := 0; level < len(levels)-1; level++ {
+		var score float64
+		if level == 0 {
+			score = float64(len(levels[level])) / float64(opts.l0Trigger)
+		} else {
+			score = float64(levelSize(levels[level])) / float64(targetLevelSize(level, opts))
+		}
+		if score >= 1 && score > bestScore {
+			best, bestScore = level, score
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+
+	c := &compaction{level: best}
+	if best == 0 {
+		// L0 tables may overlap, so all of them go to the next level at once
+		c.inputs = levels[0]
+	} else {
+		c.inputs = []*fileStorage{pickTable(levels[best])}
+	}
+
+	smallest, largest := keyRange(c.inputs, opts.comparer)
+	c.overlapping = overlapping(levels[best+1], smallest, largest, opts.comparer)
+	c.dropTombstones = true
+	for _, deeper := range levels[best+2:] {
+		if len(overlapping(deeper, smallest, largest, opts.comparer)) > 0 {
+			c.dropTombstones = false
+		}
+	}
+	return c
+}
+
+// pickTable prefers table with the most tombstones since its compaction frees the most space.
+// Otherwise, the oldest table is picked.
+func pickTable(tables []*fileStorage) *fileStorage {
+	picked := tables[0]
+	for _, f := range tables[1:] {
+		density, pickedDensity := tombstoneDensity(f.table.props), tombstoneDensity(picked.table.props)
+		if density > pickedDensity ||
+			(density == pickedDensity && f.table.props.SmallestSeq < picked.table.props.SmallestSeq) {
+			picked = f
+		}
+	}
+	return picked
+}
+
+func tombstoneDensity(props sstable.Properties) float64 {
+	if props.Entries == 0 {
+		return 0
+	}
+	return float64(props.Tombstones) / float64(props.Entries)
+}
+
+// levelSize sums sizes of level tables. Tombstones are counted as big as values they delete,
+// because that's the space which is freed once they are compacted.
+func levelSize(tables []*fileStorage) int {
+	size := 0
+	for _, f := range tables {
+		size += compensatedSize(f.table.props)
+	}
+	return size
+}
+
+func compensatedSize(props sstable.Properties) int {
+	size := props.DataSize
+	if values := props.Entries - props.Tombstones; values > 0 {
+		size += props.Tombstones * props.RawValueSize / values
+	}
+	return size
+}
+
+func targetLevelSize(level int, opts compactionOptions) int {
+	size := opts.baseLevelSize
+	for l := 1; l < level; l++ {
+		size *= levelSizeMultiplier
+	}
+	return size
+}
+
+// pendingCompactionBytes estimates how many bytes must be compacted till all levels are within their limits
+func pendingCompactionBytes(levels [][]*fileStorage, opts compactionOptions) int64 {
+	var pending int64
+	if len(levels[0]) >= opts.l0Trigger {
+		pending += int64(levelSize(levels[0]))
+	}
+	for level := 1; level < len(levels)-1; level++ {
+		if excess := levelSize(levels[level]) - targetLevelSize(level, opts); excess > 0 {
+			pending += int64(excess)
+		}
+	}
+	return pending
+}
+
+// keyRange returns the smallest and the largest key of given tables
+func keyRange(tables []*fileStorage, comparer kv.Comparer) ([]byte, []byte) {
+	var smallest, largest []byte
+	for _, f := range tables {
+		if f.table.props.Entries+f.table.props.RangeTombstones == 0 {
+			continue
+		}
+		if smallest == nil || comparer.Compare(f.table.props.SmallestKey, smallest) < 0 {
+			smallest = f.table.props.SmallestKey
+		}
+		if largest == nil || comparer.Compare(f.table.props.LargestKey, largest) > 0 {
+			largest = f.table.props.LargestKey
+		}
+	}
+	return smallest, largest
+}
+
+func overlapping(tables []*fileStorage, smallest, largest []byte, comparer kv.Comparer) []*fileStorage {
+	var found []*fileStorage
+	if smallest == nil {
+		return found
+	}
+	for _, f := range tables {
+		if f.table.props.Overlaps(comparer, smallest, largest) {
+			found = append(found, f)
+		}
+	}
+	return found
+}
+
+// Compact runs compactions till all levels are within their limits.
+// Compaction running in the background is completed first.
+func (t *Tree) Compact() error {
+	t.compactionMu.Lock()
+	defer t.compactionMu.Unlock()
+	return t.compactLevels()
+}
+
+// scheduleCompaction runs compaction in the background unless one is waiting to be run already
+// or compaction style doesn't compact in the background
+func (t *Tree) scheduleCompaction() {
+	if t.cfg.CompactionStyle == CompactionNone || !t.compactionScheduled.CompareAndSwap(false, true) {
+		return
+	}
+	t.background.Add(1)
+	go func() {
+		defer t.background.Done()
+		t.compactionMu.Lock()
+		defer t.compactionMu.Unlock()
+		t.compactionScheduled.Store(false)
+		if err := t.compactLevels(); err != nil {
+			t.reportBackgroundError(err)
+		}
+	}()
+}
+
+// compactLevels compacts levels of each column family one by one. Compaction mutex must be held.
+func (t *Tree) compactLevels() error {
+	// memory is flushed in order, so a table published meanwhile is always newer than compacted ones
+	for _, cf := range t.columnFamilies() {
+		for {
+			done, err := t.compactOnce(cf)
+			if err != nil {
+				return err
+			}
+			if done {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (t *Tree) compactOnce(cf *ColumnFamily) (bool, error) {
+	view, err := t.storageProvider.FilesStorage(cf.id)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = view.Release() // TODO log error
+	}()
+
+	c := pickCompaction(view.levels, cf.cfg.compactionOptions())
+	if c == nil {
+		return true, nil
+	}
+	if err := t.compact(cf, c); err != nil {
+		return false, err
+	}
+	t.backgroundProgressed()
+	return false, nil
+}
+
+// compact merges compaction tables into new tables of the next level which replace them.
+// Keys deleted by range tombstones are dropped, tombstones are kept unless no deeper level keeps given keys.
+// Written tables are removed when compaction fails before they are published.
+func (t *Tree) compact(cf *ColumnFamily, c *compaction) error {
+	files := append(append([]*fileStorage{}, c.inputs...), c.overlapping...)
+	iterators := make([]iterator, 0, len(files))
+	removed := make([]tableFile, 0, len(files))
+	var rangeDels []sstable.RangeTombstone
+	// iterators of the tables are closed once their readers are released
+	defer func() {
+		for _, f := range files {
+			_ = f.Release() // TODO log error
+		}
+	}()
+	for _, f := range files {
+		it, err := f.NewIterator()
+		if err != nil {
+			return err
+		}
+		dels, err := f.rangeTombstones()
+		if err != nil {
+			return err
+		}
+		iterators = append(iterators, it)
+		removed = append(removed, f.table)
+		rangeDels = append(rangeDels, dels...)
+	}
+
+	var (
+		writer *tableWriter
+		added  []tableFile
+		full   bool   // table is closed once the first key of the next table is known
+		lower  []byte // the first key of the table being written, nil for the first table
+		opts   = cf.cfg.compactionOptions()
+		kept   = rangeDels
+	)
+	if c.dropTombstones {
+		kept = nil
+	}
+	// complete tables are removed as well, otherwise they would be kept till the tree is opened again
+	abort := func(err error) error {
+		if writer != nil {
+			_ = writer.Abort() // TODO log error
+		}
+		if len(added) > 0 {
+			err = errors.Join(err, t.storageProvider.RemoveTables(added))
+		}
+		return err
+	}
+	// each table keeps parts of range tombstones till the first key of the next table
+	closeTable := func(upper []byte) error {
+		for _, del := range clipRangeDels(opts.comparer, kept, lower, upper) {
+			if err := writer.AddRangeTombstone(del); err != nil {
+				return abort(err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			writer = nil // aborted already
+			return abort(err)
+		}
+		added = append(added, writer.tableAt(c.level+1))
+		writer, full, lower = nil, false, upper
+		return nil
+	}
+
+	// operands are resolved once no deeper level keeps the keys, expired values are dropped like deleted ones
+	merged := newMergingIterator(opts.comparer, iterators...).
+		resolveMerges(cf.cfg.MergeOperator, c.dropTombstones).
+		expireAt(cf.cfg.now()).
+		withRangeDels(rangeDels)
+	for merged.Next() {
+		v, err := kv.DecodeValue(merged.Value())
+		if err != nil {
+			return abort(err)
+		}
+		if v.IsTombstone() && c.dropTombstones {
+			continue
+		}
+
+		if full {
+			if err := closeTable(bytes.Clone(merged.Key())); err != nil {
+				return err
+			}
+		}
+		if writer == nil {
+			if writer, err = t.storageProvider.NewSSTableWriter(cf.id); err != nil {
+				return abort(err)
+			}
+		}
+		if err := writer.Write(merged.Key(), merged.Value()); err != nil {
+			return abort(err)
+		}
+		full = writer.EstimatedSize() >= opts.targetFileSize
+	}
+	if err := merged.Err(); err != nil {
+		return abort(err)
+	}
+	if writer == nil && len(clipRangeDels(opts.comparer, kept, lower, nil)) > 0 {
+		var err error
+		if writer, err = t.storageProvider.NewSSTableWriter(cf.id); err != nil {
+			return abort(err)
+		}
+	}
+	if writer != nil {
+		if err := closeTable(nil); err != nil {
+			return err
+		}
+	}
+
+	if err := t.storageProvider.PublishTables(added, removed); err != nil {
+		// tables are published already when only obsolete tables couldn't be removed
+		if len(added) == 0 {
+			return err
+		}
+		if published, viewErr := t.published(cf.id, added[0]); viewErr != nil {
+			err = errors.Join(err, viewErr)
+		} else if !published {
+			err = errors.Join(err, t.storageProvider.RemoveTables(added))
+		}
+		return err
+	}
+	return nil
+}
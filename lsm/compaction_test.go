@@ -0,0 +1,164 @@
+package lsm
+
+import (
+	"challenge-lsm-store/kv"
+	"challenge-lsm-store/sstable"
+	"challenge-lsm-store/vfs"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+)
+
+func table(num uint64, smallest, largest string, props sstable.Properties) *fileStorage {
+	props.SmallestKey, props.LargestKey = []byte(smallest), []byte(largest)
+	if props.Entries == 0 {
+		props.Entries = 1
+	}
+	return &fileStorage{table: tableFile{num: num, props: props}}
+}
+
+func Test_LSM_Compaction_PickL0Tables(t *testing.T) {
+	opts := compactionOptions{l0Trigger: 2, baseLevelSize: 1000, targetFileSize: 100, comparer: kv.BytewiseComparer}
+	levels := make([][]*fileStorage, numLevels)
+
+	//GIVEN L0 below its limit
+	levels[0] = []*fileStorage{table(1, "a", "c", sstable.Properties{})}
+	assert.Nil(t, pickCompaction(levels, opts), "no compaction expected")
+
+	//WHEN L0 reaches its limit
+	levels[0] = append(levels[0], table(2, "b", "d", sstable.Properties{}))
+	levels[1] = []*fileStorage{
+		table(3, "a", "a", sstable.Properties{}),
+		table(4, "e", "f", sstable.Properties{}),
+	}
+	c := pickCompaction(levels, opts)
+
+	//THEN all L0 tables are merged with overlapping tables of L1
+	require.NotNil(t, c, "compaction expected")
+	assert.Equal(t, 0, c.level, "unexpected level")
+	assert.Equal(t, levels[0], c.inputs, "unexpected inputs")
+	assert.Equal(t, []*fileStorage{levels[1][0]}, c.overlapping, "unexpected overlapping tables")
+	assert.True(t, c.dropTombstones, "no deeper level keeps the keys")
+
+	//WHEN deeper level keeps the keys
+	levels[3] = []*fileStorage{table(5, "c", "c", sstable.Properties{})}
+
+	//THEN tombstones are kept
+	assert.False(t, pickCompaction(levels, opts).dropTombstones, "deeper level keeps the keys")
+}
+
+func Test_LSM_Compaction_ScoreUsingTableProperties(t *testing.T) {
+	opts := compactionOptions{l0Trigger: 4, baseLevelSize: 1000, targetFileSize: 100, comparer: kv.BytewiseComparer}
+	levels := make([][]*fileStorage, numLevels)
+
+	//GIVEN L1 below its limit when tombstones are not counted
+	levels[1] = []*fileStorage{
+		table(1, "a", "b", sstable.Properties{Entries: 10, DataSize: 400, RawValueSize: 400, SmallestSeq: 1}),
+		table(2, "c", "d", sstable.Properties{Entries: 10, DataSize: 300, RawValueSize: 200, Tombstones: 5, SmallestSeq: 5}),
+		table(3, "e", "f", sstable.Properties{Entries: 10, DataSize: 200, RawValueSize: 200, SmallestSeq: 3}),
+	}
+
+	//WHEN compaction is picked
+	c := pickCompaction(levels, opts)
+
+	//THEN tombstones are compensated with size of deleted values
+	require.NotNil(t, c, "compaction expected")
+	assert.Equal(t, 1, c.level, "unexpected level")
+	//AND table with the most tombstones is picked
+	assert.Equal(t, []*fileStorage{levels[1][1]}, c.inputs, "unexpected inputs")
+
+	//WHEN tables have no tombstones
+	levels[1][1] = table(2, "c", "d", sstable.Properties{Entries: 10, DataSize: 500, RawValueSize: 500, SmallestSeq: 5})
+
+	//THEN the oldest table is picked
+	assert.Equal(t, []*fileStorage{levels[1][0]}, pickCompaction(levels, opts).inputs, "unexpected inputs")
+}
+
+func Test_LSM_MergingIterator_KeepNewestValues(t *testing.T) {
+	//GIVEN tables with overlapping keys
+	storage, _ := newMemStorageProvider(t, Config{})
+	tables := []tableFile{
+		writeTable(t, storage, 0, set("key1", 1, "old1"), set("key2", 2, "old2")),
+		writeTable(t, storage, 0, pair{key: "key2", value: kv.Value{Kind: kv.KindDelete, Seq: 4}}, set("key3", 3, "value3")),
+		writeTable(t, storage, 0, set("key1", 5, "new1")),
+	}
+	require.NoError(t, storage.PublishTables(tables, nil), "publish error")
+	view, err := storage.FilesStorage(defaultColumnFamilyID)
+	require.NoError(t, err, "files storage error")
+	defer func() {
+		require.NoError(t, view.Release(), "release error")
+	}()
+
+	//WHEN tables are merged
+	iterators := make([]iterator, 0, len(view.levels[0]))
+	for _, f := range view.levels[0] {
+		it, err := f.NewIterator()
+		require.NoError(t, err, "iterator error")
+		iterators = append(iterators, it)
+	}
+	merged := newMergingIterator(kv.BytewiseComparer, iterators...)
+
+	//THEN each key is returned once with its newest value
+	var keys []string
+	var values []kv.Value
+	for merged.Next() {
+		v, err := kv.DecodeValue(merged.Value())
+		require.NoError(t, err, "invalid value")
+		keys = append(keys, string(merged.Key()))
+		values = append(values, v)
+	}
+	require.NoError(t, merged.Err(), "merge error")
+	assert.Equal(t, []string{"key1", "key2", "key3"}, keys, "unexpected keys")
+	assert.Equal(t, []byte("new1"), values[0].Payload, "unexpected value of key1")
+	assert.True(t, values[1].IsTombstone(), "key2 must be deleted")
+	assert.Equal(t, []byte("value3"), values[2].Payload, "unexpected value of key3")
+}
+
+func Test_LSM_Compaction_RemoveTablesWhichCantBePublished(t *testing.T) {
+	//GIVEN a tree with L0 tables compacted into many tables
+	fs := vfs.NewFaultFS()
+	tree, err := Open(testDir, WithFS(fs), WithMemtableSize(300), WithCompactionStyle(CompactionNone))
+	require.NoError(t, err, "open error")
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		require.NoError(t, tree.Put(key, key), "put error")
+	}
+	require.NoError(t, tree.Flush(context.Background()), "flush error")
+	cf := tree.defaultFamily()
+	cf.cfg.TargetFileSize = 200
+	tables := listDir(t, fs, testTablesDir)
+	view, err := tree.storageProvider.FilesStorage(cf.id)
+	require.NoError(t, err, "files storage error")
+	c := &compaction{level: 0, inputs: view.levels[0]}
+
+	//WHEN manifest with the compacted tables can't be written
+	fs.FailCreate(filepath.Join(testDir, manifestFile+".tmp"))
+	err = tree.compact(cf, c)
+
+	//THEN written tables are removed
+	assert.True(t, errors.Is(err, vfs.ErrInjected), fmt.Sprintf("unexpected error: %v", err))
+	assert.Equal(t, tables, listDir(t, fs, testTablesDir), "written tables must be removed")
+	//AND readers of compacted tables are released
+	cache := tree.storageProvider.(*OSStorageProvider).tableCache
+	for _, f := range c.inputs {
+		assert.True(t, f.reader == nil, "reader of table %d must be released", f.table.num)
+		if cached, ok := cache.tables[f.table.num]; ok {
+			assert.Equal(t, 1, cached.refs, "table %d must be kept by the cache only", f.table.num)
+		}
+	}
+	require.NoError(t, view.Release(), "release error")
+
+	//WHEN the tables are compacted once manifest can be written
+	fs.FailAt(0)
+	require.NoError(t, tree.Compact(), "compaction error")
+
+	//THEN all keys are found
+	it, err := tree.NewIterator()
+	require.NoError(t, err, "iterator error")
+	assert.Len(t, iterate(t, it), 100, "unexpected number of keys")
+	require.NoError(t, tree.Close(), "close error")
+}
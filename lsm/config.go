@@ -1,7 +1,218 @@
 package lsm
 
+import (
+	"challenge-lsm-store/kv"
+	"challenge-lsm-store/sstable"
+	"challenge-lsm-store/vfs"
+	"challenge-lsm-store/wal"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultL0CompactionTrigger = 4
+	defaultBaseLevelSize       = 10 * 1024 * 1024
+	defaultTargetFileSize      = 2 * 1024 * 1024
+	defaultFlushAttempts       = 5
+	defaultFlushRetryDelay     = 10 * time.Millisecond
+
+	defaultMaxImmutableMemtables      = 4
+	defaultL0SlowdownTrigger          = 20
+	defaultL0StopTrigger              = 36
+	defaultSoftPendingCompactionBytes = 1 << 30
+	defaultHardPendingCompactionBytes = 4 << 30
+)
+
+var ErrInvalidOption = errors.New("invalid option")
+
+// Config keeps settings of the tree, zero values stand for defaults. See Open for options with defaults.
 type Config struct {
-	MemoryThreshold   int
-	Dir               string
-	SparseKeyDistance int // TODO pass to SSTable writer (for now hardcoded)
+	MemoryThreshold     int
+	Dir                 string
+	SparseKeyDistance   int                 // number of data blocks indexed by a single sparse index entry
+	BlockSize           int                 // size (bytes) which table data block reaches before it's written
+	Compression         sstable.Compression // compression of table data blocks, none by default
+	ReadMode            sstable.ReadMode    // pread (default) or mmap access to table files
+	BlockCacheSize      int64               // capacity (bytes) of block cache shared by all tables (pinned indexes & filters aside), 0 disables it
+	MaxOpenTables       int                 // max number of tables kept open at the same time
+	WALSyncMode         WALSyncMode         // when WAL is made durable, each write is synced by default
+	CompactionStyle     CompactionStyle     // how tables are compacted, leveled compaction by default
+	Comparer            kv.Comparer         // order of keys, bytewise by default. Tables can't be read with another one.
+	L0CompactionTrigger int                 // number of L0 tables which triggers their compaction
+	BaseLevelSize       int                 // target size (bytes) of L1, each next level is 10 times bigger
+	TargetFileSize      int                 // size (bytes) of tables written by compaction
+	FS                  vfs.FS              // file system keeping table files, OS file system by default
+	FlushAttempts       int                 // attempts to flush memory before the tree becomes read-only
+	FlushRetryDelay     time.Duration       // delay of the first flush retry, it's doubled with each next retry
+	ColumnFamilies      map[string][]Option // options of column families which differ from settings of the tree
+	MergeOperator       MergeOperator       // combines operands written by Tree.Merge, merges are rejected without it
+	Clock               func() time.Time    // current time used to expire values, see Tree.PutWithTTL
+	PrefixExtractor     kv.PrefixExtractor  // extracts prefixes of keys kept by bloom filters of tables, none by default
+
+	// writes are slowed down and then stopped when flushes or compactions fall behind
+	MaxImmutableMemtables      int                   // number of memtables waiting for flush which stops writes
+	L0SlowdownTrigger          int                   // number of L0 tables which slows writes down
+	L0StopTrigger              int                   // number of L0 tables which stops writes
+	SoftPendingCompactionBytes int64                 // estimated bytes waiting for compaction which slow writes down
+	HardPendingCompactionBytes int64                 // estimated bytes waiting for compaction which stop writes
+	OnWriteStall               func(WriteStallEvent) // called whenever writes are slowed down, stopped or resumed
+}
+
+func (c Config) compactionOptions() compactionOptions {
+	opts := compactionOptions{
+		l0Trigger:      c.L0CompactionTrigger,
+		baseLevelSize:  c.BaseLevelSize,
+		targetFileSize: c.TargetFileSize,
+		comparer:       c.comparer(),
+	}
+	if opts.l0Trigger <= 0 {
+		opts.l0Trigger = defaultL0CompactionTrigger
+	}
+	if opts.baseLevelSize <= 0 {
+		opts.baseLevelSize = defaultBaseLevelSize
+	}
+	if opts.targetFileSize <= 0 {
+		opts.targetFileSize = defaultTargetFileSize
+	}
+	return opts
+}
+
+func (c Config) flushRetries() (int, time.Duration) {
+	attempts, delay := c.FlushAttempts, c.FlushRetryDelay
+	if attempts <= 0 {
+		attempts = defaultFlushAttempts
+	}
+	if delay <= 0 {
+		delay = defaultFlushRetryDelay
+	}
+	return attempts, delay
+}
+
+func (c Config) stallOptions() stallOptions {
+	opts := stallOptions{
+		maxImmutableMemtables:      c.MaxImmutableMemtables,
+		l0SlowdownTrigger:          c.L0SlowdownTrigger,
+		l0StopTrigger:              c.L0StopTrigger,
+		softPendingCompactionBytes: c.SoftPendingCompactionBytes,
+		hardPendingCompactionBytes: c.HardPendingCompactionBytes,
+	}
+	if opts.maxImmutableMemtables <= 0 {
+		opts.maxImmutableMemtables = defaultMaxImmutableMemtables
+	}
+	if opts.l0SlowdownTrigger <= 0 {
+		opts.l0SlowdownTrigger = defaultL0SlowdownTrigger
+	}
+	if opts.l0StopTrigger <= 0 {
+		opts.l0StopTrigger = defaultL0StopTrigger
+	}
+	if opts.softPendingCompactionBytes <= 0 {
+		opts.softPendingCompactionBytes = defaultSoftPendingCompactionBytes
+	}
+	if opts.hardPendingCompactionBytes <= 0 {
+		opts.hardPendingCompactionBytes = defaultHardPendingCompactionBytes
+	}
+	return opts
+}
+
+func (c Config) writerOptions() []sstable.WriterOption {
+	opts := []sstable.WriterOption{sstable.WithCompression(c.Compression), sstable.WithComparer(c.comparer())}
+	if c.SparseKeyDistance > 0 {
+		opts = append(opts, sstable.WithSparseKeyDistance(c.SparseKeyDistance))
+	}
+	if c.BlockSize > 0 {
+		opts = append(opts, sstable.WithBlockSize(c.BlockSize))
+	}
+	if c.PrefixExtractor != nil {
+		opts = append(opts, sstable.WithPrefixExtractor(c.PrefixExtractor))
+	}
+	return opts
+}
+
+func (c Config) comparer() kv.Comparer {
+	if c.Comparer == nil {
+		return kv.BytewiseComparer
+	}
+	return c.Comparer
+}
+
+// now returns current unix time (nanoseconds) of the clock
+func (c Config) now() int64 {
+	if c.Clock == nil {
+		return time.Now().UnixNano()
+	}
+	return c.Clock().UnixNano()
+}
+
+func (c Config) walOptions() []wal.WriterOption {
+	if c.WALSyncMode == WALSyncNone {
+		return []wal.WriterOption{wal.WithoutSyncOnWrite()}
+	}
+	return nil
+}
+
+// columnFamily returns settings of given column family. Family shares memory, WAL and compaction style
+// with the tree, so only settings of its tables and compaction limits can differ.
+func (c Config) columnFamily(name string) Config {
+	return c.withFamilyOptions(c.ColumnFamilies[name]...)
+}
+
+// withFamilyOptions returns settings of a column family changed by given options
+func (c Config) withFamilyOptions(opts ...Option) Config {
+	f := c
+	f.ColumnFamilies = nil
+	for _, opt := range opts {
+		opt(&f)
+	}
+	f.MemoryThreshold, f.WALSyncMode, f.CompactionStyle = c.MemoryThreshold, c.WALSyncMode, c.CompactionStyle
+	f.FS, f.Dir, f.Clock = c.FS, c.Dir, c.Clock
+	return f
+}
+
+// validate checks settings once defaults are applied to them
+func (c Config) validate() error {
+	for name := range c.ColumnFamilies {
+		if err := c.columnFamily(name).validate(); err != nil {
+			return fmt.Errorf("column family %s: %w", name, err)
+		}
+	}
+
+	compaction, stall := c.compactionOptions(), c.stallOptions()
+	blockSize := c.BlockSize
+	if blockSize <= 0 {
+		blockSize = sstable.DefaultBlockSize
+	}
+
+	switch {
+	case c.MemoryThreshold <= 0:
+		return fmt.Errorf("%w: memtable size %d must be positive", ErrInvalidOption, c.MemoryThreshold)
+	case c.SparseKeyDistance < 0:
+		return fmt.Errorf("%w: sparse key distance %d must not be negative", ErrInvalidOption, c.SparseKeyDistance)
+	case c.BlockSize < 0:
+		return fmt.Errorf("%w: block size %d must not be negative", ErrInvalidOption, c.BlockSize)
+	case c.BlockCacheSize < 0:
+		return fmt.Errorf("%w: block cache size %d must not be negative", ErrInvalidOption, c.BlockCacheSize)
+	case c.MaxOpenTables < 0:
+		return fmt.Errorf("%w: max open tables %d must not be negative", ErrInvalidOption, c.MaxOpenTables)
+	case c.ReadMode != sstable.ReadModePread && c.ReadMode != sstable.ReadModeMmap:
+		return fmt.Errorf("%w: read mode %d", ErrInvalidOption, c.ReadMode)
+	case !c.Compression.Valid():
+		return fmt.Errorf("%w: compression %s", ErrInvalidOption, c.Compression)
+	case c.WALSyncMode != WALSyncAlways && c.WALSyncMode != WALSyncNone:
+		return fmt.Errorf("%w: WAL sync mode %d", ErrInvalidOption, c.WALSyncMode)
+	case c.CompactionStyle != CompactionLeveled && c.CompactionStyle != CompactionNone:
+		return fmt.Errorf("%w: compaction style %d", ErrInvalidOption, c.CompactionStyle)
+	case blockSize > compaction.targetFileSize:
+		return fmt.Errorf("%w: block size %d exceeds target file size %d", ErrInvalidOption, blockSize, compaction.targetFileSize)
+	case stall.l0SlowdownTrigger >= stall.l0StopTrigger:
+		return fmt.Errorf("%w: L0 slowdown trigger %d must be below L0 stop trigger %d",
+			ErrInvalidOption, stall.l0SlowdownTrigger, stall.l0StopTrigger)
+	case c.CompactionStyle == CompactionLeveled && compaction.l0Trigger >= stall.l0SlowdownTrigger:
+		return fmt.Errorf("%w: L0 compaction trigger %d must be below L0 slowdown trigger %d",
+			ErrInvalidOption, compaction.l0Trigger, stall.l0SlowdownTrigger)
+	case stall.softPendingCompactionBytes >= stall.hardPendingCompactionBytes:
+		return fmt.Errorf("%w: soft pending compaction bytes %d must be below hard limit %d",
+			ErrInvalidOption, stall.softPendingCompactionBytes, stall.hardPendingCompactionBytes)
+	}
+	return nil
 }
@@ -0,0 +1,257 @@
+package lsm
+
+import (
+	"bytes"
+	"challenge-lsm-store/kv"
+	"challenge-lsm-store/wal"
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+const (
+	// DefaultColumnFamily is the column family used by Get/Put/Delete of the tree, it can't be dropped
+	DefaultColumnFamily = "default"
+
+	defaultColumnFamilyID uint32 = 0
+)
+
+var (
+	ErrColumnFamilyExists      = errors.New("column family already exists")
+	ErrColumnFamilyNotFound    = errors.New("column family not found")
+	ErrDropDefaultColumnFamily = errors.New("default column family can't be dropped")
+)
+
+type (
+	// ColumnFamily is a named keyspace of the tree. Each family has its own memtable, tables and their options,
+	// but all families share the WAL, so a batch changing many families is applied atomically (see Tree.Write).
+	ColumnFamily struct {
+		tree *Tree
+		id   uint32
+		name string
+		cfg  Config
+	}
+
+	// Batch collects changes of many column families, they are applied atomically by Tree.Write
+	Batch struct {
+		changes []batchChange
+	}
+
+	batchChange struct {
+		family    *ColumnFamily
+		kind      kv.Kind
+		key       []byte
+		value     []byte
+		expiresAt int64 // see kv.Value
+	}
+)
+
+// CreateColumnFamily creates an empty column family. Given options change settings of the tree for the family,
+// they must be given by WithColumnFamily whenever the tree is opened again.
+func (t *Tree) CreateColumnFamily(name string, opts ...Option) (*ColumnFamily, error) {
+	if name == "" {
+		return nil, fmt.Errorf("%w: empty column family name", ErrInvalidOption)
+	}
+	cfg := t.cfg.withFamilyOptions(append(t.cfg.ColumnFamilies[name], opts...)...)
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	t.currentMu.RLock()
+	defer t.currentMu.RUnlock()
+	if t.closed {
+		return nil, ErrClosed
+	}
+	id, err := t.storageProvider.CreateColumnFamily(name, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	cf := &ColumnFamily{tree: t, id: id, name: name, cfg: cfg}
+	t.familiesMu.Lock()
+	t.families[name] = cf
+	t.familiesMu.Unlock()
+	return cf, nil
+}
+
+// DropColumnFamily removes column family with all its data. Handles of the family fail with ErrColumnFamilyNotFound.
+func (t *Tree) DropColumnFamily(name string) error {
+	if name == DefaultColumnFamily {
+		return ErrDropDefaultColumnFamily
+	}
+
+	// no change of the family is written meanwhile
+	t.currentMu.Lock()
+	defer t.currentMu.Unlock()
+	if t.closed {
+		return ErrClosed
+	}
+	cf, err := t.ColumnFamily(name)
+	if err != nil {
+		return err
+	}
+	if err := t.storageProvider.DropColumnFamily(cf.id); err != nil {
+		return err
+	}
+
+	t.familiesMu.Lock()
+	delete(t.families, name)
+	t.familiesMu.Unlock()
+
+	// WAL keeps changes of the family till its memory is flushed, they are skipped on replay
+	t.current.dropFamily(cf.id)
+	t.flushingMu.RLock()
+	for _, job := range t.flushing {
+		job.memory.dropFamily(cf.id)
+	}
+	t.flushingMu.RUnlock()
+	return nil
+}
+
+// ColumnFamily returns handle of the column family
+func (t *Tree) ColumnFamily(name string) (*ColumnFamily, error) {
+	t.familiesMu.RLock()
+	defer t.familiesMu.RUnlock()
+	cf, ok := t.families[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrColumnFamilyNotFound, name)
+	}
+	return cf, nil
+}
+
+// ColumnFamilies returns names of all column families, the default one included
+func (t *Tree) ColumnFamilies() []string {
+	t.familiesMu.RLock()
+	defer t.familiesMu.RUnlock()
+	names := make([]string, 0, len(t.families))
+	for name := range t.families {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// defaultFamily returns handle of the default column family, which always exists
+func (t *Tree) defaultFamily() *ColumnFamily {
+	t.familiesMu.RLock()
+	defer t.familiesMu.RUnlock()
+	return t.families[DefaultColumnFamily]
+}
+
+// columnFamilies returns all column families ordered by their ids
+func (t *Tree) columnFamilies() []*ColumnFamily {
+	t.familiesMu.RLock()
+	defer t.familiesMu.RUnlock()
+	families := make([]*ColumnFamily, 0, len(t.families))
+	for _, cf := range t.families {
+		families = append(families, cf)
+	}
+	slices.SortFunc(families, func(a, b *ColumnFamily) int {
+		return cmp.Compare(a.id, b.id)
+	})
+	return families
+}
+
+// exists tells whether the column family hasn't been dropped
+func (cf *ColumnFamily) exists() error {
+	cf.tree.familiesMu.RLock()
+	defer cf.tree.familiesMu.RUnlock()
+	if cf.tree.families[cf.name] != cf {
+		return fmt.Errorf("%w: %s", ErrColumnFamilyNotFound, cf.name)
+	}
+	return nil
+}
+
+// Write applies all changes of the batch atomically, i.e. all of them are recovered after crash or none of them
+func (t *Tree) Write(b *Batch) error {
+	if len(b.changes) == 0 {
+		return nil
+	}
+	return t.write(func() error {
+		return t.apply(b)
+	})
+}
+
+// apply writes changes of the batch into current memory, each change gets its own sequence number.
+// Current memory must be locked.
+func (t *Tree) apply(b *Batch) error {
+	entries := make([]wal.EntryV2, 0, len(b.changes))
+	for _, c := range b.changes {
+		if c.family.tree != t {
+			return fmt.Errorf("%w: %s belongs to another tree", ErrColumnFamilyNotFound, c.family.name)
+		}
+		if err := c.family.exists(); err != nil {
+			return err
+		}
+		entries = append(entries, wal.EntryV2{
+			Family: c.family.id,
+			Key:    c.key,
+			Value:  encodeChange(c, t.seq.Add(1)),
+		})
+	}
+	return t.current.Apply(entries)
+}
+
+func encodeChange(c batchChange, seq kv.SeqNum) []byte {
+	if c.kind == kv.KindSet {
+		return kv.EncodeExpiringValue(seq, c.expiresAt, c.value)
+	}
+	return kv.EncodeValue(c.kind, seq, c.value)
+}
+
+// Put sets value of the key in given column family
+func (b *Batch) Put(cf *ColumnFamily, key, value []byte) {
+	b.changes = append(b.changes, batchChange{family: cf, kind: kv.KindSet, key: key, value: value})
+}
+
+// Delete deletes the key from given column family
+func (b *Batch) Delete(cf *ColumnFamily, key []byte) {
+	b.changes = append(b.changes, batchChange{family: cf, kind: kv.KindDelete, key: key})
+}
+
+// Len returns number of changes in the batch
+func (b *Batch) Len() int {
+	return len(b.changes)
+}
+
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// Get returns value of the key, nil is returned when the key doesn't exist
+func (cf *ColumnFamily) Get(key []byte) ([]byte, error) {
+	if err := cf.exists(); err != nil {
+		return nil, err
+	}
+	return cf.tree.get(cf.id, key)
+}
+
+func (cf *ColumnFamily) Put(key, value []byte) error {
+	b := &Batch{}
+	b.Put(cf, key, value)
+	return cf.tree.Write(b)
+}
+
+func (cf *ColumnFamily) Delete(key []byte) error {
+	b := &Batch{}
+	b.Delete(cf, key)
+	return cf.tree.Write(b)
+}
+
+// NewIterator returns iterator going through keys of the column family, see Iterator
+func (cf *ColumnFamily) NewIterator() (*Iterator, error) {
+	if err := cf.exists(); err != nil {
+		return nil, err
+	}
+	return cf.tree.newIterator(cf.id, cf.cfg.comparer(), nil, nil)
+}
+
+// NewPrefixIterator returns iterator going through keys of the column family which start with the prefix,
+// see Tree.NewPrefixIterator
+func (cf *ColumnFamily) NewPrefixIterator(prefix []byte) (*Iterator, error) {
+	if err := cf.exists(); err != nil {
+		return nil, err
+	}
+	return cf.tree.newIterator(cf.id, cf.cfg.comparer(), bytes.Clone(prefix), nil)
+}
@@ -0,0 +1,278 @@
+package lsm
+
+import (
+	"challenge-lsm-store/kv"
+	"challenge-lsm-store/sstable"
+	"challenge-lsm-store/vfs"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/rand/v2"
+	"testing"
+)
+
+// iterate returns all pairs returned by the iterator as key=value
+func iterate(t *testing.T, it *Iterator) []string {
+	var pairs []string
+	for it.Next() {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", it.Key(), it.Value()))
+	}
+	require.Nil(t, it.Err(), "iterator error")
+	require.Nil(t, it.Close(), "iterator close error")
+	return pairs
+}
+
+func Test_LSM_ColumnFamily_IsolatedKeyspaces(t *testing.T) {
+	//GIVEN a tree with two column families
+	fs := vfs.NewMemFS()
+	tree, err := Open(testDir, WithFS(fs), WithMemtableSize(1000))
+	require.Nil(t, err, "open error")
+	docs, err := tree.CreateColumnFamily("docs")
+	require.Nil(t, err, "create error")
+	index, err := tree.CreateColumnFamily("index")
+	require.Nil(t, err, "create error")
+
+	//WHEN the same keys are written into each family
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		require.Nil(t, tree.Put(key, []byte("default")), "put error")
+		require.Nil(t, docs.Put(key, []byte("doc")), "put error")
+		require.Nil(t, index.Put(key, []byte("index")), "put error")
+	}
+	require.Nil(t, index.Delete([]byte("key000")), "delete error")
+
+	//THEN each family keeps its own values, in memory and in tables
+	assertValues := func(tree *Tree) {
+		for _, name := range []string{DefaultColumnFamily, "docs", "index"} {
+			cf, err := tree.ColumnFamily(name)
+			require.Nil(t, err, "family not found")
+			for i := 1; i < 100; i++ {
+				v, err := cf.Get([]byte(fmt.Sprintf("key%03d", i)))
+				require.Nil(t, err, "get error")
+				require.Equal(t, map[string]string{DefaultColumnFamily: "default", "docs": "doc", "index": "index"}[name], string(v),
+					"unexpected value of family %s", name)
+			}
+		}
+		v, err := index.Get([]byte("key000"))
+		assert.Nil(t, err, "get error")
+		assert.Nil(t, v, "deleted key must not be found")
+		v, err = tree.Get([]byte("key000"))
+		assert.Nil(t, err, "get error")
+		assert.Equal(t, []byte("default"), v, "key must be deleted only from its family")
+	}
+	assertValues(tree)
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+	assertValues(tree)
+	assert.Equal(t, []string{DefaultColumnFamily, "docs", "index"}, tree.ColumnFamilies(), "unexpected families")
+
+	//AND families are kept once the tree is opened again
+	require.Nil(t, tree.Close(), "close error")
+	tree, err = Open(testDir, WithFS(fs), WithMemtableSize(1000))
+	require.Nil(t, err, "reopen error")
+	assert.Equal(t, []string{DefaultColumnFamily, "docs", "index"}, tree.ColumnFamilies(), "families must be recovered")
+	index, err = tree.ColumnFamily("index")
+	require.Nil(t, err, "family not found")
+	assertValues(tree)
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_ColumnFamily_AtomicBatch(t *testing.T) {
+	//GIVEN a tree with two column families
+	fs := vfs.NewFaultFS()
+	tree, err := Open(testDir, WithFS(fs))
+	require.Nil(t, err, "open error")
+	docs, err := tree.CreateColumnFamily("docs")
+	require.Nil(t, err, "create error")
+	index, err := tree.CreateColumnFamily("index")
+	require.Nil(t, err, "create error")
+	require.Nil(t, index.Put([]byte("word"), []byte("doc0")), "put error")
+
+	//WHEN a batch changing both families is written
+	b := &Batch{}
+	b.Put(docs, []byte("doc1"), []byte("text"))
+	b.Put(index, []byte("word"), []byte("doc1"))
+	b.Delete(tree.families[DefaultColumnFamily], []byte("missing"))
+	require.Nil(t, tree.Write(b), "write error")
+
+	//AND the tree crashes
+	fs = fs.Crash(rand.New(rand.NewPCG(1, 2)))
+
+	//THEN whole batch is recovered
+	tree, err = Open(testDir, WithFS(fs))
+	require.Nil(t, err, "reopen error")
+	docs, err = tree.ColumnFamily("docs")
+	require.Nil(t, err, "family not found")
+	index, err = tree.ColumnFamily("index")
+	require.Nil(t, err, "family not found")
+	v, err := docs.Get([]byte("doc1"))
+	assert.Nil(t, err, "get error")
+	assert.Equal(t, []byte("text"), v, "unexpected document")
+	v, err = index.Get([]byte("word"))
+	assert.Nil(t, err, "get error")
+	assert.Equal(t, []byte("doc1"), v, "unexpected index entry")
+
+	//AND a batch changing a missing family is rejected
+	dropped, err := tree.CreateColumnFamily("dropped")
+	require.Nil(t, err, "create error")
+	require.Nil(t, tree.DropColumnFamily("dropped"), "drop error")
+	b = &Batch{}
+	b.Put(docs, []byte("doc2"), []byte("text"))
+	b.Put(dropped, []byte("key"), []byte("value"))
+	assert.True(t, errors.Is(tree.Write(b), ErrColumnFamilyNotFound), "missing family must be reported")
+	v, err = docs.Get([]byte("doc2"))
+	assert.Nil(t, err, "get error")
+	assert.Nil(t, v, "rejected batch must not be applied")
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_ColumnFamily_Drop(t *testing.T) {
+	//GIVEN a column family with data in tables and in memory
+	fs := vfs.NewMemFS()
+	tree, err := Open(testDir, WithFS(fs))
+	require.Nil(t, err, "open error")
+	docs, err := tree.CreateColumnFamily("docs")
+	require.Nil(t, err, "create error")
+	require.Nil(t, docs.Put([]byte("key1"), []byte("value1")), "put error")
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+	require.Nil(t, docs.Put([]byte("key2"), []byte("value2")), "put error")
+	require.Nil(t, tree.Put([]byte("key1"), []byte("default")), "put error")
+	tables := len(listDir(t, fs, testTablesDir))
+
+	//WHEN the family is dropped
+	require.Nil(t, tree.DropColumnFamily("docs"), "drop error")
+
+	//THEN the family can't be used anymore
+	_, err = docs.Get([]byte("key1"))
+	assert.True(t, errors.Is(err, ErrColumnFamilyNotFound), "dropped family must not be read")
+	assert.True(t, errors.Is(docs.Put([]byte("key3"), nil), ErrColumnFamilyNotFound), "dropped family must not be written")
+	_, err = tree.ColumnFamily("docs")
+	assert.True(t, errors.Is(err, ErrColumnFamilyNotFound), "dropped family must not be found")
+	assert.True(t, errors.Is(tree.DropColumnFamily("docs"), ErrColumnFamilyNotFound), "dropped family must not be dropped again")
+
+	//AND its tables are removed
+	assert.Len(t, listDir(t, fs, testTablesDir), tables-1, "tables of the family must be removed")
+
+	//AND the family isn't recovered, not even from WAL, once the tree is opened again
+	require.Nil(t, tree.Close(), "close error")
+	tree, err = Open(testDir, WithFS(fs))
+	require.Nil(t, err, "reopen error")
+	assert.Equal(t, []string{DefaultColumnFamily}, tree.ColumnFamilies(), "dropped family must not be recovered")
+	docs, err = tree.CreateColumnFamily("docs")
+	require.Nil(t, err, "create error")
+	for _, key := range []string{"key1", "key2"} {
+		v, err := docs.Get([]byte(key))
+		assert.Nil(t, err, "get error")
+		assert.Nil(t, v, "family created again must be empty")
+	}
+	v, err := tree.Get([]byte("key1"))
+	assert.Nil(t, err, "get error")
+	assert.Equal(t, []byte("default"), v, "other families must be kept")
+
+	//AND the default family can't be dropped
+	assert.Equal(t, ErrDropDefaultColumnFamily, tree.DropColumnFamily(DefaultColumnFamily), "default family must be kept")
+	//AND family names are unique
+	_, err = tree.CreateColumnFamily("docs")
+	assert.True(t, errors.Is(err, ErrColumnFamilyExists), "existing family must be reported")
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_ColumnFamily_Iterator(t *testing.T) {
+	//GIVEN a family with values in tables and in memory
+	tree, err := Open(testDir, WithFS(vfs.NewMemFS()))
+	require.Nil(t, err, "open error")
+	docs, err := tree.CreateColumnFamily("docs")
+	require.Nil(t, err, "create error")
+	require.Nil(t, docs.Put([]byte("key1"), []byte("old1")), "put error")
+	require.Nil(t, docs.Put([]byte("key2"), []byte("value2")), "put error")
+	require.Nil(t, docs.Put([]byte("key4"), []byte("value4")), "put error")
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+	require.Nil(t, docs.Put([]byte("key1"), []byte("new1")), "put error")
+	require.Nil(t, docs.Put([]byte("key3"), []byte("value3")), "put error")
+	require.Nil(t, docs.Delete([]byte("key2")), "delete error")
+	require.Nil(t, tree.Put([]byte("key0"), []byte("default")), "put error")
+
+	//WHEN the family is iterated
+	it, err := docs.NewIterator()
+	require.Nil(t, err, "iterator error")
+
+	//AND it's changed meanwhile
+	require.Nil(t, docs.Put([]byte("key5"), []byte("value5")), "put error")
+
+	//THEN the newest values of the family are returned in order, deleted keys are skipped
+	assert.Equal(t, []string{"key1=new1", "key3=value3", "key4=value4"}, iterate(t, it), "unexpected pairs")
+
+	//AND the default family is iterated on its own
+	it, err = tree.NewIterator()
+	require.Nil(t, err, "iterator error")
+	assert.Equal(t, []string{"key0=default"}, iterate(t, it), "unexpected pairs")
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_ColumnFamily_Options(t *testing.T) {
+	//GIVEN a family ordering numeric keys by their value while the default family is ordered bytewise
+	fs := vfs.NewMemFS()
+	tree, err := Open(testDir, WithFS(fs), WithMemtableSize(100))
+	require.Nil(t, err, "open error")
+	numbers, err := tree.CreateColumnFamily("numbers", WithComparer(kv.LittleEndianComparer), WithCompression(sstable.FlateCompression))
+	require.Nil(t, err, "create error")
+
+	//WHEN numeric keys are written into both families and moved into tables
+	const keys = 300
+	for i := uint64(0); i < keys; i++ {
+		key := binary.LittleEndian.AppendUint64(nil, i)
+		require.Nil(t, numbers.Put(key, []byte("value")), "put error")
+		require.Nil(t, tree.Put(key, []byte("value")), "put error")
+	}
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+	require.Nil(t, tree.Compact(), "compaction error")
+
+	//THEN keys of each family are returned in order of its comparer
+	it, err := numbers.NewIterator()
+	require.Nil(t, err, "iterator error")
+	i := uint64(0)
+	for ; it.Next(); i++ {
+		require.Equal(t, i, binary.LittleEndian.Uint64(it.Key()), "keys must be ordered numerically")
+	}
+	require.Nil(t, it.Close(), "close error")
+	assert.Equal(t, uint64(keys), i, "unexpected number of keys")
+	it, err = tree.NewIterator()
+	require.Nil(t, err, "iterator error")
+	require.True(t, it.Next(), "first key expected")
+	assert.Equal(t, binary.LittleEndian.AppendUint64(nil, 0), it.Key(), "unexpected first key")
+	require.True(t, it.Next(), "second key expected")
+	assert.Equal(t, binary.LittleEndian.AppendUint64(nil, 256), it.Key(), "keys must be ordered bytewise")
+	require.Nil(t, it.Close(), "close error")
+
+	//AND tables of the family are written with its options
+	view, err := tree.storageProvider.FilesStorage(numbers.id)
+	require.Nil(t, err, "view error")
+	for _, level := range view.levels {
+		for _, f := range level {
+			assert.Equal(t, kv.LittleEndianComparer.Name(), f.table.props.ComparerName, "comparer must be recorded")
+			assert.Equal(t, sstable.FlateCompression, f.table.props.Compression, "table must be compressed")
+		}
+	}
+	require.Nil(t, view.Release(), "release error")
+	require.Nil(t, tree.Close(), "close error")
+
+	//WHEN the tree is opened without options of the family
+	_, err = Open(testDir, WithFS(fs))
+
+	//THEN it fails
+	assert.True(t, errors.Is(err, sstable.ErrComparerMismatch), "comparer mismatch must be reported")
+
+	//WHEN the tree is opened with options of the family
+	tree, err = Open(testDir, WithFS(fs), WithColumnFamily("numbers", WithComparer(kv.LittleEndianComparer)))
+
+	//THEN it works
+	require.Nil(t, err, "reopen error")
+	numbers, err = tree.ColumnFamily("numbers")
+	require.Nil(t, err, "family not found")
+	v, err := numbers.Get(binary.LittleEndian.AppendUint64(nil, keys-1))
+	assert.Nil(t, err, "get error")
+	assert.Equal(t, []byte("value"), v, "expected value")
+	require.Nil(t, tree.Close(), "close error")
+}
@@ -1,19 +1,114 @@
 package lsm
 
 import (
+	"challenge-lsm-store/kv"
 	"challenge-lsm-store/sstable"
-	"sync"
+	"errors"
 )
 
-// fileStorage represents data kept in a single file
+// tableWriter writes a new table which becomes visible for readers once it's published (see storageProvider)
+type tableWriter struct {
+	*sstable.Writer
+	table tableFile
+}
+
+// fileStorage represents data kept in a single table. Table is opened only when it's really searched.
+// fileStorage is not thread-safe, each reader gets its own instance.
 type fileStorage struct {
-	reader *sstable.Reader
-	mu     sync.Mutex
+	table    tableFile
+	tables   *tableCache
+	reader   *sstable.Reader
+	cached   *cachedTable
+	comparer kv.Comparer
+	// prefixExtractor extracts prefixes kept by bloom filter of the table
+	prefixExtractor kv.PrefixExtractor
+}
+
+// tablesView is a set of tables (per level) visible for readers at some point of time.
+// Tables of the view stay on disk till the view is released.
+type tablesView struct {
+	levels  [][]*fileStorage
+	release func() error
+}
+
+// mayContain tells whether the key is in range of table keys, so there is a point to search the table
+func (s *fileStorage) mayContain(key []byte) bool {
+	return s.table.props.Contains(s.comparer, key)
 }
 
+// Find searches for the key in the file. Reader is stateless per lookup, so many routines can search at the same time.
 func (s *fileStorage) Find(key []byte) ([]byte, bool, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	// TODO some common cross-file cache could appear here
+	if err := s.open(); err != nil {
+		return nil, false, err
+	}
 	return s.reader.Find(key)
 }
+
+// NewIterator returns iterator going through all entries of the table
+func (s *fileStorage) NewIterator() (*sstable.Iterator, error) {
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s.reader.NewIterator(), nil
+}
+
+func (s *fileStorage) open() error {
+	if s.reader != nil {
+		return nil
+	}
+	t, err := s.tables.acquire(s.table)
+	if err != nil {
+		return err
+	}
+	s.cached = t
+	s.reader = t.reader
+	return nil
+}
+
+// Release gives back the reader (i.e. to the table cache). File storage must not be used afterwards.
+func (s *fileStorage) Release() error {
+	if s.cached == nil {
+		return nil
+	}
+	t := s.cached
+	s.cached, s.reader = nil, nil
+	return s.tables.release(t)
+}
+
+// Release gives back all tables of the view. View must not be used afterwards.
+func (v *tablesView) Release() error {
+	var errs []error
+	for _, level := range v.levels {
+		for _, f := range level {
+			errs = append(errs, f.Release())
+		}
+	}
+	if v.release != nil {
+		errs = append(errs, v.release())
+	}
+	return errors.Join(errs...)
+}
+
+// tableAt returns the written table placed at given level
+func (w *tableWriter) tableAt(level int) tableFile {
+	table := w.table
+	table.level = level
+	return table
+}
+
+// Close completes the table, its properties are known afterwards
+func (w *tableWriter) Close() error {
+	if err := w.Writer.Close(); err != nil {
+		return err
+	}
+	w.table.props = w.Writer.Properties()
+	return nil
+}
+
+// indexKeys returns index keys of all data blocks of the table, see sstable.Reader.IndexKeys
+func (s *fileStorage) indexKeys() ([][]byte, error) {
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s.reader.IndexKeys()
+}
@@ -0,0 +1,174 @@
+package lsm
+
+import (
+	"challenge-lsm-store/kv"
+	"challenge-lsm-store/sstable"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+var ErrInvalidExternalTable = errors.New("invalid external table")
+
+// externalTable is a table built outside of the tree
+type externalTable struct {
+	path  string
+	props sstable.Properties // properties the table had before it was ingested
+}
+
+// Ingest adds tables built outside of the tree (see sstable.Builder) into the default column family
+// without writing their entries into WAL and memory. Tables are moved into the tree, so they must be kept
+// by the file system of the tree. See ColumnFamily.Ingest.
+func (t *Tree) Ingest(paths ...string) error {
+	return t.ingest(t.defaultFamily(), paths)
+}
+
+// Ingest adds tables built outside of the tree into the column family. Key ranges of the tables must not overlap.
+// All entries of the tables get a single sequence number, so they are newer than all changes written before.
+// Memory keeping changes of the family is flushed first, writes wait meanwhile. Each table is placed
+// at the deepest level whose tables and tables of levels above don't overlap with it.
+// Tables are published at once, they are moved back (with their original properties) when they can't be moved
+// into the tree or published.
+func (cf *ColumnFamily) Ingest(paths ...string) error {
+	if err := cf.exists(); err != nil {
+		return err
+	}
+	return cf.tree.ingest(cf, paths)
+}
+
+func (t *Tree) ingest(cf *ColumnFamily, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	comparer := cf.cfg.comparer()
+	external := make([]externalTable, len(paths))
+	for i, path := range paths {
+		props, err := t.storageProvider.ExternalTableProperties(cf.id, path)
+		if err != nil {
+			return fmt.Errorf("table %s: %w", path, err)
+		}
+		if props.Entries+props.RangeTombstones == 0 {
+			return fmt.Errorf("%w: table %s is empty", ErrInvalidExternalTable, path)
+		}
+		external[i] = externalTable{path: path, props: props}
+	}
+	if err := checkKeyRanges(external, comparer); err != nil {
+		return err
+	}
+
+	// no change is written till tables are published, so ingested entries are newer than all changes in memory
+	t.currentMu.Lock()
+	defer t.currentMu.Unlock()
+	if t.closed {
+		return ErrClosed
+	}
+	if err := t.readOnly(); err != nil {
+		return err
+	}
+	if err := t.flushFamily(cf.id); err != nil {
+		return err
+	}
+
+	// level of tables can't be changed by compaction till they are published
+	t.compactionMu.Lock()
+	defer t.compactionMu.Unlock()
+	view, err := t.storageProvider.FilesStorage(cf.id)
+	if err != nil {
+		return err
+	}
+	levels := make([]int, len(external))
+	for i, e := range external {
+		levels[i] = ingestLevel(view.levels, e.props, comparer)
+	}
+	if err := view.Release(); err != nil {
+		return err
+	}
+
+	tables, err := t.storageProvider.IngestTables(cf.id, external, t.seq.Add(1))
+	if err != nil {
+		return err
+	}
+	for i := range tables {
+		tables[i].level = levels[i]
+	}
+	if err := t.storageProvider.PublishTables(tables, nil); err != nil {
+		// tables which are not published would be removed once the tree is opened again, so they are moved back
+		if published, viewErr := t.published(cf.id, tables[0]); viewErr != nil {
+			err = errors.Join(err, viewErr)
+		} else if !published {
+			err = errors.Join(err, t.storageProvider.RestoreTables(tables, external))
+		}
+		return err
+	}
+	t.backgroundProgressed()
+	t.scheduleCompaction()
+	return nil
+}
+
+// checkKeyRanges checks that key ranges of tables don't overlap
+func checkKeyRanges(external []externalTable, comparer kv.Comparer) error {
+	sorted := slices.Clone(external)
+	slices.SortFunc(sorted, func(a, b externalTable) int {
+		return comparer.Compare(a.props.SmallestKey, b.props.SmallestKey)
+	})
+	for i := 1; i < len(sorted); i++ {
+		prev, next := sorted[i-1], sorted[i]
+		if comparer.Compare(prev.props.LargestKey, next.props.SmallestKey) >= 0 {
+			return fmt.Errorf("%w: key ranges of tables %s and %s overlap", ErrInvalidExternalTable, prev.path, next.path)
+		}
+	}
+	return nil
+}
+
+// published tells whether the table is visible for readers, publishing may fail once tables are published already
+// (i.e. when obsolete tables can't be removed)
+func (t *Tree) published(family uint32, table tableFile) (bool, error) {
+	view, err := t.storageProvider.FilesStorage(family)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = view.Release() // TODO log error
+	}()
+	for _, f := range view.levels[table.level] {
+		if f.table.num == table.num {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// flushFamily moves memory keeping changes of the column family into tables, since memory is searched before tables.
+// Current memory must be locked.
+func (t *Tree) flushFamily(family uint32) error {
+	if slices.Contains(t.current.columnFamilies(), family) {
+		if err := t.rotate(); err != nil {
+			return err
+		}
+	}
+
+	// memory is flushed in order, so the last job keeping the family is waited for only
+	t.flushingMu.RLock()
+	var last *flushJob
+	for _, job := range t.flushing {
+		if slices.Contains(job.memory.columnFamilies(), family) {
+			last = job
+		}
+	}
+	t.flushingMu.RUnlock()
+	if last == nil {
+		return nil
+	}
+	<-last.done
+	return last.err
+}
+
+// ingestLevel returns the deepest level whose tables and tables of levels above don't overlap with the table
+func ingestLevel(levels [][]*fileStorage, props sstable.Properties, comparer kv.Comparer) int {
+	level := 0
+	for level+1 < len(levels) && len(overlapping(levels[level], props.SmallestKey, props.LargestKey, comparer)) == 0 &&
+		len(overlapping(levels[level+1], props.SmallestKey, props.LargestKey, comparer)) == 0 {
+		level++
+	}
+	return level
+}
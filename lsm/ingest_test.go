@@ -0,0 +1,209 @@
+package lsm
+
+import (
+	"challenge-lsm-store/kv"
+	"challenge-lsm-store/sstable"
+	"challenge-lsm-store/vfs"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+)
+
+// buildExternalTable builds table of given keys outside of the tree, values are prefixed keys
+func buildExternalTable(t *testing.T, fs vfs.FS, path, valuePrefix string, keys ...string) {
+	builder, err := sstable.NewBuilder(fs, path)
+	require.Nil(t, err, "builder error")
+	for _, key := range keys {
+		require.Nil(t, builder.Set([]byte(key), []byte(valuePrefix+key)), "set error")
+	}
+	require.Nil(t, builder.Close(), "builder close error")
+}
+
+// tableLevels returns levels of tables of the default column family
+func tableLevels(t *testing.T, tree *Tree) []int {
+	view, err := tree.storageProvider.FilesStorage(defaultColumnFamilyID)
+	require.Nil(t, err, "files storage error")
+	defer func() {
+		require.Nil(t, view.Release(), "release error")
+	}()
+	var levels []int
+	for level, tables := range view.levels {
+		for range tables {
+			levels = append(levels, level)
+		}
+	}
+	return levels
+}
+
+func Test_LSM_Ingest_NewerThanWrittenKeys(t *testing.T) {
+	//GIVEN a tree with keys in tables and memory
+	fs := vfs.NewMemFS()
+	tree, err := Open(testDir, WithFS(fs), WithCompactionStyle(CompactionNone))
+	require.Nil(t, err, "open error")
+	require.Nil(t, tree.Put([]byte("key1"), []byte("old")), "put error")
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+	require.Nil(t, tree.Put([]byte("key2"), []byte("old")), "put error")
+	require.Nil(t, tree.Put([]byte("key9"), []byte("old")), "put error")
+
+	//WHEN tables built outside of the tree are ingested
+	buildExternalTable(t, fs, "external/1", "new-", "key1", "key2")
+	buildExternalTable(t, fs, "external/2", "new-", "key3", "key4")
+	require.Nil(t, tree.Ingest("external/1", "external/2"), "ingest error")
+
+	//THEN ingested values replace written ones
+	exp := []string{"key1=new-key1", "key2=new-key2", "key3=new-key3", "key4=new-key4", "key9=old"}
+	it, err := tree.NewIterator()
+	require.Nil(t, err, "iterator error")
+	assert.Equal(t, exp, iterate(t, it), "unexpected pairs")
+	//AND tables are moved into the tree
+	assert.Empty(t, listDir(t, fs, "external"), "ingested tables must be moved")
+
+	//WHEN a key is written again and the tree is opened again
+	require.Nil(t, tree.Put([]byte("key3"), []byte("newest")), "put error")
+	require.Nil(t, tree.Close(), "close error")
+	tree, err = Open(testDir, WithFS(fs), WithCompactionStyle(CompactionNone))
+	require.Nil(t, err, "open error")
+
+	//THEN written value is newer than ingested one
+	for key, value := range map[string]string{"key1": "new-key1", "key3": "newest", "key9": "old"} {
+		v, err := tree.Get([]byte(key))
+		assert.Nil(t, err, "get error")
+		assert.Equal(t, []byte(value), v, "unexpected value of %s", key)
+	}
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_Ingest_LowestLevelTheTableFits(t *testing.T) {
+	//GIVEN an empty tree
+	fs := vfs.NewMemFS()
+	tree, err := Open(testDir, WithFS(fs), WithCompactionStyle(CompactionNone))
+	require.Nil(t, err, "open error")
+	last := numLevels - 1
+
+	ingest := func(path string, keys ...string) {
+		buildExternalTable(t, fs, path, "", keys...)
+		require.Nil(t, tree.Ingest(path), "ingest error")
+	}
+
+	//WHEN table is ingested into the empty tree
+	ingest("external/1", "key1", "key3")
+	//THEN it's placed at the last level
+	assert.Equal(t, []int{last}, tableLevels(t, tree), "unexpected levels")
+
+	//WHEN overlapping table is ingested
+	ingest("external/2", "key2")
+	//THEN it's placed above the overlapping one
+	assert.Equal(t, []int{last - 1, last}, tableLevels(t, tree), "unexpected levels of overlapping table")
+
+	//WHEN table overlapping with L0 is ingested
+	require.Nil(t, tree.Put([]byte("key5"), []byte("v")), "put error")
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+	ingest("external/3", "key4", "key5")
+	//THEN it's placed at L0
+	assert.Equal(t, []int{0, 0, last - 1, last}, tableLevels(t, tree), "unexpected levels of table overlapping L0")
+
+	//WHEN table which doesn't overlap is ingested
+	ingest("external/4", "key7")
+	//THEN it's placed at the last level
+	assert.Equal(t, []int{0, 0, last - 1, last, last}, tableLevels(t, tree), "unexpected levels of separate table")
+	v, err := tree.Get([]byte("key5"))
+	assert.Nil(t, err, "get error")
+	assert.Equal(t, []byte("key5"), v, "ingested value must be newer than flushed one")
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_Ingest_InvalidTables(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func(t *testing.T, fs vfs.FS)
+		err   error
+	}{
+		{
+			name: "overlapping tables",
+			build: func(t *testing.T, fs vfs.FS) {
+				buildExternalTable(t, fs, "external/1", "", "key1", "key3")
+				buildExternalTable(t, fs, "external/2", "", "key3", "key4")
+			},
+			err: ErrInvalidExternalTable,
+		},
+		{
+			name: "empty table",
+			build: func(t *testing.T, fs vfs.FS) {
+				buildExternalTable(t, fs, "external/1", "")
+				buildExternalTable(t, fs, "external/2", "", "key1")
+			},
+			err: ErrInvalidExternalTable,
+		},
+		{
+			name: "different comparer",
+			build: func(t *testing.T, fs vfs.FS) {
+				buildExternalTable(t, fs, "external/1", "", "key1")
+				builder, err := sstable.NewBuilder(fs, "external/2", sstable.WithComparer(kv.LittleEndianComparer))
+				require.Nil(t, err, "builder error")
+				require.Nil(t, builder.Set([]byte("key2"), []byte("v")), "set error")
+				require.Nil(t, builder.Close(), "builder close error")
+			},
+			err: sstable.ErrComparerMismatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//GIVEN a tree and invalid tables built outside of it
+			fs := vfs.NewMemFS()
+			tree, err := Open(testDir, WithFS(fs))
+			require.Nil(t, err, "open error")
+			tt.build(t, fs)
+
+			//WHEN tables are ingested
+			err = tree.Ingest("external/1", "external/2")
+
+			//THEN no table is ingested
+			assert.True(t, errors.Is(err, tt.err), fmt.Sprintf("unexpected error: %v", err))
+			assert.Empty(t, tableLevels(t, tree), "no table expected")
+			assert.Len(t, listDir(t, fs, "external"), 2, "tables must be kept")
+			require.Nil(t, tree.Close(), "close error")
+		})
+	}
+}
+
+func Test_LSM_Ingest_RestoreTablesWhichCantBePublished(t *testing.T) {
+	//GIVEN a tree and tables built outside of it
+	fs := vfs.NewFaultFS()
+	tree, err := Open(testDir, WithFS(fs))
+	require.Nil(t, err, "open error")
+	buildExternalTable(t, fs, "external/1", "", "key1", "key2")
+	buildExternalTable(t, fs, "external/2", "", "key3")
+
+	//WHEN manifest with the tables can't be written
+	fs.FailCreate(filepath.Join(testDir, manifestFile+".tmp"))
+	err = tree.Ingest("external/1", "external/2")
+
+	//THEN tables are moved back
+	assert.True(t, errors.Is(err, vfs.ErrInjected), fmt.Sprintf("unexpected error: %v", err))
+	assert.Empty(t, tableLevels(t, tree), "no table expected")
+	assert.Empty(t, listDir(t, fs, testTablesDir), "ingested tables must be moved back")
+	//AND they keep their original properties
+	for _, path := range []string{"external/1", "external/2"} {
+		reader, err := sstable.NewFileReader(fs, path, sstable.ReadModePread)
+		require.Nil(t, err, "table of %s must be kept", path)
+		props, err := reader.Properties()
+		assert.Nil(t, err, "properties error")
+		assert.Zero(t, props.GlobalSeq, "global sequence number of %s must not be kept", path)
+		assert.Zero(t, props.LargestSeq, "unexpected largest sequence number of %s", path)
+		require.Nil(t, reader.Close(), "close error")
+	}
+
+	//WHEN the tables are ingested once manifest can be written
+	fs.FailAt(0)
+	require.Nil(t, tree.Ingest("external/1", "external/2"), "ingest error")
+
+	//THEN keys of the tables are found
+	v, err := tree.Get([]byte("key3"))
+	assert.Nil(t, err, "get error")
+	assert.Equal(t, []byte("key3"), v, "unexpected value")
+	require.Nil(t, tree.Close(), "close error")
+}
@@ -0,0 +1,337 @@
+package lsm
+
+import (
+	"bytes"
+	"challenge-lsm-store/kv"
+	"challenge-lsm-store/memtable"
+	"challenge-lsm-store/sstable"
+	"container/heap"
+)
+
+// iterator goes through sorted key-value pairs
+type iterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Err() error
+}
+
+type (
+	// mergingIterator merges sorted iterators into one. Values must be envelopes (see kv.Value).
+	// When the same key is returned by many iterators only its newest value (highest sequence number) is kept.
+	mergingIterator struct {
+		heap     iteratorHeap
+		merge    MergeOperator // combines merge operands with older values of the same key
+		complete bool          // no older value exists out of merged iterators, so operands are resolved
+		now      int64         // unix time (nanoseconds) which expires values, expiry is not checked when 0
+		// range tombstones of merged iterators, keys deleted by them are skipped
+		rangeDels []sstable.RangeTombstone
+		key       []byte
+		value     []byte
+		err       error
+	}
+
+	heapItem struct {
+		it  iterator
+		seq kv.SeqNum
+	}
+
+	// iteratorHeap orders iterators by their current keys, newer value goes first for the same key
+	iteratorHeap struct {
+		items    []*heapItem
+		comparer kv.Comparer
+	}
+)
+
+// newMergingIterator merges iterators whose keys are ordered by given comparer
+func newMergingIterator(comparer kv.Comparer, iterators ...iterator) *mergingIterator {
+	m := &mergingIterator{heap: iteratorHeap{comparer: comparer}}
+	for _, it := range iterators {
+		m.advance(&heapItem{it: it})
+	}
+	return m
+}
+
+func (m *mergingIterator) Next() bool {
+	for m.err == nil && m.heap.Len() > 0 {
+		if m.nextKey() {
+			return true
+		}
+	}
+	m.key, m.value = nil, nil
+	return false
+}
+
+// nextKey combines values of the next key, false is returned when the key is deleted by a range tombstone
+func (m *mergingIterator) nextKey() bool {
+	item := heap.Pop(&m.heap).(*heapItem)
+	m.key, m.value = item.it.Key(), item.it.Value()
+	newer, err := kv.DecodeValue(m.value)
+	if err != nil {
+		m.err = err
+		return false
+	}
+	m.advance(item)
+	deletedSeq := sstable.CoveringSeq(m.heap.comparer, m.rangeDels, m.key)
+	deleted := newer.Seq < deletedSeq
+
+	// older values of the same key are skipped unless they are combined with merge operands
+	oldest := newer.Seq
+	for m.err == nil && m.heap.Len() > 0 && m.heap.comparer.Compare(m.heap.items[0].it.Key(), m.key) == 0 {
+		older := heap.Pop(&m.heap).(*heapItem)
+		// the same change may be read from flushed memory and its table
+		if !deleted && newer.IsMerge() && older.seq < oldest && older.seq > deletedSeq {
+			m.value, m.err = mergeValues(m.merge, m.key, older.it.Value(), newer, m.now)
+			if m.err == nil {
+				newer, m.err = kv.DecodeValue(m.value)
+				oldest = older.seq
+			}
+		}
+		if m.err == nil {
+			m.advance(older)
+		}
+	}
+	if m.err != nil || deleted {
+		return false
+	}
+	if newer.IsMerge() && deletedSeq > 0 {
+		// operands newer than range tombstone start from a missing value
+		tombstone := kv.EncodeValue(kv.KindDelete, deletedSeq, nil)
+		if m.value, m.err = mergeValues(m.merge, m.key, tombstone, newer, m.now); m.err == nil {
+			newer, m.err = kv.DecodeValue(m.value)
+		}
+	}
+	if m.err == nil && m.complete && newer.IsMerge() {
+		m.value, m.err = resolveMerge(m.merge, m.key, m.value)
+	}
+	if m.err == nil && m.now != 0 {
+		m.value, m.err = hideExpired(m.value, m.now)
+	}
+	return m.err == nil
+}
+
+// resolveMerges combines merge operands with older values using given operator. Complete iterator merges all data
+// of the keys, so operands without older value are turned into values.
+func (m *mergingIterator) resolveMerges(op MergeOperator, complete bool) *mergingIterator {
+	m.merge, m.complete = op, complete
+	return m
+}
+
+// expireAt returns values expired at given unix time (nanoseconds) as tombstones, so they hide older values as well
+func (m *mergingIterator) expireAt(now int64) *mergingIterator {
+	m.now = now
+	return m
+}
+
+// withRangeDels skips keys deleted by given range tombstones, tombstones themselves are not returned
+func (m *mergingIterator) withRangeDels(dels []sstable.RangeTombstone) *mergingIterator {
+	m.rangeDels = dels
+	return m
+}
+
+func (m *mergingIterator) Key() []byte {
+	return m.key
+}
+
+func (m *mergingIterator) Value() []byte {
+	return m.value
+}
+
+func (m *mergingIterator) Err() error {
+	return m.err
+}
+
+// advance moves item's iterator to the next entry and puts it back on the heap unless it's exhausted
+func (m *mergingIterator) advance(item *heapItem) {
+	if !item.it.Next() {
+		if err := item.it.Err(); err != nil {
+			m.err = err
+		}
+		return
+	}
+	v, err := kv.DecodeValue(item.it.Value())
+	if err != nil {
+		m.err = err
+		return
+	}
+	item.seq = v.Seq
+	heap.Push(&m.heap, item)
+}
+
+func (h *iteratorHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *iteratorHeap) Less(i, j int) bool {
+	if c := h.comparer.Compare(h.items[i].it.Key(), h.items[j].it.Key()); c != 0 {
+		return c < 0
+	}
+	return h.items[i].seq > h.items[j].seq
+}
+
+func (h *iteratorHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+}
+
+func (h *iteratorHeap) Push(x any) {
+	h.items = append(h.items, x.(*heapItem))
+}
+
+func (h *iteratorHeap) Pop() any {
+	item := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return item
+}
+
+type (
+	// Iterator goes through keys of a column family in order of its comparer, deleted keys are skipped.
+	// Iterator sees data as they were once it was created. It must be closed once it's no longer used.
+	Iterator struct {
+		merged    iterator // values are envelopes
+		release   func() error
+		key       []byte
+		value     []byte
+		expiresAt int64  // expiry time of the current value, see kv.Value
+		prefix    []byte // keys out of the prefix stop the iteration, see Tree.NewPrefixIterator
+		left      bool   // iteration has left the prefix
+		err       error
+	}
+
+	// memoryIterator goes through entries copied from memory
+	memoryIterator struct {
+		entries []memtable.Entry
+		pos     int
+	}
+)
+
+// NewIterator returns iterator going through keys of the default column family, see Iterator
+func (t *Tree) NewIterator() (*Iterator, error) {
+	return t.newIterator(defaultColumnFamilyID, t.cfg.comparer(), nil, nil)
+}
+
+// newIterator returns iterator of the column family, keys out of the prefix are skipped unless the prefix is nil.
+// Iteration starts at the lower bound unless it's nil, memory and tables are sought there right away.
+func (t *Tree) newIterator(family uint32, comparer kv.Comparer, prefix, lower []byte) (*Iterator, error) {
+	start := prefix
+	if lower != nil && (start == nil || comparer.Compare(lower, start) > 0) {
+		start = lower
+	}
+
+	t.currentMu.RLock()
+	if t.closed {
+		t.currentMu.RUnlock()
+		return nil, ErrClosed
+	}
+	// memory goes first, so data flushed meanwhile are found at least in tables
+	memories := []*MemoryStorage{t.current}
+	t.flushingMu.RLock()
+	for i := len(t.flushing) - 1; i >= 0; i-- {
+		memories = append(memories, t.flushing[i].memory)
+	}
+	var (
+		iterators []iterator
+		rangeDels []sstable.RangeTombstone
+	)
+	for _, memory := range memories {
+		entries := memory.entries(family)
+		if start != nil {
+			entries = seekEntries(entries, comparer, start)
+		}
+		iterators = append(iterators, &memoryIterator{entries: entries})
+		rangeDels = append(rangeDels, memory.rangeTombstones(family)...)
+	}
+	t.flushingMu.RUnlock()
+	// memory can't be moved into tables till tables are taken, so they don't keep changes written afterwards
+	view, err := t.storageProvider.FilesStorage(family)
+	t.currentMu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	for _, level := range view.levels {
+		for _, f := range level {
+			it, dels, err := f.newPrefixIterator(prefix, start)
+			if err != nil {
+				_ = view.Release() // TODO log error
+				return nil, err
+			}
+			if it != nil {
+				iterators = append(iterators, it)
+				rangeDels = append(rangeDels, dels...)
+			}
+		}
+	}
+	merged := newMergingIterator(comparer, iterators...).
+		resolveMerges(t.mergeOperator(family), true).
+		expireAt(t.cfg.now()).
+		withRangeDels(rangeDels)
+	return &Iterator{merged: merged, release: view.Release, prefix: prefix}, nil
+}
+
+func (it *Iterator) Next() bool {
+	for it.err == nil && !it.left && it.merged.Next() {
+		if it.prefix != nil && !bytes.HasPrefix(it.merged.Key(), it.prefix) {
+			it.left = true
+			break
+		}
+		v, err := kv.DecodeValue(it.merged.Value())
+		if err != nil {
+			it.err = err
+			break
+		}
+		if v.IsTombstone() {
+			continue
+		}
+		it.key, it.value, it.expiresAt = it.merged.Key(), v.Payload, v.ExpiresAt
+		return true
+	}
+	if it.err == nil {
+		it.err = it.merged.Err()
+	}
+	it.key, it.value = nil, nil
+	return false
+}
+
+// Key returns key of the current entry. It must not be modified. With sstable.ReadModeMmap it may point into
+// mapped table file, which is unmapped once the iterator is closed, so it must be copied to be used afterwards.
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+// Value returns value of the current entry, it's valid as long as Key is
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases tables read by the iterator
+func (it *Iterator) Close() error {
+	if it.release == nil {
+		return nil
+	}
+	release := it.release
+	it.release = nil
+	return release()
+}
+
+func (it *memoryIterator) Next() bool {
+	if it.pos >= len(it.entries) {
+		return false
+	}
+	it.pos++
+	return true
+}
+
+func (it *memoryIterator) Key() []byte {
+	return it.entries[it.pos-1].GetKey()
+}
+
+func (it *memoryIterator) Value() []byte {
+	return it.entries[it.pos-1].GetValue()
+}
+
+func (it *memoryIterator) Err() error {
+	return nil
+}
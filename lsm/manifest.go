@@ -0,0 +1,201 @@
+package lsm
+
+import (
+	"bytes"
+	"challenge-lsm-store/vfs"
+	"challenge-lsm-store/wal"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const manifestFile = "MANIFEST"
+
+var ErrInvalidManifest = errors.New("invalid manifest")
+
+// manifest keeps the current version of each column family durable
+type manifest struct {
+	lastFileNum  uint64 // the last number given to a file, numbers are never reused (even after restart)
+	lastFamilyID uint32 // the last id given to a column family, ids are never reused as WAL may keep changes of dropped ones
+	families     []manifestFamily
+	tables       []manifestEntry
+}
+
+// manifestFamily names a column family other than the default one
+type manifestFamily struct {
+	id   uint32
+	name string
+}
+
+// manifestEntry points at a table of the current version
+type manifestEntry struct {
+	num    uint64
+	level  int
+	name   string // name of the table directory
+	family uint32
+}
+
+func (m *manifest) addVersion(v *version) {
+	for _, tables := range v.levels {
+		for _, table := range tables {
+			m.tables = append(m.tables, manifestEntry{
+				num:    table.num,
+				level:  table.level,
+				name:   filepath.Base(table.dir),
+				family: table.family,
+			})
+		}
+	}
+}
+
+// writeManifest makes the manifest durable. The whole manifest is rewritten atomically:
+// it's written into a temporary file which replaces the previous manifest once it's synced.
+func writeManifest(fs vfs.FS, dir string, m manifest) error {
+	buff := bytes.NewBuffer(nil)
+	buff.Write(binary.AppendUvarint(nil, m.lastFileNum))
+	buff.Write(binary.AppendUvarint(nil, uint64(len(m.tables))))
+	for _, e := range m.tables {
+		buff.Write(binary.AppendUvarint(nil, e.num))
+		buff.Write(binary.AppendUvarint(nil, uint64(e.level)))
+		buff.Write(binary.AppendUvarint(nil, uint64(len(e.name))))
+		buff.WriteString(e.name)
+	}
+	// column families are written at the end, so manifest written before they existed can be read
+	buff.Write(binary.AppendUvarint(nil, uint64(m.lastFamilyID)))
+	buff.Write(binary.AppendUvarint(nil, uint64(len(m.families))))
+	for _, f := range m.families {
+		buff.Write(binary.AppendUvarint(nil, uint64(f.id)))
+		buff.Write(binary.AppendUvarint(nil, uint64(len(f.name))))
+		buff.WriteString(f.name)
+	}
+	for _, e := range m.tables {
+		buff.Write(binary.AppendUvarint(nil, uint64(e.family)))
+	}
+
+	return writeRecordFile(fs, dir, manifestFile, buff.Bytes())
+}
+
+// writeRecordFile atomically replaces the file with a single record. The record is written into a temporary file
+// which replaces the previous one once it's synced.
+func writeRecordFile(fs vfs.FS, dir, name string, record []byte) error {
+	tmpPath := filepath.Join(dir, name+".tmp")
+	writer, err := wal.NewFileWriter(fs, tmpPath)
+	if err != nil {
+		return err
+	}
+	// single record which is synced once written
+	if err := writer.Write(record); err != nil {
+		_ = writer.Close() // TODO log error
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := fs.Rename(tmpPath, filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	return fs.Sync(dir)
+}
+
+// readRecordFile returns the record written by writeRecordFile, os.ErrNotExist is returned when the file doesn't exist
+func readRecordFile(fs vfs.FS, dir, name string) ([]byte, error) {
+	reader, err := wal.NewFileReader(fs, filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = reader.Close() // TODO log error
+	}()
+	return reader.Read()
+}
+
+// readManifest returns the last written manifest, it's empty when manifest doesn't exist
+func readManifest(fs vfs.FS, dir string) (manifest, error) {
+	var m manifest
+	record, err := readRecordFile(fs, dir, manifestFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return m, fmt.Errorf("%w: %w", ErrInvalidManifest, err)
+	}
+
+	buff := bytes.NewReader(record)
+	if m.lastFileNum, err = binary.ReadUvarint(buff); err != nil {
+		return m, fmt.Errorf("%w: %w", ErrInvalidManifest, err)
+	}
+	count, err := binary.ReadUvarint(buff)
+	if err != nil {
+		return m, fmt.Errorf("%w: %w", ErrInvalidManifest, err)
+	}
+	m.tables = make([]manifestEntry, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var e manifestEntry
+		var level, nameLen uint64
+		if e.num, err = binary.ReadUvarint(buff); err != nil {
+			return m, fmt.Errorf("%w: %w", ErrInvalidManifest, err)
+		}
+		if level, err = binary.ReadUvarint(buff); err != nil {
+			return m, fmt.Errorf("%w: %w", ErrInvalidManifest, err)
+		}
+		if nameLen, err = binary.ReadUvarint(buff); err != nil {
+			return m, fmt.Errorf("%w: %w", ErrInvalidManifest, err)
+		}
+		name := make([]byte, nameLen)
+		if _, err := io.ReadFull(buff, name); err != nil {
+			return m, fmt.Errorf("%w: %w", ErrInvalidManifest, err)
+		}
+		if level >= numLevels {
+			return m, fmt.Errorf("%w: level %d out of range", ErrInvalidManifest, level)
+		}
+		e.level, e.name = int(level), string(name)
+		m.tables = append(m.tables, e)
+	}
+
+	if buff.Len() == 0 {
+		return m, nil // all tables belong to the default column family
+	}
+	if err := readFamilies(buff, &m); err != nil {
+		return m, fmt.Errorf("%w: %w", ErrInvalidManifest, err)
+	}
+	return m, nil
+}
+
+func readFamilies(buff *bytes.Reader, m *manifest) error {
+	lastFamilyID, err := binary.ReadUvarint(buff)
+	if err != nil {
+		return err
+	}
+	m.lastFamilyID = uint32(lastFamilyID)
+	count, err := binary.ReadUvarint(buff)
+	if err != nil {
+		return err
+	}
+	m.families = make([]manifestFamily, 0, min(count, uint64(buff.Len())))
+	for i := uint64(0); i < count; i++ {
+		id, err := binary.ReadUvarint(buff)
+		if err != nil {
+			return err
+		}
+		nameLen, err := binary.ReadUvarint(buff)
+		if err != nil {
+			return err
+		}
+		name := make([]byte, nameLen)
+		if _, err := io.ReadFull(buff, name); err != nil {
+			return err
+		}
+		m.families = append(m.families, manifestFamily{id: uint32(id), name: string(name)})
+	}
+	for i := range m.tables {
+		family, err := binary.ReadUvarint(buff)
+		if err != nil {
+			return err
+		}
+		m.tables[i].family = uint32(family)
+	}
+	return nil
+}
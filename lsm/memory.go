@@ -2,30 +2,56 @@ package lsm
 
 import (
 	"bytes"
+	"challenge-lsm-store/kv"
 	"challenge-lsm-store/memtable"
 	"challenge-lsm-store/sstable"
 	"challenge-lsm-store/wal"
+	"errors"
+	"slices"
 	"sync"
 )
 
-// MemoryStorage represents data kept only in memory for now but backed-up using WAL
+// MemoryStorage represents data kept only in memory for now but backed-up using WAL.
+// Each column family has its own memtable, all of them share the WAL.
 type MemoryStorage struct {
-	memory *memtable.Memtable
-	wal    *wal.Writer
-	buff   *bytes.Buffer
-	mu     sync.RWMutex
+	memory      *memtable.Memtable            // memtable of the default column family
+	families    map[uint32]*memtable.Memtable // memtables of other column families, created on their first change
+	newMemtable func(family uint32) *memtable.Memtable
+	merge       func(family uint32) MergeOperator // merge operator of the family, operands are combined on write
+	now         func() int64                      // unix time (nanoseconds) which expires values combined with operands
+	comparer    func(family uint32) kv.Comparer   // order of keys of the family, range tombstones are checked by it
+	wal         *wal.Writer
+	buff        *bytes.Buffer
+	mu          sync.RWMutex
+
+	// range tombstones of column families are kept aside of memtables
+	rangeDels     map[uint32][]sstable.RangeTombstone
+	rangeDelsSize int // size of all range tombstones
 }
 
+// Size returns size of all memtables and range tombstones
 func (s *MemoryStorage) Size() int {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.memory.Size()
+	size := s.memory.Size() + s.rangeDelsSize
+	for _, m := range s.families {
+		size += m.Size()
+	}
+	return size
 }
 
 func (s *MemoryStorage) Get(key []byte) ([]byte, bool) {
+	return s.get(defaultColumnFamilyID, key)
+}
+
+func (s *MemoryStorage) get(family uint32, key []byte) ([]byte, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.memory.Get(key)
+	m := s.memtable(family)
+	if m == nil {
+		return nil, false
+	}
+	return m.Get(key)
 }
 
 // Put loads value into a memory and updates WAL about given change
@@ -33,6 +59,11 @@ func (s *MemoryStorage) Put(key []byte, value []byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	stored, err := s.combine(defaultColumnFamilyID, key, value)
+	if err != nil {
+		return err
+	}
+
 	defer s.buff.Reset()
 	walEntry := wal.EntryV1{
 		Key:   key,
@@ -46,21 +77,169 @@ func (s *MemoryStorage) Put(key []byte, value []byte) error {
 	}
 
 	// memory
-	s.memory.Upsert(key, value)
+	s.store(defaultColumnFamilyID, key, stored)
+	return nil
+}
+
+// Apply loads changes of many column families into a memory. Changes are written into WAL as a single record,
+// so all of them are recovered or none of them.
+func (s *MemoryStorage) Apply(entries []wal.EntryV2) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	defer s.buff.Reset()
+	batch := wal.BatchV2{Entries: entries}
+	if err := batch.Encode(s.buff); err != nil {
+		return err
+	}
+	if err := s.wal.Write(s.buff.Bytes()); err != nil {
+		return err
+	}
+
+	// memory
+	for _, e := range entries {
+		if err := s.upsert(e.Family, e.Key, e.Value); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// Load loads (imports) value into a memory without keeping WAL about it
-func (s *MemoryStorage) Load(key []byte, value []byte) {
-	s.memory.Upsert(key, value)
+// upsert loads value into memtable of given family, the memtable is created when it doesn't exist.
+// Memory must be locked.
+func (s *MemoryStorage) upsert(family uint32, key, value []byte) error {
+	value, err := s.combine(family, key, value)
+	if err != nil {
+		return err
+	}
+	s.store(family, key, value)
+	return nil
+}
+
+// store keeps combined value in memory of given family, range tombstones are kept aside of the memtable.
+// Memory must be locked.
+func (s *MemoryStorage) store(family uint32, key, value []byte) {
+	if v, err := kv.DecodeValue(value); err == nil && v.IsRangeDelete() {
+		s.addRangeDel(family, sstable.RangeTombstone{Start: key, End: v.Payload, Seq: v.Seq})
+		return
+	}
+	m := s.memtable(family)
+	if m == nil {
+		if s.newMemtable != nil {
+			m = s.newMemtable(family)
+		} else {
+			m = memtable.NewMemtable()
+		}
+		if s.families == nil {
+			s.families = make(map[uint32]*memtable.Memtable)
+		}
+		s.families[family] = m
+	}
+	m.Upsert(key, value)
+}
+
+// combine returns value kept in memory for given change, merge operand is combined with the value of the key
+// kept by the memtable already. Memory must be locked.
+func (s *MemoryStorage) combine(family uint32, key, value []byte) ([]byte, error) {
+	// anything but merge operand is kept as it is
+	v, err := kv.DecodeValue(value)
+	if err != nil || !v.IsMerge() {
+		return value, nil
+	}
+	older, found, deletedSeq := s.find(family, key)
+	if deletedSeq > 0 && (!found || olderThan(older, deletedSeq)) {
+		// range tombstone is the newest older change of the key
+		older, found = kv.EncodeValue(kv.KindDelete, deletedSeq, nil), true
+	}
+	if !found {
+		return value, nil
+	}
+	var (
+		op  MergeOperator
+		now int64
+	)
+	if s.merge != nil {
+		op = s.merge(family)
+	}
+	if s.now != nil {
+		now = s.now()
+	}
+	return mergeValues(op, key, older, v, now)
+}
+
+// find returns value of the key kept in memtable of given family and the highest sequence number of range
+// tombstones covering the key (0 when there is none). Memory must be locked.
+func (s *MemoryStorage) find(family uint32, key []byte) ([]byte, bool, kv.SeqNum) {
+	var (
+		value []byte
+		found bool
+	)
+	if m := s.memtable(family); m != nil {
+		value, found = m.Get(key)
+	}
+	if dels := s.rangeDels[family]; len(dels) > 0 {
+		return value, found, sstable.CoveringSeq(s.familyComparer(family), dels, key)
+	}
+	return value, found, 0
+}
+
+// familyComparer returns order of keys of given family
+func (s *MemoryStorage) familyComparer(family uint32) kv.Comparer {
+	if s.comparer == nil {
+		return kv.BytewiseComparer
+	}
+	return s.comparer(family)
+}
+
+// memtable returns memtable of given family or nil when family has no changes. Memory must be locked.
+func (s *MemoryStorage) memtable(family uint32) *memtable.Memtable {
+	if family == defaultColumnFamilyID {
+		return s.memory
+	}
+	return s.families[family]
+}
+
+// columnFamilies returns column families having any data in memory
+func (s *MemoryStorage) columnFamilies() []uint32 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ids []uint32
+	if s.memory.Size() > 0 {
+		ids = append(ids, defaultColumnFamilyID)
+	}
+	for id, m := range s.families {
+		if m.Size() > 0 {
+			ids = append(ids, id)
+		}
+	}
+	for id := range s.rangeDels {
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
 }
 
 func (s *MemoryStorage) Write(writer *sstable.Writer) error {
+	return s.writeFamily(defaultColumnFamilyID, writer)
+}
+
+// writeFamily writes data of given column family into a table
+func (s *MemoryStorage) writeFamily(family uint32, writer *sstable.Writer) error {
 	s.mu.RLock() // because it only reads from memory
 	defer s.mu.RUnlock()
 
-	for e := range s.memory.GetAll() {
-		if err := writer.Write(e.GetKey(), e.GetValue()); err != nil {
+	if m := s.memtable(family); m != nil {
+		for e := range m.GetAll() {
+			if err := writer.Write(e.GetKey(), e.GetValue()); err != nil {
+				return err
+			}
+		}
+	}
+	for _, t := range s.rangeDels[family] {
+		if err := writer.AddRangeTombstone(t); err != nil {
 			return err
 		}
 	}
@@ -68,6 +247,45 @@ func (s *MemoryStorage) Write(writer *sstable.Writer) error {
 	return nil
 }
 
+// entries returns copy of data of given column family, it's not changed by writes made afterwards
+func (s *MemoryStorage) entries(family uint32) []memtable.Entry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	m := s.memtable(family)
+	if m == nil {
+		return nil
+	}
+	return memtableEntries(m)
+}
+
+// memtableEntries copies entries of the memtable in order
+func memtableEntries(m *memtable.Memtable) []memtable.Entry {
+	var entries []memtable.Entry
+	for e := range m.GetAll() {
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// dropFamily forgets data of given column family, WAL still keeps it but it's skipped on replay
+func (s *MemoryStorage) dropFamily(family uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.families, family)
+	for _, t := range s.rangeDels[family] {
+		s.rangeDelsSize -= len(t.Start) + len(t.End)
+	}
+	delete(s.rangeDels, family)
+}
+
+// Close makes WAL durable and closes it, memory can be recovered from WAL later on
+func (s *MemoryStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return errors.Join(s.wal.Sync(), s.wal.Close())
+}
+
 func (s *MemoryStorage) Clear() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -80,6 +298,8 @@ func (s *MemoryStorage) Clear() error {
 	}
 
 	s.memory.Clear()
+	s.families = nil
+	s.rangeDels, s.rangeDelsSize = nil, 0
 
 	return nil
 }
@@ -3,10 +3,12 @@ package lsm
 import (
 	"bytes"
 	"challenge-lsm-store/memtable"
+	"challenge-lsm-store/vfs"
 	"challenge-lsm-store/wal"
 	"errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"os"
 	"testing"
 )
 
@@ -16,49 +18,51 @@ func Test_LSM_MemoryStorage_Put(t *testing.T) {
 		value []byte
 	}
 	tests := []struct {
-		name   string
-		buff   *closeableBuffer
-		input  pair
-		expErr error
+		name      string
+		walClosed bool
+		input     pair
+		expErr    error
 	}{
 		{
 			name: "should write to memory and WAL",
-			buff: &closeableBuffer{buff: bytes.NewBuffer(nil)},
 			input: pair{
 				key:   []byte("key1"),
 				value: []byte("value1"),
 			},
 		},
 		{
-			name: "should not write to memory if WAL write fails",
-			buff: &closeableBuffer{
-				buff:     bytes.NewBuffer(nil),
-				writeErr: errors.New("WAL write error"),
-			},
+			name:      "should not write to memory if WAL write fails",
+			walClosed: true,
 			input: pair{
 				key:   []byte("key1"),
 				value: []byte("value1"),
 			},
-			expErr: errors.New("WAL write error"),
+			expErr: os.ErrClosed,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			writer := wal.NewWriter(tt.buff, fnStub, fnStub)
+			fs := vfs.NewMemFS()
+			writer, err := wal.NewFileWriter(fs, "/test.wal")
+			require.NoError(t, err, "WAL create error")
+			if tt.walClosed {
+				require.NoError(t, writer.Close(), "WAL close error")
+			}
 			s := &MemoryStorage{
 				memory: memtable.NewMemtable(),
 				wal:    writer,
 				buff:   bytes.NewBuffer(nil),
 			}
 
-			err := s.Put(tt.input.key, tt.input.value)
+			err = s.Put(tt.input.key, tt.input.value)
 			if tt.expErr != nil {
-				assert.Equal(t, tt.expErr, err, "unexpected put error")
+				assert.True(t, errors.Is(err, tt.expErr), "unexpected put error")
 			} else {
 				require.NoError(t, err, "put error")
 
 				// check WAL
-				r := wal.NewReader(tt.buff)
+				r, err := wal.NewFileReader(fs, "/test.wal")
+				require.Nil(t, err, "WAL open error")
 				d, err := r.Read()
 				require.Nil(t, err, "read error")
 				e := wal.EntryV1{}
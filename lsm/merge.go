@@ -0,0 +1,226 @@
+package lsm
+
+import (
+	"challenge-lsm-store/kv"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrMergeOperatorNotSet = errors.New("merge operator is not set")
+	ErrInvalidMergeOperand = errors.New("invalid merge operand")
+)
+
+// MergeOperator combines partial updates written by Tree.Merge. Operands are combined with older values lazily
+// on reads and eagerly by compaction, which keeps a combined operand when it doesn't reach an older value.
+// So existing value may be an older operand as well, operator must be associative.
+type MergeOperator interface {
+	// Name identifies the operator
+	Name() string
+	// Merge applies operand on top of existing value, existing value is nil when the key doesn't exist
+	Merge(key, existing, operand []byte) ([]byte, error)
+}
+
+type (
+	uint64AddOperator  struct{}
+	listAppendOperator struct{}
+)
+
+var (
+	// UInt64AddOperator adds 8-byte little-endian unsigned integers, missing value is 0
+	UInt64AddOperator MergeOperator = uint64AddOperator{}
+	// ListAppendOperator appends lists of items, see EncodeList
+	ListAppendOperator MergeOperator = listAppendOperator{}
+)
+
+func (uint64AddOperator) Name() string {
+	return "lsm.UInt64AddOperator"
+}
+
+func (uint64AddOperator) Merge(_, existing, operand []byte) ([]byte, error) {
+	if len(operand) != 8 || (existing != nil && len(existing) != 8) {
+		return nil, fmt.Errorf("%w: uint64 must have 8 bytes", ErrInvalidMergeOperand)
+	}
+	var n uint64
+	if existing != nil {
+		n = binary.LittleEndian.Uint64(existing)
+	}
+	return binary.LittleEndian.AppendUint64(nil, n+binary.LittleEndian.Uint64(operand)), nil
+}
+
+func (listAppendOperator) Name() string {
+	return "lsm.ListAppendOperator"
+}
+
+func (listAppendOperator) Merge(_, existing, operand []byte) ([]byte, error) {
+	if _, err := DecodeList(operand); err != nil {
+		return nil, err
+	}
+	return append(append(make([]byte, 0, len(existing)+len(operand)), existing...), operand...), nil
+}
+
+// EncodeList encodes items as a list merged by ListAppendOperator, each item is prefixed by its length
+func EncodeList(items ...[]byte) []byte {
+	var list []byte
+	for _, item := range items {
+		list = binary.AppendUvarint(list, uint64(len(item)))
+		list = append(list, item...)
+	}
+	return list
+}
+
+// DecodeList returns items of a list encoded by EncodeList, items point at the list
+func DecodeList(list []byte) ([][]byte, error) {
+	var items [][]byte
+	for len(list) > 0 {
+		n, read := binary.Uvarint(list)
+		if read <= 0 || uint64(len(list)-read) < n {
+			return nil, fmt.Errorf("%w: list is corrupted", ErrInvalidMergeOperand)
+		}
+		items = append(items, list[read:read+int(n)])
+		list = list[read+int(n):]
+	}
+	return items, nil
+}
+
+// mergeValues applies newer merge operand on top of older envelope of the key. The result is newer than both,
+// it stays an operand till it's combined with a value or a tombstone.
+// Value expired at given unix time (nanoseconds) is missing for the operand.
+func mergeValues(op MergeOperator, key, older []byte, newer kv.Value, now int64) ([]byte, error) {
+	if op == nil {
+		return nil, ErrMergeOperatorNotSet
+	}
+	v, err := kv.DecodeValue(older)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		existing  []byte
+		expiresAt int64
+	)
+	if !v.IsTombstone() && !v.IsExpired(now) {
+		existing, expiresAt = v.Payload, v.ExpiresAt
+	}
+	merged, err := op.Merge(key, existing, newer.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if v.IsMerge() {
+		return kv.EncodeValue(kv.KindMerge, newer.Seq, merged), nil
+	}
+	// operand changes the value, not its expiry
+	return kv.EncodeExpiringValue(newer.Seq, expiresAt, merged), nil
+}
+
+// resolveMerge turns an operand into a value once no older value of the key exists
+func resolveMerge(op MergeOperator, key, encoded []byte) ([]byte, error) {
+	v, err := kv.DecodeValue(encoded)
+	if err != nil || !v.IsMerge() {
+		return encoded, err
+	}
+	return mergeValues(op, key, kv.EncodeValue(kv.KindDelete, v.Seq, nil), v, 0)
+}
+
+// valueLookup combines values of a key found in memory and tables going from the newest one
+type valueLookup struct {
+	merge  MergeOperator
+	now    int64 // unix time (nanoseconds) which expires values
+	family uint32
+	key    []byte
+	value  []byte    // envelope combined so far
+	seq    kv.SeqNum // sequence number of the oldest change combined so far
+	done   bool      // no older value can change the result
+}
+
+// addFrom combines value of the key kept in given memory
+func (l *valueLookup) addFrom(memory *MemoryStorage) error {
+	memory.mu.RLock()
+	value, found, deletedSeq := memory.find(l.family, l.key)
+	memory.mu.RUnlock()
+	return l.addFound(value, found, deletedSeq)
+}
+
+// addFound combines value of the key and range tombstone covering it (if deleted sequence number is not 0)
+// found in the same memory or table, the newer one goes first
+func (l *valueLookup) addFound(value []byte, found bool, deletedSeq kv.SeqNum) error {
+	if deletedSeq == 0 {
+		if found {
+			return l.add(value)
+		}
+		return nil
+	}
+	tombstone := kv.EncodeValue(kv.KindDelete, deletedSeq, nil)
+	if !found || olderThan(value, deletedSeq) {
+		return l.add(tombstone)
+	}
+	if err := l.add(value); err != nil || l.done {
+		return err
+	}
+	return l.add(tombstone)
+}
+
+// add combines older envelope of the key with the value found so far
+func (l *valueLookup) add(encoded []byte) error {
+	v, err := kv.DecodeValue(encoded)
+	if err != nil {
+		return err
+	}
+	if l.value == nil {
+		l.value, l.seq, l.done = encoded, v.Seq, !v.IsMerge()
+		return nil
+	}
+	// memory flushed meanwhile is found again in tables
+	if v.Seq >= l.seq {
+		return nil
+	}
+	newer, err := kv.DecodeValue(l.value)
+	if err != nil {
+		return err
+	}
+	if l.value, err = mergeValues(l.merge, l.key, encoded, newer, l.now); err != nil {
+		return err
+	}
+	l.seq, l.done = v.Seq, !v.IsMerge()
+	return nil
+}
+
+// result returns the newest value of the key, operands without older value are resolved.
+// Expired value is returned as a tombstone.
+func (l *valueLookup) result() ([]byte, bool, error) {
+	if l.value == nil {
+		return nil, false, nil
+	}
+	value, err := resolveMerge(l.merge, l.key, l.value)
+	if err == nil {
+		value, err = hideExpired(value, l.now)
+	}
+	return value, err == nil, err
+}
+
+// mergeOperator returns merge operator of the column family, dropped family has none
+func (t *Tree) mergeOperator(family uint32) MergeOperator {
+	t.familiesMu.RLock()
+	defer t.familiesMu.RUnlock()
+	for _, cf := range t.families {
+		if cf.id == family {
+			return cf.cfg.MergeOperator
+		}
+	}
+	return nil
+}
+
+// Merge combines operand with the value of the key in the default column family using merge operator of the tree,
+// see MergeOperator. ErrMergeOperatorNotSet is returned when the tree has no operator.
+func (t *Tree) Merge(key, operand []byte) error {
+	if t.cfg.MergeOperator == nil {
+		return ErrMergeOperatorNotSet
+	}
+	// invalid operand would fail reads & compactions later on
+	if _, err := t.cfg.MergeOperator.Merge(key, nil, operand); err != nil {
+		return err
+	}
+	return t.write(func() error {
+		return t.current.Put(key, kv.EncodeValue(kv.KindMerge, t.seq.Add(1), operand))
+	})
+}
@@ -0,0 +1,183 @@
+package lsm
+
+import (
+	"challenge-lsm-store/kv"
+	"challenge-lsm-store/vfs"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func u64(n uint64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, n)
+}
+
+func operand(key string, seq kv.SeqNum, n uint64) pair {
+	return pair{key: key, value: kv.Value{Kind: kv.KindMerge, Seq: seq, Payload: u64(n)}}
+}
+
+func Test_LSM_Merge_CombineOperandsOfTables(t *testing.T) {
+	//GIVEN tables with merge operands
+	storage, _ := newMemStorageProvider(t, Config{})
+	tables := []tableFile{
+		writeTable(t, storage, 0, set("base", 1, string(u64(10))), operand("operands", 2, 1)),
+		writeTable(t, storage, 0, operand("base", 3, 2), operand("operands", 4, 3)),
+		writeTable(t, storage, 0, operand("base", 5, 4), operand("operands", 6, 5)),
+	}
+	require.NoError(t, storage.PublishTables(tables, nil), "publish error")
+	view, err := storage.FilesStorage(defaultColumnFamilyID)
+	require.NoError(t, err, "files storage error")
+	defer func() {
+		require.NoError(t, view.Release(), "release error")
+	}()
+
+	for _, complete := range []bool{false, true} {
+		//WHEN tables are merged
+		var iterators []iterator
+		for _, f := range view.levels[0] {
+			it, err := f.NewIterator()
+			require.NoError(t, err, "iterator error")
+			iterators = append(iterators, it)
+		}
+		// the same table is merged twice as memory flushed meanwhile is
+		it, err := view.levels[0][0].NewIterator()
+		require.NoError(t, err, "iterator error")
+		merged := newMergingIterator(kv.BytewiseComparer, append(iterators, it)...).resolveMerges(UInt64AddOperator, complete)
+
+		//THEN operands are combined with older values once
+		var values []kv.Value
+		for merged.Next() {
+			v, err := kv.DecodeValue(merged.Value())
+			require.NoError(t, err, "invalid value")
+			values = append(values, v)
+		}
+		require.NoError(t, merged.Err(), "merge error")
+		require.Len(t, values, 2, "unexpected number of keys")
+		assert.Equal(t, kv.Value{Kind: kv.KindSet, Seq: 5, Payload: u64(16)}, values[0], "operands must be applied on value")
+
+		//AND operands without value are resolved only when no older value can exist
+		exp := kv.Value{Kind: kv.KindMerge, Seq: 6, Payload: u64(9)}
+		if complete {
+			exp.Kind = kv.KindSet
+		}
+		assert.Equal(t, exp, values[1], "unexpected operands of complete=%t", complete)
+	}
+}
+
+func Test_LSM_Merge_Counters(t *testing.T) {
+	//GIVEN a tree adding counters
+	fs := vfs.NewMemFS()
+	opts := []Option{WithFS(fs), WithMemtableSize(200), WithMergeOperator(UInt64AddOperator), WithCompactionStyle(CompactionNone)}
+	tree, err := Open(testDir, opts...)
+	require.Nil(t, err, "open error")
+	require.Nil(t, tree.Put([]byte("deleted"), u64(100)), "put error")
+	require.Nil(t, tree.Put([]byte("set"), u64(100)), "put error")
+
+	//WHEN counters are incremented over many memtables and tables
+	const increments = 50
+	for i := 0; i < increments; i++ {
+		for _, key := range []string{"deleted", "new", "set"} {
+			require.Nil(t, tree.Merge([]byte(key), u64(1)), "merge error")
+		}
+		if i == increments/2 {
+			require.Nil(t, tree.Delete([]byte("deleted")), "delete error")
+		}
+	}
+
+	//THEN operands are combined with the latest value
+	assertCounters := func(tree *Tree) {
+		exp := map[string]uint64{"deleted": increments/2 - 1, "new": increments, "set": 100 + increments}
+		for key, n := range exp {
+			v, err := tree.Get([]byte(key))
+			require.Nil(t, err, "get error")
+			assert.Equal(t, u64(n), v, "unexpected counter %s", key)
+		}
+		it, err := tree.NewIterator()
+		require.Nil(t, err, "iterator error")
+		assert.Equal(t, []string{
+			fmt.Sprintf("deleted=%s", u64(exp["deleted"])),
+			fmt.Sprintf("new=%s", u64(exp["new"])),
+			fmt.Sprintf("set=%s", u64(exp["set"])),
+		}, iterate(t, it), "unexpected pairs")
+	}
+	assertCounters(tree)
+
+	//AND counters are recovered from WAL
+	require.Nil(t, tree.Close(), "close error")
+	tree, err = Open(testDir, opts...)
+	require.Nil(t, err, "reopen error")
+	assertCounters(tree)
+
+	//WHEN tables are compacted
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+	view, err := tree.storageProvider.FilesStorage(defaultColumnFamilyID)
+	require.Nil(t, err, "files storage error")
+	require.Greater(t, len(view.levels[0]), defaultL0CompactionTrigger, "L0 must be compacted")
+	require.Nil(t, view.Release(), "release error")
+	require.Nil(t, tree.Compact(), "compaction error")
+
+	//THEN operands are combined into values
+	view, err = tree.storageProvider.FilesStorage(defaultColumnFamilyID)
+	require.Nil(t, err, "files storage error")
+	for _, level := range view.levels {
+		for _, f := range level {
+			it, err := f.NewIterator()
+			require.Nil(t, err, "iterator error")
+			for it.Next() {
+				v, err := kv.DecodeValue(it.Value())
+				require.Nil(t, err, "invalid value")
+				assert.False(t, v.IsMerge(), "operand of %s must be combined", it.Key())
+			}
+		}
+	}
+	require.Nil(t, view.Release(), "release error")
+	assertCounters(tree)
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_Merge_PostingList(t *testing.T) {
+	//GIVEN a tree appending lists
+	tree, err := Open(testDir, WithFS(vfs.NewMemFS()), WithMergeOperator(ListAppendOperator))
+	require.Nil(t, err, "open error")
+
+	//WHEN doc IDs are appended to a posting list
+	require.Nil(t, tree.Merge([]byte("term"), EncodeList([]byte("doc1"), []byte("doc2"))), "merge error")
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+	require.Nil(t, tree.Merge([]byte("term"), EncodeList([]byte("doc3"))), "merge error")
+
+	//THEN the list keeps all of them in order
+	v, err := tree.Get([]byte("term"))
+	require.Nil(t, err, "get error")
+	items, err := DecodeList(v)
+	require.Nil(t, err, "decode error")
+	assert.Equal(t, [][]byte{[]byte("doc1"), []byte("doc2"), []byte("doc3")}, items, "unexpected items")
+
+	//AND invalid operand is rejected
+	err = tree.Merge([]byte("term"), []byte{5})
+	assert.True(t, errors.Is(err, ErrInvalidMergeOperand), "invalid operand must be rejected")
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_Merge_RequireOperator(t *testing.T) {
+	//GIVEN a tree with operands in a table
+	fs := vfs.NewMemFS()
+	tree, err := Open(testDir, WithFS(fs), WithMergeOperator(UInt64AddOperator))
+	require.Nil(t, err, "open error")
+	require.Nil(t, tree.Merge([]byte("count"), u64(1)), "merge error")
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+	require.Nil(t, tree.Close(), "close error")
+
+	//WHEN the tree is opened without merge operator
+	tree, err = Open(testDir, WithFS(fs))
+	require.Nil(t, err, "reopen error")
+
+	//THEN operands can't be written nor read
+	assert.True(t, errors.Is(tree.Merge([]byte("count"), u64(1)), ErrMergeOperatorNotSet), "merge must fail")
+	_, err = tree.Get([]byte("count"))
+	assert.True(t, errors.Is(err, ErrMergeOperatorNotSet), "get must fail")
+	require.Nil(t, tree.Close(), "close error")
+}
@@ -0,0 +1,188 @@
+package lsm
+
+import (
+	"challenge-lsm-store/kv"
+	"challenge-lsm-store/sstable"
+	"challenge-lsm-store/vfs"
+	"time"
+)
+
+const (
+	defaultMemtableSize   = 4 * 1024 * 1024
+	defaultBlockCacheSize = 8 * 1024 * 1024
+)
+
+// WALSyncMode defines when WAL is made durable
+type WALSyncMode int
+
+const (
+	// WALSyncAlways syncs WAL after each write, so acknowledged writes survive a crash
+	WALSyncAlways WALSyncMode = iota
+	// WALSyncNone leaves writes in OS buffers, WAL is synced once the tree is closed.
+	// The latest writes can be lost on crash (not on process failure), but writes are much faster.
+	WALSyncNone
+)
+
+// CompactionStyle defines how tables are compacted
+type CompactionStyle int
+
+const (
+	// CompactionLeveled merges tables into levels of growing size in the background
+	CompactionLeveled CompactionStyle = iota
+	// CompactionNone never compacts tables in the background, they are compacted only by Tree.Compact
+	CompactionNone
+)
+
+// Option changes default settings of the tree opened by Open
+type Option func(c *Config)
+
+// WithMemtableSize sets size (bytes) which memory reaches before it's moved into a table
+func WithMemtableSize(size int) Option {
+	return func(c *Config) {
+		c.MemoryThreshold = size
+	}
+}
+
+// WithSparseKeyDistance sets number of data blocks indexed by a single sparse index entry
+func WithSparseKeyDistance(n int) Option {
+	return func(c *Config) {
+		c.SparseKeyDistance = n
+	}
+}
+
+// WithBlockSize sets size (bytes) which table data block reaches before it's written
+func WithBlockSize(size int) Option {
+	return func(c *Config) {
+		c.BlockSize = size
+	}
+}
+
+// WithCompression compresses table data blocks
+func WithCompression(compression sstable.Compression) Option {
+	return func(c *Config) {
+		c.Compression = compression
+	}
+}
+
+// WithBlockCacheSize sets capacity (bytes) of block cache shared by all tables, 0 disables the cache.
+// Indexes and filters of open tables are pinned in the cache on top of its capacity.
+func WithBlockCacheSize(size int64) Option {
+	return func(c *Config) {
+		c.BlockCacheSize = size
+	}
+}
+
+// WithReadMode sets how table files are read, see sstable.ReadMode
+func WithReadMode(mode sstable.ReadMode) Option {
+	return func(c *Config) {
+		c.ReadMode = mode
+	}
+}
+
+// WithMaxOpenTables sets max number of tables kept open at the same time, 0 stands for the default.
+// Tables in use are kept open till they are released.
+func WithMaxOpenTables(n int) Option {
+	return func(c *Config) {
+		c.MaxOpenTables = n
+	}
+}
+
+// WithWALSyncMode sets when WAL is made durable
+func WithWALSyncMode(mode WALSyncMode) Option {
+	return func(c *Config) {
+		c.WALSyncMode = mode
+	}
+}
+
+// WithCompactionStyle sets how tables are compacted
+func WithCompactionStyle(style CompactionStyle) Option {
+	return func(c *Config) {
+		c.CompactionStyle = style
+	}
+}
+
+// WithComparer orders keys using given comparer. The tree can't be opened later on using a different one.
+func WithComparer(comparer kv.Comparer) Option {
+	return func(c *Config) {
+		c.Comparer = comparer
+	}
+}
+
+// WithMergeOperator combines operands written by Tree.Merge using given operator.
+// The tree must be opened with the same operator whenever it keeps operands.
+func WithMergeOperator(op MergeOperator) Option {
+	return func(c *Config) {
+		c.MergeOperator = op
+	}
+}
+
+// WithClock sets clock which tells whether values expired, see Tree.PutWithTTL
+func WithClock(now func() time.Time) Option {
+	return func(c *Config) {
+		c.Clock = now
+	}
+}
+
+// WithPrefixExtractor keeps bloom filters of key prefixes in tables, so prefix iterators and lookups skip tables
+// which don't keep the prefix (see Tree.NewPrefixIterator). Tables written with a different extractor aren't filtered.
+func WithPrefixExtractor(p kv.PrefixExtractor) Option {
+	return func(c *Config) {
+		c.PrefixExtractor = p
+	}
+}
+
+// WithColumnFamily sets options of the column family which differ from settings of the tree.
+// Family options must be given whenever the tree is opened, e.g. the family can't be read using a different comparer.
+// Only options of tables and compaction limits apply, memory, WAL and compaction style are shared by all families.
+func WithColumnFamily(name string, opts ...Option) Option {
+	return func(c *Config) {
+		families := make(map[string][]Option, len(c.ColumnFamilies)+1)
+		for n, o := range c.ColumnFamilies {
+			families[n] = o
+		}
+		families[name] = append(families[name][:len(families[name]):len(families[name])], opts...)
+		c.ColumnFamilies = families
+	}
+}
+
+// WithFS keeps the tree in given file system instead of the OS one
+func WithFS(fs vfs.FS) Option {
+	return func(c *Config) {
+		c.FS = fs
+	}
+}
+
+// Open opens the tree kept in given directory, the directory is created when it doesn't exist.
+// Settings which are not changed by options have their defaults. ErrInvalidOption is returned for invalid settings.
+func Open(dir string, opts ...Option) (*Tree, error) {
+	cfg, err := newConfig(dir, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	storage, err := NewOSStorageProvider(cfg)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := New(storage, cfg)
+	if err != nil {
+		_ = storage.Close() // TODO log error
+		return nil, err
+	}
+	return tree, nil
+}
+
+// newConfig returns validated settings with defaults changed by given options
+func newConfig(dir string, opts ...Option) (Config, error) {
+	cfg := Config{
+		Dir:               dir,
+		MemoryThreshold:   defaultMemtableSize,
+		SparseKeyDistance: sstable.DefaultSparseKeyDistance,
+		BlockSize:         sstable.DefaultBlockSize,
+		BlockCacheSize:    defaultBlockCacheSize,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg, cfg.validate()
+}
@@ -0,0 +1,247 @@
+package lsm
+
+import (
+	"challenge-lsm-store/kv"
+	"challenge-lsm-store/sstable"
+	"challenge-lsm-store/vfs"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/rand/v2"
+	"testing"
+)
+
+func Test_LSM_Options_OpenWithDefaults(t *testing.T) {
+	//GIVEN a tree opened without options
+	tree, err := Open(testDir, WithFS(vfs.NewMemFS()))
+	require.Nil(t, err, "open error")
+
+	//THEN settings have their defaults
+	assert.Equal(t, defaultMemtableSize, tree.cfg.MemoryThreshold, "unexpected memtable size")
+	assert.Equal(t, sstable.DefaultSparseKeyDistance, tree.cfg.SparseKeyDistance, "unexpected sparse key distance")
+	assert.Equal(t, sstable.DefaultBlockSize, tree.cfg.BlockSize, "unexpected block size")
+	assert.Equal(t, sstable.NoCompression, tree.cfg.Compression, "unexpected compression")
+	assert.Equal(t, int64(defaultBlockCacheSize), tree.cfg.BlockCacheSize, "unexpected block cache size")
+	assert.Equal(t, WALSyncAlways, tree.cfg.WALSyncMode, "unexpected WAL sync mode")
+	assert.Equal(t, CompactionLeveled, tree.cfg.CompactionStyle, "unexpected compaction style")
+
+	//AND the tree works
+	require.Nil(t, tree.Put([]byte("key1"), []byte("value1")), "put error")
+	v, err := tree.Get([]byte("key1"))
+	assert.Nil(t, err, "get error")
+	assert.Equal(t, []byte("value1"), v, "expected value")
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_Options_RejectInvalidOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "memtable size", opts: []Option{WithMemtableSize(0)}},
+		{name: "sparse key distance", opts: []Option{WithSparseKeyDistance(-1)}},
+		{name: "block size", opts: []Option{WithBlockSize(-1)}},
+		{name: "block cache size", opts: []Option{WithBlockCacheSize(-1)}},
+		{name: "read mode", opts: []Option{WithReadMode(sstable.ReadMode(42))}},
+		{name: "max open tables", opts: []Option{WithMaxOpenTables(-1)}},
+		{name: "compression", opts: []Option{WithCompression(sstable.Compression(42))}},
+		{name: "WAL sync mode", opts: []Option{WithWALSyncMode(WALSyncMode(42))}},
+		{name: "compaction style", opts: []Option{WithCompactionStyle(CompactionStyle(42))}},
+		{name: "block size exceeding target file size", opts: []Option{WithBlockSize(defaultTargetFileSize + 1)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//GIVEN invalid options
+			fs := vfs.NewMemFS()
+
+			//WHEN the tree is opened
+			_, err := Open(testDir, append(tt.opts, WithFS(fs))...)
+
+			//THEN options are rejected
+			assert.True(t, errors.Is(err, ErrInvalidOption), "invalid option must be reported")
+
+			//AND the directory is not locked
+			tree, err := Open(testDir, WithFS(fs))
+			require.Nil(t, err, "directory must stay unlocked")
+			require.Nil(t, tree.Close(), "close error")
+		})
+	}
+}
+
+func Test_LSM_Options_RejectInvalidCombinations(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{name: "L0 slowdown trigger above stop trigger", cfg: Config{L0SlowdownTrigger: 10, L0StopTrigger: 5}},
+		{name: "L0 compaction trigger above slowdown trigger", cfg: Config{L0CompactionTrigger: 30, L0SlowdownTrigger: 20}},
+		{name: "soft pending compaction bytes above hard limit", cfg: Config{SoftPendingCompactionBytes: 200, HardPendingCompactionBytes: 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//GIVEN invalid combination of settings
+			tt.cfg.MemoryThreshold = 1000
+			storage, _ := newMemStorageProvider(t, tt.cfg)
+
+			//WHEN the tree is created
+			_, err := New(storage, tt.cfg)
+
+			//THEN settings are rejected
+			assert.True(t, errors.Is(err, ErrInvalidOption), "invalid combination must be reported")
+			require.Nil(t, storage.Close(), "close error")
+		})
+	}
+}
+
+func Test_LSM_Options_WriteTablesWithOptions(t *testing.T) {
+	//GIVEN a tree which compresses small blocks
+	tree, err := Open(testDir,
+		WithFS(vfs.NewMemFS()),
+		WithMemtableSize(1000),
+		WithBlockSize(64),
+		WithSparseKeyDistance(2),
+		WithCompression(sstable.FlateCompression),
+		WithCompactionStyle(CompactionNone),
+	)
+	require.Nil(t, err, "open error")
+
+	//WHEN memory is moved into a table
+	for i := 0; i < 100; i++ {
+		require.Nil(t, tree.Put([]byte{'k', byte(i)}, []byte("value")), "put error")
+	}
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+
+	//THEN tables are written with given options
+	view, err := tree.storageProvider.FilesStorage(defaultColumnFamilyID)
+	require.Nil(t, err, "view error")
+	require.NotEmpty(t, view.levels[0], "memory must be flushed")
+	for _, f := range view.levels[0] {
+		assert.Equal(t, sstable.FlateCompression, f.table.props.Compression, "table must be compressed")
+	}
+	assert.Empty(t, view.levels[1], "tables must not be compacted")
+	require.Nil(t, view.Release(), "release error")
+
+	//AND values are read from compressed tables
+	for i := 0; i < 100; i++ {
+		v, err := tree.Get([]byte{'k', byte(i)})
+		require.Nil(t, err, "get error")
+		require.Equal(t, []byte("value"), v, "expected value")
+	}
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_Options_ReadTablesWithOptions(t *testing.T) {
+	//GIVEN a tree which maps a few tables into memory
+	tree, err := Open(t.TempDir(),
+		WithMemtableSize(1000),
+		WithReadMode(sstable.ReadModeMmap),
+		WithMaxOpenTables(2),
+		WithBlockCacheSize(0),
+		WithCompactionStyle(CompactionNone),
+	)
+	require.Nil(t, err, "open error")
+	assert.Equal(t, sstable.ReadModeMmap, tree.cfg.ReadMode, "unexpected read mode")
+	assert.Equal(t, 2, tree.cfg.MaxOpenTables, "unexpected max open tables")
+
+	//WHEN keys of many tables are read
+	for i := 0; i < 100; i++ {
+		require.Nil(t, tree.Put([]byte{'k', byte(i)}, []byte("value")), "put error")
+		if i%20 == 19 {
+			require.Nil(t, tree.Flush(context.Background()), "flush error")
+		}
+	}
+	tables := tableLevels(t, tree)
+	require.Greater(t, len(tables), 2, "many tables expected")
+	for i := 0; i < 100; i++ {
+		v, err := tree.Get([]byte{'k', byte(i)})
+		require.Nil(t, err, "get error")
+		require.Equal(t, []byte("value"), v, "expected value")
+	}
+
+	//THEN only a few tables are kept open
+	cache := tree.storageProvider.(*OSStorageProvider).tableCache
+	assert.LessOrEqual(t, cache.lru.Len(), 2, "too many open tables")
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_Options_WALSyncMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     WALSyncMode
+		expValue []byte
+	}{
+		{name: "sync always", mode: WALSyncAlways, expValue: []byte("value1")},
+		{name: "sync none", mode: WALSyncNone, expValue: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//GIVEN a tree with WAL sync mode
+			fs := vfs.NewFaultFS()
+			tree, err := Open(testDir, WithFS(fs), WithWALSyncMode(tt.mode))
+			require.Nil(t, err, "open error")
+			require.Nil(t, tree.Put([]byte("key1"), []byte("value1")), "put error")
+
+			//WHEN the tree crashes
+			fs = fs.Crash(rand.New(rand.NewPCG(1, 2)))
+
+			//THEN only synced writes are recovered
+			tree, err = Open(testDir, WithFS(fs))
+			require.Nil(t, err, "reopen error")
+			v, err := tree.Get([]byte("key1"))
+			assert.Nil(t, err, "get error")
+			assert.Equal(t, tt.expValue, v, "unexpected value")
+			require.Nil(t, tree.Close(), "close error")
+		})
+	}
+}
+
+func Test_LSM_Options_Comparer(t *testing.T) {
+	//GIVEN a tree ordering numeric keys by their value
+	fs := vfs.NewMemFS()
+	tree, err := Open(testDir, WithFS(fs), WithMemtableSize(100), WithComparer(kv.LittleEndianComparer))
+	require.Nil(t, err, "open error")
+
+	//WHEN keys are moved into tables
+	const keys = 300
+	for i := uint64(0); i < keys; i++ {
+		require.Nil(t, tree.Put(binary.LittleEndian.AppendUint64(nil, i), []byte("value")), "put error")
+	}
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+	require.Nil(t, tree.Compact(), "compaction error")
+
+	//THEN tables keep keys in order of the comparer
+	view, err := tree.storageProvider.FilesStorage(defaultColumnFamilyID)
+	require.Nil(t, err, "view error")
+	for _, level := range view.levels {
+		for _, f := range level {
+			smallest := binary.LittleEndian.Uint64(f.table.props.SmallestKey)
+			largest := binary.LittleEndian.Uint64(f.table.props.LargestKey)
+			assert.LessOrEqual(t, smallest, largest, "table keys must be ordered numerically")
+			assert.Equal(t, kv.LittleEndianComparer.Name(), f.table.props.ComparerName, "comparer must be recorded")
+		}
+	}
+	require.Nil(t, view.Release(), "release error")
+
+	//AND all keys are found
+	for i := uint64(0); i < keys; i++ {
+		v, err := tree.Get(binary.LittleEndian.AppendUint64(nil, i))
+		require.Nil(t, err, "get error")
+		require.Equalf(t, []byte("value"), v, "value of key %d not found", i)
+	}
+	require.Nil(t, tree.Close(), "close error")
+
+	//WHEN the tree is opened using a different comparer
+	_, err = Open(testDir, WithFS(fs))
+
+	//THEN it fails
+	assert.True(t, errors.Is(err, sstable.ErrComparerMismatch), "comparer mismatch must be reported")
+
+	//WHEN the tree is opened using the same comparer
+	tree, err = Open(testDir, WithFS(fs), WithComparer(kv.LittleEndianComparer))
+
+	//THEN it works
+	require.Nil(t, err, "reopen error")
+	require.Nil(t, tree.Close(), "close error")
+}
@@ -0,0 +1,323 @@
+package lsm
+
+import (
+	"bytes"
+	"challenge-lsm-store/kv"
+	"challenge-lsm-store/vfs"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const partitionsFile = "PARTITIONS"
+
+var ErrPartitionerMismatch = errors.New("store is partitioned by another partitioner")
+
+// Partitioner routes keys to partitions. A key must be always routed to the same partition, so the store records
+// name & bounds of its partitioner and it can't be opened later on using a different one.
+type Partitioner interface {
+	// Partitions returns number of partitions
+	Partitions() int
+	// Partition returns index of the partition keeping the key
+	Partition(key []byte) int
+	// Name identifies the way keys are routed, it must change whenever any key could be routed elsewhere
+	// while bounds stay the same
+	Name() string
+	// Bounds returns ordered lower bounds of partitions (the first partition aside), nil when keys are not
+	// routed by their ranges
+	Bounds() [][]byte
+}
+
+type (
+	hashPartitioner struct {
+		n int
+	}
+
+	rangePartitioner struct {
+		comparer kv.Comparer
+		bounds   [][]byte
+	}
+)
+
+// HashPartitioner spreads keys over n partitions by FNV-1a hash of the key. Keys of a range are spread
+// over all partitions, so iterator merges all of them. Store can't be opened with less than one partition.
+func HashPartitioner(n int) Partitioner {
+	return hashPartitioner{n: n}
+}
+
+// RangePartitioner splits keys into ranges by given bounds ordered by the comparer. Partition i keeps keys
+// from bounds[i-1] (included) till bounds[i] (excluded), the last partition keeps keys from the last bound.
+func RangePartitioner(comparer kv.Comparer, bounds ...[]byte) Partitioner {
+	bounds = slices.Clone(bounds)
+	slices.SortFunc(bounds, comparer.Compare)
+	bounds = slices.CompactFunc(bounds, func(a, b []byte) bool {
+		return comparer.Compare(a, b) == 0
+	})
+	return rangePartitioner{comparer: comparer, bounds: bounds}
+}
+
+func (p hashPartitioner) Partitions() int {
+	return p.n
+}
+
+func (p hashPartitioner) Partition(key []byte) int {
+	if p.n < 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	return int(h.Sum32() % uint32(p.n))
+}
+
+func (p hashPartitioner) Name() string {
+	return fmt.Sprintf("hash(%d)", p.n)
+}
+
+func (p hashPartitioner) Bounds() [][]byte {
+	return nil
+}
+
+func (p rangePartitioner) Partitions() int {
+	return len(p.bounds) + 1
+}
+
+func (p rangePartitioner) Partition(key []byte) int {
+	i, found := slices.BinarySearchFunc(p.bounds, key, p.comparer.Compare)
+	if found {
+		return i + 1
+	}
+	return i
+}
+
+func (p rangePartitioner) Name() string {
+	return fmt.Sprintf("range(%s)", p.comparer.Name())
+}
+
+func (p rangePartitioner) Bounds() [][]byte {
+	return p.bounds
+}
+
+// PartitionedStore routes keys to independent trees. Each tree has its own directory, WAL and background work,
+// so writes to different partitions don't wait for each other.
+type PartitionedStore struct {
+	partitioner Partitioner
+	comparer    kv.Comparer
+	trees       []*Tree
+}
+
+// OpenPartitioned opens store kept in given directory, each partition is a tree opened with given options
+// in its own subdirectory. ErrPartitionerMismatch is returned when the store has been partitioned differently.
+func OpenPartitioned(dir string, partitioner Partitioner, opts ...Option) (*PartitionedStore, error) {
+	cfg, err := newConfig(dir, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if partitioner.Partitions() < 1 {
+		return nil, fmt.Errorf("%w: %d partitions", ErrInvalidOption, partitioner.Partitions())
+	}
+	// keys of range partitions must be ordered the same way as keys of trees, otherwise iterators miss keys
+	if p, ok := partitioner.(rangePartitioner); ok && p.comparer.Name() != cfg.comparer().Name() {
+		return nil, fmt.Errorf("%w: range partitioner orders keys by %s, trees by %s",
+			ErrInvalidOption, p.comparer.Name(), cfg.comparer().Name())
+	}
+	fs := cfg.FS
+	if fs == nil {
+		fs = vfs.Default
+	}
+	if err := fs.MkdirAll(dir); err != nil {
+		return nil, err
+	}
+	if err := checkPartitioner(fs, dir, partitioner); err != nil {
+		return nil, err
+	}
+
+	s := &PartitionedStore{partitioner: partitioner, comparer: cfg.comparer()}
+	for i := 0; i < partitioner.Partitions(); i++ {
+		tree, err := Open(partitionDir(dir, i), opts...)
+		if err != nil {
+			_ = s.Close() // TODO log error
+			return nil, fmt.Errorf("partition %d: %w", i, err)
+		}
+		s.trees = append(s.trees, tree)
+	}
+	return s, nil
+}
+
+// checkPartitioner records name & bounds of the partitioner of a new store, otherwise it compares them
+// with the recorded ones
+func checkPartitioner(fs vfs.FS, dir string, partitioner Partitioner) error {
+	layout := partitionLayout{name: partitioner.Name(), bounds: partitioner.Bounds()}
+	record, err := readRecordFile(fs, dir, partitionsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return writeRecordFile(fs, dir, partitionsFile, layout.encode())
+	}
+	if err != nil {
+		return err
+	}
+	var recorded partitionLayout
+	if err := recorded.decode(record); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidPartitionMap, err)
+	}
+	if !recorded.equal(layout) {
+		return fmt.Errorf("%w: %s, store is partitioned by %s", ErrPartitionerMismatch, layout, recorded)
+	}
+	return nil
+}
+
+// partitionLayout is the record of partitions file
+type partitionLayout struct {
+	name   string
+	bounds [][]byte
+}
+
+func (l partitionLayout) encode() []byte {
+	buff := binary.AppendUvarint(nil, uint64(len(l.name)))
+	buff = append(buff, l.name...)
+	buff = binary.AppendUvarint(buff, uint64(len(l.bounds)))
+	for _, b := range l.bounds {
+		buff = binary.AppendUvarint(buff, uint64(len(b)))
+		buff = append(buff, b...)
+	}
+	return buff
+}
+
+func (l *partitionLayout) decode(record []byte) error {
+	buff := bytes.NewReader(record)
+	readBytes := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(buff)
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(buff.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(buff, b)
+		return b, err
+	}
+	name, err := readBytes()
+	if err != nil {
+		return err
+	}
+	count, err := binary.ReadUvarint(buff)
+	if err != nil {
+		return err
+	}
+	l.name, l.bounds = string(name), make([][]byte, 0, min(count, uint64(buff.Len())))
+	for i := uint64(0); i < count; i++ {
+		b, err := readBytes()
+		if err != nil {
+			return err
+		}
+		l.bounds = append(l.bounds, b)
+	}
+	return nil
+}
+
+func (l partitionLayout) equal(other partitionLayout) bool {
+	return l.name == other.name && slices.EqualFunc(l.bounds, other.bounds, bytes.Equal)
+}
+
+func (l partitionLayout) String() string {
+	if len(l.bounds) == 0 {
+		return l.name
+	}
+	bounds := make([]string, 0, len(l.bounds))
+	for _, b := range l.bounds {
+		bounds = append(bounds, hex.EncodeToString(b))
+	}
+	return fmt.Sprintf("%s bounded by %s", l.name, strings.Join(bounds, ","))
+}
+
+func partitionDir(dir string, i int) string {
+	return filepath.Join(dir, fmt.Sprintf("partition-%04d", i))
+}
+
+// partition returns tree keeping the key
+func (s *PartitionedStore) partition(key []byte) *Tree {
+	return s.trees[s.partitioner.Partition(key)]
+}
+
+func (s *PartitionedStore) Get(key []byte) ([]byte, error) {
+	return s.partition(key).Get(key)
+}
+
+func (s *PartitionedStore) Put(key []byte, value []byte) error {
+	return s.partition(key).Put(key, value)
+}
+
+func (s *PartitionedStore) Delete(key []byte) error {
+	return s.partition(key).Delete(key)
+}
+
+// NewIterator returns iterator going through keys from lower (included) till upper (excluded) bound in order,
+// nil bound means there is no limit, see Iterator. Partitions are iterated at the same time, so keys of hash
+// partitions are merged. Range partitions out of the bounds are skipped.
+func (s *PartitionedStore) NewIterator(lower, upper []byte) (*Iterator, error) {
+	trees := s.trees
+	if s.partitioner.Bounds() != nil {
+		first, last := 0, len(trees)-1
+		if lower != nil {
+			first = s.partitioner.Partition(lower)
+		}
+		if upper != nil {
+			last = s.partitioner.Partition(upper)
+		}
+		trees = trees[first : max(first, last)+1]
+	}
+	iterators := make([]iterator, 0, len(trees))
+	opened := make([]*Iterator, 0, len(trees))
+	release := func() error {
+		var errs []error
+		for _, it := range opened {
+			errs = append(errs, it.Close())
+		}
+		return errors.Join(errs...)
+	}
+	for _, tree := range trees {
+		it, err := tree.newIterator(defaultColumnFamilyID, s.comparer, nil, lower)
+		if err != nil {
+			_ = release() // TODO log error
+			return nil, err
+		}
+		// partitions never share a key, so iterators of trees are merged as they are
+		iterators = append(iterators, it.merged)
+		opened = append(opened, it)
+	}
+	merged := &boundedIterator{
+		it:       newMergingIterator(s.comparer, iterators...),
+		upper:    upper,
+		comparer: s.comparer,
+	}
+	return &Iterator{merged: merged, release: release}, nil
+}
+
+// Flush moves memory of all partitions into tables, see Tree.Flush
+func (s *PartitionedStore) Flush(ctx context.Context) error {
+	var errs []error
+	for i, tree := range s.trees {
+		if err := tree.Flush(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("partition %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes trees of all partitions
+func (s *PartitionedStore) Close() error {
+	var errs []error
+	for i, tree := range s.trees {
+		if err := tree.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("partition %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,153 @@
+package lsm
+
+import (
+	"challenge-lsm-store/kv"
+	"challenge-lsm-store/vfs"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_LSM_Partition_RangePartitioner(t *testing.T) {
+	//GIVEN partitioner with unordered bounds
+	p := RangePartitioner(kv.BytewiseComparer, []byte("t"), []byte("k"), []byte("k"))
+
+	//THEN keys are routed by ordered bounds
+	assert.Equal(t, 3, p.Partitions(), "unexpected number of partitions")
+	for key, partition := range map[string]int{"a": 0, "j": 0, "k": 1, "m": 1, "t": 2, "z": 2} {
+		assert.Equal(t, partition, p.Partition([]byte(key)), "unexpected partition of %s", key)
+	}
+	assert.Equal(t, "range(kv.BytewiseComparer)", p.Name(), "unexpected name")
+	assert.Equal(t, [][]byte{[]byte("k"), []byte("t")}, p.Bounds(), "unexpected bounds")
+}
+
+func Test_LSM_Partition_HashPartitionedStore(t *testing.T) {
+	//GIVEN a store with hash partitions
+	fs := vfs.NewMemFS()
+	store, err := OpenPartitioned(testDir, HashPartitioner(4), WithFS(fs), WithMemtableSize(1000))
+	require.Nil(t, err, "open error")
+
+	//WHEN keys are written and some of them deleted
+	const keys = 200
+	var expPairs []string
+	for i := 0; i < keys; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		require.Nil(t, store.Put(key, key), "put error")
+		if i%10 == 0 {
+			require.Nil(t, store.Delete(key), "delete error")
+		} else {
+			expPairs = append(expPairs, fmt.Sprintf("%s=%s", key, key))
+		}
+	}
+
+	//THEN keys are spread over all partitions
+	for i, tree := range store.trees {
+		it, err := tree.NewIterator()
+		require.Nil(t, err, "iterator error")
+		assert.NotEmpty(t, iterate(t, it), "partition %d must keep some keys", i)
+	}
+
+	//AND keys are found
+	for i := 0; i < keys; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		v, err := store.Get(key)
+		require.Nil(t, err, "get error")
+		if i%10 == 0 {
+			require.Nil(t, v, "deleted key must not be found")
+		} else {
+			require.Equal(t, key, v, "unexpected value")
+		}
+	}
+
+	//AND iterator merges partitions in order
+	require.Nil(t, store.Flush(context.Background()), "flush error")
+	it, err := store.NewIterator(nil, nil)
+	require.Nil(t, err, "iterator error")
+	assert.Equal(t, expPairs, iterate(t, it), "unexpected pairs")
+	require.Nil(t, store.Close(), "close error")
+
+	//WHEN the store is opened with a different number of partitions
+	_, err = OpenPartitioned(testDir, HashPartitioner(2), WithFS(fs))
+
+	//THEN it fails
+	assert.True(t, errors.Is(err, ErrPartitionerMismatch), "partitioner mismatch must be reported")
+
+	//WHEN the store is opened with the same partitioner
+	store, err = OpenPartitioned(testDir, HashPartitioner(4), WithFS(fs))
+
+	//THEN keys are found
+	require.Nil(t, err, "reopen error")
+	v, err := store.Get([]byte("key001"))
+	assert.Nil(t, err, "get error")
+	assert.Equal(t, []byte("key001"), v, "unexpected value")
+	require.Nil(t, store.Close(), "close error")
+}
+
+func Test_LSM_Partition_RangePartitionedStore(t *testing.T) {
+	//GIVEN a store with range partitions
+	fs := vfs.NewMemFS()
+	store, err := OpenPartitioned(testDir, RangePartitioner(kv.BytewiseComparer, []byte("k"), []byte("t")), WithFS(fs))
+	require.Nil(t, err, "open error")
+
+	//WHEN keys of all ranges are written
+	for _, key := range []string{"z", "m", "a", "k", "t", "b"} {
+		require.Nil(t, store.Put([]byte(key), []byte(key)), "put error")
+	}
+
+	//THEN each partition keeps its range
+	for i, exp := range [][]string{{"a=a", "b=b"}, {"k=k", "m=m"}, {"t=t", "z=z"}} {
+		it, err := store.trees[i].NewIterator()
+		require.Nil(t, err, "iterator error")
+		assert.Equal(t, exp, iterate(t, it), "unexpected keys of partition %d", i)
+	}
+
+	//AND iterator goes through partitions in order
+	it, err := store.NewIterator(nil, nil)
+	require.Nil(t, err, "iterator error")
+	assert.Equal(t, []string{"a=a", "b=b", "k=k", "m=m", "t=t", "z=z"}, iterate(t, it), "unexpected pairs")
+	//AND bounded iterator goes through keys of its range only
+	it, err = store.NewIterator([]byte("b"), []byte("t"))
+	require.Nil(t, err, "iterator error")
+	assert.Equal(t, []string{"b=b", "k=k", "m=m"}, iterate(t, it), "unexpected pairs of the range")
+	//AND bounded iterator seeks tables to its lower bound
+	require.Nil(t, store.Flush(context.Background()), "flush error")
+	it, err = store.NewIterator([]byte("l"), []byte("z"))
+	require.Nil(t, err, "iterator error")
+	assert.Equal(t, []string{"m=m", "t=t"}, iterate(t, it), "unexpected pairs of flushed range")
+	require.Nil(t, store.Close(), "close error")
+
+	//WHEN the store is opened with different bounds
+	_, err = OpenPartitioned(testDir, RangePartitioner(kv.BytewiseComparer, []byte("m"), []byte("t")), WithFS(fs))
+
+	//THEN it fails
+	assert.True(t, errors.Is(err, ErrPartitionerMismatch), fmt.Sprintf("unexpected error: %v", err))
+
+	//WHEN the store is opened with the same bounds
+	store, err = OpenPartitioned(testDir, RangePartitioner(kv.BytewiseComparer, []byte("t"), []byte("k")), WithFS(fs))
+
+	//THEN keys are found
+	require.Nil(t, err, "reopen error")
+	v, err := store.Get([]byte("m"))
+	assert.Nil(t, err, "get error")
+	assert.Equal(t, []byte("m"), v, "unexpected value")
+	require.Nil(t, store.Close(), "close error")
+}
+
+func Test_LSM_Partition_RejectInvalidPartitioner(t *testing.T) {
+	//WHEN a store without partitions is opened
+	_, err := OpenPartitioned(testDir, HashPartitioner(0), WithFS(vfs.NewMemFS()))
+
+	//THEN it fails
+	assert.True(t, errors.Is(err, ErrInvalidOption), "invalid partitioner must be reported")
+	//AND the partitioner doesn't route keys by itself
+	assert.Zero(t, HashPartitioner(0).Partition([]byte("key")), "no partition expected")
+
+	//WHEN a store is opened with range partitioner ordering keys differently than trees
+	_, err = OpenPartitioned(testDir, RangePartitioner(kv.LittleEndianComparer, []byte("k")), WithFS(vfs.NewMemFS()))
+
+	//THEN it fails
+	assert.True(t, errors.Is(err, ErrInvalidOption), fmt.Sprintf("unexpected error: %v", err))
+}
@@ -0,0 +1,79 @@
+package lsm
+
+import (
+	"bytes"
+	"challenge-lsm-store/kv"
+	"challenge-lsm-store/memtable"
+	"challenge-lsm-store/sstable"
+	"slices"
+)
+
+// NewPrefixIterator returns iterator going through keys of the default column family which start with the prefix.
+// Keys sharing a prefix must be adjacent in order of the comparer (as in bytewise order), the iteration stops
+// at the first key out of the prefix. Tables which can't keep the prefix are skipped, see WithPrefixExtractor.
+func (t *Tree) NewPrefixIterator(prefix []byte) (*Iterator, error) {
+	return t.newIterator(defaultColumnFamilyID, t.cfg.comparer(), bytes.Clone(prefix), nil)
+}
+
+// mayContainPrefix tells whether the table may keep keys starting with the prefix. Bloom filter of the table
+// is checked unless the table has range tombstones, which may delete keys of the prefix kept by older tables.
+func (s *fileStorage) mayContainPrefix(prefix []byte) (bool, error) {
+	props := s.table.props
+	if props.Entries+props.RangeTombstones == 0 || s.comparer.Compare(props.LargestKey, prefix) < 0 ||
+		(s.comparer.Compare(props.SmallestKey, prefix) > 0 && !bytes.HasPrefix(props.SmallestKey, prefix)) {
+		return false, nil
+	}
+	if s.prefixExtractor == nil || props.RangeTombstones > 0 {
+		return true, nil
+	}
+	if err := s.open(); err != nil {
+		return false, err
+	}
+	return s.reader.MayContainPrefix(prefix)
+}
+
+// mayContainKey checks bloom filter of the table for prefix of the key, see mayContainPrefix
+func (s *fileStorage) mayContainKey(key []byte) (bool, error) {
+	if s.prefixExtractor == nil || s.table.props.RangeTombstones > 0 {
+		return true, nil
+	}
+	prefix, ok := s.prefixExtractor.Prefix(key)
+	if !ok {
+		return true, nil
+	}
+	if err := s.open(); err != nil {
+		return false, err
+	}
+	return s.reader.MayContainPrefix(prefix)
+}
+
+// newPrefixIterator returns iterator of table keys starting with the prefix and range tombstones of the table.
+// Nil iterator is returned when the table can't keep the prefix. Nil prefix stands for all keys.
+// Iterator is sought to the start key unless it's nil.
+func (s *fileStorage) newPrefixIterator(prefix, start []byte) (*sstable.Iterator, []sstable.RangeTombstone, error) {
+	if prefix != nil {
+		if ok, err := s.mayContainPrefix(prefix); err != nil || !ok {
+			return nil, nil, err
+		}
+	}
+	it, err := s.NewIterator()
+	if err != nil {
+		return nil, nil, err
+	}
+	dels, err := s.rangeTombstones()
+	if err != nil {
+		return nil, nil, err
+	}
+	if start != nil {
+		it.Seek(start)
+	}
+	return it, dels, nil
+}
+
+// seekEntries skips entries whose keys are smaller than given one
+func seekEntries(entries []memtable.Entry, comparer kv.Comparer, key []byte) []memtable.Entry {
+	i, _ := slices.BinarySearchFunc(entries, key, func(e memtable.Entry, key []byte) int {
+		return comparer.Compare(e.GetKey(), key)
+	})
+	return entries[i:]
+}
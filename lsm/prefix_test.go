@@ -0,0 +1,100 @@
+package lsm
+
+import (
+	"challenge-lsm-store/kv"
+	"challenge-lsm-store/vfs"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// postingKey composes key of a posting list entry
+func postingKey(term, doc int) []byte {
+	return []byte(fmt.Sprintf("term%02d\x00doc%02d", term, doc))
+}
+
+func Test_LSM_Prefix_Iterator(t *testing.T) {
+	//GIVEN a tree with posting lists in many tables and memory
+	tree, err := Open(testDir, WithFS(vfs.NewMemFS()), WithPrefixExtractor(kv.SeparatorPrefix(0)),
+		WithCompactionStyle(CompactionNone))
+	require.Nil(t, err, "open error")
+	for term := 0; term < 10; term++ {
+		for doc := 0; doc < 3; doc++ {
+			require.Nil(t, tree.Put(postingKey(term, doc), []byte("v1")), "put error")
+		}
+		require.Nil(t, tree.Flush(context.Background()), "flush error")
+	}
+	require.Nil(t, tree.Put(postingKey(3, 1), []byte("v2")), "put error")
+	require.Nil(t, tree.Delete(postingKey(3, 2)), "delete error")
+	require.Nil(t, tree.Put(postingKey(3, 3), []byte("v2")), "put error")
+	require.Nil(t, tree.Put([]byte("term03"), []byte("no prefix")), "put error")
+
+	prefixPairs := func(prefix string) []string {
+		it, err := tree.NewPrefixIterator([]byte(prefix))
+		require.Nil(t, err, "iterator error")
+		return iterate(t, it)
+	}
+
+	//THEN only keys of the prefix are found
+	exp := []string{"term03\x00doc00=v1", "term03\x00doc01=v2", "term03\x00doc03=v2"}
+	assert.Equal(t, exp, prefixPairs("term03\x00"), "unexpected pairs of the term")
+	assert.Empty(t, prefixPairs("term42\x00"), "missing term")
+	assert.Empty(t, prefixPairs("zzz"), "prefix after all keys")
+	//AND prefixes which aren't extracted can be iterated as well
+	assert.Equal(t, append([]string{"term03=no prefix"}, exp...), prefixPairs("term03"), "unexpected pairs of prefix without filter")
+	assert.Len(t, prefixPairs("term0"), 10*3+1, "unexpected number of pairs") // two keys set, one deleted
+
+	//WHEN range of the prefix is deleted
+	require.Nil(t, tree.DeleteRange(postingKey(3, 1), postingKey(3, 4)), "delete range error")
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+
+	//THEN deleted keys are not found
+	assert.Equal(t, exp[:1], prefixPairs("term03\x00"), "unexpected pairs once range is deleted")
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_Prefix_FilterSkipsTables(t *testing.T) {
+	//GIVEN a tree with tables of different terms
+	tree, err := Open(testDir, WithFS(vfs.NewMemFS()), WithPrefixExtractor(kv.SeparatorPrefix(0)),
+		WithCompactionStyle(CompactionNone))
+	require.Nil(t, err, "open error")
+	const terms = 10
+	for term := 0; term < terms; term++ {
+		// terms interleave, so ranges of tables overlap
+		for _, t2 := range []int{term, terms + term, 2*terms + term} {
+			require.Nil(t, tree.Put(postingKey(t2, 0), []byte("v")), "put error")
+		}
+		require.Nil(t, tree.Flush(context.Background()), "flush error")
+	}
+	view, err := tree.storageProvider.FilesStorage(defaultColumnFamilyID)
+	require.Nil(t, err, "files storage error")
+	defer func() {
+		require.Nil(t, view.Release(), "release error")
+	}()
+	require.Len(t, view.levels[0], terms, "unexpected number of tables")
+
+	//WHEN tables are checked for a prefix
+	var prefixTables, keyTables int
+	for _, f := range view.levels[0] {
+		ok, err := f.mayContainPrefix([]byte("term15\x00"))
+		require.Nil(t, err, "filter error")
+		if ok {
+			prefixTables++
+		}
+		ok, err = f.mayContainKey(postingKey(15, 7))
+		require.Nil(t, err, "filter error")
+		if ok {
+			keyTables++
+		}
+	}
+
+	//THEN only table keeping the prefix may contain it
+	assert.Equal(t, 1, prefixTables, "tables of other prefixes must be skipped")
+	assert.Equal(t, 1, keyTables, "tables of other prefixes must be skipped by lookups")
+	v, err := tree.Get(postingKey(15, 0))
+	assert.Nil(t, err, "get error")
+	assert.Equal(t, []byte("v"), v, "unexpected value")
+	require.Nil(t, tree.Close(), "close error")
+}
@@ -0,0 +1,91 @@
+package lsm
+
+import (
+	"bytes"
+	"challenge-lsm-store/kv"
+	"challenge-lsm-store/sstable"
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidRange = errors.New("invalid key range")
+
+// DeleteRange deletes keys of the default column family from start (inclusive) to end (exclusive).
+// The range is kept as a single range tombstone, covered keys are dropped by compaction.
+func (t *Tree) DeleteRange(start, end []byte) error {
+	if t.cfg.comparer().Compare(start, end) >= 0 {
+		return fmt.Errorf("%w: start %q must be before end %q", ErrInvalidRange, start, end)
+	}
+	return t.write(func() error {
+		return t.current.Put(start, kv.EncodeValue(kv.KindRangeDelete, t.seq.Add(1), end))
+	})
+}
+
+// addRangeDel keeps range tombstone of given family. Memory must be locked.
+func (s *MemoryStorage) addRangeDel(family uint32, t sstable.RangeTombstone) {
+	if s.rangeDels == nil {
+		s.rangeDels = make(map[uint32][]sstable.RangeTombstone)
+	}
+	t.Start, t.End = bytes.Clone(t.Start), bytes.Clone(t.End)
+	s.rangeDels[family] = append(s.rangeDels[family], t)
+	s.rangeDelsSize += len(t.Start) + len(t.End)
+}
+
+// rangeTombstones returns range tombstones of given family, they are not changed by writes made afterwards
+func (s *MemoryStorage) rangeTombstones(family uint32) []sstable.RangeTombstone {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	dels := s.rangeDels[family]
+	return dels[:len(dels):len(dels)]
+}
+
+// rangeTombstones returns range tombstones of the table
+func (s *fileStorage) rangeTombstones() ([]sstable.RangeTombstone, error) {
+	if s.table.props.RangeTombstones == 0 {
+		return nil, nil
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s.reader.RangeTombstones()
+}
+
+// findCovered searches for the key and range tombstones covering it in the table, see MemoryStorage.find
+func (s *fileStorage) findCovered(key []byte) ([]byte, bool, kv.SeqNum, error) {
+	if ok, err := s.mayContainKey(key); err != nil || !ok {
+		return nil, false, 0, err
+	}
+	value, found, err := s.Find(key)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	dels, err := s.rangeTombstones()
+	if err != nil {
+		return nil, false, 0, err
+	}
+	return value, found, sstable.CoveringSeq(s.comparer, dels, key), nil
+}
+
+// olderThan tells whether encoded value has been changed before given sequence number
+func olderThan(encoded []byte, seq kv.SeqNum) bool {
+	v, err := kv.DecodeValue(encoded)
+	return err == nil && v.Seq < seq
+}
+
+// clipRangeDels returns parts of range tombstones between lower (inclusive) and upper (exclusive) bound,
+// nil bound is unlimited. Each table written by compaction keeps tombstones clipped to its own range.
+func clipRangeDels(cmp kv.Comparer, dels []sstable.RangeTombstone, lower, upper []byte) []sstable.RangeTombstone {
+	var clipped []sstable.RangeTombstone
+	for _, t := range dels {
+		if lower != nil && cmp.Compare(t.Start, lower) < 0 {
+			t.Start = lower
+		}
+		if upper != nil && cmp.Compare(t.End, upper) > 0 {
+			t.End = upper
+		}
+		if cmp.Compare(t.Start, t.End) < 0 {
+			clipped = append(clipped, t)
+		}
+	}
+	return clipped
+}
@@ -0,0 +1,170 @@
+package lsm
+
+import (
+	"challenge-lsm-store/kv"
+	"challenge-lsm-store/sstable"
+	"challenge-lsm-store/vfs"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_LSM_RangeDelete_HideDeletedKeys(t *testing.T) {
+	//GIVEN a tree with keys in tables and memory
+	fs := vfs.NewMemFS()
+	tree, err := Open(testDir, WithFS(fs))
+	require.Nil(t, err, "open error")
+	for i := 0; i < 10; i++ {
+		require.Nil(t, tree.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))), "put error")
+		if i == 4 {
+			require.Nil(t, tree.Flush(context.Background()), "flush error")
+		}
+	}
+
+	//WHEN a range of keys is deleted and a key of the range is set again
+	require.Nil(t, tree.DeleteRange([]byte("key3"), []byte("key7")), "delete range error")
+	require.Nil(t, tree.Put([]byte("key5"), []byte("new")), "put error")
+
+	//THEN only keys out of the range and newer keys are found
+	exp := []string{"key0=value0", "key1=value1", "key2=value2", "key5=new", "key7=value7", "key8=value8", "key9=value9"}
+	assertPairs := func(tree *Tree) {
+		it, err := tree.NewIterator()
+		require.Nil(t, err, "iterator error")
+		assert.Equal(t, exp, iterate(t, it), "unexpected pairs")
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("key%d", i)
+			v, err := tree.Get([]byte(key))
+			assert.Nil(t, err, "get error")
+			if i == 3 || i == 4 || i == 6 {
+				assert.Nil(t, v, "deleted key %s must not be found", key)
+			} else {
+				assert.NotNil(t, v, "key %s must be found", key)
+			}
+		}
+	}
+	assertPairs(tree)
+
+	//AND range tombstone is recovered from WAL
+	require.Nil(t, tree.Close(), "close error")
+	tree, err = Open(testDir, WithFS(fs))
+	require.Nil(t, err, "reopen error")
+	assertPairs(tree)
+
+	//AND it's kept in a table
+	require.Nil(t, tree.Put([]byte("key4"), []byte("value4")), "put error")
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+	exp = append(exp[:3], append([]string{"key4=value4"}, exp[3:]...)...)
+	it, err := tree.NewIterator()
+	require.Nil(t, err, "iterator error")
+	assert.Equal(t, exp, iterate(t, it), "unexpected pairs")
+
+	//AND invalid range is rejected
+	assert.True(t, errors.Is(tree.DeleteRange([]byte("key7"), []byte("key3")), ErrInvalidRange), "reversed range")
+	assert.True(t, errors.Is(tree.DeleteRange([]byte("key7"), []byte("key7")), ErrInvalidRange), "empty range")
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_RangeDelete_CompactionDropsCoveredKeys(t *testing.T) {
+	//GIVEN a tree with keys compacted into L1
+	tree, err := Open(testDir, WithFS(vfs.NewMemFS()), WithMemtableSize(300), WithCompactionStyle(CompactionNone))
+	require.Nil(t, err, "open error")
+	const keys = 100
+	for i := 0; i < keys; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		require.Nil(t, tree.Put(key, key), "put error")
+	}
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+	require.Nil(t, tree.Compact(), "compaction error")
+
+	//WHEN a range is deleted and L0 is compacted while deeper levels may keep deleted keys
+	require.Nil(t, tree.DeleteRange([]byte("key020"), []byte("key080")), "delete range error")
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+	cf := tree.defaultFamily()
+	cf.cfg.TargetFileSize = 200
+	view, err := tree.storageProvider.FilesStorage(cf.id)
+	require.Nil(t, err, "files storage error")
+	require.Len(t, view.levels[0], 1, "range tombstone must be flushed")
+	smallest, largest := keyRange(view.levels[0], kv.BytewiseComparer)
+	c := &compaction{level: 0, inputs: view.levels[0], overlapping: overlapping(view.levels[1], smallest, largest, kv.BytewiseComparer)}
+	require.Nil(t, tree.compact(cf, c), "compaction error")
+	require.Nil(t, view.Release(), "release error")
+
+	//THEN covered keys are dropped
+	view, err = tree.storageProvider.FilesStorage(cf.id)
+	require.Nil(t, err, "files storage error")
+	var (
+		stored     int
+		tombstones []sstable.RangeTombstone
+	)
+	for _, f := range view.levels[1] {
+		it, err := f.NewIterator()
+		require.Nil(t, err, "iterator error")
+		for it.Next() {
+			assert.False(t, string(it.Key()) >= "key020" && string(it.Key()) < "key080", "key %s must be dropped", it.Key())
+			stored++
+		}
+		//AND range tombstone is kept by tables of the level within their ranges
+		dels, err := f.rangeTombstones()
+		require.Nil(t, err, "range tombstones error")
+		for _, del := range dels {
+			assert.True(t, f.table.props.Contains(kv.BytewiseComparer, del.Start), "tombstone must be in table range")
+			if len(tombstones) > 0 {
+				assert.Equal(t, tombstones[len(tombstones)-1].End, del.Start, "tombstone parts must be adjacent")
+			}
+		}
+		tombstones = append(tombstones, dels...)
+	}
+	require.Greater(t, len(view.levels[1]), 1, "keys must be split into many tables")
+	require.Nil(t, view.Release(), "release error")
+	assert.Equal(t, keys-60, stored, "unexpected number of kept keys")
+	require.NotEmpty(t, tombstones, "range tombstone must be kept")
+	assert.Equal(t, []byte("key020"), tombstones[0].Start, "unexpected start of range")
+	assert.Equal(t, []byte("key080"), tombstones[len(tombstones)-1].End, "unexpected end of range")
+
+	//AND keys are still deleted
+	it, err := tree.NewIterator()
+	require.Nil(t, err, "iterator error")
+	assert.Len(t, iterate(t, it), keys-60, "unexpected number of keys")
+	v, err := tree.Get([]byte("key050"))
+	assert.Nil(t, err, "get error")
+	assert.Nil(t, v, "deleted key must not be found")
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_RangeDelete_MergeAfterDelete(t *testing.T) {
+	//GIVEN a tree with counters in a table and memory
+	tree, err := Open(testDir, WithFS(vfs.NewMemFS()), WithMergeOperator(UInt64AddOperator))
+	require.Nil(t, err, "open error")
+	require.Nil(t, tree.Put([]byte("flushed"), u64(5)), "put error")
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+	require.Nil(t, tree.Put([]byte("memory"), u64(5)), "put error")
+
+	//WHEN counters are deleted and incremented afterwards
+	require.Nil(t, tree.DeleteRange([]byte("a"), []byte("z")), "delete range error")
+	for _, key := range []string{"flushed", "memory"} {
+		require.Nil(t, tree.Merge([]byte(key), u64(1)), "merge error")
+	}
+
+	//THEN counters start from zero
+	assertCounters := func() {
+		for _, key := range []string{"flushed", "memory"} {
+			v, err := tree.Get([]byte(key))
+			assert.Nil(t, err, "get error")
+			assert.Equal(t, u64(1), v, "unexpected counter %s", key)
+		}
+		it, err := tree.NewIterator()
+		require.Nil(t, err, "iterator error")
+		assert.Equal(t, []string{fmt.Sprintf("flushed=%s", u64(1)), fmt.Sprintf("memory=%s", u64(1))}, iterate(t, it), "unexpected pairs")
+	}
+	assertCounters()
+
+	//AND once they are flushed & compacted
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+	assertCounters()
+	require.Nil(t, tree.Compact(), "compaction error")
+	assertCounters()
+	require.Nil(t, tree.Close(), "close error")
+}
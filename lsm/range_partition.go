@@ -0,0 +1,916 @@
+package lsm
+
+import (
+	"bytes"
+	"challenge-lsm-store/kv"
+	"challenge-lsm-store/sstable"
+	"challenge-lsm-store/vfs"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	partitionMapFile = "PARTITION_MAP"
+
+	defaultPartitionSplitSize = 64 * 1024 * 1024
+	defaultPartitionMergeSize = 8 * 1024 * 1024
+
+	// rebalanceInterval is number of writes after which sizes of partitions are checked in the background
+	rebalanceInterval = 1024
+	// copyTablePrefix is prefix of tables built in directory of a partition while partitions are split or merged
+	copyTablePrefix = "copy-"
+)
+
+var ErrInvalidPartitionMap = errors.New("invalid partition map")
+
+type (
+	// PartitionLimits drive split & merge of range partitions, zero values stand for defaults
+	PartitionLimits struct {
+		SplitSize int64 // size (bytes) above which partition is split at its median key
+		MergeSize int64 // size (bytes) below which partition is merged with its small neighbour
+	}
+
+	// RangePartitionedStore keeps ranges of keys in partitions backed by their own trees. Boundaries of partitions
+	// are kept in the partition map, so they survive restarts. Partition which grows past the split size is split
+	// at its median key and small neighbours are merged, both in the background (see Rebalance).
+	// Keys are copied into tables ingested by new partitions (see Tree.Ingest), so they are not written again.
+	// Writes of the partition go on while its keys are copied, they wait only while keys written meanwhile
+	// are copied again. Reads and iterators keep using its old tree. Only the default column family is kept.
+	RangePartitionedStore struct {
+		dir      string
+		opts     []Option
+		fs       vfs.FS
+		comparer kv.Comparer
+		limits   PartitionLimits
+
+		mu         sync.RWMutex
+		partitions []*rangePartition // ordered by their lower bounds
+		nextID     uint64            // id of the next partition, ids are never reused
+		closed     bool
+
+		refsMu  sync.Mutex                   // guards references of partitions
+		retired map[*rangePartition]struct{} // replaced partitions which are still used
+
+		rebalanceMu        sync.Mutex // only one split or merge runs at the same time
+		rebalanceScheduled atomic.Bool
+		writes             atomic.Int64
+		background         sync.WaitGroup
+		backgroundErr      error // the last error of rebalance running in the background, reported on close
+	}
+
+	// rangePartition keeps keys from its lower bound (included) till lower bound of the next partition (excluded)
+	rangePartition struct {
+		id      uint64
+		lower   []byte // nil for the first partition
+		tree    *Tree
+		writeMu sync.RWMutex // writes hold it shared, split & merge exclusively once they copy keys written meanwhile
+		retired atomic.Bool  // partition has been replaced, its tree is closed & removed once it's not used
+		refs    int          // readers & writers using the partition
+		// size of the partition which couldn't be split, it's not split again till it grows by the split size.
+		// It's guarded by rebalance mutex.
+		unsplitSize int64
+
+		touchedMu sync.Mutex
+		touched   map[string]struct{} // keys written while the partition is copied, nil when it's not copied
+	}
+)
+
+// OpenRangePartitioned opens store kept in given directory, each partition is a tree opened with given options
+// in its own subdirectory. A new store starts with a single partition keeping all keys.
+func OpenRangePartitioned(dir string, limits PartitionLimits, opts ...Option) (*RangePartitionedStore, error) {
+	cfg, err := newConfig(dir, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if limits.SplitSize <= 0 {
+		limits.SplitSize = defaultPartitionSplitSize
+	}
+	if limits.MergeSize <= 0 {
+		limits.MergeSize = min(defaultPartitionMergeSize, limits.SplitSize/4)
+	}
+	// merged partition must not be split right away
+	if limits.MergeSize*2 >= limits.SplitSize {
+		return nil, fmt.Errorf("%w: partition merge size %d must be below half of split size %d",
+			ErrInvalidOption, limits.MergeSize, limits.SplitSize)
+	}
+	// keys of other column families are neither routed nor copied by split & merge
+	for name := range cfg.ColumnFamilies {
+		if name != DefaultColumnFamily {
+			return nil, fmt.Errorf("%w: column family %s, range partitions keep the default one only",
+				ErrInvalidOption, name)
+		}
+	}
+
+	s := &RangePartitionedStore{
+		dir:      dir,
+		opts:     opts,
+		fs:       cfg.FS,
+		comparer: cfg.comparer(),
+		limits:   limits,
+		retired:  make(map[*rangePartition]struct{}),
+	}
+	if s.fs == nil {
+		s.fs = vfs.Default
+	}
+	if err := s.fs.MkdirAll(dir); err != nil {
+		return nil, err
+	}
+	if err := s.open(); err != nil {
+		_ = s.Close() // TODO log error
+		return nil, err
+	}
+	return s, nil
+}
+
+// open opens trees of partitions recorded in partition map. Directories of partitions which are not in the map
+// are left by interrupted split or merge, they are removed.
+func (s *RangePartitionedStore) open() error {
+	bounds, err := s.readPartitionMap()
+	if err != nil {
+		return err
+	}
+	if len(bounds) == 0 {
+		s.nextID = 1
+		bounds = []partitionBound{{id: s.newPartitionID()}}
+		if err := s.writePartitionMap(bounds); err != nil {
+			return err
+		}
+	}
+
+	known := make(map[string]struct{}, len(bounds))
+	for _, b := range bounds {
+		tree, err := Open(s.partitionDir(b.id), s.opts...)
+		if err != nil {
+			return fmt.Errorf("partition %d: %w", b.id, err)
+		}
+		s.partitions = append(s.partitions, &rangePartition{id: b.id, lower: b.lower, tree: tree})
+		known[filepath.Base(s.partitionDir(b.id))] = struct{}{}
+	}
+
+	names, err := s.fs.List(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		var id uint64
+		if _, err := fmt.Sscanf(name, "range-%d", &id); err != nil {
+			continue
+		}
+		if _, ok := known[name]; !ok {
+			if err := s.fs.RemoveAll(filepath.Join(s.dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *RangePartitionedStore) partitionDir(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("range-%d", id))
+}
+
+func (s *RangePartitionedStore) newPartitionID() uint64 {
+	id := s.nextID
+	s.nextID++
+	return id
+}
+
+// partitionBound is an entry of partition map
+type partitionBound struct {
+	id    uint64
+	lower []byte
+}
+
+// writePartitionMap makes boundaries of partitions durable, the whole map is rewritten atomically
+func (s *RangePartitionedStore) writePartitionMap(bounds []partitionBound) error {
+	buff := bytes.NewBuffer(nil)
+	buff.Write(binary.AppendUvarint(nil, s.nextID))
+	buff.Write(binary.AppendUvarint(nil, uint64(len(bounds))))
+	for _, b := range bounds {
+		buff.Write(binary.AppendUvarint(nil, b.id))
+		buff.Write(binary.AppendUvarint(nil, uint64(len(b.lower))))
+		buff.Write(b.lower)
+	}
+	return writeRecordFile(s.fs, s.dir, partitionMapFile, buff.Bytes())
+}
+
+// readPartitionMap returns boundaries of partitions, none is returned when the map doesn't exist
+func (s *RangePartitionedStore) readPartitionMap() ([]partitionBound, error) {
+	record, err := readRecordFile(s.fs, s.dir, partitionMapFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPartitionMap, err)
+	}
+
+	buff := bytes.NewReader(record)
+	if s.nextID, err = binary.ReadUvarint(buff); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPartitionMap, err)
+	}
+	count, err := binary.ReadUvarint(buff)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPartitionMap, err)
+	}
+	bounds := make([]partitionBound, 0, min(count, uint64(buff.Len())))
+	for i := uint64(0); i < count; i++ {
+		var b partitionBound
+		if b.id, err = binary.ReadUvarint(buff); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidPartitionMap, err)
+		}
+		n, err := binary.ReadUvarint(buff)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidPartitionMap, err)
+		}
+		if n > 0 {
+			b.lower = make([]byte, n)
+			if _, err := io.ReadFull(buff, b.lower); err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrInvalidPartitionMap, err)
+			}
+		}
+		bounds = append(bounds, b)
+	}
+	return bounds, nil
+}
+
+// acquire returns partition keeping the key, it must be released once it's no longer used
+func (s *RangePartitionedStore) acquire(key []byte) (*rangePartition, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	i, found := slices.BinarySearchFunc(s.partitions[1:], key, func(p *rangePartition, key []byte) int {
+		return s.comparer.Compare(p.lower, key)
+	})
+	if found {
+		i++
+	}
+	p := s.partitions[i]
+	s.ref(p)
+	return p, nil
+}
+
+func (s *RangePartitionedStore) ref(p *rangePartition) {
+	s.refsMu.Lock()
+	p.refs++
+	s.refsMu.Unlock()
+}
+
+// release gives back the partition, partition which has been replaced is removed once no one uses it
+func (s *RangePartitionedStore) release(p *rangePartition) error {
+	s.refsMu.Lock()
+	p.refs--
+	remove := p.refs == 0 && p.retired.Load()
+	if remove {
+		delete(s.retired, p)
+	}
+	s.refsMu.Unlock()
+
+	if remove {
+		return s.removePartition(p)
+	}
+	return nil
+}
+
+// retire marks replaced partition, it's removed once no one uses it
+func (s *RangePartitionedStore) retire(p *rangePartition) error {
+	s.refsMu.Lock()
+	p.retired.Store(true)
+	remove := p.refs == 0
+	if !remove {
+		s.retired[p] = struct{}{}
+	}
+	s.refsMu.Unlock()
+
+	if remove {
+		return s.removePartition(p)
+	}
+	return nil
+}
+
+func (s *RangePartitionedStore) removePartition(p *rangePartition) error {
+	return errors.Join(p.tree.Close(), s.fs.RemoveAll(s.partitionDir(p.id)))
+}
+
+func (s *RangePartitionedStore) Get(key []byte) ([]byte, error) {
+	p, err := s.acquire(key)
+	if err != nil {
+		return nil, err
+	}
+	value, err := p.tree.Get(key)
+	return value, errors.Join(err, s.release(p))
+}
+
+func (s *RangePartitionedStore) Put(key []byte, value []byte) error {
+	return s.write(key, func(tree *Tree) error {
+		return tree.Put(key, value)
+	})
+}
+
+func (s *RangePartitionedStore) Delete(key []byte) error {
+	return s.write(key, func(tree *Tree) error {
+		return tree.Delete(key)
+	})
+}
+
+// write applies change to the partition keeping the key. Change waits while the partition is split or merged
+// and it goes to the partition which replaced it.
+func (s *RangePartitionedStore) write(key []byte, change func(tree *Tree) error) error {
+	for {
+		p, err := s.acquire(key)
+		if err != nil {
+			return err
+		}
+		p.writeMu.RLock()
+		if p.retired.Load() {
+			p.writeMu.RUnlock()
+			if err := s.release(p); err != nil {
+				return err
+			}
+			continue
+		}
+		err = change(p.tree)
+		p.touch(key)
+		p.writeMu.RUnlock()
+		if err := errors.Join(err, s.release(p)); err != nil {
+			return err
+		}
+
+		if s.writes.Add(1)%rebalanceInterval == 0 {
+			s.scheduleRebalance()
+		}
+		return nil
+	}
+}
+
+// NewIterator returns iterator going through keys from lower (included) till upper (excluded) bound in order,
+// nil bound means there is no limit. Iterator keeps using trees of partitions which are split or merged meanwhile.
+func (s *RangePartitionedStore) NewIterator(lower, upper []byte) (*Iterator, error) {
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return nil, ErrClosed
+	}
+	var partitions []*rangePartition
+	for i, p := range s.partitions {
+		if upper != nil && p.lower != nil && s.comparer.Compare(p.lower, upper) >= 0 {
+			break
+		}
+		if lower != nil && i+1 < len(s.partitions) && s.comparer.Compare(s.partitions[i+1].lower, lower) <= 0 {
+			continue
+		}
+		s.ref(p)
+		partitions = append(partitions, p)
+	}
+	s.mu.RUnlock()
+
+	var (
+		iterators []iterator
+		opened    []*Iterator
+	)
+	release := func() error {
+		var errs []error
+		for _, it := range opened {
+			errs = append(errs, it.Close())
+		}
+		for _, p := range partitions {
+			errs = append(errs, s.release(p))
+		}
+		return errors.Join(errs...)
+	}
+	for _, p := range partitions {
+		it, err := p.tree.newIterator(defaultColumnFamilyID, s.comparer, nil, lower)
+		if err != nil {
+			_ = release() // TODO log error
+			return nil, err
+		}
+		iterators = append(iterators, it.merged)
+		opened = append(opened, it)
+	}
+
+	// partitions keep disjoint ranges, so their iterators are merged as they are
+	merged := &boundedIterator{
+		it:       newMergingIterator(s.comparer, iterators...),
+		upper:    upper,
+		comparer: s.comparer,
+	}
+	return &Iterator{merged: merged, release: release}, nil
+}
+
+// boundedIterator stops at its upper bound, merged iterators start at the lower bound already
+type boundedIterator struct {
+	it       iterator
+	upper    []byte
+	comparer kv.Comparer
+	done     bool
+}
+
+func (it *boundedIterator) Next() bool {
+	if !it.done && it.it.Next() {
+		if it.upper == nil || it.comparer.Compare(it.it.Key(), it.upper) < 0 {
+			return true
+		}
+	}
+	it.done = true
+	return false
+}
+
+func (it *boundedIterator) Key() []byte {
+	return it.it.Key()
+}
+
+func (it *boundedIterator) Value() []byte {
+	return it.it.Value()
+}
+
+func (it *boundedIterator) Err() error {
+	return it.it.Err()
+}
+
+// Partitions returns lower bounds of partitions in order, the first partition has no lower bound
+func (s *RangePartitionedStore) Partitions() [][]byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	bounds := make([][]byte, 0, len(s.partitions))
+	for _, p := range s.partitions {
+		bounds = append(bounds, p.lower)
+	}
+	return bounds
+}
+
+// scheduleRebalance runs rebalance in the background unless one is waiting to be run already
+func (s *RangePartitionedStore) scheduleRebalance() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed || !s.rebalanceScheduled.CompareAndSwap(false, true) {
+		return
+	}
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		if err := s.Rebalance(); err != nil && !errors.Is(err, ErrClosed) {
+			s.rebalanceMu.Lock()
+			s.backgroundErr = err
+			s.rebalanceMu.Unlock()
+		}
+	}()
+}
+
+// Rebalance splits partitions bigger than the split size and merges neighbours smaller than the merge size,
+// till all partitions are within their limits
+func (s *RangePartitionedStore) Rebalance() error {
+	s.rebalanceMu.Lock()
+	defer s.rebalanceMu.Unlock()
+	s.rebalanceScheduled.Store(false)
+
+	for {
+		changed, err := s.rebalanceOnce()
+		if err != nil || !changed {
+			return err
+		}
+	}
+}
+
+// rebalanceOnce splits or merges a single partition, false is returned when there is nothing to do.
+// Rebalance mutex must be held.
+func (s *RangePartitionedStore) rebalanceOnce() (bool, error) {
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return false, ErrClosed
+	}
+	partitions := slices.Clone(s.partitions)
+	s.mu.RUnlock()
+
+	sizes := make([]int64, len(partitions))
+	for i, p := range partitions {
+		size, err := p.tree.approximateSize()
+		if err != nil {
+			return false, err
+		}
+		sizes[i] = size
+	}
+
+	for i, p := range partitions {
+		if sizes[i] <= s.limits.SplitSize || (p.unsplitSize > 0 && sizes[i] < p.unsplitSize+s.limits.SplitSize) {
+			continue
+		}
+		split, err := s.split(p)
+		if err != nil || split {
+			return split, err
+		}
+		p.unsplitSize = sizes[i]
+	}
+	for i := 0; i+1 < len(partitions); i++ {
+		if sizes[i] < s.limits.MergeSize && sizes[i+1] < s.limits.MergeSize {
+			return true, s.merge(partitions[i], partitions[i+1])
+		}
+	}
+	return false, nil
+}
+
+// split replaces the partition with two partitions divided by its median key. False is returned when the partition
+// can't be split, e.g. it keeps a single key.
+func (s *RangePartitionedStore) split(p *rangePartition) (bool, error) {
+	// median key is found in indexes of tables
+	if err := p.tree.Flush(context.Background()); err != nil {
+		return false, err
+	}
+	median, err := p.tree.medianKey()
+	if err != nil || median == nil {
+		return false, err
+	}
+	// keys smaller than the median go to the left partition, the other ones to the right partition
+	smallest, largest, err := p.tree.keyRange()
+	if err != nil || smallest == nil {
+		return false, err
+	}
+	if s.comparer.Compare(smallest, median) >= 0 || s.comparer.Compare(median, largest) > 0 {
+		return false, nil
+	}
+
+	left, err := s.newPartition(p.lower)
+	if err != nil {
+		return false, err
+	}
+	right, err := s.newPartition(median)
+	if err != nil {
+		return false, errors.Join(err, s.removePartition(left))
+	}
+	abort := func(err error) (bool, error) {
+		return false, errors.Join(err, s.removePartition(left), s.removePartition(right))
+	}
+	target := func(key []byte) *rangePartition {
+		if s.comparer.Compare(key, median) < 0 {
+			return left
+		}
+		return right
+	}
+
+	from := []*rangePartition{p}
+	copied, err := s.copyPartitions(from, target)
+	if err != nil {
+		return abort(err)
+	}
+	// tables may keep deleted keys only
+	if copied[left] == 0 || copied[right] == 0 {
+		p.untrack()
+		return abort(nil)
+	}
+	unlock := lockWrites(from)
+	defer unlock()
+	if err := s.catchUp(from, target); err != nil {
+		return abort(err)
+	}
+	return true, s.replace(from, left, right)
+}
+
+// merge replaces neighbour partitions with a single partition
+func (s *RangePartitionedStore) merge(a, b *rangePartition) error {
+	merged, err := s.newPartition(a.lower)
+	if err != nil {
+		return err
+	}
+	target := func([]byte) *rangePartition {
+		return merged
+	}
+
+	from := []*rangePartition{a, b}
+	if _, err := s.copyPartitions(from, target); err != nil {
+		return errors.Join(err, s.removePartition(merged))
+	}
+	unlock := lockWrites(from)
+	defer unlock()
+	if err := s.catchUp(from, target); err != nil {
+		return errors.Join(err, s.removePartition(merged))
+	}
+	return s.replace(from, merged)
+}
+
+// lockWrites makes writes of partitions wait till returned function is called
+func lockWrites(partitions []*rangePartition) func() {
+	for _, p := range partitions {
+		p.writeMu.Lock()
+	}
+	return func() {
+		for _, p := range partitions {
+			p.writeMu.Unlock()
+		}
+	}
+}
+
+func (s *RangePartitionedStore) newPartition(lower []byte) (*rangePartition, error) {
+	s.mu.Lock()
+	id := s.newPartitionID()
+	s.mu.Unlock()
+
+	tree, err := Open(s.partitionDir(id), s.opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &rangePartition{id: id, lower: lower, tree: tree}, nil
+}
+
+// copyPartitions copies keys of partitions into tables ingested by partitions chosen by target, so copied keys
+// are not written into WAL & memory again. Keys of each target must be chosen in order.
+// Partitions are written meanwhile, keys written since the copy started are copied again by catchUp.
+// Number of keys copied into each target is returned.
+func (s *RangePartitionedStore) copyPartitions(from []*rangePartition, target func(key []byte) *rangePartition) (map[*rangePartition]int, error) {
+	copied := make(map[*rangePartition]int)
+	builders := make(map[*rangePartition]*sstable.Builder)
+	tables := make(map[*rangePartition][]string) // built tables are left in directories of targets till ingested
+	abort := func(err error) (map[*rangePartition]int, error) {
+		for _, b := range builders {
+			_ = b.Abort() // TODO log error
+		}
+		for _, p := range from {
+			p.untrack()
+		}
+		return nil, err
+	}
+	// keys are tracked before iterators are created, so each change missed by them is copied again
+	for _, p := range from {
+		p.track()
+	}
+	closeTable := func(to *rangePartition) error {
+		b := builders[to]
+		delete(builders, to)
+		return b.Close()
+	}
+
+	for _, p := range from {
+		it, err := p.tree.NewIterator()
+		if err != nil {
+			return abort(err)
+		}
+		for it.Next() {
+			to := target(it.Key())
+			b := builders[to]
+			if b == nil {
+				path := filepath.Join(s.partitionDir(to.id), fmt.Sprintf("%s%d", copyTablePrefix, len(tables[to])))
+				if b, err = sstable.NewBuilder(s.fs, path, to.tree.cfg.writerOptions()...); err != nil {
+					_ = it.Close() // TODO log error
+					return abort(err)
+				}
+				builders[to] = b
+				tables[to] = append(tables[to], path)
+			}
+			// values are resolved by the iterator, expiry is kept
+			if err := b.SetExpiring(it.Key(), it.Value(), it.expiresAt); err != nil {
+				_ = it.Close() // TODO log error
+				return abort(err)
+			}
+			copied[to]++
+			if b.EstimatedSize() >= to.tree.defaultFamily().cfg.compactionOptions().targetFileSize {
+				if err := closeTable(to); err != nil {
+					_ = it.Close() // TODO log error
+					return abort(err)
+				}
+			}
+		}
+		if err := errors.Join(it.Err(), it.Close()); err != nil {
+			return abort(err)
+		}
+	}
+	for to := range builders {
+		if err := closeTable(to); err != nil {
+			return abort(err)
+		}
+	}
+	for to, paths := range tables {
+		if err := to.tree.Ingest(paths...); err != nil {
+			return abort(err)
+		}
+	}
+	return copied, nil
+}
+
+// catchUp copies the latest values of keys written to partitions since their copy started (see copyPartitions)
+// and stops tracking of their writes. Writes of partitions must wait.
+func (s *RangePartitionedStore) catchUp(from []*rangePartition, target func(key []byte) *rangePartition) error {
+	var errs []error
+	for _, p := range from {
+		for _, key := range p.untrack() {
+			p.tree.currentMu.RLock()
+			value, found, err := p.tree.latest(defaultColumnFamilyID, key)
+			p.tree.currentMu.RUnlock()
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			to := target(key).tree
+			v, err := kv.DecodeValue(value)
+			switch {
+			case !found || (err == nil && v.IsTombstone()):
+				err = to.Delete(key)
+			case err == nil:
+				err = to.putExpiring(key, v.Payload, v.ExpiresAt)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// track starts recording keys written to the partition
+func (p *rangePartition) track() {
+	p.touchedMu.Lock()
+	p.touched = make(map[string]struct{})
+	p.touchedMu.Unlock()
+}
+
+// touch records key written to the partition while it's tracked
+func (p *rangePartition) touch(key []byte) {
+	p.touchedMu.Lock()
+	if p.touched != nil {
+		p.touched[string(key)] = struct{}{}
+	}
+	p.touchedMu.Unlock()
+}
+
+// untrack stops recording keys written to the partition and returns keys recorded so far
+func (p *rangePartition) untrack() [][]byte {
+	p.touchedMu.Lock()
+	defer p.touchedMu.Unlock()
+	keys := make([][]byte, 0, len(p.touched))
+	for key := range p.touched {
+		keys = append(keys, []byte(key))
+	}
+	p.touched = nil
+	return keys
+}
+
+// replace makes new partitions durable in partition map and replaces old ones with them.
+// Old partitions are removed once no one uses them.
+func (s *RangePartitionedStore) replace(old []*rangePartition, added ...*rangePartition) error {
+	s.mu.RLock()
+	i := slices.Index(s.partitions, old[0])
+	partitions := slices.Concat(s.partitions[:i], added, s.partitions[i+len(old):])
+	s.mu.RUnlock()
+
+	bounds := make([]partitionBound, 0, len(partitions))
+	for _, p := range partitions {
+		bounds = append(bounds, partitionBound{id: p.id, lower: p.lower})
+	}
+	if err := s.writePartitionMap(bounds); err != nil {
+		errs := []error{err}
+		for _, p := range added {
+			errs = append(errs, s.removePartition(p))
+		}
+		return errors.Join(errs...)
+	}
+
+	s.mu.Lock()
+	s.partitions = partitions
+	s.mu.Unlock()
+
+	var errs []error
+	for _, p := range old {
+		errs = append(errs, s.retire(p))
+	}
+	return errors.Join(errs...)
+}
+
+// Flush moves memory of all partitions into tables, see Tree.Flush. Partitions which have been replaced
+// but are still used (i.e. by iterators) are flushed as well.
+func (s *RangePartitionedStore) Flush(ctx context.Context) error {
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return ErrClosed
+	}
+	// partitions are referenced, so they are not removed while they are flushed
+	s.refsMu.Lock()
+	partitions := slices.Clone(s.partitions)
+	for p := range s.retired {
+		partitions = append(partitions, p)
+	}
+	for _, p := range partitions {
+		p.refs++
+	}
+	s.refsMu.Unlock()
+	s.mu.RUnlock()
+
+	var errs []error
+	for _, p := range partitions {
+		if err := p.tree.Flush(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("partition %d: %w", p.id, err))
+		}
+	}
+	for _, p := range partitions {
+		errs = append(errs, s.release(p))
+	}
+	return errors.Join(errs...)
+}
+
+// Close waits till rebalance running in the background is done and closes trees of all partitions.
+// Partitions used by open iterators are closed once the iterators are closed.
+func (s *RangePartitionedStore) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	s.closed = true
+	s.mu.Unlock()
+	s.background.Wait()
+
+	s.rebalanceMu.Lock()
+	defer s.rebalanceMu.Unlock()
+	errs := []error{s.backgroundErr}
+	for _, p := range s.partitions {
+		if err := p.tree.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("partition %d: %w", p.id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// approximateSize returns size of data of the default column family kept in tables and in memory
+func (t *Tree) approximateSize() (int64, error) {
+	view, err := t.storageProvider.FilesStorage(defaultColumnFamilyID)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, level := range view.levels {
+		for _, f := range level {
+			size += int64(f.table.props.DataSize)
+		}
+	}
+
+	t.currentMu.RLock()
+	if !t.closed {
+		size += int64(t.current.Size())
+	}
+	t.currentMu.RUnlock()
+	t.flushingMu.RLock()
+	for _, job := range t.flushing {
+		size += int64(job.memory.Size())
+	}
+	t.flushingMu.RUnlock()
+	return size, view.Release()
+}
+
+// keyRange returns the smallest and the largest key kept in tables of the default column family,
+// nil keys are returned when there are no tables
+func (t *Tree) keyRange() ([]byte, []byte, error) {
+	view, err := t.storageProvider.FilesStorage(defaultColumnFamilyID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var smallest, largest []byte
+	comparer := t.cfg.comparer()
+	for _, level := range view.levels {
+		for _, f := range level {
+			props := f.table.props
+			if props.Entries == 0 {
+				continue
+			}
+			if smallest == nil || comparer.Compare(props.SmallestKey, smallest) < 0 {
+				smallest = props.SmallestKey
+			}
+			if largest == nil || comparer.Compare(props.LargestKey, largest) > 0 {
+				largest = props.LargestKey
+			}
+		}
+	}
+	return smallest, largest, view.Release()
+}
+
+// medianKey returns key which splits tables of the default column family into two parts of similar size.
+// It's found among index keys of tables, data in memory are not considered. Nil is returned when there are no tables.
+func (t *Tree) medianKey() ([]byte, error) {
+	view, err := t.storageProvider.FilesStorage(defaultColumnFamilyID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = view.Release() // TODO log error
+	}()
+
+	var keys [][]byte
+	for _, level := range view.levels {
+		for _, f := range level {
+			indexKeys, err := f.indexKeys()
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, indexKeys...)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	slices.SortFunc(keys, t.cfg.comparer().Compare)
+	return keys[len(keys)/2], nil
+}
@@ -0,0 +1,287 @@
+package lsm
+
+import (
+	"challenge-lsm-store/vfs"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+var testPartitionLimits = PartitionLimits{SplitSize: 16 * 1024, MergeSize: 4 * 1024}
+
+func docKey(i int) []byte {
+	return []byte(fmt.Sprintf("doc%05d", i))
+}
+
+func docValue(i int) []byte {
+	return []byte(fmt.Sprintf("a document of a reasonable size %05d", i))
+}
+
+// writeDocs writes documents from start till end (excluded)
+func writeDocs(t *testing.T, s *RangePartitionedStore, start, end int) {
+	for i := start; i < end; i++ {
+		require.Nil(t, s.Put(docKey(i), docValue(i)), "put error")
+	}
+}
+
+func assertDocs(t *testing.T, s *RangePartitionedStore, docs int) {
+	for i := 0; i < docs; i++ {
+		v, err := s.Get(docKey(i))
+		require.Nil(t, err, "get error")
+		require.Equal(t, docValue(i), v, "unexpected value of document %d", i)
+	}
+}
+
+func Test_LSM_RangePartition_Split(t *testing.T) {
+	//GIVEN a store whose single partition exceeds the split size
+	fs := vfs.NewMemFS()
+	s, err := OpenRangePartitioned(testDir, testPartitionLimits, WithFS(fs), WithMemtableSize(4*1024))
+	require.Nil(t, err, "open error")
+	const docs = 1000
+	writeDocs(t, s, 0, docs)
+	require.Nil(t, s.Flush(context.Background()), "flush error")
+	require.Len(t, s.Partitions(), 1, "single partition expected")
+
+	//WHEN partitions are rebalanced
+	require.Nil(t, s.Rebalance(), "rebalance error")
+
+	//THEN the partition is split into ordered partitions within the limit
+	bounds := s.Partitions()
+	require.Greater(t, len(bounds), 2, "partition must be split")
+	assert.Nil(t, bounds[0], "the first partition must keep the smallest keys")
+	for i, p := range s.partitions {
+		size, err := p.tree.approximateSize()
+		require.Nil(t, err, "size error")
+		assert.LessOrEqual(t, size, testPartitionLimits.SplitSize, "partition %d exceeds split size", i)
+		if i > 1 {
+			assert.Less(t, string(bounds[i-1]), string(bounds[i]), "partitions must be ordered")
+		}
+	}
+
+	//AND all documents are found
+	assertDocs(t, s, docs)
+	//AND copied documents are ingested into the last level instead of being written again
+	for i, p := range s.partitions {
+		for _, level := range tableLevels(t, p.tree) {
+			assert.Equal(t, numLevels-1, level, "unexpected level of table of partition %d", i)
+		}
+	}
+
+	//AND documents of a range are iterated over many partitions
+	it, err := s.NewIterator(docKey(100), docKey(900))
+	require.Nil(t, err, "iterator error")
+	var expPairs []string
+	for i := 100; i < 900; i++ {
+		expPairs = append(expPairs, fmt.Sprintf("%s=%s", docKey(i), docValue(i)))
+	}
+	assert.Equal(t, expPairs, iterate(t, it), "unexpected pairs")
+
+	//AND partitions are kept once the store is opened again
+	require.Nil(t, s.Close(), "close error")
+	s, err = OpenRangePartitioned(testDir, testPartitionLimits, WithFS(fs), WithMemtableSize(4*1024))
+	require.Nil(t, err, "reopen error")
+	assert.Equal(t, bounds, s.Partitions(), "partitions must be recovered")
+	assertDocs(t, s, docs)
+
+	//AND directories of replaced partitions are removed
+	assert.Len(t, listDir(t, fs, testDir), len(bounds)+1, "only partitions and partition map expected")
+	require.Nil(t, s.Close(), "close error")
+}
+
+func Test_LSM_RangePartition_ScanDuringSplit(t *testing.T) {
+	//GIVEN a store which needs to be split
+	s, err := OpenRangePartitioned(testDir, testPartitionLimits, WithFS(vfs.NewMemFS()), WithMemtableSize(4*1024))
+	require.Nil(t, err, "open error")
+	const docs = 1000
+	writeDocs(t, s, 0, docs)
+
+	//AND a scan started before the split
+	scan, err := s.NewIterator(nil, nil)
+	require.Nil(t, err, "iterator error")
+
+	//WHEN partitions are split while documents are read & written
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		assert.Nil(t, s.Rebalance(), "rebalance error")
+	}()
+	go func() {
+		defer wg.Done()
+		for i := docs; i < 2*docs; i++ {
+			if !assert.Nil(t, s.Put(docKey(i), docValue(i)), "put error") {
+				return
+			}
+			v, err := s.Get(docKey(i - docs))
+			if !assert.Nil(t, err, "get error") || !assert.Equal(t, docValue(i-docs), v, "unexpected value") {
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	//THEN the scan sees documents written before it started
+	pairs := iterate(t, scan)
+	require.Len(t, pairs, docs, "unexpected number of scanned documents")
+	assert.Equal(t, fmt.Sprintf("%s=%s", docKey(docs-1), docValue(docs-1)), pairs[docs-1], "unexpected last document")
+
+	//AND no write is lost
+	assert.Greater(t, len(s.Partitions()), 1, "partition must be split")
+	assertDocs(t, s, 2*docs)
+	it, err := s.NewIterator(nil, nil)
+	require.Nil(t, err, "iterator error")
+	assert.Len(t, iterate(t, it), 2*docs, "unexpected number of documents")
+	require.Nil(t, s.Close(), "close error")
+}
+
+func Test_LSM_RangePartition_UpdateDuringSplit(t *testing.T) {
+	//GIVEN a store which needs to be split
+	s, err := OpenRangePartitioned(testDir, testPartitionLimits, WithFS(vfs.NewMemFS()), WithMemtableSize(4*1024))
+	require.Nil(t, err, "open error")
+	const docs = 1000
+	writeDocs(t, s, 0, docs)
+
+	//WHEN documents being copied are updated & deleted while partitions are split
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		assert.Nil(t, s.Rebalance(), "rebalance error")
+	}()
+	for _, start := range []int{0, docs / 2} {
+		go func(start int) {
+			defer wg.Done()
+			for i := start; i < start+docs/2; i++ {
+				var err error
+				if i%2 == 0 {
+					err = s.Put(docKey(i), []byte("updated"))
+				} else {
+					err = s.Delete(docKey(i))
+				}
+				if !assert.Nil(t, err, "write error") {
+					return
+				}
+			}
+		}(start)
+	}
+	wg.Wait()
+
+	//THEN changes written meanwhile are kept
+	assert.Greater(t, len(s.Partitions()), 1, "partition must be split")
+	for i := 0; i < docs; i++ {
+		v, err := s.Get(docKey(i))
+		require.Nil(t, err, "get error")
+		if i%2 == 0 {
+			require.Equal(t, []byte("updated"), v, "document %d must be updated", i)
+		} else {
+			require.Nil(t, v, "document %d must be deleted", i)
+		}
+	}
+	require.Nil(t, s.Close(), "close error")
+}
+
+func Test_LSM_RangePartition_FlushPartitionsUsedByIterators(t *testing.T) {
+	//GIVEN a store with a scan started before the split
+	s, err := OpenRangePartitioned(testDir, testPartitionLimits, WithFS(vfs.NewMemFS()), WithMemtableSize(4*1024))
+	require.Nil(t, err, "open error")
+	const docs = 1000
+	writeDocs(t, s, 0, docs)
+	scan, err := s.NewIterator(nil, nil)
+	require.Nil(t, err, "iterator error")
+	require.Nil(t, s.Rebalance(), "rebalance error")
+	require.Len(t, s.retired, 1, "replaced partition must be kept by the scan")
+
+	//WHEN partitions are flushed
+	require.Nil(t, s.Flush(context.Background()), "flush error")
+
+	//THEN the replaced partition is flushed as well
+	for p := range s.retired {
+		assert.Zero(t, p.tree.current.Size(), "memory of replaced partition must be flushed")
+	}
+	//AND it's removed once the scan is closed
+	assert.Len(t, iterate(t, scan), docs, "unexpected number of scanned documents")
+	assert.Empty(t, s.retired, "replaced partition must be removed")
+	require.Nil(t, s.Close(), "close error")
+}
+
+func Test_LSM_RangePartition_SplitInBackground(t *testing.T) {
+	//GIVEN a store
+	s, err := OpenRangePartitioned(testDir, testPartitionLimits, WithFS(vfs.NewMemFS()), WithMemtableSize(4*1024))
+	require.Nil(t, err, "open error")
+
+	//WHEN many documents are written
+	const docs = 3 * rebalanceInterval
+	writeDocs(t, s, 0, docs)
+	s.background.Wait()
+
+	//THEN partition is split in the background
+	assert.Greater(t, len(s.Partitions()), 1, "partition must be split")
+	assertDocs(t, s, docs)
+	require.Nil(t, s.Close(), "close error")
+}
+
+func Test_LSM_RangePartition_Merge(t *testing.T) {
+	//GIVEN a store split into many partitions
+	fs := vfs.NewMemFS()
+	s, err := OpenRangePartitioned(testDir, testPartitionLimits, WithFS(fs), WithMemtableSize(4*1024))
+	require.Nil(t, err, "open error")
+	const docs = 1000
+	writeDocs(t, s, 0, docs)
+	require.Nil(t, s.Rebalance(), "rebalance error")
+	require.Greater(t, len(s.Partitions()), 2, "partition must be split")
+	require.Nil(t, s.Close(), "close error")
+
+	//AND a directory left by interrupted split
+	require.Nil(t, fs.MkdirAll(filepath.Join(testDir, "range-999")), "mkdir error")
+
+	//WHEN the store is opened with limits making partitions small
+	s, err = OpenRangePartitioned(testDir, PartitionLimits{SplitSize: 1 << 30, MergeSize: 1 << 20}, WithFS(fs), WithMemtableSize(4*1024))
+	require.Nil(t, err, "reopen error")
+	require.Nil(t, s.Rebalance(), "rebalance error")
+
+	//THEN neighbours are merged
+	assert.Equal(t, [][]byte{nil}, s.Partitions(), "partitions must be merged")
+	assertDocs(t, s, docs)
+
+	//AND left directory is removed
+	assert.Len(t, listDir(t, fs, testDir), 2, "only partition and partition map expected")
+	require.Nil(t, s.Close(), "close error")
+}
+
+func Test_LSM_RangePartition_KeepPartitionWhichCantBeSplit(t *testing.T) {
+	//GIVEN a store whose single key exceeds the split size
+	fs := vfs.NewMemFS()
+	s, err := OpenRangePartitioned(testDir, testPartitionLimits, WithFS(fs), WithMemtableSize(4*1024))
+	require.Nil(t, err, "open error")
+	require.Nil(t, s.Put(docKey(0), make([]byte, 2*testPartitionLimits.SplitSize)), "put error")
+
+	//WHEN partitions are rebalanced
+	require.Nil(t, s.Rebalance(), "rebalance error")
+
+	//THEN the partition is kept
+	assert.Equal(t, [][]byte{nil}, s.Partitions(), "partition can't be split")
+	//AND no partition is created for the split
+	assert.Len(t, listDir(t, fs, testDir), 2, "only partition and partition map expected")
+	//AND the partition is not split again till it grows
+	assert.True(t, s.partitions[0].unsplitSize > testPartitionLimits.SplitSize, "partition must be remembered")
+	require.Nil(t, s.Close(), "close error")
+}
+
+func Test_LSM_RangePartition_RejectInvalidLimits(t *testing.T) {
+	//WHEN merged partitions would exceed the split size
+	_, err := OpenRangePartitioned(testDir, PartitionLimits{SplitSize: 100, MergeSize: 50}, WithFS(vfs.NewMemFS()))
+
+	//THEN limits are rejected
+	assert.True(t, errors.Is(err, ErrInvalidOption), "invalid limits must be reported")
+
+	//WHEN a store is opened with a column family which isn't copied by split & merge
+	_, err = OpenRangePartitioned(testDir, testPartitionLimits, WithFS(vfs.NewMemFS()), WithColumnFamily("numbers"))
+
+	//THEN the family is rejected
+	assert.True(t, errors.Is(err, ErrInvalidOption), fmt.Sprintf("unexpected error: %v", err))
+}
@@ -0,0 +1,182 @@
+package lsm
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// writeSlowdownDelay is added to each write while writes are slowed down
+const writeSlowdownDelay = time.Millisecond
+
+// WriteStallCondition tells whether writes go at full speed, are slowed down or stopped
+type WriteStallCondition int
+
+const (
+	WriteStallNormal WriteStallCondition = iota
+	WriteStallSlowdown
+	WriteStallStop
+)
+
+// WriteStallCause names the limit which stalls writes
+type WriteStallCause string
+
+const (
+	WriteStallCauseNone                   WriteStallCause = ""
+	WriteStallCauseImmutableMemtables     WriteStallCause = "immutable memtables"
+	WriteStallCauseL0Tables               WriteStallCause = "L0 tables"
+	WriteStallCausePendingCompactionBytes WriteStallCause = "pending compaction bytes"
+)
+
+type (
+	// WriteStallEvent is reported whenever write stall condition changes
+	WriteStallEvent struct {
+		Condition WriteStallCondition
+		Cause     WriteStallCause
+	}
+
+	// WriteStallStats counts writes which have been delayed and how long they waited
+	WriteStallStats struct {
+		Slowdowns        int64
+		SlowdownDuration time.Duration
+		Stops            int64
+		StopDuration     time.Duration
+	}
+
+	stallOptions struct {
+		maxImmutableMemtables      int
+		l0SlowdownTrigger          int
+		l0StopTrigger              int
+		softPendingCompactionBytes int64
+		hardPendingCompactionBytes int64
+	}
+
+	// writeStall keeps state of the background work which writes depend on
+	writeStall struct {
+		mu        sync.Mutex
+		cond      *sync.Cond // signalled whenever background work makes progress
+		condition WriteStallCondition
+		cause     WriteStallCause
+
+		l0Tables               atomic.Int64
+		pendingCompactionBytes atomic.Int64
+
+		slowdowns        atomic.Int64
+		slowdownDuration atomic.Int64
+		stops            atomic.Int64
+		stopDuration     atomic.Int64
+	}
+)
+
+func newWriteStall() *writeStall {
+	s := &writeStall{}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// stallWrites delays the write while flushes or compactions fall behind. Writes are slowed down first,
+// they are stopped once a hard limit is hit till the background work catches up.
+func (t *Tree) stallWrites() {
+	condition, cause := t.writeStallCondition()
+	t.reportWriteStall(condition, cause)
+
+	switch condition {
+	case WriteStallSlowdown:
+		start := time.Now()
+		time.Sleep(writeSlowdownDelay)
+		t.stall.slowdowns.Add(1)
+		t.stall.slowdownDuration.Add(int64(time.Since(start)))
+
+	case WriteStallStop:
+		start := time.Now()
+		t.stall.mu.Lock()
+		// progress is broadcast under the lock, so the condition is checked again not to miss progress made
+		// before the lock was taken
+		condition, cause = t.writeStallCondition()
+		// closed or read-only tree doesn't make any progress, the write fails instead
+		for condition == WriteStallStop && !t.isClosing() && t.readOnly() == nil {
+			t.stall.cond.Wait()
+			condition, cause = t.writeStallCondition()
+		}
+		t.stall.mu.Unlock()
+		t.stall.stops.Add(1)
+		t.stall.stopDuration.Add(int64(time.Since(start)))
+		t.reportWriteStall(condition, cause)
+	}
+}
+
+func (t *Tree) writeStallCondition() (WriteStallCondition, WriteStallCause) {
+	opts := t.cfg.stallOptions()
+	t.flushingMu.RLock()
+	immutable := len(t.flushing)
+	t.flushingMu.RUnlock()
+	l0Tables, pending := t.stall.l0Tables.Load(), t.stall.pendingCompactionBytes.Load()
+	if t.cfg.CompactionStyle == CompactionNone {
+		// no compaction would ever catch up
+		l0Tables, pending = 0, 0
+	}
+
+	switch {
+	case immutable >= opts.maxImmutableMemtables:
+		return WriteStallStop, WriteStallCauseImmutableMemtables
+	case l0Tables >= int64(opts.l0StopTrigger):
+		return WriteStallStop, WriteStallCauseL0Tables
+	case pending >= opts.hardPendingCompactionBytes:
+		return WriteStallStop, WriteStallCausePendingCompactionBytes
+	case l0Tables >= int64(opts.l0SlowdownTrigger):
+		return WriteStallSlowdown, WriteStallCauseL0Tables
+	case pending >= opts.softPendingCompactionBytes:
+		return WriteStallSlowdown, WriteStallCausePendingCompactionBytes
+	}
+	return WriteStallNormal, WriteStallCauseNone
+}
+
+// reportWriteStall calls the callback when write stall condition changes
+func (t *Tree) reportWriteStall(condition WriteStallCondition, cause WriteStallCause) {
+	t.stall.mu.Lock()
+	changed := t.stall.condition != condition || t.stall.cause != cause
+	t.stall.condition, t.stall.cause = condition, cause
+	t.stall.mu.Unlock()
+
+	if changed && t.cfg.OnWriteStall != nil {
+		t.cfg.OnWriteStall(WriteStallEvent{Condition: condition, Cause: cause})
+	}
+}
+
+// backgroundProgressed refreshes state of levels and wakes up stopped writes
+func (t *Tree) backgroundProgressed() {
+	// the family which falls behind the most stalls writes of all families, as they share memory
+	var l0Tables, pending int64
+	for _, cf := range t.columnFamilies() {
+		if view, err := t.storageProvider.FilesStorage(cf.id); err == nil {
+			l0Tables = max(l0Tables, int64(len(view.levels[0])))
+			pending += pendingCompactionBytes(view.levels, cf.cfg.compactionOptions())
+			_ = view.Release() // TODO log error
+		}
+	}
+	t.stall.l0Tables.Store(l0Tables)
+	t.stall.pendingCompactionBytes.Store(pending)
+
+	t.stall.mu.Lock()
+	t.stall.cond.Broadcast()
+	t.stall.mu.Unlock()
+}
+
+func (t *Tree) isClosing() bool {
+	select {
+	case <-t.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// WriteStallStats returns counters of writes delayed since the tree has been opened
+func (t *Tree) WriteStallStats() WriteStallStats {
+	return WriteStallStats{
+		Slowdowns:        t.stall.slowdowns.Load(),
+		SlowdownDuration: time.Duration(t.stall.slowdownDuration.Load()),
+		Stops:            t.stall.stops.Load(),
+		StopDuration:     time.Duration(t.stall.stopDuration.Load()),
+	}
+}
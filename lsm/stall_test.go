@@ -0,0 +1,149 @@
+package lsm
+
+import (
+	"challenge-lsm-store/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingFS blocks creation of tables till it's released
+type blockingFS struct {
+	vfs.FS
+	released chan struct{}
+}
+
+func (f *blockingFS) MkdirAll(dir string) error {
+	if strings.HasPrefix(dir, testTablesDir+"/") {
+		<-f.released
+	}
+	return f.FS.MkdirAll(dir)
+}
+
+func Test_LSM_Stall_WriteStallCondition(t *testing.T) {
+	tree := Tree{
+		cfg: Config{
+			MaxImmutableMemtables:      2,
+			L0SlowdownTrigger:          2,
+			L0StopTrigger:              4,
+			SoftPendingCompactionBytes: 100,
+			HardPendingCompactionBytes: 200,
+		},
+		stall: newWriteStall(),
+	}
+	check := func(expCondition WriteStallCondition, expCause WriteStallCause, msg string) {
+		condition, cause := tree.writeStallCondition()
+		assert.Equal(t, expCondition, condition, msg)
+		assert.Equal(t, expCause, cause, msg)
+	}
+
+	//GIVEN background work within limits
+	check(WriteStallNormal, WriteStallCauseNone, "writes must not be stalled")
+
+	//WHEN soft limits are hit
+	tree.stall.pendingCompactionBytes.Store(100)
+	check(WriteStallSlowdown, WriteStallCausePendingCompactionBytes, "writes must be slowed down")
+	tree.stall.l0Tables.Store(2)
+	check(WriteStallSlowdown, WriteStallCauseL0Tables, "writes must be slowed down")
+
+	//WHEN hard limits are hit
+	tree.stall.pendingCompactionBytes.Store(200)
+	check(WriteStallStop, WriteStallCausePendingCompactionBytes, "writes must be stopped")
+	tree.stall.l0Tables.Store(4)
+	check(WriteStallStop, WriteStallCauseL0Tables, "writes must be stopped")
+	tree.flushing = append(tree.flushing, &flushJob{}, &flushJob{})
+	check(WriteStallStop, WriteStallCauseImmutableMemtables, "writes must be stopped")
+}
+
+func Test_LSM_Stall_StopWritesTillFlushIsDone(t *testing.T) {
+	//GIVEN a tree which flush is blocked
+	fs := &blockingFS{FS: vfs.NewMemFS(), released: make(chan struct{})}
+	var mu sync.Mutex
+	var events []WriteStallEvent
+	cfg := Config{
+		MemoryThreshold:       1,
+		FS:                    fs,
+		Dir:                   testDir,
+		MaxImmutableMemtables: 1,
+		OnWriteStall: func(e WriteStallEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, e)
+		},
+	}
+	storage, err := NewOSStorageProvider(cfg)
+	require.Nil(t, err, "couldn't create storage provider")
+	tree, err := New(storage, cfg)
+	require.Nil(t, err, "couldn't create a new tree")
+	require.Nil(t, tree.Put([]byte("key1"), []byte("value1")), "put error")
+
+	//WHEN too many memtables wait for flush
+	done := make(chan error)
+	go func() {
+		done <- tree.Put([]byte("key2"), []byte("value2"))
+	}()
+
+	//THEN writes are stopped
+	select {
+	case <-done:
+		require.Fail(t, "write must be stopped")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	//WHEN flush is done
+	close(fs.released)
+
+	//THEN writes are resumed
+	require.Nil(t, <-done, "put error")
+	stats := tree.WriteStallStats()
+	assert.Equal(t, int64(1), stats.Stops, "unexpected stopped writes")
+	assert.True(t, stats.StopDuration > 0, "stop duration must be counted")
+
+	//AND stall is reported
+	require.Nil(t, tree.Close(), "close error")
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []WriteStallEvent{
+		{Condition: WriteStallStop, Cause: WriteStallCauseImmutableMemtables},
+		{Condition: WriteStallNormal, Cause: WriteStallCauseNone},
+	}, events, "unexpected write stall events")
+}
+
+func Test_LSM_Stall_ProgressBeforeWaitIsNotMissed(t *testing.T) {
+	//GIVEN a tree whose writes are stopped
+	tree := Tree{
+		cfg:     Config{L0StopTrigger: 4},
+		stall:   newWriteStall(),
+		closing: make(chan struct{}),
+	}
+	tree.stall.l0Tables.Store(4)
+
+	//WHEN a write is stalled
+	tree.stall.mu.Lock()
+	stalled := make(chan struct{})
+	go func() {
+		defer close(stalled)
+		tree.stallWrites()
+	}()
+	// the write finds out it's stopped and waits for the lock
+	time.Sleep(50 * time.Millisecond)
+
+	//AND background work catches up before the write waits for progress
+	tree.stall.l0Tables.Store(0)
+	tree.stall.cond.Broadcast()
+	tree.stall.mu.Unlock()
+
+	//THEN the write is resumed
+	select {
+	case <-stalled:
+	case <-time.After(time.Second):
+		assert.Fail(t, "write must be resumed")
+		close(tree.closing)
+		tree.stall.mu.Lock()
+		tree.stall.cond.Broadcast()
+		tree.stall.mu.Unlock()
+	}
+}
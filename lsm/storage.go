@@ -2,11 +2,19 @@ package lsm
 
 import (
 	"bytes"
+	"challenge-lsm-store/cache"
+	"challenge-lsm-store/kv"
 	"challenge-lsm-store/memtable"
 	"challenge-lsm-store/sstable"
+	"challenge-lsm-store/storageio"
+	"challenge-lsm-store/vfs"
 	"challenge-lsm-store/wal"
+	"cmp"
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"path/filepath"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -15,76 +23,631 @@ import (
 const (
 	walDir    = "wal"
 	tablesDir = "tables"
-
-	dirPerm = 0755
+	lockFile  = "LOCK"
 )
 
+var ErrDirLocked = errors.New("store directory is used by another process")
+
+// OSStorageProvider keeps WAL & tables in files of the file system set in config (OS file system by default)
 type OSStorageProvider struct {
 	cfg     Config
+	fs      vfs.FS
 	buff    *bytes.Buffer
-	counter atomic.Uint32
+	counter atomic.Uint64 // the last number given to a file
+	cache   *cache.Cache
+	lock    io.Closer // exclusive lock of the store directory
+
+	families     map[uint32]*familyTables // dropped families are kept till the provider is closed
+	lastFamilyID uint32                   // the last id given to a column family
+	mu           sync.Mutex
+	publishMu    sync.Mutex // versions are made durable in the same order they are published
+	tableCache   *tableCache
+
+	recoveredWALs []walFile // WAL files left by the previous run
+}
+
+// walFile points at a WAL file
+type walFile struct {
+	num  uint64
+	path string
+}
 
-	// TODO tables dir kept created directories for tables.
-	// in the future it may be cache or should be removed since it's workaround for now */
-	tablesDir []string
-	mu        sync.RWMutex //needed for now for tables dir
+// tableFile points at a directory with table files
+type tableFile struct {
+	num    uint64
+	dir    string
+	level  int
+	family uint32 // column family keeping the table
+	props  sstable.Properties
 }
 
+// familyTables keeps versions of tables of a column family
+type familyTables struct {
+	id       uint32
+	name     string
+	cfg      Config
+	versions []*version // oldest first, the last one is the current version
+	dropped  bool
+}
+
+// NewOSStorageProvider opens the store directory, which is locked till the provider is closed.
+// ErrDirLocked is returned when the directory is used by another provider.
 func NewOSStorageProvider(cfg Config) (*OSStorageProvider, error) {
+	fs := cfg.FS
+	if fs == nil {
+		fs = vfs.Default
+	}
+	lock, err := fs.Lock(filepath.Join(cfg.Dir, lockFile))
+	if errors.Is(err, vfs.ErrLocked) {
+		return nil, fmt.Errorf("%w: %s", ErrDirLocked, cfg.Dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := &OSStorageProvider{
+		cfg:      cfg,
+		fs:       fs,
+		buff:     bytes.NewBuffer(nil),
+		lock:     lock,
+		families: map[uint32]*familyTables{defaultColumnFamilyID: newFamilyTables(defaultColumnFamilyID, DefaultColumnFamily, cfg)},
+	}
+	if cfg.BlockCacheSize > 0 {
+		s.cache = cache.New(cfg.BlockCacheSize)
+	}
+	s.tableCache = newTableCache(cfg.MaxOpenTables, s.openTable)
+
+	if err := s.open(); err != nil {
+		_ = lock.Close() // TODO log error
+		return nil, err
+	}
+	return s, nil
+}
+
+// open prepares the store directory and recovers files left by the previous run
+func (s *OSStorageProvider) open() error {
 	for _, subDir := range []string{walDir, tablesDir} {
-		if err := os.MkdirAll(fmt.Sprintf("%s/%s", cfg.Dir, subDir), dirPerm); err != nil {
+		if err := s.fs.MkdirAll(fmt.Sprintf("%s/%s", s.cfg.Dir, subDir)); err != nil {
+			return err
+		}
+	}
+	if err := s.recoverTables(); err != nil {
+		return err
+	}
+	return s.findWALs()
+}
+
+// recoverTables loads tables of the last durable version. All other table directories are removed,
+// i.e. incomplete tables, tables which haven't been published and obsolete ones.
+func (s *OSStorageProvider) recoverTables() error {
+	m, err := readManifest(s.fs, s.cfg.Dir)
+	if err != nil {
+		return err
+	}
+	s.keepCounterAbove(m.lastFileNum)
+	s.lastFamilyID = m.lastFamilyID
+	for _, f := range m.families {
+		s.families[f.id] = newFamilyTables(f.id, f.name, s.cfg.columnFamily(f.name))
+	}
+
+	dir := fmt.Sprintf("%s/%s", s.cfg.Dir, tablesDir)
+	known := make(map[string]struct{}, len(m.tables))
+	tables := make(map[uint32][]tableFile, len(s.families))
+	for _, e := range m.tables {
+		if _, ok := s.families[e.family]; !ok {
+			return fmt.Errorf("%w: table %s of unknown column family %d", ErrInvalidManifest, e.name, e.family)
+		}
+		table := tableFile{num: e.num, dir: filepath.Join(dir, e.name), level: e.level, family: e.family}
+		reader, err := s.openTable(table)
+		if err != nil {
+			return fmt.Errorf("table %s: %w", table.dir, err)
+		}
+		table.props, err = reader.Properties()
+		_ = reader.Close() // TODO log error
+		if err != nil {
+			return fmt.Errorf("table %s: %w", table.dir, err)
+		}
+
+		known[e.name] = struct{}{}
+		tables[e.family] = append(tables[e.family], table)
+	}
+
+	names, err := s.fs.List(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, ok := known[name]; ok {
+			continue
+		}
+		// number of a table which hasn't been published yet may be missing in manifest
+		var num uint64
+		if _, err := fmt.Sscanf(name, "%d-", &num); err == nil {
+			s.keepCounterAbove(num)
+		}
+		if err := s.fs.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+
+	for id, f := range s.families {
+		f.versions = []*version{f.current().apply(tables[id], nil)}
+	}
+	return nil
+}
+
+// findWALs finds WAL files left by the previous run, they are replayed oldest first
+func (s *OSStorageProvider) findWALs() error {
+	dir := fmt.Sprintf("%s/%s", s.cfg.Dir, walDir)
+	names, err := s.fs.List(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		var num uint64
+		if _, err := fmt.Sscanf(name, "%d-", &num); err != nil {
+			continue // not a WAL file
+		}
+		s.recoveredWALs = append(s.recoveredWALs, walFile{num: num, path: filepath.Join(dir, name)})
+		s.keepCounterAbove(num)
+	}
+	slices.SortFunc(s.recoveredWALs, func(a, b walFile) int {
+		return cmp.Compare(a.num, b.num)
+	})
+	return nil
+}
+
+// keepCounterAbove makes sure numbers of new files don't collide with numbers of recovered files
+func (s *OSStorageProvider) keepCounterAbove(num uint64) {
+	if s.counter.Load() < num {
+		s.counter.Store(num)
+	}
+}
+
+// RecoveredMemoryStorages returns memory rebuilt from WAL files left by the previous run, oldest first.
+// Incomplete record at the end of WAL is skipped, it's a change which hasn't been acknowledged.
+// WAL file is removed once its memory is cleared.
+func (s *OSStorageProvider) RecoveredMemoryStorages() ([]*MemoryStorage, error) {
+	storages := make([]*MemoryStorage, 0, len(s.recoveredWALs))
+	for _, f := range s.recoveredWALs {
+		storage, err := s.replayWAL(f.path)
+		if err != nil {
+			for _, storage := range storages {
+				_ = storage.wal.Close() // TODO log error
+			}
+			return nil, fmt.Errorf("WAL %s: %w", f.path, err)
+		}
+		storages = append(storages, storage)
+	}
+	s.recoveredWALs = nil
+	return storages, nil
+}
+
+func (s *OSStorageProvider) replayWAL(path string) (*MemoryStorage, error) {
+	file, err := s.fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := wal.NewReader(file)
+	memory := s.newMemoryStorage(wal.NewWriter(file, file.Sync, func() error {
+		return s.fs.Remove(path)
+	}))
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, storageio.ErrInvalidChecksum) {
+			break
+		}
+		if err != nil {
+			_ = file.Close() // TODO log error
 			return nil, err
 		}
+
+		var batch wal.BatchV2
+		if err := batch.Decode(bytes.NewBuffer(record)); err != nil {
+			_ = file.Close() // TODO log error
+			return nil, err
+		}
+		for _, e := range batch.Entries {
+			// changes of dropped column families are forgotten
+			if f := s.families[e.Family]; f != nil && !f.dropped {
+				if err := memory.upsert(e.Family, e.Key, e.Value); err != nil {
+					_ = file.Close() // TODO log error
+					return nil, err
+				}
+			}
+		}
 	}
 
-	return &OSStorageProvider{
-		cfg:  cfg,
-		buff: bytes.NewBuffer(nil),
-	}, nil
+	// WAL is never written again, it's only closed & deleted once memory is moved into a table
+	return memory, nil
 }
 
 func (s *OSStorageProvider) NewMemoryStorage() (*MemoryStorage, error) {
+	dir := fmt.Sprintf("%s/%s", s.cfg.Dir, walDir)
 	writer, err := wal.NewFileWriter(
-		fmt.Sprintf("%s/%s/%d-%d.wal", s.cfg.Dir, walDir, s.counter.Add(1), time.Now().Unix()),
+		s.fs,
+		fmt.Sprintf("%s/%d-%d.wal", dir, s.counter.Add(1), time.Now().Unix()),
+		s.cfg.walOptions()...,
 	)
 	if err != nil {
 		return nil, err
 	}
+	// WAL must be found after crash, not only its content must be durable
+	if err := s.fs.Sync(dir); err != nil {
+		_ = writer.Close() // TODO log error
+		return nil, err
+	}
+	return s.newMemoryStorage(writer), nil
+}
+
+func (s *OSStorageProvider) newMemoryStorage(writer *wal.Writer) *MemoryStorage {
 	return &MemoryStorage{
-		memory: memtable.NewMemtable(),
-		wal:    writer,
-		buff:   s.buff,
+		memory:      memtable.NewMemtableWithComparer(s.cfg.comparer()),
+		newMemtable: s.newMemtable,
+		merge:       s.mergeOperator,
+		now:         s.cfg.now,
+		comparer:    s.familyComparer,
+		wal:         writer,
+		buff:        s.buff,
+	}
+}
+
+// newMemtable creates memtable keeping keys in order of given column family
+func (s *OSStorageProvider) newMemtable(family uint32) *memtable.Memtable {
+	return memtable.NewMemtableWithComparer(s.familyComparer(family))
+}
+
+// familyComparer returns order of keys of given column family
+func (s *OSStorageProvider) familyComparer(family uint32) kv.Comparer {
+	if f, err := s.family(family); err == nil {
+		return f.cfg.comparer()
+	}
+	return s.cfg.comparer()
+}
+
+// mergeOperator returns merge operator of given column family
+func (s *OSStorageProvider) mergeOperator(family uint32) MergeOperator {
+	if f, err := s.family(family); err == nil {
+		return f.cfg.MergeOperator
+	}
+	return s.cfg.MergeOperator
+}
+
+func (s *OSStorageProvider) NewSSTableWriter(family uint32) (*tableWriter, error) {
+	f, err := s.family(family)
+	if err != nil {
+		return nil, err
+	}
+	table := s.newTableFile(family)
+	writer, err := sstable.NewFileWriter(s.fs, table.dir, f.cfg.writerOptions()...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tableWriter{
+		Writer: writer,
+		table:  table,
 	}, nil
 }
 
-func (s *OSStorageProvider) NewSSTableWriter() (*sstable.Writer, error) {
-	dir := fmt.Sprintf("%s/%s/%d-%d", s.cfg.Dir, tablesDir, s.counter.Add(1), time.Now().Unix())
-	if err := os.MkdirAll(dir, dirPerm); err != nil {
+// newTableFile points at directory of a new table of the column family
+func (s *OSStorageProvider) newTableFile(family uint32) tableFile {
+	table := tableFile{num: s.counter.Add(1), family: family}
+	table.dir = fmt.Sprintf("%s/%s/%d-%d", s.cfg.Dir, tablesDir, table.num, time.Now().Unix())
+	return table
+}
+
+// ExternalTableProperties reads properties of a table built outside of the tree.
+// ErrComparerMismatch is returned when keys of the table are not ordered by comparer of the column family.
+func (s *OSStorageProvider) ExternalTableProperties(family uint32, path string) (sstable.Properties, error) {
+	f, err := s.family(family)
+	if err != nil {
+		return sstable.Properties{}, err
+	}
+	reader, err := sstable.NewFileReader(s.fs, path, sstable.ReadModePread, sstable.WithReaderComparer(f.cfg.comparer()))
+	if err != nil {
+		return sstable.Properties{}, err
+	}
+	props, err := reader.Properties()
+	_ = reader.Close() // TODO log error
+	return props, err
+}
+
+// IngestTables moves tables built outside of the tree into tables of the column family (see sstable.IngestTable),
+// all of them are moved back when any of them can't be moved. Tables are visible for readers once they are published.
+func (s *OSStorageProvider) IngestTables(family uint32, external []externalTable, seq kv.SeqNum) ([]tableFile, error) {
+	if _, err := s.family(family); err != nil {
 		return nil, err
 	}
+	tables := make([]tableFile, 0, len(external))
+	for _, e := range external {
+		table := s.newTableFile(family)
+		props, err := sstable.IngestTable(s.fs, e.path, table.dir, seq)
+		if err != nil {
+			return nil, errors.Join(err, s.RestoreTables(tables, external))
+		}
+		table.props = props
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+// RestoreTables moves ingested tables which haven't been published back to paths of given external tables,
+// they get their original properties back (see sstable.RestoreTable)
+func (s *OSStorageProvider) RestoreTables(tables []tableFile, external []externalTable) error {
+	var errs []error
+	for i, table := range tables {
+		errs = append(errs, sstable.RestoreTable(s.fs, table.dir, external[i].path, external[i].props))
+	}
+	return errors.Join(errs...)
+}
+
+// RemoveTables removes complete tables which haven't been published (i.e. outputs of a failed compaction)
+func (s *OSStorageProvider) RemoveTables(tables []tableFile) error {
+	return s.removeTables(tables)
+}
 
+func (s *OSStorageProvider) FilesStorage(family uint32) (*tablesView, error) {
 	s.mu.Lock()
-	s.tablesDir = append(s.tablesDir, dir)
+	f := s.families[family]
+	if f == nil {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("%w: %d", ErrColumnFamilyNotFound, family)
+	}
+	v := f.current()
+	v.refs++
 	s.mu.Unlock()
 
-	return sstable.NewFileWriter(dir)
+	view := &tablesView{
+		levels: make([][]*fileStorage, len(v.levels)),
+		release: func() error {
+			return s.releaseVersion(f, v)
+		},
+	}
+	for level, tables := range v.levels {
+		view.levels[level] = make([]*fileStorage, 0, len(tables))
+		for _, table := range tables {
+			view.levels[level] = append(view.levels[level], &fileStorage{
+				table:           table,
+				tables:          s.tableCache,
+				comparer:        v.comparer,
+				prefixExtractor: f.cfg.PrefixExtractor,
+			})
+		}
+	}
+	return view, nil
 }
 
-func (s *OSStorageProvider) FilesStorage() ([]*fileStorage, error) {
-	// TODO check OS dir to get tables dirs
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	files := make([]*fileStorage, 0)
+// PublishTables publishes tables of many column families at once. Tables of a dropped family are removed right away.
+func (s *OSStorageProvider) PublishTables(added, removed []tableFile) error {
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
 
-	for _, dir := range s.tablesDir {
-		reader, err := sstable.NewFileReader(dir)
-		if err != nil {
-			return nil, err
+	s.mu.Lock()
+	addedOf, removedOf := make(map[*familyTables][]tableFile), make(map[*familyTables][]tableFile)
+	var unused []tableFile
+	for _, table := range added {
+		f := s.families[table.family]
+		if f == nil || f.dropped {
+			unused = append(unused, table)
+			continue
+		}
+		addedOf[f] = append(addedOf[f], table)
+	}
+	for _, table := range removed {
+		// tables of a dropped family are obsolete already
+		if f := s.families[table.family]; f != nil && !f.dropped {
+			removedOf[f] = append(removedOf[f], table)
+		}
+	}
+	next := make(map[*familyTables]*version, len(addedOf)+len(removedOf))
+	for _, f := range s.families {
+		if len(addedOf[f]) > 0 || len(removedOf[f]) > 0 {
+			next[f] = f.current().apply(addedOf[f], removedOf[f])
+		}
+	}
+	m := s.manifest(next)
+	s.mu.Unlock()
+
+	// tables can't be removed till the version without them is durable
+	if err := writeManifest(s.fs, s.cfg.Dir, m); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	obsolete := unused
+	for f, v := range next {
+		obsolete = append(obsolete, f.publish(v, removedOf[f])...)
+	}
+	s.mu.Unlock()
+
+	return s.removeTables(obsolete)
+}
+
+// manifest returns manifest of current versions of all column families replaced by given ones.
+// Provider must be locked.
+func (s *OSStorageProvider) manifest(next map[*familyTables]*version) manifest {
+	m := manifest{lastFileNum: s.counter.Load(), lastFamilyID: s.lastFamilyID}
+	ids := make([]uint32, 0, len(s.families))
+	for id, f := range s.families {
+		if !f.dropped {
+			ids = append(ids, id)
 		}
-		files = append(files, &fileStorage{
-			reader: reader,
-		})
 	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		f := s.families[id]
+		if id != defaultColumnFamilyID {
+			m.families = append(m.families, manifestFamily{id: id, name: f.name})
+		}
+		v, ok := next[f]
+		if !ok {
+			v = f.current()
+		}
+		m.addVersion(v)
+	}
+	return m
+}
+
+func (s *OSStorageProvider) releaseVersion(f *familyTables, v *version) error {
+	s.mu.Lock()
+	v.refs--
+	obsolete := f.dropUnusedVersions()
+	s.mu.Unlock()
+
+	return s.removeTables(obsolete)
+}
+
+// family returns column family by its id, dropped family is returned as well
+func (s *OSStorageProvider) family(id uint32) (*familyTables, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.families[id]
+	if f == nil {
+		return nil, fmt.Errorf("%w: %d", ErrColumnFamilyNotFound, id)
+	}
+	return f, nil
+}
 
-	return files, nil
+// ColumnFamilies returns ids of column families by their names, the default family included
+func (s *OSStorageProvider) ColumnFamilies() map[string]uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make(map[string]uint32, len(s.families))
+	for id, f := range s.families {
+		if !f.dropped {
+			ids[f.name] = id
+		}
+	}
+	return ids
+}
+
+// CreateColumnFamily adds an empty column family, the family is durable once it's returned
+func (s *OSStorageProvider) CreateColumnFamily(name string, cfg Config) (uint32, error) {
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+
+	if _, ok := s.ColumnFamilies()[name]; ok {
+		return 0, fmt.Errorf("%w: %s", ErrColumnFamilyExists, name)
+	}
+	s.mu.Lock()
+	f := newFamilyTables(s.lastFamilyID+1, name, cfg)
+	s.lastFamilyID++
+	s.families[f.id] = f
+	m := s.manifest(nil)
+	s.mu.Unlock()
+
+	if err := writeManifest(s.fs, s.cfg.Dir, m); err != nil {
+		s.mu.Lock()
+		delete(s.families, f.id)
+		s.mu.Unlock()
+		return 0, err
+	}
+	return f.id, nil
+}
+
+// DropColumnFamily removes column family with all its tables. Tables are deleted once no reader uses them.
+func (s *OSStorageProvider) DropColumnFamily(id uint32) error {
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+
+	if id == defaultColumnFamilyID {
+		return ErrDropDefaultColumnFamily
+	}
+	s.mu.Lock()
+	f := s.families[id]
+	if f == nil || f.dropped {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %d", ErrColumnFamilyNotFound, id)
+	}
+	f.dropped = true
+	m := s.manifest(nil)
+	s.mu.Unlock()
+
+	if err := writeManifest(s.fs, s.cfg.Dir, m); err != nil {
+		s.mu.Lock()
+		f.dropped = false
+		s.mu.Unlock()
+		return err
+	}
+
+	s.mu.Lock()
+	current := f.current()
+	var tables []tableFile
+	for _, level := range current.levels {
+		tables = append(tables, level...)
+	}
+	obsolete := f.publish(current.apply(nil, tables), tables)
+	s.mu.Unlock()
+
+	return s.removeTables(obsolete)
+}
+
+func newFamilyTables(id uint32, name string, cfg Config) *familyTables {
+	return &familyTables{id: id, name: name, cfg: cfg, versions: []*version{newVersion(cfg.comparer())}}
+}
+
+func (f *familyTables) current() *version {
+	return f.versions[len(f.versions)-1]
+}
+
+// publish makes given version the current one and returns tables which are not needed anymore.
+// Provider must be locked.
+func (f *familyTables) publish(next *version, removed []tableFile) []tableFile {
+	f.current().obsolete = removed
+	f.versions = append(f.versions, next)
+	return f.dropUnusedVersions()
+}
+
+// dropUnusedVersions forgets old versions no one uses and returns tables which are not needed anymore.
+// Table removed by a version can be still used by any older version, thus versions are dropped in order.
+// Provider must be locked.
+func (f *familyTables) dropUnusedVersions() []tableFile {
+	var obsolete []tableFile
+	for len(f.versions) > 1 && f.versions[0].refs == 0 {
+		obsolete = append(obsolete, f.versions[0].obsolete...)
+		f.versions = f.versions[1:]
+	}
+	return obsolete
+}
+
+func (s *OSStorageProvider) removeTables(tables []tableFile) error {
+	var errs []error
+	for _, table := range tables {
+		errs = append(errs, s.tableCache.evict(table.num))
+		if s.cache != nil {
+			s.cache.EvictFile(table.num)
+		}
+		errs = append(errs, s.fs.RemoveAll(table.dir))
+	}
+	return errors.Join(errs...)
+}
+
+func (s *OSStorageProvider) openTable(table tableFile) (*sstable.Reader, error) {
+	f, err := s.family(table.family)
+	if err != nil {
+		return nil, err
+	}
+	opts := []sstable.ReaderOption{
+		sstable.WithReaderComparer(f.cfg.comparer()),
+		sstable.WithReaderPrefixExtractor(f.cfg.PrefixExtractor),
+	}
+	if s.cache != nil {
+		opts = append(opts, sstable.WithCache(s.cache, table.num))
+	}
+	return sstable.NewFileReader(s.fs, table.dir, s.cfg.ReadMode, opts...)
+}
+
+// Close closes all open tables and unlocks the store directory. Tables in use are closed once they are released.
+func (s *OSStorageProvider) Close() error {
+	return errors.Join(s.tableCache.close(), s.lock.Close())
+}
+
+// BlockCacheStats returns counters of block cache shared by all tables
+func (s *OSStorageProvider) BlockCacheStats() cache.Stats {
+	if s.cache == nil {
+		return cache.Stats{}
+	}
+	return s.cache.Stats()
 }
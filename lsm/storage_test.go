@@ -0,0 +1,165 @@
+package lsm
+
+import (
+	"challenge-lsm-store/kv"
+	"challenge-lsm-store/vfs"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+const (
+	testDir       = "/db"
+	testWALDir    = testDir + "/" + walDir
+	testTablesDir = testDir + "/" + tablesDir
+)
+
+type pair struct {
+	key   string
+	value kv.Value
+}
+
+// newMemStorageProvider returns storage provider keeping all files in memory
+func newMemStorageProvider(t *testing.T, cfg Config) (*OSStorageProvider, *vfs.MemFS) {
+	fs := vfs.NewMemFS()
+	cfg.FS, cfg.Dir = fs, testDir
+	storage, err := NewOSStorageProvider(cfg)
+	require.NoError(t, err, "couldn't create storage provider")
+	return storage, fs
+}
+
+// writeTable writes complete table with given (sorted) pairs
+func writeTable(t *testing.T, storage storageProvider, level int, pairs ...pair) tableFile {
+	writer, err := storage.NewSSTableWriter(defaultColumnFamilyID)
+	require.NoError(t, err, "couldn't create a new table writer")
+	for _, p := range pairs {
+		err := writer.Write([]byte(p.key), kv.EncodeValue(p.value.Kind, p.value.Seq, p.value.Payload))
+		require.NoError(t, err, "write error")
+	}
+	require.NoError(t, writer.Close(), "close error")
+	return writer.tableAt(level)
+}
+
+func set(key string, seq kv.SeqNum, value string) pair {
+	return pair{key: key, value: kv.Value{Kind: kv.KindSet, Seq: seq, Payload: []byte(value)}}
+}
+
+func listDir(t *testing.T, fs vfs.FS, dir string) []string {
+	names, err := fs.List(dir)
+	require.NoError(t, err, "list error")
+	return names
+}
+
+func Test_LSM_Storage_PublishTables(t *testing.T) {
+	storage, fs := newMemStorageProvider(t, Config{})
+
+	//WHEN tables are published
+	table1 := writeTable(t, storage, 0, set("key1", 1, "value1"))
+	table2 := writeTable(t, storage, 1, set("key2", 2, "value2"))
+	require.NoError(t, storage.PublishTables([]tableFile{table1, table2}, nil), "publish error")
+
+	//THEN they are visible at their levels
+	view, err := storage.FilesStorage(defaultColumnFamilyID)
+	require.NoError(t, err, "files storage error")
+	require.Equal(t, 1, len(view.levels[0]), "unexpected L0 tables")
+	require.Equal(t, 1, len(view.levels[1]), "unexpected L1 tables")
+	value, found, err := view.levels[1][0].Find([]byte("key2"))
+	require.NoError(t, err, "find error")
+	assert.True(t, found, "key not found")
+	assert.Equal(t, kv.EncodeValue(kv.KindSet, 2, []byte("value2")), value, "unexpected value")
+	assert.Equal(t, 2, len(listDir(t, fs, testTablesDir)), "unexpected table directories")
+	require.NoError(t, view.Release(), "release error")
+}
+
+func Test_LSM_Storage_RemoveObsoleteTablesOnceNotUsed(t *testing.T) {
+	storage, fs := newMemStorageProvider(t, Config{})
+
+	//GIVEN published table used by a reader
+	table := writeTable(t, storage, 0, set("key1", 1, "value1"))
+	require.NoError(t, storage.PublishTables([]tableFile{table}, nil), "publish error")
+	view, err := storage.FilesStorage(defaultColumnFamilyID)
+	require.NoError(t, err, "files storage error")
+
+	//WHEN table is removed
+	require.NoError(t, storage.PublishTables(nil, []tableFile{table}), "publish error")
+
+	//THEN it's not visible for new readers
+	newView, err := storage.FilesStorage(defaultColumnFamilyID)
+	require.NoError(t, err, "files storage error")
+	assert.Empty(t, newView.levels[0], "removed table must not be visible")
+	require.NoError(t, newView.Release(), "release error")
+
+	//AND it's kept on disk as long as it's used
+	assert.Equal(t, 1, len(listDir(t, fs, testTablesDir)), "table used by a reader must be kept")
+	_, found, err := view.levels[0][0].Find([]byte("key1"))
+	require.NoError(t, err, "find error")
+	assert.True(t, found, "key not found")
+
+	require.NoError(t, view.Release(), "release error")
+	assert.Empty(t, listDir(t, fs, testTablesDir), "obsolete table must be removed")
+}
+
+func Test_LSM_Storage_RecoverPublishedTables(t *testing.T) {
+	storage, fs := newMemStorageProvider(t, Config{})
+
+	//GIVEN published tables
+	table1 := writeTable(t, storage, 0, set("key1", 1, "value1"))
+	table2 := writeTable(t, storage, 2, set("key2", 2, "value2"))
+	require.NoError(t, storage.PublishTables([]tableFile{table1, table2}, nil), "publish error")
+	//AND table which has not been published
+	writeTable(t, storage, 0, set("key3", 3, "value3"))
+
+	//WHEN storage is opened again
+	require.NoError(t, storage.Close(), "close error")
+	recovered, err := NewOSStorageProvider(Config{FS: fs, Dir: testDir})
+	require.NoError(t, err, "couldn't recover storage provider")
+
+	//THEN published tables are recovered at their levels
+	view, err := recovered.FilesStorage(defaultColumnFamilyID)
+	require.NoError(t, err, "files storage error")
+	require.Equal(t, 1, len(view.levels[0]), "unexpected L0 tables")
+	require.Equal(t, 1, len(view.levels[2]), "unexpected L2 tables")
+	assert.Equal(t, table1.props, view.levels[0][0].table.props, "unexpected L0 table properties")
+	assert.Equal(t, table2.props, view.levels[2][0].table.props, "unexpected L2 table properties")
+	require.NoError(t, view.Release(), "release error")
+
+	//AND table which has not been published is removed
+	assert.Equal(t, 2, len(listDir(t, fs, testTablesDir)), "unexpected table directories")
+
+	//AND new tables don't reuse numbers of recovered ones
+	table := writeTable(t, recovered, 0, set("key4", 4, "value4"))
+	assert.Greater(t, table.num, table2.num, "table number must not be reused")
+}
+
+func Test_LSM_Storage_LockDirectory(t *testing.T) {
+	//GIVEN opened storage
+	storage, fs := newMemStorageProvider(t, Config{})
+
+	//WHEN the same directory is opened again
+	_, err := NewOSStorageProvider(Config{FS: fs, Dir: testDir})
+
+	//THEN it fails till the storage is closed
+	assert.True(t, errors.Is(err, ErrDirLocked), "directory must be locked")
+	require.NoError(t, storage.Close(), "close error")
+	storage, err = NewOSStorageProvider(Config{FS: fs, Dir: testDir})
+	require.NoError(t, err, "directory must be unlocked")
+	require.NoError(t, storage.Close(), "close error")
+}
+
+func Test_LSM_Storage_NeverReuseFileNumbers(t *testing.T) {
+	//GIVEN table which has been removed
+	storage, fs := newMemStorageProvider(t, Config{})
+	table := writeTable(t, storage, 0, set("key1", 1, "value1"))
+	require.NoError(t, storage.PublishTables([]tableFile{table}, nil), "publish error")
+	require.NoError(t, storage.PublishTables(nil, []tableFile{table}), "publish error")
+	require.Empty(t, listDir(t, fs, testTablesDir), "table must be removed")
+
+	//WHEN storage is opened again
+	require.NoError(t, storage.Close(), "close error")
+	storage, err := NewOSStorageProvider(Config{FS: fs, Dir: testDir})
+	require.NoError(t, err, "couldn't open storage provider")
+
+	//THEN new files get greater numbers
+	assert.Greater(t, writeTable(t, storage, 0).num, table.num, "table number must not be reused")
+}
@@ -0,0 +1,139 @@
+package lsm
+
+import (
+	"challenge-lsm-store/sstable"
+	"container/list"
+	"errors"
+	"sync"
+)
+
+const defaultMaxOpenTables = 256
+
+type (
+	openTableFn = func(table tableFile) (*sstable.Reader, error)
+
+	// tableCache keeps bounded number of open table readers (LRU by file number).
+	// Readers are reference counted so reader evicted while in use is closed once the last user releases it.
+	// tableCache is thread-safe.
+	tableCache struct {
+		mu       sync.Mutex
+		capacity int
+		open     openTableFn
+		tables   map[uint64]*cachedTable
+		lru      *list.List // most recently used first
+	}
+
+	cachedTable struct {
+		num    uint64
+		reader *sstable.Reader
+		refs   int // users of the reader, cache itself holds one reference as long as reader is cached
+		elem   *list.Element
+	}
+)
+
+func newTableCache(capacity int, open openTableFn) *tableCache {
+	if capacity <= 0 {
+		capacity = defaultMaxOpenTables
+	}
+	return &tableCache{
+		capacity: capacity,
+		open:     open,
+		tables:   make(map[uint64]*cachedTable),
+		lru:      list.New(),
+	}
+}
+
+// acquire returns reader of given table opening it when needed. Reader must be released once it's no longer used.
+func (c *tableCache) acquire(table tableFile) (*cachedTable, error) {
+	c.mu.Lock()
+	if t, ok := c.tables[table.num]; ok {
+		t.refs++
+		c.lru.MoveToFront(t.elem)
+		c.mu.Unlock()
+		return t, nil
+	}
+	c.mu.Unlock()
+
+	// files are opened without lock to not block other readers
+	reader, err := c.open(table)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t, ok := c.tables[table.num]; ok {
+		// table has been opened by other routine in the meantime
+		_ = reader.Close() // TODO log error
+		t.refs++
+		c.lru.MoveToFront(t.elem)
+		return t, nil
+	}
+
+	t := &cachedTable{num: table.num, reader: reader, refs: 2} // cache & caller
+	t.elem = c.lru.PushFront(t)
+	c.tables[table.num] = t
+
+	for c.lru.Len() > c.capacity {
+		_ = c.remove(c.lru.Back().Value.(*cachedTable)) // TODO log error
+	}
+	return t, nil
+}
+
+// release gives back reader acquired before
+func (c *tableCache) release(t *cachedTable) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.unref(t)
+}
+
+// evict drops table from the cache, i.e. when table is obsolete. Reader is closed once it's no longer used.
+func (c *tableCache) evict(num uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, ok := c.tables[num]
+	if !ok {
+		return nil
+	}
+	return c.remove(t)
+}
+
+// close evicts all tables
+func (c *tableCache) close() error {
+	c.mu.Lock()
+	nums := make([]uint64, 0, len(c.tables))
+	for num := range c.tables {
+		nums = append(nums, num)
+	}
+	c.mu.Unlock()
+
+	var errs []error
+	for _, num := range nums {
+		errs = append(errs, c.evict(num))
+	}
+	return errors.Join(errs...)
+}
+
+// len returns number of open tables kept in the cache
+func (c *tableCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.tables)
+}
+
+// remove drops table from the cache together with cache's reference. Cache must be locked.
+func (c *tableCache) remove(t *cachedTable) error {
+	delete(c.tables, t.num)
+	c.lru.Remove(t.elem)
+	return c.unref(t)
+}
+
+// unref drops single reference closing reader when it was the last one. Cache must be locked.
+func (c *tableCache) unref(t *cachedTable) error {
+	t.refs--
+	if t.refs > 0 {
+		return nil
+	}
+	return t.reader.Close()
+}
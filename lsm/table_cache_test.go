@@ -0,0 +1,171 @@
+package lsm
+
+import (
+	"challenge-lsm-store/sstable"
+	"challenge-lsm-store/vfs"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// trackedTables opens in-memory tables and keeps track of their open readers
+type trackedTables struct {
+	fs      *vfs.MemFS
+	opened  map[uint64]int
+	closed  map[uint64]int
+	openErr error
+}
+
+type trackedCloser struct {
+	vfs.File
+	onClose func()
+}
+
+func newTrackedTables(t *testing.T) *trackedTables {
+	fs := vfs.NewMemFS()
+	for _, name := range []string{"data", "index", "sparse", "properties"} {
+		f, err := fs.Create(name)
+		require.NoError(t, err, "create error")
+		require.NoError(t, f.Close(), "close error")
+	}
+	return &trackedTables{
+		fs:     fs,
+		opened: make(map[uint64]int),
+		closed: make(map[uint64]int),
+	}
+}
+
+func (tt *trackedTables) open(table tableFile) (*sstable.Reader, error) {
+	if tt.openErr != nil {
+		return nil, tt.openErr
+	}
+
+	files := make([]sstable.ReadAtCloser, 0, 4)
+	for _, name := range []string{"data", "index", "sparse", "properties"} {
+		f, err := tt.fs.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	tt.opened[table.num]++
+	files[0] = &trackedCloser{
+		File: files[0].(vfs.File),
+		onClose: func() {
+			tt.closed[table.num]++
+		},
+	}
+
+	return sstable.NewReader(files[0], files[1], files[2], files[3]), nil
+}
+
+func (tt *trackedTables) openCount() int {
+	count := 0
+	for num, opened := range tt.opened {
+		count += opened - tt.closed[num]
+	}
+	return count
+}
+
+func (c *trackedCloser) Close() error {
+	c.onClose()
+	return c.File.Close()
+}
+
+func Test_LSM_TableCache_ReuseOpenTable(t *testing.T) {
+	tables := newTrackedTables(t)
+	c := newTableCache(10, tables.open)
+
+	t1, err := c.acquire(tableFile{num: 1})
+	require.NoError(t, err, "acquire error")
+	require.NoError(t, c.release(t1), "release error")
+	t2, err := c.acquire(tableFile{num: 1})
+	require.NoError(t, err, "acquire error")
+	require.NoError(t, c.release(t2), "release error")
+
+	assert.Same(t, t1.reader, t2.reader, "table must be opened only once")
+	assert.Equal(t, 1, tables.opened[1], "unexpected open calls")
+	assert.Equal(t, 1, tables.openCount(), "table must be kept open")
+	assert.Equal(t, 1, c.len(), "unexpected cached tables")
+}
+
+func Test_LSM_TableCache_BoundOpenTables(t *testing.T) {
+	tables := newTrackedTables(t)
+	c := newTableCache(3, tables.open)
+
+	for num := uint64(1); num <= 10; num++ {
+		table, err := c.acquire(tableFile{num: num})
+		require.NoError(t, err, "acquire error")
+		require.NoError(t, c.release(table), "release error")
+		assert.LessOrEqual(t, tables.openCount(), 3, "too many open tables")
+	}
+
+	assert.Equal(t, 3, c.len(), "unexpected cached tables")
+	// the least recently used tables are closed
+	for num := uint64(1); num <= 7; num++ {
+		assert.Equalf(t, 1, tables.closed[num], "table not closed: %d", num)
+	}
+	for num := uint64(8); num <= 10; num++ {
+		assert.Equalf(t, 0, tables.closed[num], "table closed: %d", num)
+	}
+}
+
+func Test_LSM_TableCache_CloseEvictedTableOnceReleased(t *testing.T) {
+	tables := newTrackedTables(t)
+	c := newTableCache(1, tables.open)
+
+	t1, err := c.acquire(tableFile{num: 1})
+	require.NoError(t, err, "acquire error")
+
+	// table 1 is evicted but still in use
+	t2, err := c.acquire(tableFile{num: 2})
+	require.NoError(t, err, "acquire error")
+	assert.Equal(t, 0, tables.closed[1], "table in use must not be closed")
+
+	require.NoError(t, c.release(t1), "release error")
+	assert.Equal(t, 1, tables.closed[1], "evicted table must be closed once released")
+
+	require.NoError(t, c.release(t2), "release error")
+	assert.Equal(t, 0, tables.closed[2], "cached table must stay open")
+}
+
+func Test_LSM_TableCache_EvictObsoleteTable(t *testing.T) {
+	tables := newTrackedTables(t)
+	c := newTableCache(10, tables.open)
+
+	t1, err := c.acquire(tableFile{num: 1})
+	require.NoError(t, err, "acquire error")
+
+	require.NoError(t, c.evict(1), "evict error")
+	assert.Equal(t, 0, tables.closed[1], "table in use must not be closed")
+	assert.Equal(t, 0, c.len(), "obsolete table must not be cached")
+
+	require.NoError(t, c.release(t1), "release error")
+	assert.Equal(t, 1, tables.closed[1], "obsolete table must be closed once released")
+}
+
+func Test_LSM_TableCache_Close(t *testing.T) {
+	tables := newTrackedTables(t)
+	c := newTableCache(10, tables.open)
+
+	for num := uint64(1); num <= 5; num++ {
+		table, err := c.acquire(tableFile{num: num})
+		require.NoError(t, err, "acquire error")
+		require.NoError(t, c.release(table), "release error")
+	}
+
+	require.NoError(t, c.close(), "close error")
+	assert.Equal(t, 0, tables.openCount(), "all tables must be closed")
+	assert.Equal(t, 0, c.len(), "no tables must be cached")
+}
+
+func Test_LSM_TableCache_OpenError(t *testing.T) {
+	tables := newTrackedTables(t)
+	tables.openErr = errors.New("open error")
+	c := newTableCache(10, tables.open)
+
+	_, err := c.acquire(tableFile{num: 1})
+	assert.Equal(t, tables.openErr, err, "unexpected acquire error")
+	assert.Equal(t, 0, c.len(), "table must not be cached")
+}
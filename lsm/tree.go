@@ -1,161 +1,579 @@
 package lsm
 
 import (
+	"challenge-lsm-store/kv"
 	"challenge-lsm-store/sstable"
+	"context"
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrClosed   = errors.New("tree is closed")
+	ErrReadOnly = errors.New("tree is read-only")
 )
 
 type storageProvider interface {
+	// RecoveredMemoryStorages returns memory left by the previous run, oldest first
+	RecoveredMemoryStorages() ([]*MemoryStorage, error)
 	NewMemoryStorage() (*MemoryStorage, error)
-	NewSSTableWriter() (*sstable.Writer, error)
-	FilesStorage() ([]*fileStorage, error)
+	NewSSTableWriter(family uint32) (*tableWriter, error)
+	// FilesStorage returns tables of the column family visible for readers,
+	// view must be released once it's no longer used
+	FilesStorage(family uint32) (*tablesView, error)
+	// PublishTables atomically adds complete tables and removes obsolete ones, tables may belong to many families
+	PublishTables(added, removed []tableFile) error
+	// ExternalTableProperties reads properties of a table built outside of the tree
+	ExternalTableProperties(family uint32, path string) (sstable.Properties, error)
+	// IngestTables moves tables built outside of the tree into tables of the column family,
+	// their entries get given sequence number. Tables must be published afterwards.
+	IngestTables(family uint32, external []externalTable, seq kv.SeqNum) ([]tableFile, error)
+	// RestoreTables moves ingested tables which haven't been published back where they were built
+	RestoreTables(tables []tableFile, external []externalTable) error
+	// RemoveTables removes complete tables which haven't been published
+	RemoveTables(tables []tableFile) error
+	// ColumnFamilies returns ids of column families by their names, the default family included
+	ColumnFamilies() map[string]uint32
+	CreateColumnFamily(name string, cfg Config) (uint32, error)
+	DropColumnFamily(id uint32) error
+	// Close closes all tables, tables in use are closed once they are released
+	Close() error
 }
 
-// Tree represents single tree for LSM store. Tree is not thread-safe.
+// Tree represents single tree for LSM store. Tree is thread-safe: Get, Write (and changes built on it), iterators,
+// Flush, Compact and Ingest can be called concurrently. Writes are applied one by one, memory is moved into tables
+// and tables are compacted in the background. Iterators and transactions themselves must not be shared
+// between goroutines. Close doesn't flush current memory, it's replayed from WAL once the tree is opened again.
+// Calls made once the tree is closed fail with ErrClosed.
 type Tree struct {
 	cfg             Config
 	storageProvider storageProvider
 
 	//TODO move to separate structure to manage it more easily
-	flushingMu sync.RWMutex
-	flushing   map[*MemoryStorage]struct{}
+	flushingMu     sync.RWMutex
+	flushing       []*flushJob // immutable memory waiting to be moved into tables, oldest first
+	flushScheduled bool        // flushes run one by one in the background, so tables are published in order
 
 	currentMu sync.RWMutex
 	current   *MemoryStorage
+	seq       atomic.Uint64 // sequence number of the last change
+	closed    bool
+
+	compactionMu        sync.Mutex  // only one compaction runs at the same time
+	compactionScheduled atomic.Bool // compaction waits to be run in the background
+
+	background     sync.WaitGroup // flushes & compactions running in the background
+	closing        chan struct{}  // closed once tree is being closed, it stops flush retries
+	backgroundMu   sync.Mutex
+	backgroundErrs []error // errors of background work reported on close
+	readOnlyErr    error   // persistent failure which makes the tree read-only
+
+	stall *writeStall
+
+	familiesMu sync.RWMutex
+	families   map[string]*ColumnFamily
 }
 
-// TODO replace config with options to make default settings possible
+// flushJob tracks memory which is being moved into a table
+type flushJob struct {
+	memory *MemoryStorage
+	done   chan struct{}
+	err    error
+}
+
+// New creates a tree on top of given storage, see Open for settings with defaults.
+// ErrInvalidOption is returned for invalid settings.
 func New(storageProvider storageProvider, cfg Config) (*Tree, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	t := &Tree{
+		cfg:             cfg,
+		storageProvider: storageProvider,
+		closing:         make(chan struct{}),
+		stall:           newWriteStall(),
+		families:        make(map[string]*ColumnFamily),
+	}
+	for name, id := range storageProvider.ColumnFamilies() {
+		t.families[name] = &ColumnFamily{tree: t, id: id, name: name, cfg: cfg.columnFamily(name)}
+	}
+	t.families[DefaultColumnFamily].cfg = cfg
+	if err := t.recover(); err != nil {
+		return nil, err
+	}
+	t.backgroundProgressed()
+
 	storage, err := storageProvider.NewMemoryStorage()
 	if err != nil {
 		return nil, err
 	}
+	t.current = storage
+	return t, nil
+}
 
-	return &Tree{
-		cfg:             cfg,
-		storageProvider: storageProvider,
-		current:         storage,
-		flushing:        make(map[*MemoryStorage]struct{}),
-	}, nil
+// recover moves memory left by the previous run into tables and restores the last sequence number
+func (t *Tree) recover() error {
+	recovered, err := t.storageProvider.RecoveredMemoryStorages()
+	if err != nil {
+		return err
+	}
+	for i, storage := range recovered {
+		if storage.Size() == 0 {
+			err = storage.Clear()
+		} else {
+			err = t.flushNow(storage)
+		}
+		if err != nil {
+			for _, left := range recovered[i+1:] {
+				_ = left.wal.Close() // TODO log error
+			}
+			return err
+		}
+	}
+
+	for _, cf := range t.columnFamilies() {
+		view, err := t.storageProvider.FilesStorage(cf.id)
+		if err != nil {
+			return err
+		}
+		for _, level := range view.levels {
+			for _, f := range level {
+				t.seq.Store(max(t.seq.Load(), f.table.props.LargestSeq))
+			}
+		}
+		if err := view.Release(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// Put sets value of the key in the default column family
 func (t *Tree) Put(key []byte, value []byte) error {
+	return t.write(func() error {
+		return t.current.Put(key, kv.EncodeValue(kv.KindSet, t.seq.Add(1), value))
+	})
+}
+
+// Delete deletes the key from the default column family
+func (t *Tree) Delete(key []byte) error {
+	return t.write(func() error {
+		return t.current.Put(key, kv.EncodeValue(kv.KindDelete, t.seq.Add(1), nil))
+	})
+}
+
+// write applies change to current memory, which is rotated once it's full
+func (t *Tree) write(change func() error) error {
+	t.stallWrites()
+
 	t.currentMu.Lock()
 	defer t.currentMu.Unlock()
-	err := t.current.Put(key, value)
+	if t.closed {
+		return ErrClosed
+	}
+	if err := t.readOnly(); err != nil {
+		return err
+	}
+	if err := change(); err != nil {
+		return err
+	}
+
+	if t.current.Size() > t.cfg.MemoryThreshold {
+		return t.rotate()
+	}
 
+	return nil
+}
+
+// rotate replaces current memory with a new one and moves the old one into a table in the background.
+// Current memory must be locked.
+func (t *Tree) rotate() error {
+	newMemoryStorage, err := t.storageProvider.NewMemoryStorage()
 	if err != nil {
 		return err
 	}
 
-	if t.current.Size() > t.cfg.MemoryThreshold {
-		newMemoryStorage, err := t.storageProvider.NewMemoryStorage()
-		if err != nil {
-			return err
+	old := t.current
+	t.current = newMemoryStorage
+	// old memory must stay visible for readers till its table is published
+	t.flushingMu.Lock()
+	defer t.flushingMu.Unlock()
+	t.flushing = append(t.flushing, &flushJob{memory: old, done: make(chan struct{})})
+	if !t.flushScheduled {
+		t.flushScheduled = true
+		t.background.Add(1)
+		go t.flushInOrder()
+	}
+	return nil
+}
+
+// flushInOrder moves immutable memory into tables from the oldest one, so a newer table is never published
+// before an older one. Once a flush fails for good, the memory left is not flushed anymore.
+func (t *Tree) flushInOrder() {
+	defer t.background.Done()
+	for {
+		t.flushingMu.Lock()
+		job := t.nextFlushJob()
+		if job == nil {
+			t.flushScheduled = false
+			t.flushingMu.Unlock()
+			return
 		}
+		t.flushingMu.Unlock()
 
-		old := t.current
-		t.current = newMemoryStorage
-		go func() {
-			// TODO log error here
-			_ = t.WriteToFile(old)
-			// TODO if we couldn't move data from memory into file I guess we should revert operation
+		err := t.writeToFileWithRetries(job.memory)
+		job.finish(err)
+		if err == nil {
+			continue
+		}
+
+		// memory stays readable & its WAL is kept, but no more changes are accepted
+		t.reportBackgroundError(err)
+		t.backgroundMu.Lock()
+		if t.readOnlyErr == nil {
+			t.readOnlyErr = err
+		}
+		t.backgroundMu.Unlock()
 
-			// TODO it could take a while till old memory storage will appear in flushing area thus consider 2 options:
-			// 1) run write to file directly (not as a routine) which may block put for much longer
-			// 2) we can add old storage to flushing map here and run write to file anyways
-			// 3) write to file can return a channel which will signal when writing started thus when old memory is in flushing area already
-		}()
+		// newer memory can't be published on top of the failed one
+		t.flushingMu.Lock()
+		for job := t.nextFlushJob(); job != nil; job = t.nextFlushJob() {
+			job.finish(err)
+		}
+		t.flushScheduled = false
+		t.flushingMu.Unlock()
+		t.backgroundProgressed()
+		return
 	}
+}
 
+// nextFlushJob returns the oldest job which is not finished yet. Flushing memory must be locked.
+func (t *Tree) nextFlushJob() *flushJob {
+	for _, job := range t.flushing {
+		if !job.finished() {
+			return job
+		}
+	}
 	return nil
 }
 
-// LoadIntoMemory loads data from storage into current memory without touching WAL
-// TODO this fn is rather for testing purposes now (which is bad) to speed up import
-func (t *Tree) LoadIntoMemory(memoryStorage *MemoryStorage) {
-	t.currentMu.Lock()
-	defer t.currentMu.Unlock()
+// writeToFileWithRetries retries failed flush with growing delay till attempts are over or tree is closed
+func (t *Tree) writeToFileWithRetries(memoryStorage *MemoryStorage) error {
+	attempts, delay := t.cfg.flushRetries()
+	for attempt := 1; ; attempt++ {
+		err := t.writeToFile(memoryStorage)
+		if err == nil || attempt >= attempts {
+			return err
+		}
 
-	for pair := range memoryStorage.memory.GetAll() {
-		t.current.Load(pair.GetKey(), pair.GetValue())
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-t.closing:
+			return err
+		}
 	}
 }
 
-// WriteToFile moves data from memory into files
-// TODO delegate it with flushing map & its mu to separate struct
-func (t *Tree) WriteToFile(memoryStorage *MemoryStorage) error {
-	writer, err := t.storageProvider.NewSSTableWriter()
-	if err != nil {
+// readOnly returns error when the tree doesn't accept changes after a persistent background failure
+func (t *Tree) readOnly() error {
+	t.backgroundMu.Lock()
+	defer t.backgroundMu.Unlock()
+	if t.readOnlyErr != nil {
+		return fmt.Errorf("%w: %w", ErrReadOnly, t.readOnlyErr)
+	}
+	return nil
+}
+
+// Flush moves current memory into a table and waits till all memory is written into tables.
+// Errors of all flushes it waited for are reported.
+func (t *Tree) Flush(ctx context.Context) error {
+	t.currentMu.Lock()
+	if t.closed {
+		t.currentMu.Unlock()
+		return ErrClosed
+	}
+	if err := t.readOnly(); err != nil {
+		t.currentMu.Unlock()
 		return err
 	}
+	if t.current.Size() > 0 {
+		if err := t.rotate(); err != nil {
+			t.currentMu.Unlock()
+			return err
+		}
+	}
+	t.currentMu.Unlock()
+
+	t.flushingMu.RLock()
+	jobs := append([]*flushJob(nil), t.flushing...)
+	t.flushingMu.RUnlock()
+
+	var errs []error
+	for _, job := range jobs {
+		select {
+		case <-job.done:
+			errs = append(errs, job.err)
+		case <-ctx.Done():
+			return errors.Join(append(errs, ctx.Err())...)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close stops accepting changes, waits till work in the background is done, closes WAL and all tables.
+// Current memory is not flushed, it's recovered from WAL once the tree is opened again.
+// Errors of the work done in the background are reported as well.
+func (t *Tree) Close() error {
+	t.currentMu.Lock()
+	if t.closed {
+		t.currentMu.Unlock()
+		return ErrClosed
+	}
+	t.closed = true
+	t.currentMu.Unlock()
+
+	close(t.closing)
+	t.backgroundProgressed() // stopped writes fail once the tree is closed
+	t.background.Wait()
 
+	t.backgroundMu.Lock()
+	errs := t.backgroundErrs
+	t.backgroundMu.Unlock()
+
+	errs = append(errs, t.current.Close())
+	// memory which couldn't be flushed is kept in its WAL as well
 	t.flushingMu.Lock()
-	t.flushing[memoryStorage] = struct{}{}
+	for _, job := range t.flushing {
+		errs = append(errs, job.memory.Close())
+	}
 	t.flushingMu.Unlock()
 
-	defer writer.Close() // TODO log error
+	errs = append(errs, t.storageProvider.Close())
+	return errors.Join(errs...)
+}
 
-	if err := memoryStorage.Write(writer); err != nil {
-		// TODO should we retry here or just try to move WAL to SSTable by some manual actions using CLI?
-		return err
-	} else {
-		t.flushingMu.Lock()
-		delete(t.flushing, memoryStorage)
+func (j *flushJob) finish(err error) {
+	j.err = err
+	close(j.done)
+}
+
+func (j *flushJob) finished() bool {
+	select {
+	case <-j.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *Tree) reportBackgroundError(err error) {
+	t.backgroundMu.Lock()
+	defer t.backgroundMu.Unlock()
+	t.backgroundErrs = append(t.backgroundErrs, err)
+}
+
+// flushNow moves data from memory into files right away. Memory flushed in the background is kept in order,
+// so given memory must not be newer than memory waiting for flush. When the memory is being flushed
+// in the background already, that flush is waited for.
+// TODO delegate it with flushing queue & its mu to separate struct
+func (t *Tree) flushNow(memoryStorage *MemoryStorage) error {
+	t.flushingMu.Lock()
+	i := t.flushingIndex(memoryStorage)
+	if i >= 0 && !t.flushing[i].finished() {
+		// the job is finished by the routine flushing it
+		job := t.flushing[i]
 		t.flushingMu.Unlock()
+		<-job.done
+		return job.err
+	}
+	job := &flushJob{memory: memoryStorage, done: make(chan struct{})}
+	if i < 0 {
+		t.flushing = append(t.flushing, job)
+	} else {
+		t.flushing[i] = job
+	}
+	t.flushingMu.Unlock()
 
-		if err := memoryStorage.Clear(); err != nil {
+	job.finish(t.writeToFile(memoryStorage))
+	return job.err
+}
+
+// writeToFile writes a table per column family, tables of all families are published at once.
+// WAL shared by the families is deleted only once all their tables are durable.
+func (t *Tree) writeToFile(memoryStorage *MemoryStorage) error {
+	var added []tableFile
+	for _, family := range memoryStorage.columnFamilies() {
+		table, err := t.writeTable(memoryStorage, family)
+		if err != nil {
+			return errors.Join(err, t.storageProvider.RemoveTables(added))
+		}
+		added = append(added, table)
+	}
+	// data must stay in flushing memory till tables are complete and visible for readers
+	if err := t.storageProvider.PublishTables(added, nil); err != nil {
+		// tables are written again by the next flush, so the ones which are not published are removed
+		if len(added) == 0 {
 			return err
 		}
+		if published, viewErr := t.published(added[0].family, added[0]); viewErr != nil {
+			err = errors.Join(err, viewErr)
+		} else if !published {
+			err = errors.Join(err, t.storageProvider.RemoveTables(added))
+		}
+		return err
+	}
+
+	t.flushingMu.Lock()
+	if i := t.flushingIndex(memoryStorage); i >= 0 {
+		t.flushing = append(t.flushing[:i:i], t.flushing[i+1:]...)
+	}
+	t.flushingMu.Unlock()
+	t.backgroundProgressed()
+
+	if err := memoryStorage.Clear(); err != nil {
+		return err
 	}
 
+	t.scheduleCompaction()
 	return nil
 }
 
+func (t *Tree) writeTable(memoryStorage *MemoryStorage, family uint32) (tableFile, error) {
+	writer, err := t.storageProvider.NewSSTableWriter(family)
+	if err != nil {
+		return tableFile{}, err
+	}
+
+	if err := memoryStorage.writeFamily(family, writer.Writer); err != nil {
+		_ = writer.Abort() // TODO log error
+		// TODO should we retry here or just try to move WAL to SSTable by some manual actions using CLI?
+		return tableFile{}, err
+	}
+	if err := writer.Close(); err != nil {
+		return tableFile{}, err
+	}
+	return writer.table, nil
+}
+
+// Get returns value of the key kept in the default column family, nil is returned when the key doesn't exist
 func (t *Tree) Get(key []byte) ([]byte, error) {
+	return t.get(defaultColumnFamilyID, key)
+}
+
+func (t *Tree) get(family uint32, key []byte) ([]byte, error) {
 	t.currentMu.RLock()
-	value, found := t.current.Get(key)
+	if t.closed {
+		t.currentMu.RUnlock()
+		return nil, ErrClosed
+	}
+	l := t.newLookup(family, key)
+	err := l.addFrom(t.current)
 	t.currentMu.RUnlock()
-	if found {
-		return value, nil
+	if err == nil && !l.done {
+		err = t.findFlushed(l)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	value, ok := t.findInFlushingMemory(key)
-	if ok {
-		return value, nil
+	value, found, err := l.result()
+	if err != nil || !found {
+		return nil, err
 	}
+	return payloadOf(value)
+}
+
+// latest returns the newest envelope of the key visible for readers, merge operands are combined.
+// Current memory must be locked.
+func (t *Tree) latest(family uint32, key []byte) ([]byte, bool, error) {
+	l := t.newLookup(family, key)
+	err := l.addFrom(t.current)
+	if err == nil && !l.done {
+		err = t.findFlushed(l)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return l.result()
+}
 
-	return t.findInFiles(key)
+// newLookup starts lookup of the key using merge operator of the column family
+func (t *Tree) newLookup(family uint32, key []byte) *valueLookup {
+	return &valueLookup{merge: t.mergeOperator(family), now: t.cfg.now(), family: family, key: key}
 }
 
-func (t *Tree) findInFlushingMemory(key []byte) ([]byte, bool) {
+// findFlushed looks the key up in immutable memory and tables
+func (t *Tree) findFlushed(l *valueLookup) error {
+	if err := t.findInFlushingMemory(l); err != nil || l.done {
+		return err
+	}
+	return t.findInFiles(l)
+}
+
+// flushingIndex returns position of given memory in the flushing queue or -1. Flushing memory must be locked.
+func (t *Tree) flushingIndex(memoryStorage *MemoryStorage) int {
+	for i, job := range t.flushing {
+		if job.memory == memoryStorage {
+			return i
+		}
+	}
+	return -1
+}
+
+// findInFlushingMemory searches immutable memory from the newest one, so the latest value of the key is found
+func (t *Tree) findInFlushingMemory(l *valueLookup) error {
 	t.flushingMu.RLock()
 	defer t.flushingMu.RUnlock()
-	for f := range t.flushing {
-		value, found := f.Get(key)
-		if found {
-			return value, true
+	for i := len(t.flushing) - 1; i >= 0 && !l.done; i-- {
+		if err := l.addFrom(t.flushing[i].memory); err != nil {
+			return err
 		}
 	}
-
-	return nil, false
+	return nil
 }
 
-func (t *Tree) findInFiles(key []byte) ([]byte, error) {
-	files, err := t.storageProvider.FilesStorage()
+func (t *Tree) findInFiles(l *valueLookup) error {
+	view, err := t.storageProvider.FilesStorage(l.family)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer func() {
+		_ = view.Release() // TODO log error
+	}()
 
-	for _, r := range files {
-		value, found, err := r.Find(key)
-		if err != nil {
-			return nil, err
-		}
-		if found {
-			return value, nil
+	// levels go from the newest data to the oldest one, tables of L0 may overlap thus they are kept newest first
+	for _, level := range view.levels {
+		for _, f := range level {
+			if l.done {
+				return nil
+			}
+			if !f.mayContain(l.key) {
+				continue
+			}
+			value, found, deletedSeq, err := f.findCovered(l.key)
+			if err != nil {
+				return err
+			}
+			if err := l.addFound(value, found, deletedSeq); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
+}
 
-	return nil, nil
+// payloadOf unwraps stored value from its envelope, deleted key has no value
+func payloadOf(encoded []byte) ([]byte, error) {
+	v, err := kv.DecodeValue(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if v.IsTombstone() {
+		return nil, nil
+	}
+	return v.Payload, nil
 }
@@ -1,66 +1,70 @@
 package lsm
 
 import (
+	"challenge-lsm-store/kv"
 	"challenge-lsm-store/memtable"
+	"challenge-lsm-store/vfs"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func Test_LSM_Tree_PutWithoutClearingMemory(t *testing.T) {
 	//GIVEN a tree
-	storage := &mockStorageProvider{}
-	tree, err := New(
-		storage,
-		Config{
-			MemoryThreshold: 1000,
-		},
-	)
+	cfg := Config{
+		MemoryThreshold: 1000,
+	}
+	storage, fs := newMemStorageProvider(t, cfg)
+	tree, err := New(storage, cfg)
 	require.Nil(t, err, "couldn't create a new tree")
 
 	//WHEN key-value is stored
 	require.Nil(t, tree.Put([]byte("key1"), []byte("value1")), "put error")
 
 	// THEN key-value is kept in memory
-	assert.Equal(t, 1, len(storage.memoryTables), "unexpected memory tables")
-	assert.Equal(t, 1, len(storage.walBuffers), "unexpected wal buffers")
+	assert.Equal(t, 1, len(listDir(t, fs, testWALDir)), "unexpected WAL files")
 
 	v, err := tree.Get([]byte("key1"))
 	assert.Nil(t, err, "get error")
 	assert.Equal(t, []byte("value1"), v, "expected value")
 
 	// AND key-value is not stored in tables yet
-	assert.Equal(t, 0, len(storage.tableDataWriters), "unexpected file table writers")
+	assert.Empty(t, listDir(t, fs, testTablesDir), "unexpected tables")
 }
 
 func Test_LSM_Tree_PutAndDumpMemoryToFile(t *testing.T) {
 	//GIVEN a tree
-	storage := &mockStorageProvider{}
-	tree, err := New(
-		storage,
-		Config{
-			MemoryThreshold: 1,
-		},
-	)
+	cfg := Config{
+		MemoryThreshold: 1,
+	}
+	storage, fs := newMemStorageProvider(t, cfg)
+	tree, err := New(storage, cfg)
 	require.Nil(t, err, "couldn't create a new tree")
+	walFiles := listDir(t, fs, testWALDir)
 
 	//WHEN key-value is stored
 	require.Nil(t, tree.Put([]byte("key1"), []byte("value1")), "put error")
 
-	<-time.After(50 * time.Millisecond) // TODO replace with re-tries since we can observe when dumping is finished
-
 	// THEN key-value is not kept in memory anymore
-	assert.Equal(t, 2, len(storage.memoryTables), "unexpected memory tables")
-	assert.Equal(t, 2, len(storage.walBuffers), "unexpected wal buffers")
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+	files := listDir(t, fs, testWALDir)
+	require.Equal(t, 1, len(files), "WAL of dumped memory is not deleted")
+	require.NotEqual(t, walFiles[0], files[0], "WAL of dumped memory is not deleted")
+	_, found := tree.current.Get([]byte("key1"))
+	assert.False(t, found, "key must not be kept in current memory")
 
+	// AND key-value is dumped to table file
+	assert.Equal(t, 1, len(listDir(t, fs, testTablesDir)), "unexpected tables")
 	v, err := tree.Get([]byte("key1"))
 	assert.Nil(t, err, "get error")
-	assert.Nil(t, v, "expected no value")
-
-	// AND key-value is dumped to table file
-	assert.Equal(t, 1, len(storage.tableDataWriters), "unexpected file table writers")
-	assert.NotEqual(t, 0, len(storage.tableDataWriters[0].Bytes()), "file table is empty")
+	assert.Equal(t, []byte("value1"), v, "expected value")
 }
 
 func Test_LSM_Tree_GetFromMainMemoryTable(t *testing.T) {
@@ -70,13 +74,12 @@ func Test_LSM_Tree_GetFromMainMemoryTable(t *testing.T) {
 		cfg: Config{
 			MemoryThreshold: 1000,
 		},
-		flushing: make(map[*MemoryStorage]struct{}),
 		current: &MemoryStorage{
 			memory: currentTable,
 		},
 	}
 	//AND value is present in memory
-	currentTable.Upsert([]byte("key1"), []byte("value1"))
+	currentTable.Upsert([]byte("key1"), kv.EncodeValue(kv.KindSet, 1, []byte("value1")))
 
 	//WHEN key-value is get
 	v, err := tree.Get([]byte("key1"))
@@ -92,17 +95,17 @@ func Test_LSM_Tree_GetFromFlushingMemoryTable(t *testing.T) {
 		cfg: Config{
 			MemoryThreshold: 1000,
 		},
-		flushing: make(map[*MemoryStorage]struct{}),
 		current: &MemoryStorage{
 			memory: memtable.NewMemtable(),
 		},
 	}
 	//AND value is present in older tables that are being dumped atm.
 	flushingTable := memtable.NewMemtable()
-	tree.flushing[&MemoryStorage{
-		memory: flushingTable,
-	}] = struct{}{}
-	flushingTable.Upsert([]byte("key1"), []byte("value1"))
+	tree.flushing = append(tree.flushing, &flushJob{
+		memory: &MemoryStorage{memory: flushingTable},
+		done:   make(chan struct{}),
+	})
+	flushingTable.Upsert([]byte("key1"), kv.EncodeValue(kv.KindSet, 1, []byte("value1")))
 
 	//WHEN key-value is get
 	v, err := tree.Get([]byte("key1"))
@@ -112,23 +115,331 @@ func Test_LSM_Tree_GetFromFlushingMemoryTable(t *testing.T) {
 	assert.Nil(t, err, "get error")
 }
 
+func Test_LSM_Tree_GetNewestValueFromFlushingMemoryTables(t *testing.T) {
+	//GIVEN a tree
+	tree := Tree{
+		cfg: Config{
+			MemoryThreshold: 1000,
+		},
+		current: &MemoryStorage{
+			memory: memtable.NewMemtable(),
+		},
+	}
+	//AND the key is overwritten in many tables that are being dumped atm.
+	const tables = 10
+	for seq := uint64(1); seq <= tables; seq++ {
+		flushingTable := memtable.NewMemtable()
+		flushingTable.Upsert([]byte("key1"), kv.EncodeValue(kv.KindSet, seq, []byte(fmt.Sprintf("value%d", seq))))
+		tree.flushing = append(tree.flushing, &flushJob{
+			memory: &MemoryStorage{memory: flushingTable},
+			done:   make(chan struct{}),
+		})
+	}
+
+	for i := 0; i < 100; i++ {
+		//WHEN key-value is get
+		v, err := tree.Get([]byte("key1"))
+
+		// THEN the newest value is read every time
+		require.Nil(t, err, "get error")
+		require.Equal(t, []byte(fmt.Sprintf("value%d", tables)), v, "older value is read")
+	}
+}
+
+// publishRecorder records the largest sequence number of each flushed table in order of publishing
+type publishRecorder struct {
+	*OSStorageProvider
+	mu        sync.Mutex
+	published []uint64
+}
+
+func (r *publishRecorder) PublishTables(added, removed []tableFile) error {
+	if len(removed) == 0 {
+		r.mu.Lock()
+		for _, table := range added {
+			r.published = append(r.published, table.props.LargestSeq)
+		}
+		r.mu.Unlock()
+	}
+	return r.OSStorageProvider.PublishTables(added, removed)
+}
+
+func Test_LSM_Tree_PublishFlushedTablesInOrder(t *testing.T) {
+	//GIVEN a tree which flushes memory after each put
+	cfg := Config{
+		MemoryThreshold: 1,
+	}
+	storage, _ := newMemStorageProvider(t, cfg)
+	recorder := &publishRecorder{OSStorageProvider: storage}
+	tree, err := New(recorder, cfg)
+	require.Nil(t, err, "couldn't create a new tree")
+
+	//WHEN the key is overwritten many times
+	const puts = 20
+	for i := 1; i <= puts; i++ {
+		require.Nil(t, tree.Put([]byte("key1"), []byte(fmt.Sprintf("value%d", i))), "put error")
+	}
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+
+	//THEN tables are published from the oldest one
+	recorder.mu.Lock()
+	published := recorder.published
+	recorder.mu.Unlock()
+	require.Equal(t, puts, len(published), "unexpected published tables")
+	for i := 1; i < len(published); i++ {
+		assert.Less(t, published[i-1], published[i], "newer table is published before an older one")
+	}
+
+	//AND the newest value is read
+	v, err := tree.Get([]byte("key1"))
+	assert.Nil(t, err, "get error")
+	assert.Equal(t, []byte(fmt.Sprintf("value%d", puts)), v, "expected value")
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_Tree_FlushNowWaitsForRunningFlush(t *testing.T) {
+	//GIVEN a tree with memory being flushed in the background
+	cfg := Config{
+		MemoryThreshold: 1000,
+	}
+	storage, _ := newMemStorageProvider(t, cfg)
+	tree, err := New(storage, cfg)
+	require.Nil(t, err, "couldn't create a new tree")
+	memory, err := storage.NewMemoryStorage()
+	require.Nil(t, err, "memory storage error")
+	job := &flushJob{memory: memory, done: make(chan struct{})}
+	tree.flushingMu.Lock()
+	tree.flushing = append(tree.flushing, job)
+	tree.flushingMu.Unlock()
+
+	//WHEN the memory is flushed right away
+	flushed := make(chan error, 1)
+	go func() {
+		flushed <- tree.flushNow(memory)
+	}()
+
+	//THEN the running flush is waited for
+	select {
+	case <-flushed:
+		assert.Fail(t, "memory must not be flushed again")
+	case <-time.After(50 * time.Millisecond):
+	}
+	flushErr := errors.New("flush error")
+	job.finish(flushErr)
+	assert.Equal(t, flushErr, <-flushed, "error of the running flush expected")
+	require.Nil(t, tree.Close(), "close error")
+}
+
 func Test_LSM_Tree_GetFromTableFiles(t *testing.T) {
 	//GIVEN a tree
-	storage := &mockStorageProvider{}
-	tree, err := New(storage, Config{
+	cfg := Config{
 		MemoryThreshold: 1000,
-	})
+	}
+	storage, _ := newMemStorageProvider(t, cfg)
+	tree, err := New(storage, cfg)
 	require.Nil(t, err, "couldn't create a new tree")
 	//AND value is present in table files
-	writer, err := storage.NewSSTableWriter()
-	require.Nil(t, err, "couldn't create a new table writer")
-	require.Nil(t, writer.Write([]byte("key1"), []byte("value1")), "write error")
-	storage.MoveSSTablesToFiles()
+	table := writeTable(t, storage, 0, set("key1", 1, "value1"))
+	require.Nil(t, storage.PublishTables([]tableFile{table}, nil), "publish error")
 
 	//WHEN key-value is get
 	v, err := tree.Get([]byte("key1"))
 
-	// THEN key-value is read from memory
+	// THEN key-value is read from table
+	assert.Equal(t, []byte("value1"), v, "expected value")
+	assert.Nil(t, err, "get error")
+}
+
+func Test_LSM_Tree_RecoverMemoryFromWAL(t *testing.T) {
+	//GIVEN a tree keeping key-values in memory
+	cfg := Config{
+		MemoryThreshold: 1000,
+	}
+	storage, fs := newMemStorageProvider(t, cfg)
+	tree, err := New(storage, cfg)
+	require.Nil(t, err, "couldn't create a new tree")
+	require.Nil(t, tree.Put([]byte("key1"), []byte("value1")), "put error")
+	require.Nil(t, tree.Put([]byte("key2"), []byte("value2")), "put error")
+
+	//WHEN tree is opened again
+	require.Nil(t, storage.Close(), "close error")
+	cfg.FS, cfg.Dir = fs, testDir
+	storage, err = NewOSStorageProvider(cfg)
+	require.Nil(t, err, "couldn't recover storage provider")
+	tree, err = New(storage, cfg)
+	require.Nil(t, err, "couldn't recover tree")
+
+	//THEN memory is moved from WAL into a table
+	assert.Equal(t, 1, len(listDir(t, fs, testWALDir)), "only WAL of the new memory expected")
+	assert.Equal(t, 1, len(listDir(t, fs, testTablesDir)), "unexpected tables")
+	for _, key := range []string{"key1", "key2"} {
+		v, err := tree.Get([]byte(key))
+		assert.Nil(t, err, "get error")
+		assert.Equal(t, []byte("value"+key[3:]), v, "unexpected value of %s", key)
+	}
+
+	//AND sequence numbers continue from the recovered ones
+	assert.Equal(t, uint64(2), tree.seq.Load(), "unexpected sequence number")
+}
+
+func Test_LSM_Tree_FlushAndClose(t *testing.T) {
+	//GIVEN a tree keeping key-values in memory
+	cfg := Config{
+		MemoryThreshold: 1000,
+	}
+	storage, fs := newMemStorageProvider(t, cfg)
+	tree, err := New(storage, cfg)
+	require.Nil(t, err, "couldn't create a new tree")
+	require.Nil(t, tree.Put([]byte("key1"), []byte("value1")), "put error")
+
+	//WHEN memory is flushed
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+
+	//THEN key-value is moved into a table
+	assert.Equal(t, 1, len(listDir(t, fs, testTablesDir)), "unexpected tables")
+	v, err := tree.Get([]byte("key1"))
+	assert.Nil(t, err, "get error")
 	assert.Equal(t, []byte("value1"), v, "expected value")
+
+	//WHEN tree is closed
+	require.Nil(t, tree.Put([]byte("key2"), []byte("value2")), "put error")
+	require.Nil(t, tree.Close(), "close error")
+
+	//THEN it can't be used anymore
+	assert.Equal(t, ErrClosed, tree.Put([]byte("key3"), []byte("value3")), "put must fail")
+	_, err = tree.Get([]byte("key1"))
+	assert.Equal(t, ErrClosed, err, "get must fail")
+	assert.Equal(t, ErrClosed, tree.Flush(context.Background()), "flush must fail")
+	assert.Equal(t, ErrClosed, tree.Close(), "close must fail")
+
+	//AND memory which hasn't been flushed is recovered once tree is opened again
+	cfg.FS, cfg.Dir = fs, testDir
+	storage, err = NewOSStorageProvider(cfg)
+	require.Nil(t, err, "directory must be unlocked")
+	tree, err = New(storage, cfg)
+	require.Nil(t, err, "couldn't recover tree")
+	v, err = tree.Get([]byte("key2"))
+	assert.Nil(t, err, "get error")
+	assert.Equal(t, []byte("value2"), v, "expected value")
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_Tree_ReportFlushErrors(t *testing.T) {
+	//GIVEN a tree which file system fails
+	fs := vfs.NewFaultFS()
+	cfg := Config{
+		MemoryThreshold: 1000,
+		FS:              fs,
+		Dir:             testDir,
+		FlushRetryDelay: time.Millisecond,
+	}
+	storage, err := NewOSStorageProvider(cfg)
+	require.Nil(t, err, "couldn't create storage provider")
+	tree, err := New(storage, cfg)
+	require.Nil(t, err, "couldn't create a new tree")
+	require.Nil(t, tree.Put([]byte("key1"), []byte("value1")), "put error")
+	fs.FailAt(3) // new WAL is created, table is not
+
+	//WHEN memory is flushed
+	err = tree.Flush(context.Background())
+
+	//THEN flush fails once it's retried
+	assert.True(t, errors.Is(err, vfs.ErrInjected), "flush must fail")
+	//AND key-value is still readable
+	v, err := tree.Get([]byte("key1"))
 	assert.Nil(t, err, "get error")
+	assert.Equal(t, []byte("value1"), v, "expected value")
+	//AND tree is read-only
+	err = tree.Put([]byte("key2"), []byte("value2"))
+	assert.True(t, errors.Is(err, ErrReadOnly), "put must fail")
+	assert.True(t, errors.Is(err, vfs.ErrInjected), "put must fail with the flush error")
+	assert.True(t, errors.Is(tree.Flush(context.Background()), ErrReadOnly), "flush must fail")
+
+	//AND errors of background work are reported on close
+	assert.True(t, errors.Is(tree.Close(), vfs.ErrInjected), "close must fail")
+}
+
+// flakyFS fails to create table directories given number of times
+type flakyFS struct {
+	vfs.FS
+	failures atomic.Int32
+}
+
+func (f *flakyFS) MkdirAll(dir string) error {
+	if strings.HasPrefix(dir, testTablesDir+"/") && f.failures.Add(-1) >= 0 {
+		return vfs.ErrInjected
+	}
+	return f.FS.MkdirAll(dir)
+}
+
+func Test_LSM_Tree_RetryFailedFlush(t *testing.T) {
+	//GIVEN a tree which fails to create tables twice
+	fs := &flakyFS{FS: vfs.NewMemFS()}
+	fs.failures.Store(2)
+	cfg := Config{
+		MemoryThreshold: 1000,
+		FS:              fs,
+		Dir:             testDir,
+		FlushAttempts:   3,
+		FlushRetryDelay: time.Millisecond,
+	}
+	storage, err := NewOSStorageProvider(cfg)
+	require.Nil(t, err, "couldn't create storage provider")
+	tree, err := New(storage, cfg)
+	require.Nil(t, err, "couldn't create a new tree")
+	require.Nil(t, tree.Put([]byte("key1"), []byte("value1")), "put error")
+
+	//WHEN memory is flushed
+	err = tree.Flush(context.Background())
+
+	//THEN flush succeeds once it's retried
+	require.Nil(t, err, "flush error")
+	assert.Equal(t, 1, len(listDir(t, fs, testTablesDir)), "unexpected tables")
+	//AND changes are accepted
+	require.Nil(t, tree.Put([]byte("key2"), []byte("value2")), "put error")
+	require.Nil(t, tree.Close(), "close error")
+}
+
+// viewInterceptor runs given function before tables are taken for readers
+type viewInterceptor struct {
+	*OSStorageProvider
+	beforeView atomic.Pointer[func()]
+}
+
+func (v *viewInterceptor) FilesStorage(family uint32) (*tablesView, error) {
+	if before := v.beforeView.Swap(nil); before != nil {
+		(*before)()
+	}
+	return v.OSStorageProvider.FilesStorage(family)
+}
+
+func Test_LSM_Tree_IteratorDoesntSeeLaterFlushedWrites(t *testing.T) {
+	//GIVEN a tree with a key
+	cfg := Config{MemoryThreshold: 1000}
+	storage, _ := newMemStorageProvider(t, cfg)
+	interceptor := &viewInterceptor{OSStorageProvider: storage}
+	tree, err := New(interceptor, cfg)
+	require.Nil(t, err, "couldn't create a new tree")
+	require.Nil(t, tree.Put([]byte("key1"), []byte("value1")), "put error")
+
+	//WHEN a key is written & flushed while iterator takes tables
+	written := make(chan error, 1)
+	writeAndFlush := func() {
+		go func() {
+			written <- errors.Join(tree.Put([]byte("key2"), []byte("value2")), tree.Flush(context.Background()))
+		}()
+		select {
+		case err := <-written:
+			written <- err
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	interceptor.beforeView.Store(&writeAndFlush)
+	it, err := tree.NewIterator()
+	require.Nil(t, err, "iterator error")
+
+	//THEN the iterator sees data as they were once it was created
+	assert.Equal(t, []string{"key1=value1"}, iterate(t, it), "unexpected pairs")
+	require.Nil(t, <-written, "write error")
+	require.Nil(t, tree.Close(), "close error")
 }
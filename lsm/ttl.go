@@ -0,0 +1,41 @@
+package lsm
+
+import (
+	"challenge-lsm-store/kv"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrInvalidTTL = errors.New("invalid time to live")
+
+// PutWithTTL sets value of the key in the default column family which expires once ttl passes by the clock of the tree
+// (see WithClock). Expired key is not found by reads and compaction drops it. Merge operands combined with
+// the value keep its expiry, once it expires they start from a missing value.
+func (t *Tree) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("%w: %s must be positive", ErrInvalidTTL, ttl)
+	}
+	return t.putExpiring(key, value, t.cfg.now()+int64(ttl))
+}
+
+// putExpiring sets value of the key in the default column family which expires at given unix time (nanoseconds),
+// zero means it never expires
+func (t *Tree) putExpiring(key, value []byte, expiresAt int64) error {
+	if expiresAt == 0 {
+		return t.Put(key, value)
+	}
+	return t.write(func() error {
+		return t.current.Put(key, kv.EncodeExpiringValue(t.seq.Add(1), expiresAt, value))
+	})
+}
+
+// hideExpired turns value expired at given unix time (nanoseconds) into a tombstone,
+// so it hides older values of the key as well
+func hideExpired(encoded []byte, now int64) ([]byte, error) {
+	v, err := kv.DecodeValue(encoded)
+	if err != nil || !v.IsExpired(now) {
+		return encoded, err
+	}
+	return kv.EncodeValue(kv.KindDelete, v.Seq, nil), nil
+}
@@ -0,0 +1,155 @@
+package lsm
+
+import (
+	"challenge-lsm-store/kv"
+	"challenge-lsm-store/vfs"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClock is a clock moved only by tests
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Unix(1700000000, 0)}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func Test_LSM_TTL_HideExpiredValues(t *testing.T) {
+	//GIVEN a tree with expiring and older values
+	fs, clock := vfs.NewMemFS(), newTestClock()
+	opts := []Option{WithFS(fs), WithClock(clock.Now)}
+	tree, err := Open(testDir, opts...)
+	require.Nil(t, err, "open error")
+	require.Nil(t, tree.Put([]byte("key1"), []byte("old")), "put error")
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+	require.Nil(t, tree.PutWithTTL([]byte("key1"), []byte("short"), time.Second), "put error")
+	require.Nil(t, tree.PutWithTTL([]byte("key2"), []byte("long"), time.Hour), "put error")
+	require.Nil(t, tree.Put([]byte("key3"), []byte("forever")), "put error")
+
+	assertPairs := func(tree *Tree, exp []string) {
+		it, err := tree.NewIterator()
+		require.Nil(t, err, "iterator error")
+		assert.Equal(t, exp, iterate(t, it), "unexpected pairs")
+		for _, pair := range exp {
+			v, err := tree.Get([]byte(pair[:4]))
+			assert.Nil(t, err, "get error")
+			assert.Equal(t, pair[5:], string(v), "unexpected value of %s", pair[:4])
+		}
+	}
+
+	//THEN values are found till they expire
+	assertPairs(tree, []string{"key1=short", "key2=long", "key3=forever"})
+
+	//WHEN the tree is opened again once a value expired
+	require.Nil(t, tree.Close(), "close error")
+	clock.Advance(time.Second)
+	tree, err = Open(testDir, opts...)
+	require.Nil(t, err, "reopen error")
+
+	//THEN expired value is not found, older value of the key is hidden as well
+	assertPairs(tree, []string{"key2=long", "key3=forever"})
+	v, err := tree.Get([]byte("key1"))
+	assert.Nil(t, err, "get error")
+	assert.Nil(t, v, "expired key must not be found")
+
+	//AND expired key can be set again
+	inserted, err := tree.PutIfAbsent([]byte("key1"), []byte("new"))
+	assert.Nil(t, err, "put error")
+	assert.True(t, inserted, "expired key must be absent")
+
+	//AND invalid TTL is rejected
+	assert.True(t, errors.Is(tree.PutWithTTL([]byte("key4"), nil, 0), ErrInvalidTTL), "invalid TTL must be rejected")
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_TTL_CompactionDropsExpiredValues(t *testing.T) {
+	//GIVEN a tree with expiring values in many tables
+	clock := newTestClock()
+	tree, err := Open(testDir, WithFS(vfs.NewMemFS()), WithClock(clock.Now), WithMemtableSize(300),
+		WithCompactionStyle(CompactionNone))
+	require.Nil(t, err, "open error")
+	const keys = 100
+	for i := 0; i < keys; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		if i%2 == 0 {
+			require.Nil(t, tree.PutWithTTL(key, key, time.Minute), "put error")
+		} else {
+			require.Nil(t, tree.Put(key, key), "put error")
+		}
+	}
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+
+	//WHEN tables are compacted once values expired
+	clock.Advance(time.Minute)
+	require.Nil(t, tree.Compact(), "compaction error")
+
+	//THEN expired values are dropped
+	view, err := tree.storageProvider.FilesStorage(defaultColumnFamilyID)
+	require.Nil(t, err, "files storage error")
+	var stored int
+	for _, level := range view.levels {
+		for _, f := range level {
+			it, err := f.NewIterator()
+			require.Nil(t, err, "iterator error")
+			for it.Next() {
+				v, err := kv.DecodeValue(it.Value())
+				require.Nil(t, err, "invalid value")
+				assert.Zero(t, v.ExpiresAt, "expired value of %s must be dropped", it.Key())
+				stored++
+			}
+		}
+	}
+	require.Nil(t, view.Release(), "release error")
+	assert.Equal(t, keys/2, stored, "only values which never expire must be kept")
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_TTL_MergeIntoExpiringValue(t *testing.T) {
+	//GIVEN a tree with an expiring counter
+	clock := newTestClock()
+	tree, err := Open(testDir, WithFS(vfs.NewMemFS()), WithClock(clock.Now), WithMergeOperator(UInt64AddOperator))
+	require.Nil(t, err, "open error")
+	require.Nil(t, tree.PutWithTTL([]byte("count"), u64(5), time.Minute), "put error")
+
+	//WHEN it's incremented
+	require.Nil(t, tree.Merge([]byte("count"), u64(1)), "merge error")
+
+	//THEN the counter keeps its expiry
+	v, err := tree.Get([]byte("count"))
+	assert.Nil(t, err, "get error")
+	assert.Equal(t, u64(6), v, "unexpected counter")
+	clock.Advance(time.Minute)
+	v, err = tree.Get([]byte("count"))
+	assert.Nil(t, err, "get error")
+	assert.Nil(t, v, "counter must expire")
+
+	//WHEN expired counter is incremented
+	require.Nil(t, tree.Merge([]byte("count"), u64(1)), "merge error")
+
+	//THEN it starts from zero
+	v, err = tree.Get([]byte("count"))
+	assert.Nil(t, err, "get error")
+	assert.Equal(t, u64(1), v, "unexpected counter")
+	require.Nil(t, tree.Close(), "close error")
+}
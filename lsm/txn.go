@@ -0,0 +1,171 @@
+package lsm
+
+import (
+	"challenge-lsm-store/kv"
+	"challenge-lsm-store/memtable"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// txnSeq marks changes buffered by a transaction, they are newer than any change of the tree
+const txnSeq kv.SeqNum = math.MaxUint64
+
+var (
+	ErrConflict = errors.New("transaction conflicts with a concurrent change")
+	ErrTxnDone  = errors.New("transaction has been already committed or rolled back")
+)
+
+// Txn is an optimistic transaction over the default column family. Changes are buffered till commit,
+// reads see them on top of data of the tree as they were once the transaction began. Commit fails
+// with ErrConflict when any key read by Get has been changed since it was read. Txn is not thread-safe.
+type Txn struct {
+	tree     *Tree
+	snapshot kv.SeqNum            // sequence number of the last change visible once the transaction began
+	writes   *memtable.Memtable   // envelopes of buffered changes
+	reads    map[string]kv.SeqNum // sequence numbers of changes of read keys, 0 for keys which have not been found
+	done     bool
+}
+
+// BeginTxn starts a transaction, see Txn
+func (t *Tree) BeginTxn() *Txn {
+	return &Txn{
+		tree:     t,
+		snapshot: t.seq.Load(),
+		writes:   memtable.NewMemtableWithComparer(t.cfg.comparer()),
+		reads:    make(map[string]kv.SeqNum),
+	}
+}
+
+// Get returns value of the key changed by the transaction or kept in the tree once the transaction began,
+// nil is returned when the key doesn't exist. The tree keeps only the latest change of a key, so ErrConflict
+// is returned when the key has been changed since the transaction began or since it was read before,
+// thus reads are repeatable and the transaction can't commit anyway.
+func (tx *Txn) Get(key []byte) ([]byte, error) {
+	if tx.done {
+		return nil, ErrTxnDone
+	}
+	if value, found := tx.writes.Get(key); found {
+		return payloadOf(value)
+	}
+
+	tx.tree.currentMu.RLock()
+	if tx.tree.closed {
+		tx.tree.currentMu.RUnlock()
+		return nil, ErrClosed
+	}
+	value, seq, err := tx.latest(key)
+	tx.tree.currentMu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	read, ok := tx.reads[string(key)]
+	if seq > tx.snapshot || (ok && read != seq) {
+		return nil, fmt.Errorf("%w: key %q", ErrConflict, key)
+	}
+	tx.reads[string(key)] = seq
+	if value == nil {
+		return nil, nil
+	}
+	return payloadOf(value)
+}
+
+// latest returns the newest envelope of the key and its sequence number, nil and 0 are returned when the key
+// is not found. Current memory must be locked.
+func (tx *Txn) latest(key []byte) ([]byte, kv.SeqNum, error) {
+	value, found, err := tx.tree.latest(defaultColumnFamilyID, key)
+	if err != nil || !found {
+		return nil, 0, err
+	}
+	v, err := kv.DecodeValue(value)
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, v.Seq, nil
+}
+
+func (tx *Txn) Put(key, value []byte) error {
+	if tx.done {
+		return ErrTxnDone
+	}
+	tx.writes.Upsert(key, kv.EncodeValue(kv.KindSet, txnSeq, value))
+	return nil
+}
+
+func (tx *Txn) Delete(key []byte) error {
+	if tx.done {
+		return ErrTxnDone
+	}
+	tx.writes.Upsert(key, kv.EncodeValue(kv.KindDelete, txnSeq, nil))
+	return nil
+}
+
+// NewIterator returns iterator going through keys of the tree changed by the transaction, see Iterator.
+// The iterator sees the latest data of the tree, its keys are not checked on commit, read them by Get
+// when they matter.
+func (tx *Txn) NewIterator() (*Iterator, error) {
+	if tx.done {
+		return nil, ErrTxnDone
+	}
+	it, err := tx.tree.NewIterator()
+	if err != nil {
+		return nil, err
+	}
+	it.merged = newMergingIterator(tx.tree.cfg.comparer(), &memoryIterator{entries: memtableEntries(tx.writes)}, it.merged)
+	return it, nil
+}
+
+// Commit applies changes of the transaction as one atomic batch, see Tree.Write.
+// ErrConflict is returned when a key read by the transaction has been changed meanwhile, nothing is applied then.
+// Transaction without changes commits right away, all its reads have seen the data as they were once it began.
+func (tx *Txn) Commit() error {
+	if tx.done {
+		return ErrTxnDone
+	}
+	tx.done = true
+	if tx.writes.Size() == 0 {
+		return nil
+	}
+
+	b := &Batch{}
+	cf := tx.tree.defaultFamily()
+	for _, e := range memtableEntries(tx.writes) {
+		v, err := kv.DecodeValue(e.GetValue())
+		if err != nil {
+			return err
+		}
+		b.changes = append(b.changes, batchChange{family: cf, kind: v.Kind, key: e.GetKey(), value: v.Payload})
+	}
+	// no change is written between the check and the batch
+	return tx.tree.write(func() error {
+		if err := tx.checkConflicts(); err != nil {
+			return err
+		}
+		return tx.tree.apply(b)
+	})
+}
+
+// Rollback discards changes of the transaction
+func (tx *Txn) Rollback() error {
+	if tx.done {
+		return ErrTxnDone
+	}
+	tx.done = true
+	tx.writes.Clear()
+	return nil
+}
+
+// checkConflicts fails when the latest change of a read key differs from the change seen when it was read,
+// so the key deleted meanwhile is found even if compaction has dropped its tombstone. Current memory must be locked.
+func (tx *Txn) checkConflicts() error {
+	for key, read := range tx.reads {
+		_, seq, err := tx.latest([]byte(key))
+		if err != nil {
+			return err
+		}
+		if seq != read {
+			return fmt.Errorf("%w: key %q", ErrConflict, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package lsm
+
+import (
+	"challenge-lsm-store/vfs"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+func Test_LSM_Txn_ReadOwnChanges(t *testing.T) {
+	//GIVEN a tree with some keys
+	tree, err := Open(testDir, WithFS(vfs.NewMemFS()))
+	require.Nil(t, err, "open error")
+	for _, key := range []string{"a", "b", "c"} {
+		require.Nil(t, tree.Put([]byte(key), []byte(key)), "put error")
+	}
+
+	//WHEN a transaction changes keys
+	txn := tree.BeginTxn()
+	require.Nil(t, txn.Put([]byte("b"), []byte("B")), "put error")
+	require.Nil(t, txn.Put([]byte("d"), []byte("D")), "put error")
+	require.Nil(t, txn.Delete([]byte("c")), "delete error")
+
+	//THEN the transaction sees its changes
+	v, err := txn.Get([]byte("b"))
+	assert.Nil(t, err, "get error")
+	assert.Equal(t, []byte("B"), v, "changed value expected")
+	v, err = txn.Get([]byte("c"))
+	assert.Nil(t, err, "get error")
+	assert.Nil(t, v, "deleted key must not be found")
+	it, err := txn.NewIterator()
+	require.Nil(t, err, "iterator error")
+	assert.Equal(t, []string{"a=a", "b=B", "d=D"}, iterate(t, it), "unexpected pairs of transaction")
+
+	//AND the tree doesn't see them before commit
+	v, err = tree.Get([]byte("b"))
+	assert.Nil(t, err, "get error")
+	assert.Equal(t, []byte("b"), v, "value must not be changed before commit")
+
+	//WHEN the transaction is committed
+	require.Nil(t, txn.Commit(), "commit error")
+
+	//THEN the tree sees all changes
+	it, err = tree.NewIterator()
+	require.Nil(t, err, "iterator error")
+	assert.Equal(t, []string{"a=a", "b=B", "d=D"}, iterate(t, it), "unexpected pairs of tree")
+
+	//AND the transaction can't be used anymore
+	assert.True(t, errors.Is(txn.Commit(), ErrTxnDone), "commit must fail")
+	assert.True(t, errors.Is(txn.Put([]byte("e"), nil), ErrTxnDone), "put must fail")
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_Txn_Conflict(t *testing.T) {
+	//GIVEN a tree with a key kept in a table
+	tree, err := Open(testDir, WithFS(vfs.NewMemFS()))
+	require.Nil(t, err, "open error")
+	require.Nil(t, tree.Put([]byte("count"), []byte("1")), "put error")
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+
+	//AND transactions reading the key and a missing key
+	read := tree.BeginTxn()
+	_, err = read.Get([]byte("count"))
+	require.Nil(t, err, "get error")
+	require.Nil(t, read.Put([]byte("count"), []byte("2")), "put error")
+	readMissing := tree.BeginTxn()
+	_, err = readMissing.Get([]byte("missing"))
+	require.Nil(t, err, "get error")
+	require.Nil(t, readMissing.Put([]byte("other"), []byte("x")), "put error")
+	blind := tree.BeginTxn()
+	require.Nil(t, blind.Put([]byte("blind"), []byte("x")), "put error")
+
+	//WHEN read keys are changed by others and flushed
+	require.Nil(t, tree.Put([]byte("count"), []byte("5")), "put error")
+	require.Nil(t, tree.Put([]byte("missing"), []byte("x")), "put error")
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+
+	//THEN transactions which read them fail
+	assert.True(t, errors.Is(read.Commit(), ErrConflict), "conflict expected")
+	assert.True(t, errors.Is(readMissing.Commit(), ErrConflict), "conflict of missing key expected")
+
+	//AND their changes are not applied
+	v, err := tree.Get([]byte("count"))
+	assert.Nil(t, err, "get error")
+	assert.Equal(t, []byte("5"), v, "value of others expected")
+	v, err = tree.Get([]byte("other"))
+	assert.Nil(t, err, "get error")
+	assert.Nil(t, v, "change of failed transaction must not be applied")
+
+	//AND transaction which hasn't read anything commits
+	assert.Nil(t, blind.Commit(), "commit error")
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_Txn_ConcurrentIncrements(t *testing.T) {
+	//GIVEN a tree with a counter
+	tree, err := Open(testDir, WithFS(vfs.NewMemFS()), WithMemtableSize(1000))
+	require.Nil(t, err, "open error")
+	key := []byte("count")
+
+	//WHEN the counter is incremented by many goroutines retrying on conflicts
+	const goroutines, increments = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < increments; {
+				txn := tree.BeginTxn()
+				v, err := txn.Get(key)
+				if errors.Is(err, ErrConflict) {
+					continue
+				}
+				if !assert.Nil(t, err, "get error") {
+					return
+				}
+				var count uint64
+				if v != nil {
+					count = binary.BigEndian.Uint64(v)
+				}
+				_ = txn.Put(key, binary.BigEndian.AppendUint64(nil, count+1))
+				err = txn.Commit()
+				if errors.Is(err, ErrConflict) {
+					continue
+				}
+				if !assert.Nil(t, err, "commit error") {
+					return
+				}
+				n++
+			}
+		}()
+	}
+	wg.Wait()
+
+	//THEN no increment is lost
+	v, err := tree.Get(key)
+	require.Nil(t, err, "get error")
+	assert.Equal(t, uint64(goroutines*increments), binary.BigEndian.Uint64(v), "unexpected count")
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_Txn_RepeatableReads(t *testing.T) {
+	//GIVEN a tree with keys
+	tree, err := Open(testDir, WithFS(vfs.NewMemFS()))
+	require.Nil(t, err, "open error")
+	require.Nil(t, tree.Put([]byte("a"), []byte("1")), "put error")
+	require.Nil(t, tree.Put([]byte("b"), []byte("1")), "put error")
+
+	//AND a transaction which has read a key
+	txn := tree.BeginTxn()
+	v, err := txn.Get([]byte("a"))
+	require.Nil(t, err, "get error")
+	require.Equal(t, []byte("1"), v, "unexpected value")
+
+	//WHEN keys are changed by others
+	require.Nil(t, tree.Put([]byte("a"), []byte("2")), "put error")
+	require.Nil(t, tree.Delete([]byte("b")), "delete error")
+
+	//THEN the transaction doesn't see the changes
+	_, err = txn.Get([]byte("a"))
+	assert.True(t, errors.Is(err, ErrConflict), fmt.Sprintf("read key changed meanwhile, got: %v", err))
+	_, err = txn.Get([]byte("b"))
+	assert.True(t, errors.Is(err, ErrConflict), fmt.Sprintf("key changed since the transaction began, got: %v", err))
+	//AND keys which haven't been changed are read
+	v, err = txn.Get([]byte("c"))
+	assert.Nil(t, err, "get error")
+	assert.Nil(t, v, "missing key must not be found")
+	require.Nil(t, txn.Rollback(), "rollback error")
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_Txn_ConflictOfKeyDeletedByCompaction(t *testing.T) {
+	//GIVEN a tree with a key kept in a table
+	cfg := Config{MemoryThreshold: 1000, FS: vfs.NewMemFS(), Dir: testDir, L0CompactionTrigger: 2}
+	storage, err := NewOSStorageProvider(cfg)
+	require.Nil(t, err, "couldn't create storage provider")
+	tree, err := New(storage, cfg)
+	require.Nil(t, err, "couldn't create a new tree")
+	require.Nil(t, tree.Put([]byte("count"), []byte("1")), "put error")
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+
+	//AND a transaction which has read the key
+	txn := tree.BeginTxn()
+	_, err = txn.Get([]byte("count"))
+	require.Nil(t, err, "get error")
+	require.Nil(t, txn.Put([]byte("count"), []byte("2")), "put error")
+
+	//WHEN the key is deleted and compaction drops it together with its tombstone
+	require.Nil(t, tree.Delete([]byte("count")), "delete error")
+	require.Nil(t, tree.Flush(context.Background()), "flush error")
+	require.Nil(t, tree.Compact(), "compaction error")
+	require.Empty(t, tableLevels(t, tree), "tombstone must be dropped")
+
+	//THEN the transaction fails
+	assert.True(t, errors.Is(txn.Commit(), ErrConflict), "conflict expected")
+	require.Nil(t, tree.Close(), "close error")
+}
+
+func Test_LSM_Txn_CommitWithoutChanges(t *testing.T) {
+	//GIVEN a tree with a key
+	fs := vfs.NewFaultFS()
+	tree, err := Open(testDir, WithFS(fs))
+	require.Nil(t, err, "open error")
+	require.Nil(t, tree.Put([]byte("a"), []byte("1")), "put error")
+
+	//AND a transaction which only reads
+	txn := tree.BeginTxn()
+	_, err = txn.Get([]byte("a"))
+	require.Nil(t, err, "get error")
+
+	//WHEN it's committed while nothing can be written
+	fs.FailAt(1)
+	err = txn.Commit()
+	fs.FailAt(0)
+
+	//THEN nothing is written
+	assert.Nil(t, err, "commit error")
+	require.Nil(t, tree.Close(), "close error")
+}
@@ -0,0 +1,59 @@
+package lsm
+
+import (
+	"challenge-lsm-store/kv"
+	"cmp"
+	"slices"
+)
+
+const numLevels = 7
+
+// version is a set of tables per level visible for readers at some point of time.
+// Version is never changed, a new one is created whenever tables are added or removed.
+type version struct {
+	levels   [][]tableFile
+	refs     int         // readers using the version
+	obsolete []tableFile // tables removed by the next version, they are deleted once no older version is used
+	comparer kv.Comparer // order of table keys
+}
+
+func newVersion(comparer kv.Comparer) *version {
+	return &version{levels: make([][]tableFile, numLevels), comparer: comparer}
+}
+
+// apply returns a new version with given changes
+func (v *version) apply(added, removed []tableFile) *version {
+	removedNums := make(map[uint64]struct{}, len(removed))
+	for _, table := range removed {
+		removedNums[table.num] = struct{}{}
+	}
+
+	next := newVersion(v.comparer)
+	for level, tables := range v.levels {
+		for _, table := range tables {
+			if _, ok := removedNums[table.num]; !ok {
+				next.levels[level] = append(next.levels[level], table)
+			}
+		}
+	}
+	for _, table := range added {
+		next.levels[table.level] = append(next.levels[table.level], table)
+	}
+	sortLevels(next.levels, v.comparer)
+	return next
+}
+
+// sortLevels keeps L0 tables newest first (their keys may overlap) and tables of deeper levels ordered by keys
+func sortLevels(levels [][]tableFile, comparer kv.Comparer) {
+	slices.SortFunc(levels[0], func(a, b tableFile) int {
+		if c := cmp.Compare(b.props.LargestSeq, a.props.LargestSeq); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.num, a.num)
+	})
+	for _, tables := range levels[1:] {
+		slices.SortFunc(tables, func(a, b tableFile) int {
+			return comparer.Compare(a.props.SmallestKey, b.props.SmallestKey)
+		})
+	}
+}
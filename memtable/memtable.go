@@ -1,7 +1,7 @@
 package memtable
 
 import (
-	"bytes"
+	"challenge-lsm-store/kv"
 	"github.com/google/btree"
 )
 
@@ -25,10 +25,16 @@ type (
 	}
 )
 
+// NewMemtable creates memtable keeping keys in bytewise order
 func NewMemtable() *Memtable {
+	return NewMemtableWithComparer(kv.BytewiseComparer)
+}
+
+// NewMemtableWithComparer creates memtable keeping keys in order of given comparer
+func NewMemtableWithComparer(cmp kv.Comparer) *Memtable {
 	return &Memtable{
 		tree: btree.NewG[Entry](btreeDegree, func(a, b Entry) bool {
-			return bytes.Compare(a.key, b.key) == -1
+			return cmp.Compare(a.key, b.key) == -1
 		}),
 	}
 }
@@ -1,7 +1,9 @@
 package memtable_test
 
 import (
+	"challenge-lsm-store/kv"
 	"challenge-lsm-store/memtable"
+	"encoding/binary"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -125,3 +127,16 @@ func TestMemtable_UpsertAndGet(t *testing.T) {
 		})
 	}
 }
+
+func TestMemtable_KeysInComparerOrder(t *testing.T) {
+	m := memtable.NewMemtableWithComparer(kv.LittleEndianComparer)
+	for _, n := range []uint64{256, 1, 65536, 2} {
+		m.Upsert(binary.LittleEndian.AppendUint64(nil, n), nil)
+	}
+
+	var keys []uint64
+	for e := range m.GetAll() {
+		keys = append(keys, binary.LittleEndian.Uint64(e.GetKey()))
+	}
+	assert.Equal(t, []uint64{1, 2, 256, 65536}, keys, "keys must be ordered by comparer")
+}
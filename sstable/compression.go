@@ -0,0 +1,85 @@
+package sstable
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Compression defines how data blocks are compressed, it's recorded in table properties
+type Compression int
+
+const (
+	NoCompression Compression = iota
+	// FlateCompression compresses blocks using DEFLATE tuned for speed
+	FlateCompression
+)
+
+var ErrUnknownCompression = errors.New("unknown compression")
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case FlateCompression:
+		return "flate"
+	}
+	return fmt.Sprintf("unknown(%d)", int(c))
+}
+
+// Valid tells whether blocks can be compressed & decompressed with given compression
+func (c Compression) Valid() bool {
+	return c == NoCompression || c == FlateCompression
+}
+
+// compressor compresses blocks one by one reusing its buffers
+type compressor struct {
+	compression Compression
+	buff        *bytes.Buffer
+	flate       *flate.Writer
+}
+
+func (c *compressor) compress(block []byte) ([]byte, error) {
+	switch c.compression {
+	case NoCompression:
+		return block, nil
+	case FlateCompression:
+		if c.buff == nil {
+			c.buff = bytes.NewBuffer(nil)
+		}
+		c.buff.Reset()
+		if c.flate == nil {
+			w, err := flate.NewWriter(c.buff, flate.BestSpeed)
+			if err != nil {
+				return nil, err
+			}
+			c.flate = w
+		} else {
+			c.flate.Reset(c.buff)
+		}
+		if _, err := c.flate.Write(block); err != nil {
+			return nil, err
+		}
+		if err := c.flate.Close(); err != nil {
+			return nil, err
+		}
+		return c.buff.Bytes(), nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownCompression, c.compression)
+}
+
+func decompress(compression Compression, block []byte) ([]byte, error) {
+	switch compression {
+	case NoCompression:
+		return block, nil
+	case FlateCompression:
+		r := flate.NewReader(bytes.NewReader(block))
+		defer func() {
+			_ = r.Close() // TODO log error
+		}()
+		return io.ReadAll(r)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownCompression, compression)
+}
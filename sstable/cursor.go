@@ -0,0 +1,30 @@
+package sstable
+
+import (
+	"io"
+)
+
+// cursor reads encoded entries of a block one after another.
+// Returned bytes point directly at the block, so no copying takes place.
+type cursor struct {
+	data []byte
+	pos  int
+}
+
+func newCursor(block []byte) *cursor {
+	return &cursor{data: block}
+}
+
+// next returns following n bytes or io.EOF when there is nothing more to read
+func (c *cursor) next(n int) ([]byte, error) {
+	if c.pos >= len(c.data) {
+		return nil, io.EOF
+	}
+	if c.pos+n > len(c.data) {
+		c.pos = len(c.data)
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := c.data[c.pos : c.pos+n : c.pos+n]
+	c.pos += n
+	return b, nil
+}
@@ -40,49 +40,59 @@ func encode(w io.Writer, key []byte, value []byte) (int, error) {
 	return bytes, nil
 }
 
-func decode(r io.Reader) ([]byte, []byte, error) {
-	var encodedEntryLen [8]byte
-	if _, err := r.Read(encodedEntryLen[:]); err != nil {
-		return nil, nil, err
-	}
-
-	entryLen := decodeInt(encodedEntryLen[:])
-	encodedEntry := make([]byte, entryLen)
-	n, err := r.Read(encodedEntry)
+func decode(c *cursor) ([]byte, []byte, error) {
+	encodedEntryLen, err := c.next(8)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	if n < entryLen {
+	entryLen := decodeInt(encodedEntryLen)
+	encodedEntry, err := c.next(entryLen)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
 		return nil, nil, fmt.Errorf("the file is corrupted, failed to read entry")
 	}
+	if err != nil {
+		return nil, nil, err
+	}
 
 	keyLen := decodeInt(encodedEntry[0:8])
 	key := encodedEntry[8 : 8+keyLen]
 	keyPartLen := 8 + keyLen
 
 	if keyPartLen == len(encodedEntry) {
-		return key, nil, err
+		return key, nil, nil
 	}
 
 	valueStart := keyPartLen
 	value := encodedEntry[valueStart:]
 
-	return key, value, err
+	return key, value, nil
+}
+
+// blockHandle points at a block kept in a file
+type blockHandle struct {
+	offset int
+	length int
 }
 
-func encodeKeyOffset(w io.Writer, key []byte, offset int) (int, error) {
-	return encode(w, key, encodeInt(offset))
+func encodeKeyHandle(w io.Writer, key []byte, handle blockHandle) (int, error) {
+	encoded := make([]byte, 0, 16)
+	encoded = append(encoded, encodeInt(handle.offset)...)
+	encoded = append(encoded, encodeInt(handle.length)...)
+	return encode(w, key, encoded)
 }
 
-func decodeKeyOffset(r io.Reader) ([]byte, int, error) {
-	key, value, err := decode(r)
+func decodeKeyHandle(c *cursor) ([]byte, blockHandle, error) {
+	key, value, err := decode(c)
 	if err != nil {
-		return nil, 0, err
+		return nil, blockHandle{}, err
+	}
+
+	if len(value) != 16 {
+		return nil, blockHandle{}, fmt.Errorf("the file is corrupted, invalid block handle")
 	}
 
-	offset := decodeInt(value)
-	return key, offset, nil
+	return key, blockHandle{offset: decodeInt(value[:8]), length: decodeInt(value[8:])}, nil
 }
 
 func encodeInt(x int) []byte {
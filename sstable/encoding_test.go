@@ -37,8 +37,8 @@ func Test_SSTable_EncodeDecode(t *testing.T) {
 			_, err := encode(w, tt.key, tt.value)
 			require.Nil(t, err, "encode error")
 
-			r := bytes.NewReader(w.Bytes())
-			key, value, err := decode(r)
+			c := newCursor(w.Bytes())
+			key, value, err := decode(c)
 			require.Nil(t, err, "decode error")
 			assert.Equal(t, tt.key, key, "unexpected key")
 			if len(tt.value) == 0 {
@@ -50,29 +50,29 @@ func Test_SSTable_EncodeDecode(t *testing.T) {
 	}
 }
 
-func Test_SSTable_EncodeDecodeOffset(t *testing.T) {
+func Test_SSTable_EncodeDecodeHandle(t *testing.T) {
 	tests := []struct {
 		name   string
 		key    []byte
-		offset int
+		handle blockHandle
 	}{
 		{
 			name:   "non-empty value",
 			key:    []byte("key"),
-			offset: 123,
+			handle: blockHandle{offset: 123, length: 456},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			w := bytes.NewBuffer(nil)
-			_, err := encodeKeyOffset(w, tt.key, tt.offset)
+			_, err := encodeKeyHandle(w, tt.key, tt.handle)
 			require.Nil(t, err, "encode error")
 
-			r := bytes.NewReader(w.Bytes())
-			key, offset, err := decodeKeyOffset(r)
+			c := newCursor(w.Bytes())
+			key, handle, err := decodeKeyHandle(c)
 			require.Nil(t, err, "decode error")
 			assert.Equal(t, tt.key, key, "unexpected key")
-			assert.Equal(t, tt.offset, offset, "unexpected offset")
+			assert.Equal(t, tt.handle, handle, "unexpected handle")
 		})
 	}
 }
@@ -1,82 +1,168 @@
 package sstable
 
 import (
+	"challenge-lsm-store/vfs"
 	"errors"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 )
 
 const (
-	fileWriteFlags = os.O_WRONLY | os.O_CREATE | os.O_APPEND | os.O_TRUNC
-	fileReadFlags  = os.O_RDONLY
-
-	fileWriteReadMode = 0o666
-	fileReadOnlyMode  = 0o444
+	// tmpDirSuffix marks directory of a table being written
+	tmpDirSuffix = ".tmp"
 
 	dataFileName        = "data.db"
 	indexFileName       = "index.db"
 	sparseIndexFileName = "sparse.db"
+	propertiesFileName  = "properties.db"
+	// files of range tombstones & bloom filter, tables written before they were supported don't have them
+	rangeDelFileName = "rangedel.db"
+	filterFileName   = "filter.db"
 )
 
-var ErrFileNotDirectory = errors.New("file is not a directory")
+// ReadMode defines how table files are accessed while reading
+type ReadMode int
 
-func NewFileWriter(dirPath string) (*Writer, error) {
-	dir, err := os.OpenFile(dirPath, fileReadFlags, fileReadOnlyMode)
-	if err != nil {
+const (
+	// ReadModePread reads table files using positional reads (pread)
+	ReadModePread ReadMode = iota
+	// ReadModeMmap maps table files into memory and serves reads without copying, so keys and values of iterators
+	// are valid only till the reader is closed.
+	// Files which can't be mapped, i.e. the ones which are not OS files (*os.File) like files of vfs.MemFS,
+	// are read using pread silently.
+	ReadModeMmap
+)
+
+// NewFileWriter writes table files into a temporary directory. Once the writer is closed, files and the directory
+// are synced and the directory is renamed to given path. Thus table found under the path is always complete.
+func NewFileWriter(fs vfs.FS, dirPath string, opts ...WriterOption) (*Writer, error) {
+	tmpPath := dirPath + tmpDirSuffix
+	if err := fs.MkdirAll(tmpPath); err != nil {
 		return nil, err
 	}
-	stat, err := dir.Stat()
-	if err != nil {
-		return nil, err
+
+	files := make([]io.WriteCloser, 0, 6)
+	for _, name := range []string{dataFileName, indexFileName, sparseIndexFileName, propertiesFileName, rangeDelFileName, filterFileName} {
+		f, err := fs.Create(filepath.Join(tmpPath, name))
+		if err != nil {
+			for _, created := range files {
+				_ = created.Close() // TODO log error
+			}
+			_ = fs.RemoveAll(tmpPath) // TODO log error
+			return nil, err
+		}
+		files = append(files, syncCloser{f})
 	}
-	if !stat.IsDir() {
-		return nil, ErrFileNotDirectory
+
+	w := NewWriter(files[0], files[1], files[2], files[3], append(opts, WithRangeDelWriter(files[4]), WithFilterWriter(files[5]))...)
+	w.commit = func() error {
+		if err := commitDir(fs, tmpPath, dirPath); err != nil {
+			_ = fs.RemoveAll(tmpPath) // TODO log error
+			return err
+		}
+		return nil
+	}
+	w.abort = func() error {
+		return fs.RemoveAll(tmpPath)
 	}
+	return w, nil
+}
 
-	data, index, sparse, err := openDBFiles(dirPath, fileWriteFlags, fileWriteReadMode)
-	if err != nil {
-		return nil, err
+// commitDir makes directory durable under its final path
+func commitDir(fs vfs.FS, tmpPath, dirPath string) error {
+	if err := fs.Sync(tmpPath); err != nil {
+		return err
+	}
+	if err := fs.Rename(tmpPath, dirPath); err != nil {
+		return err
 	}
+	return fs.Sync(filepath.Dir(dirPath))
+}
 
-	return NewWriter(data, index, sparse), nil
+// syncCloser makes file content durable before the file is closed
+type syncCloser struct {
+	vfs.File
 }
 
-func NewFileReader(dirPath string) (*Reader, error) {
-	dir, err := os.OpenFile(dirPath, fileReadFlags, fileReadOnlyMode)
-	if err != nil {
-		return nil, err
+func (f syncCloser) Close() error {
+	if err := f.Sync(); err != nil {
+		_ = f.File.Close() // TODO log error
+		return err
 	}
-	stat, err := dir.Stat()
+	return f.File.Close()
+}
+
+func NewFileReader(fs vfs.FS, dirPath string, mode ReadMode, opts ...ReaderOption) (*Reader, error) {
+	data, index, sparse, props, err := openDBFiles(fs, dirPath)
 	if err != nil {
 		return nil, err
 	}
-	if !stat.IsDir() {
-		return nil, ErrFileNotDirectory
+	rangeDel, err := openOptionalFile(fs, filepath.Join(dirPath, rangeDelFileName))
+	var filter vfs.File
+	if err == nil {
+		filter, err = openOptionalFile(fs, filepath.Join(dirPath, filterFileName))
 	}
-
-	data, index, sparse, err := openDBFiles(dirPath, fileReadFlags, fileReadOnlyMode)
 	if err != nil {
+		for _, f := range []vfs.File{data, index, sparse, props, rangeDel} {
+			if f != nil {
+				_ = f.Close() // TODO log error
+			}
+		}
 		return nil, err
 	}
+	if rangeDel != nil {
+		opts = append(opts, WithRangeDelReader(rangeDel))
+	}
+	if filter != nil {
+		opts = append(opts, WithFilterReader(filter))
+	}
 
-	return NewReader(data, index, sparse), nil
+	if mode == ReadModeMmap {
+		// properties, range tombstones & filter are read only once so there is no point to map them
+		return NewReader(mmapOrFile(data), mmapOrFile(index), mmapOrFile(sparse), props, opts...), nil
+	}
+	return NewReader(data, index, sparse, props, opts...), nil
 }
 
-func openDBFiles(dirPath string, flags int, mode os.FileMode) (data *os.File, index *os.File, sparse *os.File, err error) {
-	data, err = os.OpenFile(filepath.Join(dirPath, dataFileName), flags, mode)
-	if err != nil {
-		return
+// mmapOrFile maps file into memory and falls back to the file itself when mapping is not possible,
+// i.e. file is not kept by the OS
+func mmapOrFile(f vfs.File) ReadAtCloser {
+	osFile, ok := f.(*os.File)
+	if !ok {
+		return f
 	}
-
-	index, err = os.OpenFile(filepath.Join(dirPath, indexFileName), flags, mode)
+	m, err := newMmapReader(osFile)
 	if err != nil {
-		return
+		return f
 	}
+	// mapping stays valid once file is closed
+	_ = f.Close()
+	return m
+}
 
-	sparse, err = os.OpenFile(filepath.Join(dirPath, sparseIndexFileName), flags, mode)
-	if err != nil {
-		return
+func openDBFiles(fs vfs.FS, dirPath string) (data, index, sparse, props vfs.File, err error) {
+	files := make([]vfs.File, 0, 4)
+	for _, name := range []string{dataFileName, indexFileName, sparseIndexFileName, propertiesFileName} {
+		f, err := fs.Open(filepath.Join(dirPath, name))
+		if err != nil {
+			for _, opened := range files {
+				_ = opened.Close()
+			}
+			return nil, nil, nil, nil, err
+		}
+		files = append(files, f)
 	}
 
-	return
+	return files[0], files[1], files[2], files[3], nil
+}
+
+// openOptionalFile opens file which may not exist, nil is returned then
+func openOptionalFile(fsys vfs.FS, path string) (vfs.File, error) {
+	f, err := fsys.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return f, err
 }
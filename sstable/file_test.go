@@ -0,0 +1,102 @@
+package sstable_test
+
+import (
+	"challenge-lsm-store/sstable"
+	"challenge-lsm-store/vfs"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// faultyFS fails chosen operations of the OS file system
+type faultyFS struct {
+	vfs.FS
+	syncErr   error
+	renameErr error
+	synced    []string
+}
+
+func (f *faultyFS) Sync(name string) error {
+	if f.syncErr != nil {
+		return f.syncErr
+	}
+	f.synced = append(f.synced, name)
+	return f.FS.Sync(name)
+}
+
+func (f *faultyFS) Rename(oldName, newName string) error {
+	if f.renameErr != nil {
+		return f.renameErr
+	}
+	return f.FS.Rename(oldName, newName)
+}
+
+func Test_SSTable_FileWriterCommitsTableAtomically(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	tableDir := filepath.Join(dir, "table")
+	fs := &faultyFS{FS: vfs.Default}
+
+	//GIVEN table being written
+	writer, err := sstable.NewFileWriter(fs, tableDir)
+	require.NoError(t, err, "could not create writer")
+	require.NoError(t, writer.Write([]byte("key1"), setValue([]byte("value1"))), "write error")
+
+	//THEN table is not visible under its path till it's complete
+	_, err = os.Stat(tableDir)
+	assert.True(t, os.IsNotExist(err), "incomplete table must not be visible")
+
+	//WHEN writer is closed
+	require.NoError(t, writer.Close(), "could not close writer")
+
+	//THEN table directory and its parent are synced
+	assert.Equal(t, []string{tableDir + ".tmp", dir}, fs.synced, "unexpected synced directories")
+	//AND the table can be read
+	reader, err := sstable.NewFileReader(fs, tableDir, sstable.ReadModePread)
+	require.NoError(t, err, "could not open table")
+	v, ok, err := reader.Find([]byte("key1"))
+	require.NoError(t, err, "find error")
+	require.True(t, ok, "key not found")
+	assert.Equal(t, []byte("value1"), payload(t, v), "unexpected value")
+	require.NoError(t, reader.Close(), "could not close reader")
+}
+
+func Test_SSTable_FileWriterDropsTableWhichIsNotDurable(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		fs   *faultyFS
+	}{
+		{
+			name: "sync failure",
+			fs:   &faultyFS{FS: vfs.Default, syncErr: errors.New("sync error")},
+		},
+		{
+			name: "rename failure",
+			fs:   &faultyFS{FS: vfs.Default, renameErr: errors.New("rename error")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			//GIVEN table being written
+			writer, err := sstable.NewFileWriter(tt.fs, filepath.Join(dir, "table"))
+			require.NoError(t, err, "could not create writer")
+			require.NoError(t, writer.Write([]byte("key1"), setValue([]byte("value1"))), "write error")
+
+			//WHEN table can't be made durable
+			assert.Error(t, writer.Close(), "close error expected")
+
+			//THEN no table files are left
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err, "read dir error")
+			assert.Empty(t, entries, "no table files expected")
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package sstable
+
+import (
+	"bytes"
+	"challenge-lsm-store/cache"
+	"challenge-lsm-store/kv"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+)
+
+// bitsPerPrefix gives ~1% false positive rate of bloom filter
+const bitsPerPrefix = 10
+
+// WithPrefixExtractor builds bloom filter of key prefixes extracted by given extractor, so lookups of prefixes
+// can skip the table (see Reader.MayContainPrefix). Name of the extractor is recorded in table properties.
+func WithPrefixExtractor(p kv.PrefixExtractor) WriterOption {
+	return func(w *Writer) {
+		w.prefixExtractor = p
+	}
+}
+
+// WithFilterWriter keeps bloom filter of the table in given writer (filter block)
+func WithFilterWriter(filterWriter io.WriteCloser) WriterOption {
+	return func(w *Writer) {
+		w.filterWriter = filterWriter
+	}
+}
+
+// WithReaderPrefixExtractor checks bloom filter of tables written using extractor of the same name
+func WithReaderPrefixExtractor(p kv.PrefixExtractor) ReaderOption {
+	return func(r *Reader) {
+		r.prefixExtractor = p
+	}
+}
+
+// WithFilterReader reads bloom filter of the table from given reader,
+// table written without filter block may contain any prefix
+func WithFilterReader(filterReader ReadAtCloser) ReaderOption {
+	return func(r *Reader) {
+		r.filterReader = filterReader
+	}
+}
+
+// addPrefix records prefix of written key, keys of the same prefix usually go one by one
+func (w *Writer) addPrefix(key []byte) {
+	if w.prefixExtractor == nil {
+		return
+	}
+	prefix, ok := w.prefixExtractor.Prefix(key)
+	if !ok || (len(w.prefixHashes) > 0 && bytes.Equal(prefix, w.lastPrefix)) {
+		return
+	}
+	w.lastPrefix = append(w.lastPrefix[:0], prefix...)
+	w.prefixHashes = append(w.prefixHashes, bloomHash(prefix))
+}
+
+// finishFilter writes bloom filter of key prefixes
+func (w *Writer) finishFilter() error {
+	if w.prefixExtractor == nil || w.filterWriter == nil {
+		return nil
+	}
+	filter := newBloomFilter(w.prefixHashes, bitsPerPrefix)
+	if _, err := w.filterWriter.Write(filter); err != nil {
+		return fmt.Errorf("filter write error: %w", err)
+	}
+	w.props.PrefixExtractor = w.prefixExtractor.Name()
+	w.props.FilterSize = len(filter)
+	return nil
+}
+
+// MayContainPrefix tells whether the table may contain keys starting with the prefix. False positives are possible,
+// false negatives are not. Prefix which is not extracted from itself (see kv.PrefixExtractor) may always be contained.
+func (r *Reader) MayContainPrefix(prefix []byte) (bool, error) {
+	props, err := r.Properties()
+	if err != nil {
+		return false, err
+	}
+	if r.prefixExtractor == nil || r.filterReader == nil || props.PrefixExtractor != r.prefixExtractor.Name() {
+		return true, nil
+	}
+	if extracted, ok := r.prefixExtractor.Prefix(prefix); !ok || !bytes.Equal(extracted, prefix) {
+		return true, nil
+	}
+	r.filterOnce.Do(func() {
+		load := func() ([]byte, error) {
+			return io.ReadAll(io.NewSectionReader(r.filterReader, 0, math.MaxInt64))
+		}
+		if r.cache == nil {
+			r.filter, r.filterErr = load()
+		} else {
+			r.filter, r.filterErr = r.pinBlock(cache.Key{FileNum: r.fileNum, Kind: filterBlockKind}, load)
+		}
+		if r.filterErr != nil {
+			r.filterErr = fmt.Errorf("filter error: %w", r.filterErr)
+		}
+	})
+	if r.filterErr != nil {
+		return false, r.filterErr
+	}
+	return bloomFilter(r.filter).mayContain(bloomHash(prefix)), nil
+}
+
+// bloomFilter keeps bits set by hashes of its keys, the last byte is number of hashes per key
+type bloomFilter []byte
+
+func newBloomFilter(hashes []uint32, bitsPerKey int) bloomFilter {
+	// ln(2) * bits per key minimizes false positive rate
+	k := max(1, min(30, int(float64(bitsPerKey)*0.69)))
+	bits := max(64, len(hashes)*bitsPerKey)
+	filter := make(bloomFilter, (bits+7)/8+1)
+	bits = (len(filter) - 1) * 8
+	for _, h := range hashes {
+		// double hashing derives k hashes from a single one
+		delta := h>>17 | h<<15
+		for i := 0; i < k; i++ {
+			pos := h % uint32(bits)
+			filter[pos/8] |= 1 << (pos % 8)
+			h += delta
+		}
+	}
+	filter[len(filter)-1] = byte(k)
+	return filter
+}
+
+func (f bloomFilter) mayContain(h uint32) bool {
+	if len(f) < 2 {
+		// filter is missing
+		return true
+	}
+	bits, k := uint32(len(f)-1)*8, int(f[len(f)-1])
+	delta := h>>17 | h<<15
+	for i := 0; i < k; i++ {
+		pos := h % bits
+		if f[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+func bloomHash(b []byte) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write(b)
+	return h.Sum32()
+}
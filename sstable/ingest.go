@@ -0,0 +1,148 @@
+package sstable
+
+import (
+	"bytes"
+	"challenge-lsm-store/kv"
+	"challenge-lsm-store/vfs"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+)
+
+// Builder builds a table of sorted input outside of a store, the table is ingested by the store later on.
+// Entries are written without sequence numbers, a global one is assigned to all of them once the table is ingested.
+type Builder struct {
+	writer *Writer
+}
+
+// NewBuilder builds table in given directory, see NewFileWriter. Comparer & prefix extractor of the table
+// should be the ones of the store which ingests it.
+func NewBuilder(fs vfs.FS, dirPath string, opts ...WriterOption) (*Builder, error) {
+	w, err := NewFileWriter(fs, dirPath, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Builder{writer: w}, nil
+}
+
+// Set adds value of the key. Keys must be added in ascending order.
+func (b *Builder) Set(key, value []byte) error {
+	return b.writer.Write(key, kv.EncodeValue(kv.KindSet, 0, value))
+}
+
+// SetExpiring adds value of the key which expires at given time (unix nanoseconds), zero means it never expires.
+// Keys must be added in ascending order.
+func (b *Builder) SetExpiring(key, value []byte, expiresAt int64) error {
+	return b.writer.Write(key, kv.EncodeExpiringValue(0, expiresAt, value))
+}
+
+// Delete adds tombstone of the key, so the key is deleted from the store once the table is ingested.
+// Keys must be added in ascending order.
+func (b *Builder) Delete(key []byte) error {
+	return b.writer.Write(key, kv.EncodeValue(kv.KindDelete, 0, nil))
+}
+
+// EstimatedSize returns approximate size of the table built so far
+func (b *Builder) EstimatedSize() int {
+	return b.writer.EstimatedSize()
+}
+
+// Properties returns properties of the table. They are complete once builder is closed.
+func (b *Builder) Properties() Properties {
+	return b.writer.Properties()
+}
+
+// Close completes the table, it's found under its path only once it's complete
+func (b *Builder) Close() error {
+	return b.writer.Close()
+}
+
+// Abort drops the table
+func (b *Builder) Abort() error {
+	return b.writer.Abort()
+}
+
+// IngestTable moves complete table from srcPath to dirPath and assigns global sequence number to all its entries.
+// Properties of the table are rewritten in a temporary directory, so table found under dirPath is always complete.
+// The table is moved back with its original properties when it couldn't be ingested.
+func IngestTable(fs vfs.FS, srcPath, dirPath string, globalSeq kv.SeqNum) (Properties, error) {
+	tmpPath := dirPath + tmpDirSuffix
+	if err := fs.Rename(srcPath, tmpPath); err != nil {
+		return Properties{}, err
+	}
+	props, err := readProperties(fs, tmpPath)
+	if err != nil {
+		_ = fs.Rename(tmpPath, srcPath) // TODO log error
+		return Properties{}, err
+	}
+
+	ingested := props
+	ingested.GlobalSeq = globalSeq
+	if ingested.Entries+ingested.RangeTombstones > 0 {
+		ingested.SmallestSeq, ingested.LargestSeq = globalSeq, globalSeq
+	}
+	// properties are replaced at once, so they are untouched when they can't be written
+	if err := writeProperties(fs, tmpPath, ingested); err != nil {
+		_ = fs.Rename(tmpPath, srcPath) // TODO log error
+		return Properties{}, err
+	}
+	if err := commitDir(fs, tmpPath, dirPath); err != nil {
+		// directory is under its final path already when only sync of its parent failed
+		if restoreErr := RestoreTable(fs, tmpPath, srcPath, props); restoreErr != nil {
+			_ = RestoreTable(fs, dirPath, srcPath, props) // TODO log error
+		}
+		return Properties{}, err
+	}
+	return ingested, nil
+}
+
+// RestoreTable moves table ingested into dirPath back to srcPath, given properties (the ones it had
+// before it was ingested) replace properties recorded by IngestTable
+func RestoreTable(fs vfs.FS, dirPath, srcPath string, props Properties) error {
+	if err := writeProperties(fs, dirPath, props); err != nil {
+		return err
+	}
+	return fs.Rename(dirPath, srcPath)
+}
+
+func readProperties(fs vfs.FS, dirPath string) (Properties, error) {
+	f, err := fs.Open(filepath.Join(dirPath, propertiesFileName))
+	if err != nil {
+		return Properties{}, err
+	}
+	block, err := io.ReadAll(io.NewSectionReader(f, 0, math.MaxInt64))
+	_ = f.Close() // TODO log error
+	if err != nil {
+		return Properties{}, fmt.Errorf("properties error: %w", err)
+	}
+	var props Properties
+	if err := props.decode(block); err != nil {
+		return Properties{}, fmt.Errorf("properties error: %w", err)
+	}
+	return props, nil
+}
+
+// writeProperties replaces properties file of the table at once
+func writeProperties(fs vfs.FS, dirPath string, props Properties) error {
+	path := filepath.Join(dirPath, propertiesFileName)
+	buf := bytes.NewBuffer(nil)
+	if err := props.encode(buf); err != nil {
+		return fmt.Errorf("properties error: %w", err)
+	}
+	tmp, err := fs.Create(path + tmpDirSuffix)
+	if err != nil {
+		return err
+	}
+	w := syncCloser{tmp}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		_ = w.Close()                      // TODO log error
+		_ = fs.Remove(path + tmpDirSuffix) // TODO log error
+		return err
+	}
+	if err := w.Close(); err != nil {
+		_ = fs.Remove(path + tmpDirSuffix) // TODO log error
+		return err
+	}
+	return fs.Rename(path+tmpDirSuffix, path)
+}
@@ -0,0 +1,169 @@
+package sstable_test
+
+import (
+	"challenge-lsm-store/kv"
+	"challenge-lsm-store/sstable"
+	"challenge-lsm-store/vfs"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// buildTable builds table of given keys with values equal to the keys
+func buildTable(t *testing.T, fs vfs.FS, dir string, keys ...string) {
+	builder, err := sstable.NewBuilder(fs, dir)
+	require.NoError(t, err, "could not create builder")
+	for _, key := range keys {
+		require.NoError(t, builder.Set([]byte(key), []byte(key)), "set error")
+	}
+	require.NoError(t, builder.Close(), "could not close builder")
+}
+
+func Test_SSTable_IngestTable(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	srcDir, tableDir := filepath.Join(dir, "external"), filepath.Join(dir, "table")
+
+	//GIVEN table built outside of a store
+	buildTable(t, vfs.Default, srcDir, "key1", "key2", "key3")
+
+	//WHEN the table is ingested
+	props, err := sstable.IngestTable(vfs.Default, srcDir, tableDir, 42)
+	require.NoError(t, err, "ingest error")
+
+	//THEN the table is moved
+	_, err = os.Stat(srcDir)
+	assert.True(t, os.IsNotExist(err), "ingested table must be moved")
+	//AND the global sequence number is recorded
+	assert.Equal(t, uint64(42), props.GlobalSeq, "unexpected global sequence number")
+	assert.Equal(t, uint64(42), props.SmallestSeq, "unexpected smallest sequence number")
+	assert.Equal(t, uint64(42), props.LargestSeq, "unexpected largest sequence number")
+	assert.Equal(t, 3, props.Entries, "unexpected number of entries")
+
+	//AND entries are read with the global sequence number
+	reader, err := sstable.NewFileReader(vfs.Default, tableDir, sstable.ReadModePread)
+	require.NoError(t, err, "could not open table")
+	read, err := reader.Properties()
+	require.NoError(t, err, "properties error")
+	assert.Equal(t, props, read, "unexpected properties")
+	encoded, ok, err := reader.Find([]byte("key2"))
+	require.NoError(t, err, "find error")
+	require.True(t, ok, "key not found")
+	v, err := kv.DecodeValue(encoded)
+	require.NoError(t, err, "decode error")
+	assert.Equal(t, kv.Value{Kind: kv.KindSet, Seq: 42, Payload: []byte("key2")}, v, "unexpected found value")
+
+	it := reader.NewIterator()
+	for it.Next() {
+		v, err := kv.DecodeValue(it.Value())
+		require.NoError(t, err, "decode error")
+		assert.Equal(t, uint64(42), v.Seq, "unexpected sequence number of %s", it.Key())
+	}
+	require.NoError(t, it.Err(), "iterator error")
+	require.NoError(t, reader.Close(), "could not close reader")
+}
+
+func Test_SSTable_IngestTableMovesTableBackOnFailure(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	srcDir, tableDir := filepath.Join(dir, "external"), filepath.Join(dir, "table")
+
+	//GIVEN table built outside of a store
+	buildTable(t, vfs.Default, srcDir, "key1")
+
+	//WHEN the table can't be made durable under its new path
+	_, err := sstable.IngestTable(&faultyFS{FS: vfs.Default, syncErr: errors.New("sync error")}, srcDir, tableDir, 42)
+	assert.Error(t, err, "ingest error expected")
+
+	//THEN the table is kept under its path
+	_, err = os.Stat(tableDir)
+	assert.True(t, os.IsNotExist(err), "table must not be ingested")
+	reader, err := sstable.NewFileReader(vfs.Default, srcDir, sstable.ReadModePread)
+	require.NoError(t, err, "could not open table")
+	encoded, ok, err := reader.Find([]byte("key1"))
+	assert.NoError(t, err, "find error")
+	assert.True(t, ok, "key not found")
+	//AND it keeps its properties & sequence numbers
+	props, err := reader.Properties()
+	assert.NoError(t, err, "properties error")
+	assert.Zero(t, props.GlobalSeq, "global sequence number must not be kept")
+	assert.Zero(t, props.LargestSeq, "unexpected largest sequence number")
+	v, err := kv.DecodeValue(encoded)
+	assert.NoError(t, err, "decode error")
+	assert.Zero(t, v.Seq, "unexpected sequence number")
+	require.NoError(t, reader.Close(), "could not close reader")
+}
+
+func Test_SSTable_BuilderRejectsUnsortedKeys(t *testing.T) {
+	t.Parallel()
+
+	builder, err := sstable.NewBuilder(vfs.NewMemFS(), "table")
+	require.NoError(t, err, "could not create builder")
+	require.NoError(t, builder.Set([]byte("key2"), []byte("v")), "set error")
+
+	assert.Equal(t, sstable.ErrKeysNotSorted, builder.Delete([]byte("key1")), "unexpected error")
+	require.NoError(t, builder.Abort(), "abort error")
+}
+
+func Test_SSTable_RestoreTable(t *testing.T) {
+	t.Parallel()
+
+	fs := vfs.NewMemFS()
+
+	//GIVEN ingested table
+	buildTable(t, fs, "external", "key1")
+	reader, err := sstable.NewFileReader(fs, "external", sstable.ReadModePread)
+	require.NoError(t, err, "could not open table")
+	original, err := reader.Properties()
+	require.NoError(t, err, "properties error")
+	require.NoError(t, reader.Close(), "could not close reader")
+	_, err = sstable.IngestTable(fs, "external", "table", 42)
+	require.NoError(t, err, "ingest error")
+
+	//WHEN the table is restored
+	require.NoError(t, sstable.RestoreTable(fs, "table", "external", original), "restore error")
+
+	//THEN it's moved back with its original properties
+	reader, err = sstable.NewFileReader(fs, "external", sstable.ReadModePread)
+	require.NoError(t, err, "could not open restored table")
+	props, err := reader.Properties()
+	assert.NoError(t, err, "properties error")
+	assert.Equal(t, original, props, "unexpected properties")
+	require.NoError(t, reader.Close(), "could not close reader")
+}
+
+func Test_SSTable_BuilderKeepsExpiry(t *testing.T) {
+	t.Parallel()
+
+	fs := vfs.NewMemFS()
+
+	//GIVEN table with expiring & plain values
+	builder, err := sstable.NewBuilder(fs, "table")
+	require.NoError(t, err, "could not create builder")
+	require.NoError(t, builder.SetExpiring([]byte("key1"), []byte("v1"), 42), "set error")
+	require.NoError(t, builder.SetExpiring([]byte("key2"), []byte("v2"), 0), "set error")
+	assert.True(t, builder.EstimatedSize() > 0, "size of written entries expected")
+	require.NoError(t, builder.Close(), "could not close builder")
+
+	//WHEN values are read
+	reader, err := sstable.NewFileReader(fs, "table", sstable.ReadModePread)
+	require.NoError(t, err, "could not open table")
+	values := make(map[string]kv.Value)
+	it := reader.NewIterator()
+	for it.Next() {
+		v, err := kv.DecodeValue(it.Value())
+		require.NoError(t, err, "decode error")
+		values[string(it.Key())] = v
+	}
+	require.NoError(t, it.Err(), "iterator error")
+	require.NoError(t, reader.Close(), "could not close reader")
+
+	//THEN expiry is kept
+	assert.Equal(t, kv.Value{Kind: kv.KindSet, ExpiresAt: 42, Payload: []byte("v1")}, values["key1"], "unexpected expiring value")
+	assert.Equal(t, kv.Value{Kind: kv.KindSet, Payload: []byte("v2")}, values["key2"], "unexpected plain value")
+}
@@ -0,0 +1,180 @@
+package sstable
+
+import (
+	"challenge-lsm-store/kv"
+	"fmt"
+	"io"
+)
+
+// Iterator goes through all entries of a table in ascending key order.
+// Returned key & value point at table blocks so they must not be modified.
+// They stay valid as long as the reader is open.
+type Iterator struct {
+	reader *Reader
+
+	sparseIndex *cursor
+	index       *cursor
+	data        *cursor
+
+	key     []byte
+	value   []byte
+	pending bool // current entry is returned by the next call of Next, see Seek
+	err     error
+}
+
+func (r *Reader) NewIterator() *Iterator {
+	return &Iterator{reader: r}
+}
+
+// Next moves iterator to the following entry. It returns false when there are no more entries or error occurred.
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.pending {
+		it.pending = false
+		return true
+	}
+
+	for {
+		if it.data != nil {
+			key, value, err := decode(it.data)
+			if err == nil {
+				return it.setEntry(key, value)
+			}
+			if err != io.EOF {
+				return it.fail(fmt.Errorf("data error: %w", err))
+			}
+			it.data = nil
+		}
+
+		if it.index != nil {
+			_, handle, err := decodeKeyHandle(it.index)
+			if err == nil {
+				block, err := it.reader.readBlock(it.reader.dataReader, dataBlockKind, handle)
+				if err != nil {
+					return it.fail(fmt.Errorf("data error: %w", err))
+				}
+				it.data = newCursor(block)
+				continue
+			}
+			if err != io.EOF {
+				return it.fail(fmt.Errorf("index error: %w", err))
+			}
+			it.index = nil
+		}
+
+		if it.sparseIndex == nil {
+			block, err := it.reader.loadSparseIndex()
+			if err != nil {
+				return it.fail(fmt.Errorf("sparse index error: %w", err))
+			}
+			it.sparseIndex = newCursor(block)
+		}
+		_, handle, err := decodeKeyHandle(it.sparseIndex)
+		if err == io.EOF {
+			it.key, it.value = nil, nil
+			return false
+		}
+		if err != nil {
+			return it.fail(fmt.Errorf("sparse index error: %w", err))
+		}
+		block, err := it.reader.readBlock(it.reader.indexReader, indexBlockKind, handle)
+		if err != nil {
+			return it.fail(fmt.Errorf("index error: %w", err))
+		}
+		it.index = newCursor(block)
+	}
+}
+
+// Seek moves iterator before the first entry whose key is not smaller than given one, so it's returned
+// by the next call of Next. Blocks which keep only smaller keys are not read.
+func (it *Iterator) Seek(key []byte) {
+	if it.err != nil {
+		return
+	}
+	it.sparseIndex, it.index, it.data, it.pending = nil, nil, nil, false
+	sparseIndex, err := it.reader.loadSparseIndex()
+	if err != nil {
+		it.fail(fmt.Errorf("sparse index error: %w", err))
+		return
+	}
+	it.sparseIndex = newCursor(sparseIndex)
+	if it.index, err = it.seekBlock(it.sparseIndex, it.reader.indexReader, indexBlockKind, key); err != nil {
+		it.fail(fmt.Errorf("index error: %w", err))
+		return
+	}
+	if it.index == nil {
+		// all keys are smaller
+		return
+	}
+	if it.data, err = it.seekBlock(it.index, it.reader.dataReader, dataBlockKind, key); err != nil {
+		it.fail(fmt.Errorf("data error: %w", err))
+		return
+	}
+	for it.Next() {
+		if it.reader.comparer.Compare(it.key, key) >= 0 {
+			it.pending = true
+			return
+		}
+	}
+}
+
+// seekBlock reads the first block indexed by given index whose index key is not smaller than given key.
+// Nil is returned when all keys are smaller.
+func (it *Iterator) seekBlock(index *cursor, reader ReadAtCloser, kind uint8, key []byte) (*cursor, error) {
+	for {
+		indexKey, handle, err := decodeKeyHandle(index)
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if it.reader.comparer.Compare(indexKey, key) < 0 {
+			continue
+		}
+		block, err := it.reader.readBlock(reader, kind, handle)
+		if err != nil {
+			return nil, err
+		}
+		return newCursor(block), nil
+	}
+}
+
+// setEntry makes decoded entry the current one, entries of ingested table get its global sequence number
+func (it *Iterator) setEntry(key, value []byte) bool {
+	props, err := it.reader.Properties()
+	if err != nil {
+		return it.fail(err)
+	}
+	if props.GlobalSeq != 0 {
+		if value, err = kv.WithSeq(value, props.GlobalSeq); err != nil {
+			return it.fail(fmt.Errorf("data error: %w", err))
+		}
+	}
+	it.key, it.value = key, value
+	return true
+}
+
+// Key returns key of the current entry. It must not be modified. With ReadModeMmap it may point into mapped file,
+// so it must be copied to be used once the reader is closed (unlike values returned by Reader.Find).
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+// Value returns value of the current entry, it's valid as long as Key is
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Err returns error which stopped the iteration
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+func (it *Iterator) fail(err error) bool {
+	it.err = err
+	it.key, it.value = nil, nil
+	return false
+}
@@ -0,0 +1,57 @@
+package sstable
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+var ErrMmapNotSupported = errors.New("memory mapping is not supported")
+
+// mmapReader serves content of memory mapped file.
+// Bytes read by cursors point directly at the mapping so no copying takes place.
+type mmapReader struct {
+	data []byte
+}
+
+// newMmapReader maps whole file into memory. File can be closed once mapping is done.
+func newMmapReader(f *os.File) (*mmapReader, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() == 0 {
+		// empty files can't be mapped
+		return nil, ErrMmapNotSupported
+	}
+
+	data, err := mmap(f, int(stat.Size()))
+	if err != nil {
+		return nil, err
+	}
+	return &mmapReader{data: data}, nil
+}
+
+func (m *mmapReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *mmapReader) Bytes() []byte {
+	return m.data
+}
+
+func (m *mmapReader) Close() error {
+	if m.data == nil {
+		return nil
+	}
+	data := m.data
+	m.data = nil
+	return munmap(data)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package sstable
+
+import (
+	"os"
+)
+
+func mmap(_ *os.File, _ int) ([]byte, error) {
+	return nil, ErrMmapNotSupported
+}
+
+func munmap(_ []byte) error {
+	return ErrMmapNotSupported
+}
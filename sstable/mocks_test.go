@@ -2,15 +2,29 @@ package sstable_test
 
 import (
 	"bytes"
+	"challenge-lsm-store/kv"
+	"challenge-lsm-store/sstable"
+	"github.com/stretchr/testify/require"
+	"testing"
 )
 
+// tableBuffers keep all files of a single table in memory
+type tableBuffers struct {
+	data        *closeableWriter
+	index       *closeableWriter
+	sparseIndex *closeableWriter
+	properties  *closeableWriter
+}
+
 type closeableWriter struct {
 	buff     *bytes.Buffer
 	writeErr error
 }
 
 type closeableReader struct {
-	reader *bytes.Reader
+	reader   *bytes.Reader
+	closeErr error
+	closed   bool
 }
 
 func (b *closeableWriter) Write(p []byte) (n int, err error) {
@@ -32,14 +46,56 @@ func (b *closeableWriter) Reader() *closeableReader {
 	return &closeableReader{reader: bytes.NewReader(b.Bytes())}
 }
 
-func (b *closeableReader) Read(p []byte) (n int, err error) {
-	return b.reader.Read(p)
+func (b *closeableReader) ReadAt(p []byte, off int64) (n int, err error) {
+	return b.reader.ReadAt(p, off)
 }
 
-func (b *closeableReader) Seek(offset int64, whence int) (int64, error) {
-	return b.reader.Seek(offset, whence)
+func (b *closeableReader) Close() error {
+	b.closed = true
+	return b.closeErr
 }
 
-func (b *closeableReader) Close() error {
-	return nil
+// mappedReader imitates memory mapped file which serves its content without copying
+type mappedReader struct {
+	closeableReader
+	data []byte
+}
+
+func (b *closeableWriter) MappedReader() *mappedReader {
+	return &mappedReader{
+		closeableReader: closeableReader{reader: bytes.NewReader(b.Bytes())},
+		data:            b.Bytes(),
+	}
+}
+
+func (b *mappedReader) Bytes() []byte {
+	return b.data
+}
+
+func newTableBuffers() *tableBuffers {
+	return &tableBuffers{
+		data:        &closeableWriter{buff: bytes.NewBuffer(nil)},
+		index:       &closeableWriter{buff: bytes.NewBuffer(nil)},
+		sparseIndex: &closeableWriter{buff: bytes.NewBuffer(nil)},
+		properties:  &closeableWriter{buff: bytes.NewBuffer(nil)},
+	}
+}
+
+func (b *tableBuffers) Writer(opts ...sstable.WriterOption) *sstable.Writer {
+	return sstable.NewWriter(b.data, b.index, b.sparseIndex, b.properties, opts...)
+}
+
+func (b *tableBuffers) Reader(opts ...sstable.ReaderOption) *sstable.Reader {
+	return sstable.NewReader(b.data.Reader(), b.index.Reader(), b.sparseIndex.Reader(), b.properties.Reader(), opts...)
+}
+
+func setValue(payload []byte) []byte {
+	return kv.EncodeValue(kv.KindSet, 1, payload)
+}
+
+// payload unwraps found value from its envelope
+func payload(t *testing.T, value []byte) []byte {
+	v, err := kv.DecodeValue(value)
+	require.NoError(t, err, "invalid value envelope")
+	return v.Payload
 }
@@ -0,0 +1,157 @@
+package sstable
+
+import (
+	"bytes"
+	"challenge-lsm-store/kv"
+	"io"
+)
+
+// names of properties kept in properties file
+const (
+	propEntries      = "entries"
+	propTombstones   = "tombstones"
+	propRawKeySize   = "raw.key.size"
+	propRawValueSize = "raw.value.size"
+	propDataSize     = "data.size"
+	propIndexSize    = "index.size"
+	propSmallestKey  = "smallest.key"
+	propLargestKey   = "largest.key"
+	propSmallestSeq  = "smallest.seq"
+	propLargestSeq   = "largest.seq"
+	propCreatedAt    = "created.at"
+	propCompression  = "compression"
+	propComparer     = "comparer"
+	propRangeDels    = "range.tombstones"
+	propExtractor    = "prefix.extractor"
+	propFilterSize   = "filter.size"
+	propGlobalSeq    = "global.seq"
+)
+
+// Properties describe content of a table. They are recorded once table is complete.
+type Properties struct {
+	Entries      int
+	Tombstones   int
+	RawKeySize   int // total size of keys
+	RawValueSize int // total size of values without envelopes
+	DataSize     int // size of data file
+	IndexSize    int // size of index file
+	SmallestKey  []byte
+	LargestKey   []byte
+	SmallestSeq  kv.SeqNum
+	LargestSeq   kv.SeqNum
+	CreatedAt    int64       // unix time
+	Compression  Compression // compression of data blocks
+	ComparerName string      // name of comparer which orders keys, see kv.Comparer
+	// RangeTombstones is number of range tombstones, range of table keys covers their ranges
+	RangeTombstones int
+	// PrefixExtractor is name of extractor of prefixes kept by bloom filter, the table has no filter when it's empty
+	PrefixExtractor string
+	FilterSize      int // size of filter file
+	// GlobalSeq is sequence number of all entries & range tombstones of an ingested table, see IngestTable.
+	// Entries of other tables keep their own sequence numbers.
+	GlobalSeq kv.SeqNum
+}
+
+// Contains tells whether the key is in range of table keys
+func (p *Properties) Contains(cmp kv.Comparer, key []byte) bool {
+	return p.Entries+p.RangeTombstones > 0 && cmp.Compare(key, p.SmallestKey) >= 0 && cmp.Compare(key, p.LargestKey) <= 0
+}
+
+// Overlaps tells whether range of table keys overlaps with given range (inclusive)
+func (p *Properties) Overlaps(cmp kv.Comparer, smallest, largest []byte) bool {
+	return p.Entries+p.RangeTombstones > 0 && cmp.Compare(p.SmallestKey, largest) <= 0 && cmp.Compare(p.LargestKey, smallest) >= 0
+}
+
+func (p *Properties) encode(w io.Writer) error {
+	props := []struct {
+		name  string
+		value []byte
+	}{
+		{propEntries, encodeInt(p.Entries)},
+		{propTombstones, encodeInt(p.Tombstones)},
+		{propRawKeySize, encodeInt(p.RawKeySize)},
+		{propRawValueSize, encodeInt(p.RawValueSize)},
+		{propDataSize, encodeInt(p.DataSize)},
+		{propIndexSize, encodeInt(p.IndexSize)},
+		{propSmallestKey, p.SmallestKey},
+		{propLargestKey, p.LargestKey},
+		{propSmallestSeq, encodeInt(int(p.SmallestSeq))},
+		{propLargestSeq, encodeInt(int(p.LargestSeq))},
+		{propCreatedAt, encodeInt(int(p.CreatedAt))},
+		{propCompression, encodeInt(int(p.Compression))},
+		{propComparer, []byte(p.ComparerName)},
+		{propRangeDels, encodeInt(p.RangeTombstones)},
+		{propExtractor, []byte(p.PrefixExtractor)},
+		{propFilterSize, encodeInt(p.FilterSize)},
+		{propGlobalSeq, encodeInt(int(p.GlobalSeq))},
+	}
+	for _, prop := range props {
+		if _, err := encode(w, []byte(prop.name), prop.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Properties) decode(block []byte) error {
+	c := newCursor(block)
+
+	for {
+		name, value, err := decode(c)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch string(name) {
+		case propSmallestKey:
+			p.SmallestKey = bytes.Clone(value)
+			continue
+		case propLargestKey:
+			p.LargestKey = bytes.Clone(value)
+			continue
+		case propComparer:
+			p.ComparerName = string(value)
+			continue
+		case propExtractor:
+			p.PrefixExtractor = string(value)
+			continue
+		}
+
+		if len(value) != 8 {
+			// unknown properties are skipped to be able to read tables written by newer versions
+			continue
+		}
+		n := decodeInt(value)
+		switch string(name) {
+		case propEntries:
+			p.Entries = n
+		case propTombstones:
+			p.Tombstones = n
+		case propRawKeySize:
+			p.RawKeySize = n
+		case propRawValueSize:
+			p.RawValueSize = n
+		case propDataSize:
+			p.DataSize = n
+		case propIndexSize:
+			p.IndexSize = n
+		case propSmallestSeq:
+			p.SmallestSeq = kv.SeqNum(n)
+		case propLargestSeq:
+			p.LargestSeq = kv.SeqNum(n)
+		case propCreatedAt:
+			p.CreatedAt = int64(n)
+		case propCompression:
+			p.Compression = Compression(n)
+		case propRangeDels:
+			p.RangeTombstones = n
+		case propFilterSize:
+			p.FilterSize = n
+		case propGlobalSeq:
+			p.GlobalSeq = kv.SeqNum(n)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package sstable
+
+import (
+	"bytes"
+	"challenge-lsm-store/kv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+)
+
+var ErrRangeDelNotSupported = errors.New("range tombstones need range-del writer")
+
+// RangeTombstone deletes keys from start (inclusive) to end (exclusive) written before it,
+// i.e. keys whose sequence number is lower than the one of the tombstone
+type RangeTombstone struct {
+	Start []byte
+	End   []byte
+	Seq   kv.SeqNum
+}
+
+// Covers tells whether the key is in range of the tombstone
+func (t RangeTombstone) Covers(cmp kv.Comparer, key []byte) bool {
+	return cmp.Compare(key, t.Start) >= 0 && cmp.Compare(key, t.End) < 0
+}
+
+// Deletes tells whether the tombstone deletes given change of the key
+func (t RangeTombstone) Deletes(cmp kv.Comparer, key []byte, seq kv.SeqNum) bool {
+	return seq < t.Seq && t.Covers(cmp, key)
+}
+
+// CoveringSeq returns the highest sequence number of tombstones covering the key, 0 when none of them covers it
+func CoveringSeq(cmp kv.Comparer, tombstones []RangeTombstone, key []byte) kv.SeqNum {
+	var seq kv.SeqNum
+	for _, t := range tombstones {
+		if t.Seq > seq && t.Covers(cmp, key) {
+			seq = t.Seq
+		}
+	}
+	return seq
+}
+
+// WithRangeDelWriter keeps range tombstones of the table in given writer (range-del block)
+func WithRangeDelWriter(rangeDelWriter io.WriteCloser) WriterOption {
+	return func(w *Writer) {
+		w.rangeDelWriter = rangeDelWriter
+	}
+}
+
+// WithRangeDelReader reads range tombstones of the table from given reader,
+// table written without range-del block has no range tombstones
+func WithRangeDelReader(rangeDelReader ReadAtCloser) ReaderOption {
+	return func(r *Reader) {
+		r.rangeDelReader = rangeDelReader
+	}
+}
+
+// AddRangeTombstone adds range tombstone to the table, tombstones may be added in any order.
+// Range of table keys (see Properties) covers ranges of its tombstones.
+func (w *Writer) AddRangeTombstone(t RangeTombstone) error {
+	if w.rangeDelWriter == nil {
+		return ErrRangeDelNotSupported
+	}
+	if w.comparer.Compare(t.Start, t.End) >= 0 {
+		return fmt.Errorf("range tombstone must start before its end")
+	}
+	w.rangeDels = append(w.rangeDels, RangeTombstone{Start: bytes.Clone(t.Start), End: bytes.Clone(t.End), Seq: t.Seq})
+	return nil
+}
+
+// finishRangeDels writes range tombstones sorted by their start and records them in properties
+func (w *Writer) finishRangeDels() error {
+	if w.rangeDelWriter == nil {
+		return nil
+	}
+	slices.SortFunc(w.rangeDels, func(a, b RangeTombstone) int {
+		return w.comparer.Compare(a.Start, b.Start)
+	})
+	for _, t := range w.rangeDels {
+		if _, err := encode(w.rangeDelWriter, t.Start, append(encodeInt(int(t.Seq)), t.End...)); err != nil {
+			return fmt.Errorf("range-del write error: %w", err)
+		}
+
+		if w.props.Entries == 0 && w.props.RangeTombstones == 0 {
+			w.props.SmallestKey, w.props.LargestKey = bytes.Clone(t.Start), bytes.Clone(t.End)
+			w.props.SmallestSeq, w.props.LargestSeq = t.Seq, t.Seq
+		}
+		w.props.RangeTombstones += 1
+		// end is exclusive, still it's kept as the largest key so tables can be compared by their ranges
+		if w.comparer.Compare(t.Start, w.props.SmallestKey) < 0 {
+			w.props.SmallestKey = bytes.Clone(t.Start)
+		}
+		if w.comparer.Compare(t.End, w.props.LargestKey) > 0 {
+			w.props.LargestKey = bytes.Clone(t.End)
+		}
+		w.props.SmallestSeq = min(w.props.SmallestSeq, t.Seq)
+		w.props.LargestSeq = max(w.props.LargestSeq, t.Seq)
+	}
+	return nil
+}
+
+// RangeTombstones returns range tombstones of the table sorted by their start
+func (r *Reader) RangeTombstones() ([]RangeTombstone, error) {
+	props, err := r.Properties()
+	if err != nil {
+		return nil, err
+	}
+	r.rangeDelsOnce.Do(func() {
+		if r.rangeDelReader == nil {
+			return
+		}
+		block, err := io.ReadAll(io.NewSectionReader(r.rangeDelReader, 0, math.MaxInt64))
+		if err != nil {
+			r.rangeDelsErr = fmt.Errorf("range-del error: %w", err)
+			return
+		}
+		c := newCursor(block)
+		for {
+			start, value, err := decode(c)
+			if err == io.EOF {
+				return
+			}
+			if err == nil && len(value) < 8 {
+				err = fmt.Errorf("the file is corrupted, invalid range tombstone")
+			}
+			if err != nil {
+				r.rangeDelsErr = fmt.Errorf("range-del error: %w", err)
+				return
+			}
+			seq := kv.SeqNum(decodeInt(value[:8]))
+			if props.GlobalSeq != 0 {
+				seq = props.GlobalSeq
+			}
+			r.rangeDels = append(r.rangeDels, RangeTombstone{Start: bytes.Clone(start), End: bytes.Clone(value[8:]), Seq: seq})
+		}
+	})
+	return r.rangeDels, r.rangeDelsErr
+}
@@ -2,38 +2,137 @@ package sstable
 
 import (
 	"bytes"
+	"challenge-lsm-store/cache"
+	"challenge-lsm-store/kv"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"sync"
 )
 
+// kinds of table files used to distinguish their blocks in the cache
+const (
+	dataBlockKind uint8 = iota
+	indexBlockKind
+	sparseIndexBlockKind
+	filterBlockKind
+)
+
+var ErrComparerMismatch = errors.New("table keys are ordered by a different comparer")
+
+// ReadAtCloser is a source of table data which doesn't keep any position (offset) between reads.
+// Thanks to that a single reader can serve many lookups at the same time.
+type ReadAtCloser interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// slicer is implemented by sources keeping whole content in memory (i.e. memory mapped files),
+// so blocks can be served without copying.
+type slicer interface {
+	Bytes() []byte
+}
+
+// ReaderOption changes default settings of the reader
+type ReaderOption func(r *Reader)
+
+// Reader finds keys in a table. Reader keeps no state per lookup thus it's safe for concurrent use.
 type Reader struct {
-	dataReader        io.ReadSeekCloser
-	indexReader       io.ReadSeekCloser
-	sparseIndexReader io.ReadSeekCloser
+	dataReader        ReadAtCloser
+	indexReader       ReadAtCloser
+	sparseIndexReader ReadAtCloser
+	propertiesReader  ReadAtCloser
+	rangeDelReader    ReadAtCloser // optional, see WithRangeDelReader
+	filterReader      ReadAtCloser // optional, see WithFilterReader
+
+	cache           *cache.Cache
+	fileNum         uint64
+	comparer        kv.Comparer
+	prefixExtractor kv.PrefixExtractor
+
+	// sparse index, index blocks & filter are pinned in the cache as long as reader is open
+	pinnedMu sync.Mutex
+	pinned   map[cache.Key][]byte
+
+	// sparse index is loaded once and kept in memory as long as reader is open
+	sparseIndexOnce sync.Once
+	sparseIndex     []byte
+	sparseIndexErr  error
+
+	propertiesOnce sync.Once
+	properties     Properties
+	propertiesErr  error
+
+	rangeDelsOnce sync.Once
+	rangeDels     []RangeTombstone
+	rangeDelsErr  error
+
+	filterOnce sync.Once
+	filter     []byte
+	filterErr  error
+}
+
+// WithCache makes reader keep read blocks in given cache which can be shared with other readers.
+// File number must identify the table among all tables using the cache.
+func WithCache(c *cache.Cache, fileNum uint64) ReaderOption {
+	return func(r *Reader) {
+		r.cache = c
+		r.fileNum = fileNum
+	}
+}
+
+// WithReaderComparer makes reader search keys in order of given comparer. The table must be written using
+// the comparer of the same name, otherwise reads fail with ErrComparerMismatch.
+func WithReaderComparer(c kv.Comparer) ReaderOption {
+	return func(r *Reader) {
+		r.comparer = c
+	}
 }
 
 func NewReader(
-	dataReader io.ReadSeekCloser,
-	indexReader io.ReadSeekCloser,
-	sparseIndexReader io.ReadSeekCloser,
+	dataReader ReadAtCloser,
+	indexReader ReadAtCloser,
+	sparseIndexReader ReadAtCloser,
+	propertiesReader ReadAtCloser,
+	opts ...ReaderOption,
 ) *Reader {
-	return &Reader{
+	r := &Reader{
 		dataReader:        dataReader,
 		indexReader:       indexReader,
 		sparseIndexReader: sparseIndexReader,
+		propertiesReader:  propertiesReader,
+		comparer:          kv.BytewiseComparer,
 	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
 }
 
 func (r *Reader) Find(key []byte) ([]byte, bool, error) {
-	from, to, ok, err := r.searchInSparseIndex(key)
+	props, err := r.Properties()
+	if err != nil {
+		return nil, false, err
+	}
+	sparseIndex, err := r.loadSparseIndex()
+	if err != nil {
+		return nil, false, fmt.Errorf("sparse index error: %w", err)
+	}
+
+	handle, ok, err := searchInIndexBlock(r.comparer, sparseIndex, key)
 	if err != nil {
 		return nil, false, fmt.Errorf("sparse index error: %w", err)
 	}
 	if !ok {
-		return nil, false, err
+		return nil, false, nil
 	}
 
-	offset, ok, err := r.searchInIndex(from, to, key)
+	indexBlock, err := r.readBlock(r.indexReader, indexBlockKind, handle)
+	if err != nil {
+		return nil, false, fmt.Errorf("index error: %w", err)
+	}
+	handle, ok, err = searchInIndexBlock(r.comparer, indexBlock, key)
 	if err != nil {
 		return nil, false, fmt.Errorf("index error: %w", err)
 	}
@@ -41,21 +140,73 @@ func (r *Reader) Find(key []byte) ([]byte, bool, error) {
 		return nil, false, nil
 	}
 
-	value, ok, err := r.searchInDataFile(offset, key)
+	dataBlock, err := r.readBlock(r.dataReader, dataBlockKind, handle)
 	if err != nil {
 		return nil, false, fmt.Errorf("data error: %w", err)
 	}
+	value, ok, err := searchInDataBlock(r.comparer, dataBlock, key)
+	if err != nil {
+		return nil, false, fmt.Errorf("data error: %w", err)
+	}
+	if !ok {
+		return nil, false, nil
+	}
 
-	return value, ok, nil
+	// blocks are shared (cache, mapped memory) so value must be copied to stay valid once they are gone
+	if props.GlobalSeq != 0 {
+		value, err = kv.WithSeq(value, props.GlobalSeq)
+		return value, err == nil, err
+	}
+	return bytes.Clone(value), true, nil
 }
 
-func (r *Reader) searchInDataFile(offset int, searchKey []byte) ([]byte, bool, error) {
-	if _, err := r.dataReader.Seek(int64(offset), io.SeekStart); err != nil {
-		return nil, false, fmt.Errorf("failed to seek: %w", err)
+// IndexKeys returns index keys of all data blocks in order, each of them is not smaller than the last key
+// of its block and smaller than the first key of the next block. Data blocks are of similar size,
+// so index keys split the table into parts of similar size without reading data blocks.
+func (r *Reader) IndexKeys() ([][]byte, error) {
+	if _, err := r.Properties(); err != nil {
+		return nil, err
+	}
+	sparseIndex, err := r.loadSparseIndex()
+	if err != nil {
+		return nil, fmt.Errorf("sparse index error: %w", err)
 	}
 
+	var keys [][]byte
+	sparse := newCursor(sparseIndex)
 	for {
-		key, value, err := decode(r.dataReader)
+		_, handle, err := decodeKeyHandle(sparse)
+		if err == io.EOF {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("sparse index error: %w", err)
+		}
+		indexBlock, err := r.readBlock(r.indexReader, indexBlockKind, handle)
+		if err != nil {
+			return nil, fmt.Errorf("index error: %w", err)
+		}
+		index := newCursor(indexBlock)
+		for {
+			key, _, err := decodeKeyHandle(index)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("index error: %w", err)
+			}
+			// blocks are shared (cache, mapped memory) so keys must be copied
+			keys = append(keys, bytes.Clone(key))
+		}
+	}
+}
+
+// searchInDataBlock looks for exact key in a data block
+func searchInDataBlock(comparer kv.Comparer, block []byte, searchKey []byte) ([]byte, bool, error) {
+	c := newCursor(block)
+
+	for {
+		key, value, err := decode(c)
 		if err != nil && err != io.EOF {
 			return nil, false, fmt.Errorf("failed to read: %w", err)
 		}
@@ -63,84 +214,200 @@ func (r *Reader) searchInDataFile(offset int, searchKey []byte) ([]byte, bool, e
 			return nil, false, nil
 		}
 
-		if bytes.Equal(key, searchKey) {
+		cmp := comparer.Compare(key, searchKey)
+		if cmp == 0 {
 			return value, true, nil
+		} else if cmp > 0 {
+			// keys are sorted so there is no point to look further
+			return nil, false, nil
 		}
 	}
 }
 
-func (r *Reader) searchInIndex(from, to int, searchKey []byte) (int, bool, error) {
-	if _, err := r.indexReader.Seek(int64(from), io.SeekStart); err != nil {
-		return 0, false, fmt.Errorf("failed to seek: %w", err)
-	}
+// searchInIndexBlock looks for the first block which can contain the key,
+// i.e. block whose index key (not smaller than its last key) is not smaller than the searched one.
+func searchInIndexBlock(comparer kv.Comparer, block []byte, searchKey []byte) (blockHandle, bool, error) {
+	c := newCursor(block)
 
 	for {
-		key, offset, err := decodeKeyOffset(r.indexReader)
+		key, handle, err := decodeKeyHandle(c)
 		if err != nil && err != io.EOF {
-			return 0, false, fmt.Errorf("failed to read: %w", err)
+			return blockHandle{}, false, fmt.Errorf("failed to read: %w", err)
 		}
 		if err == io.EOF {
-			return 0, false, nil
+			// all keys in the table are smaller than the search key
+			return blockHandle{}, false, nil
 		}
 
-		if bytes.Equal(key, searchKey) {
-			return offset, true, nil
+		if comparer.Compare(key, searchKey) >= 0 {
+			return handle, true, nil
 		}
+	}
+}
 
-		if to > from {
-			current, err := r.indexReader.Seek(0, io.SeekCurrent)
-			if err != nil {
-				return 0, false, fmt.Errorf("failed to seek: %w", err)
-			}
+func (r *Reader) loadSparseIndex() ([]byte, error) {
+	r.sparseIndexOnce.Do(func() {
+		if s, ok := r.sparseIndexReader.(slicer); ok {
+			// mapped memory is gone once reader is closed, so it can't be kept in the cache
+			r.sparseIndex = s.Bytes()
+			return
+		}
 
-			if current > int64(to) {
-				return 0, false, nil
-			}
+		load := func() ([]byte, error) {
+			return io.ReadAll(io.NewSectionReader(r.sparseIndexReader, 0, math.MaxInt64))
+		}
+		if r.cache == nil {
+			r.sparseIndex, r.sparseIndexErr = load()
+			return
+		}
+		r.sparseIndex, r.sparseIndexErr = r.pinBlock(cache.Key{FileNum: r.fileNum, Kind: sparseIndexBlockKind}, load)
+	})
+	return r.sparseIndex, r.sparseIndexErr
+}
+
+// pinBlock returns block pinned in the cache till the reader is closed, the block is loaded unless it's cached.
+// Reader must use a cache.
+func (r *Reader) pinBlock(key cache.Key, load func() ([]byte, error)) ([]byte, error) {
+	r.pinnedMu.Lock()
+	defer r.pinnedMu.Unlock()
+	if block, ok := r.pinned[key]; ok {
+		return block, nil
+	}
+
+	block, ok := r.cache.Get(key)
+	if !ok {
+		var err error
+		if block, err = load(); err != nil {
+			return nil, err
 		}
 	}
+	if r.pinned == nil {
+		r.pinned = make(map[cache.Key][]byte)
+	}
+	block = r.cache.Pin(key, block)
+	r.pinned[key] = block
+	return block, nil
 }
 
-func (r *Reader) searchInSparseIndex(searchKey []byte) (int, int, bool, error) {
-	defer func() {
-		_, _ = r.sparseIndexReader.Seek(0, io.SeekStart)
-	}()
+// Properties returns properties recorded when table was written.
+// ErrComparerMismatch is returned when the table is ordered by a different comparer than the reader.
+func (r *Reader) Properties() (Properties, error) {
+	r.propertiesOnce.Do(func() {
+		block, err := io.ReadAll(io.NewSectionReader(r.propertiesReader, 0, math.MaxInt64))
+		if err != nil {
+			r.propertiesErr = fmt.Errorf("properties error: %w", err)
+			return
+		}
+		if err := r.properties.decode(block); err != nil {
+			r.propertiesErr = fmt.Errorf("properties error: %w", err)
+			return
+		}
+		// tables written before comparers were recorded are ordered bytewise
+		name := r.properties.ComparerName
+		if name == "" {
+			name = kv.BytewiseComparer.Name()
+		}
+		if name != r.comparer.Name() {
+			r.propertiesErr = fmt.Errorf("%w: table %s, reader %s", ErrComparerMismatch, name, r.comparer.Name())
+		}
+	})
+	return r.properties, r.propertiesErr
+}
 
-	from := -1
-	for {
-		key, offset, err := decodeKeyOffset(r.sparseIndexReader)
-		if err != nil && err != io.EOF {
-			return 0, 0, false, err
+func (r *Reader) readBlock(reader ReadAtCloser, kind uint8, handle blockHandle) ([]byte, error) {
+	compression := NoCompression
+	if kind == dataBlockKind {
+		props, err := r.Properties()
+		if err != nil {
+			return nil, err
 		}
-		if err == io.EOF {
-			return from, 0, from != -1, nil
+		compression = props.Compression
+	}
+
+	s, mapped := reader.(slicer)
+	if mapped && compression == NoCompression {
+		return mappedBlock(s, handle)
+	}
+
+	load := func() ([]byte, error) {
+		var (
+			block []byte
+			err   error
+		)
+		if mapped {
+			block, err = mappedBlock(s, handle)
+		} else {
+			block, err = readBlockAt(reader, handle)
 		}
+		if err != nil {
+			return nil, err
+		}
+		// blocks are kept decompressed in the cache, so they are decompressed only once
+		if block, err = decompress(compression, block); err != nil {
+			return nil, fmt.Errorf("the file is corrupted, failed to decompress block: %w", err)
+		}
+		return block, nil
+	}
+	if r.cache == nil {
+		return load()
+	}
 
-		cmp := bytes.Compare(key, searchKey)
-		if cmp == 0 {
-			return offset, offset, true, nil
-		} else if cmp < 0 {
-			from = offset
-		} else if cmp > 0 {
-			if from == -1 {
-				// if the first key in the sparse index is larger than
-				// the search key, it means there is no key
-				return 0, 0, false, nil
-			} else {
-				return from, offset, true, nil
-			}
+	key := cache.Key{FileNum: r.fileNum, Kind: kind, Offset: int64(handle.offset)}
+	// index blocks are read by every lookup, so they are not evicted while the table is used
+	if kind == indexBlockKind {
+		return r.pinBlock(key, load)
+	}
+	if block, ok := r.cache.Get(key); ok {
+		return block, nil
+	}
+	block, err := load()
+	if err != nil {
+		return nil, err
+	}
+	r.cache.Set(key, block)
+	return block, nil
+}
+
+func mappedBlock(s slicer, handle blockHandle) ([]byte, error) {
+	data := s.Bytes()
+	if handle.offset+handle.length > len(data) {
+		return nil, fmt.Errorf("the file is corrupted, block out of range")
+	}
+	return data[handle.offset : handle.offset+handle.length : handle.offset+handle.length], nil
+}
+
+func readBlockAt(reader ReadAtCloser, handle blockHandle) ([]byte, error) {
+	block := make([]byte, handle.length)
+	n, err := reader.ReadAt(block, int64(handle.offset))
+	if n < handle.length {
+		if err == nil || err == io.EOF {
+			err = fmt.Errorf("the file is corrupted, failed to read block")
 		}
+		return nil, err
 	}
+	return block, nil
 }
 
 func (r *Reader) Close() error {
-	if err := r.dataReader.Close(); err != nil {
-		return err
+	r.pinnedMu.Lock()
+	for key := range r.pinned {
+		r.cache.Unpin(key)
+	}
+	r.pinned = nil
+	r.pinnedMu.Unlock()
+
+	// all files are closed even if some of them fail
+	errs := []error{
+		r.dataReader.Close(),
+		r.indexReader.Close(),
+		r.sparseIndexReader.Close(),
+		r.propertiesReader.Close(),
 	}
-	if err := r.indexReader.Close(); err != nil {
-		return err
+	if r.rangeDelReader != nil {
+		errs = append(errs, r.rangeDelReader.Close())
 	}
-	if err := r.sparseIndexReader.Close(); err != nil {
-		return err
+	if r.filterReader != nil {
+		errs = append(errs, r.filterReader.Close())
 	}
-	return nil
+	return errors.Join(errs...)
 }
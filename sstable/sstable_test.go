@@ -2,9 +2,15 @@ package sstable_test
 
 import (
 	"bytes"
+	"challenge-lsm-store/cache"
+	"challenge-lsm-store/kv"
 	"challenge-lsm-store/sstable"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"sync"
 	"testing"
 )
 
@@ -85,23 +91,22 @@ func Test_SSTable_WriteRead(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			dataWriter := &closeableWriter{buff: bytes.NewBuffer(nil)}
-			indexWriter := &closeableWriter{buff: bytes.NewBuffer(nil)}
-			sparseIndexWriter := &closeableWriter{buff: bytes.NewBuffer(nil)}
+			table := newTableBuffers()
 
-			writer := sstable.NewWriter(dataWriter, indexWriter, sparseIndexWriter)
+			writer := table.Writer()
 			for _, pair := range tt.in {
-				err := writer.Write(pair.Key, pair.Value)
+				err := writer.Write(pair.Key, setValue(pair.Value))
 				require.NoError(t, err, "could not write to file")
 			}
+			require.NoError(t, writer.Close(), "could not close file")
 
-			reader := sstable.NewReader(dataWriter.Reader(), indexWriter.Reader(), sparseIndexWriter.Reader())
+			reader := table.Reader()
 			for _, result := range tt.exp {
 				v, ok, err := reader.Find(result.Key)
 				require.NoError(t, err, "could not read from file")
 				assert.Equalf(t, result.Found, ok, "unexpected found key: %s", result.Key)
 				if result.Found {
-					assert.Equalf(t, result.Value, v, "value not equal for key: %s", result.Key)
+					assert.Equalf(t, result.Value, payload(t, v), "value not equal for key: %s", result.Key)
 				} else {
 					assert.Nilf(t, v, "value must be nil for key: %s", result.Key)
 				}
@@ -109,3 +114,546 @@ func Test_SSTable_WriteRead(t *testing.T) {
 		})
 	}
 }
+
+func Test_SSTable_ConcurrentFind(t *testing.T) {
+	t.Parallel()
+
+	const (
+		keys     = 100
+		routines = 10
+	)
+
+	table := newTableBuffers()
+	writer := table.Writer()
+	for i := 0; i < keys; i++ {
+		err := writer.Write([]byte(fmt.Sprintf("key%03d", i)), setValue([]byte(fmt.Sprintf("value%03d", i))))
+		require.NoError(t, err, "could not write to file")
+	}
+	require.NoError(t, writer.Close(), "could not close file")
+
+	reader := table.Reader()
+
+	var wg sync.WaitGroup
+	wg.Add(routines)
+	for r := 0; r < routines; r++ {
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < keys; i++ {
+				v, ok, err := reader.Find([]byte(fmt.Sprintf("key%03d", i)))
+				assert.NoError(t, err, "could not read from file")
+				assert.Truef(t, ok, "key not found: %d", i)
+				assert.Equal(t, []byte(fmt.Sprintf("value%03d", i)), payload(t, v), "unexpected value")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func Test_SSTable_FindInMappedMemory(t *testing.T) {
+	t.Parallel()
+
+	table := newTableBuffers()
+	writer := table.Writer()
+	for i := 0; i < 20; i++ {
+		err := writer.Write([]byte(fmt.Sprintf("key%03d", i)), setValue([]byte(fmt.Sprintf("value%03d", i))))
+		require.NoError(t, err, "could not write to file")
+	}
+	require.NoError(t, writer.Close(), "could not close file")
+
+	data := table.data.MappedReader()
+	reader := sstable.NewReader(
+		data, table.index.MappedReader(), table.sparseIndex.MappedReader(), table.properties.Reader(),
+	)
+
+	v, ok, err := reader.Find([]byte("key013"))
+	require.NoError(t, err, "could not read from memory")
+	require.True(t, ok, "key not found")
+	assert.Equal(t, []byte("value013"), payload(t, v), "unexpected value")
+
+	// found value must not point at the mapped memory which can be released together with the table
+	for i := range data.Bytes() {
+		data.Bytes()[i] = 0
+	}
+	assert.Equal(t, []byte("value013"), payload(t, v), "value changed together with mapped memory")
+}
+
+func Test_SSTable_FindInManyBlocks(t *testing.T) {
+	t.Parallel()
+
+	const keys = 2000
+
+	table := newTableBuffers()
+	writer := table.Writer()
+	for i := 0; i < keys; i++ {
+		err := writer.Write([]byte(fmt.Sprintf("key%05d", i*2)), setValue([]byte(fmt.Sprintf("value%05d", i*2))))
+		require.NoError(t, err, "could not write to file")
+	}
+	require.NoError(t, writer.Close(), "could not close file")
+
+	blockCache := cache.New(1024 * 1024)
+	reader := table.Reader(sstable.WithCache(blockCache, 1))
+
+	for i := 0; i < keys*2; i++ {
+		v, ok, err := reader.Find([]byte(fmt.Sprintf("key%05d", i)))
+		require.NoError(t, err, "could not read from file")
+		if i%2 == 0 {
+			assert.Truef(t, ok, "key not found: %d", i)
+			assert.Equal(t, []byte(fmt.Sprintf("value%05d", i)), payload(t, v), "unexpected value")
+		} else {
+			assert.Falsef(t, ok, "key must not be found: %d", i)
+		}
+	}
+	_, ok, err := reader.Find([]byte("zzz"))
+	require.NoError(t, err, "could not read from file")
+	assert.False(t, ok, "key after the last one must not be found")
+	_, ok, err = reader.Find([]byte("a"))
+	require.NoError(t, err, "could not read from file")
+	assert.False(t, ok, "key before the first one must not be found")
+
+	stats := blockCache.Stats()
+	assert.NotZero(t, stats.Hits, "blocks must be read from the cache")
+	assert.Greater(t, stats.PinnedBlocks, 1, "sparse index & index blocks must be pinned")
+
+	require.NoError(t, reader.Close(), "could not close reader")
+	assert.Equal(t, 0, blockCache.Stats().PinnedBlocks, "index blocks must be unpinned")
+}
+
+func Test_SSTable_PinIndexAndFilter(t *testing.T) {
+	t.Parallel()
+
+	//GIVEN a table with many index blocks & bloom filter
+	table := newTableBuffers()
+	filter := &closeableWriter{buff: bytes.NewBuffer(nil)}
+	extractor := kv.SeparatorPrefix(0)
+	writer := table.Writer(sstable.WithPrefixExtractor(extractor), sstable.WithFilterWriter(filter))
+	const keys = 2000
+	for i := 0; i < keys; i++ {
+		require.NoError(t, writer.Write([]byte(fmt.Sprintf("key%05d\x00", i)), setValue(nil)), "write error")
+	}
+	require.NoError(t, writer.Close(), "could not close file")
+	//AND a cache which can't keep any data block
+	blockCache := cache.New(1)
+	reader := table.Reader(sstable.WithCache(blockCache, 1),
+		sstable.WithReaderPrefixExtractor(extractor), sstable.WithFilterReader(filter.Reader()))
+
+	//WHEN keys & prefixes are looked up
+	for i := 0; i < keys; i++ {
+		_, ok, err := reader.Find([]byte(fmt.Sprintf("key%05d\x00", i)))
+		require.NoError(t, err, "could not read from file")
+		require.Truef(t, ok, "key not found: %d", i)
+	}
+	ok, err := reader.MayContainPrefix([]byte("key00001\x00"))
+	require.NoError(t, err, "filter error")
+	assert.True(t, ok, "prefix must be contained")
+
+	//THEN sparse index, index blocks & filter are kept in the cache outside of its capacity
+	stats := blockCache.Stats()
+	assert.Greater(t, stats.PinnedBlocks, 3, "index blocks & filter must be pinned")
+	assert.Equal(t, stats.PinnedBlocks, stats.Blocks, "only pinned blocks expected")
+
+	//WHEN the reader is closed
+	require.NoError(t, reader.Close(), "could not close reader")
+
+	//THEN blocks are unpinned & evicted
+	stats = blockCache.Stats()
+	assert.Equal(t, 0, stats.PinnedBlocks, "blocks must be unpinned")
+	assert.Equal(t, 0, stats.Blocks, "unpinned blocks must be evicted")
+}
+
+func Test_SSTable_CompressedBlocks(t *testing.T) {
+	t.Parallel()
+
+	const keys = 500
+
+	write := func(opts ...sstable.WriterOption) *tableBuffers {
+		table := newTableBuffers()
+		writer := table.Writer(opts...)
+		for i := 0; i < keys; i++ {
+			err := writer.Write([]byte(fmt.Sprintf("key%05d", i)), setValue([]byte(fmt.Sprintf("value%05d", i))))
+			require.NoError(t, err, "could not write to file")
+		}
+		require.NoError(t, writer.Close(), "could not close file")
+		return table
+	}
+	plain := write(sstable.WithBlockSize(256), sstable.WithSparseKeyDistance(2))
+	compressed := write(sstable.WithBlockSize(256), sstable.WithSparseKeyDistance(2), sstable.WithCompression(sstable.FlateCompression))
+
+	props, err := compressed.Reader().Properties()
+	require.NoError(t, err, "could not read properties")
+	assert.Equal(t, sstable.FlateCompression, props.Compression, "compression must be recorded")
+	assert.Less(t, len(compressed.data.Bytes()), len(plain.data.Bytes()), "data blocks must be compressed")
+	assert.Equal(t, len(compressed.index.Bytes()), len(plain.index.Bytes()), "index must be written for the same blocks")
+
+	readers := map[string]*sstable.Reader{
+		"pread": compressed.Reader(),
+		"cache": compressed.Reader(sstable.WithCache(cache.New(1024*1024), 1)),
+		"mmap": sstable.NewReader(
+			compressed.data.MappedReader(), compressed.index.MappedReader(),
+			compressed.sparseIndex.MappedReader(), compressed.properties.Reader(),
+		),
+	}
+	for name, reader := range readers {
+		for i := 0; i < keys; i++ {
+			v, ok, err := reader.Find([]byte(fmt.Sprintf("key%05d", i)))
+			require.NoErrorf(t, err, "could not read from file - reader: %s", name)
+			require.Truef(t, ok, "key not found - reader: %s, key: %d", name, i)
+			assert.Equalf(t, []byte(fmt.Sprintf("value%05d", i)), payload(t, v), "unexpected value - reader: %s", name)
+		}
+
+		it := reader.NewIterator()
+		i := 0
+		for it.Next() {
+			assert.Equalf(t, []byte(fmt.Sprintf("key%05d", i)), it.Key(), "unexpected key - reader: %s", name)
+			i++
+		}
+		require.NoErrorf(t, it.Err(), "iterator error - reader: %s", name)
+		assert.Equalf(t, keys, i, "unexpected number of iterated keys - reader: %s", name)
+		require.NoError(t, reader.Close(), "could not close reader")
+	}
+}
+
+// fullIndexKeys orders keys bytewise, but doesn't shorten index keys
+type fullIndexKeys struct {
+	kv.Comparer
+}
+
+func (fullIndexKeys) Separator(a, _ []byte) []byte {
+	return bytes.Clone(a)
+}
+
+func (fullIndexKeys) Successor(a []byte) []byte {
+	return bytes.Clone(a)
+}
+
+func Test_SSTable_ShortenIndexKeys(t *testing.T) {
+	t.Parallel()
+
+	const keys = 500
+
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("a-rather-long-common-key-prefix-%05d", i*2))
+	}
+	write := func(comparer kv.Comparer) *tableBuffers {
+		table := newTableBuffers()
+		writer := table.Writer(sstable.WithBlockSize(256), sstable.WithComparer(comparer))
+		for i := 0; i < keys; i++ {
+			require.NoError(t, writer.Write(key(i), setValue(key(i))), "could not write to file")
+		}
+		require.NoError(t, writer.Close(), "could not close file")
+		return table
+	}
+	full := write(fullIndexKeys{kv.BytewiseComparer})
+	shortened := write(kv.BytewiseComparer)
+	assert.Less(t, len(shortened.index.Bytes()), len(full.index.Bytes()), "index keys must be shortened")
+
+	reader := shortened.Reader()
+	for i := 0; i < keys*2; i++ {
+		k := []byte(fmt.Sprintf("a-rather-long-common-key-prefix-%05d", i))
+		v, ok, err := reader.Find(k)
+		require.NoError(t, err, "could not read from file")
+		if i%2 == 0 {
+			require.Truef(t, ok, "key not found: %s", k)
+			assert.Equal(t, k, payload(t, v), "unexpected value")
+		} else {
+			assert.Falsef(t, ok, "key must not be found: %s", k)
+		}
+	}
+	_, ok, err := reader.Find([]byte("b"))
+	require.NoError(t, err, "could not read from file")
+	assert.False(t, ok, "key after the last one must not be found")
+}
+
+func Test_SSTable_Comparer(t *testing.T) {
+	t.Parallel()
+
+	const keys = 1000
+
+	//GIVEN a table of numeric keys ordered by their value
+	table := newTableBuffers()
+	writer := table.Writer(sstable.WithBlockSize(64), sstable.WithComparer(kv.LittleEndianComparer))
+	for i := uint64(0); i < keys; i++ {
+		err := writer.Write(binary.LittleEndian.AppendUint64(nil, i), setValue([]byte(fmt.Sprintf("value%d", i))))
+		require.NoError(t, err, "could not write to file")
+	}
+	require.NoError(t, writer.Close(), "could not close file")
+
+	//WHEN keys are searched using the same comparer
+	reader := table.Reader(sstable.WithReaderComparer(kv.LittleEndianComparer))
+	props, err := reader.Properties()
+	require.NoError(t, err, "could not read properties")
+	assert.Equal(t, kv.LittleEndianComparer.Name(), props.ComparerName, "comparer must be recorded")
+
+	//THEN all keys are found
+	for i := uint64(0); i < keys; i++ {
+		v, ok, err := reader.Find(binary.LittleEndian.AppendUint64(nil, i))
+		require.NoError(t, err, "could not read from file")
+		require.Truef(t, ok, "key not found: %d", i)
+		assert.Equal(t, []byte(fmt.Sprintf("value%d", i)), payload(t, v), "unexpected value")
+	}
+
+	//WHEN the table is read using a different comparer
+	_, _, err = table.Reader().Find(binary.LittleEndian.AppendUint64(nil, 1))
+
+	//THEN reads fail
+	assert.True(t, errors.Is(err, sstable.ErrComparerMismatch), "comparer mismatch must be reported")
+	it := table.Reader().NewIterator()
+	assert.False(t, it.Next(), "iterator must not return any entries")
+	assert.True(t, errors.Is(it.Err(), sstable.ErrComparerMismatch), "comparer mismatch must be reported")
+}
+
+func Test_SSTable_Properties(t *testing.T) {
+	t.Parallel()
+
+	table := newTableBuffers()
+	writer := table.Writer()
+	require.NoError(t, writer.Write([]byte("key1"), kv.EncodeValue(kv.KindSet, 7, []byte("value1"))), "write error")
+	require.NoError(t, writer.Write([]byte("key2"), kv.EncodeValue(kv.KindDelete, 3, nil)), "write error")
+	require.NoError(t, writer.Write([]byte("key3"), kv.EncodeValue(kv.KindSet, 5, []byte("value3"))), "write error")
+	require.NoError(t, writer.Close(), "could not close file")
+
+	props, err := table.Reader().Properties()
+	require.NoError(t, err, "could not read properties")
+	assert.Equal(t, 3, props.Entries, "unexpected entries")
+	assert.Equal(t, 1, props.Tombstones, "unexpected tombstones")
+	assert.Equal(t, 12, props.RawKeySize, "unexpected raw key size")
+	assert.Equal(t, 12, props.RawValueSize, "unexpected raw value size")
+	assert.Equal(t, len(table.data.Bytes()), props.DataSize, "unexpected data size")
+	assert.Equal(t, len(table.index.Bytes()), props.IndexSize, "unexpected index size")
+	assert.Equal(t, []byte("key1"), props.SmallestKey, "unexpected smallest key")
+	assert.Equal(t, []byte("key3"), props.LargestKey, "unexpected largest key")
+	assert.Equal(t, kv.SeqNum(3), props.SmallestSeq, "unexpected smallest seq")
+	assert.Equal(t, kv.SeqNum(7), props.LargestSeq, "unexpected largest seq")
+	assert.NotZero(t, props.CreatedAt, "creation time not recorded")
+	assert.Equal(t, writer.Properties(), props, "read properties differ from written ones")
+
+	assert.True(t, props.Contains(kv.BytewiseComparer, []byte("key2")), "key in range")
+	assert.False(t, props.Contains(kv.BytewiseComparer, []byte("key4")), "key after range")
+	assert.False(t, props.Contains(kv.BytewiseComparer, []byte("key")), "key before range")
+	assert.True(t, props.Overlaps(kv.BytewiseComparer, []byte("key0"), []byte("key1")), "range overlapping first key")
+	assert.False(t, props.Overlaps(kv.BytewiseComparer, []byte("key4"), []byte("key9")), "range after table keys")
+}
+
+func Test_SSTable_RangeTombstones(t *testing.T) {
+	t.Parallel()
+
+	//GIVEN a table with range tombstones
+	table := newTableBuffers()
+	rangeDel := &closeableWriter{buff: bytes.NewBuffer(nil)}
+	writer := table.Writer(sstable.WithRangeDelWriter(rangeDel))
+	require.NoError(t, writer.Write([]byte("key3"), kv.EncodeValue(kv.KindSet, 5, []byte("value3"))), "write error")
+	require.NoError(t, writer.AddRangeTombstone(sstable.RangeTombstone{Start: []byte("key5"), End: []byte("key9"), Seq: 9}), "add error")
+	require.NoError(t, writer.AddRangeTombstone(sstable.RangeTombstone{Start: []byte("key1"), End: []byte("key4"), Seq: 2}), "add error")
+	assert.Error(t, writer.AddRangeTombstone(sstable.RangeTombstone{Start: []byte("key2"), End: []byte("key2")}), "empty range")
+	require.NoError(t, writer.Close(), "could not close file")
+
+	//WHEN the table is read
+	reader := table.Reader(sstable.WithRangeDelReader(rangeDel.Reader()))
+	props, err := reader.Properties()
+	require.NoError(t, err, "could not read properties")
+	tombstones, err := reader.RangeTombstones()
+	require.NoError(t, err, "could not read range tombstones")
+
+	//THEN tombstones are sorted by their start
+	assert.Equal(t, []sstable.RangeTombstone{
+		{Start: []byte("key1"), End: []byte("key4"), Seq: 2},
+		{Start: []byte("key5"), End: []byte("key9"), Seq: 9},
+	}, tombstones, "unexpected tombstones")
+	assert.Equal(t, kv.SeqNum(9), sstable.CoveringSeq(kv.BytewiseComparer, tombstones, []byte("key5")), "start is covered")
+	assert.Zero(t, sstable.CoveringSeq(kv.BytewiseComparer, tombstones, []byte("key9")), "end is not covered")
+	assert.True(t, tombstones[0].Deletes(kv.BytewiseComparer, []byte("key3"), 1), "older change is deleted")
+	assert.False(t, tombstones[0].Deletes(kv.BytewiseComparer, []byte("key3"), 5), "newer change is kept")
+
+	//AND range of table keys covers them
+	assert.Equal(t, 2, props.RangeTombstones, "unexpected range tombstones")
+	assert.Equal(t, []byte("key1"), props.SmallestKey, "unexpected smallest key")
+	assert.Equal(t, []byte("key9"), props.LargestKey, "unexpected largest key")
+	assert.Equal(t, kv.SeqNum(2), props.SmallestSeq, "unexpected smallest seq")
+	assert.Equal(t, kv.SeqNum(9), props.LargestSeq, "unexpected largest seq")
+
+	//AND table without range-del block rejects them
+	writer = newTableBuffers().Writer()
+	err = writer.AddRangeTombstone(sstable.RangeTombstone{Start: []byte("key1"), End: []byte("key2")})
+	assert.Equal(t, sstable.ErrRangeDelNotSupported, err, "unexpected error")
+}
+
+func Test_SSTable_WriteUnsortedKeys(t *testing.T) {
+	t.Parallel()
+
+	writer := newTableBuffers().Writer()
+	require.NoError(t, writer.Write([]byte("key2"), setValue([]byte("value2"))), "write error")
+
+	assert.Equal(t, sstable.ErrKeysNotSorted, writer.Write([]byte("key1"), setValue([]byte("value1"))), "smaller key")
+	assert.Equal(t, sstable.ErrKeysNotSorted, writer.Write([]byte("key2"), setValue([]byte("value2"))), "same key")
+	assert.True(t, errors.Is(writer.Write([]byte("key3"), []byte("raw")), kv.ErrInvalidValue), "value without envelope")
+}
+
+func Test_SSTable_Iterator(t *testing.T) {
+	t.Parallel()
+
+	const keys = 2000
+
+	table := newTableBuffers()
+	writer := table.Writer()
+	for i := 0; i < keys; i++ {
+		err := writer.Write([]byte(fmt.Sprintf("key%05d", i)), setValue([]byte(fmt.Sprintf("value%05d", i))))
+		require.NoError(t, err, "could not write to file")
+	}
+	require.NoError(t, writer.Close(), "could not close file")
+
+	it := table.Reader().NewIterator()
+	i := 0
+	for it.Next() {
+		assert.Equal(t, []byte(fmt.Sprintf("key%05d", i)), it.Key(), "unexpected key")
+		assert.Equal(t, []byte(fmt.Sprintf("value%05d", i)), payload(t, it.Value()), "unexpected value")
+		i++
+	}
+	require.NoError(t, it.Err(), "iteration error")
+	assert.Equal(t, keys, i, "not all entries iterated")
+	assert.False(t, it.Next(), "iterator must stay exhausted")
+}
+
+func Test_SSTable_IteratorSeek(t *testing.T) {
+	t.Parallel()
+
+	const keys = 2000
+
+	table := newTableBuffers()
+	writer := table.Writer(sstable.WithBlockSize(256), sstable.WithSparseKeyDistance(3))
+	for i := 0; i < keys; i++ {
+		err := writer.Write([]byte(fmt.Sprintf("key%05d", i*2)), setValue([]byte(fmt.Sprintf("value%05d", i*2))))
+		require.NoError(t, err, "could not write to file")
+	}
+	require.NoError(t, writer.Close(), "could not close file")
+	reader := table.Reader()
+
+	tests := []struct {
+		name string
+		seek string
+		exp  []string
+	}{
+		{name: "existing key", seek: "key01000", exp: []string{"key01000", "key01002"}},
+		{name: "missing key", seek: "key01001", exp: []string{"key01002", "key01004"}},
+		{name: "before the first key", seek: "a", exp: []string{"key00000", "key00002"}},
+		{name: "the last key", seek: "key03998", exp: []string{"key03998"}},
+		{name: "after the last key", seek: "key03999"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//WHEN iterator seeks the key
+			it := reader.NewIterator()
+			it.Seek([]byte(tt.seek))
+
+			//THEN it goes on from the first key which is not smaller
+			for _, exp := range tt.exp {
+				require.True(t, it.Next(), "key %s not found", exp)
+				assert.Equal(t, exp, string(it.Key()), "unexpected key")
+			}
+			if len(tt.exp) < 2 {
+				assert.False(t, it.Next(), "iterator must be exhausted")
+			}
+			require.NoError(t, it.Err(), "iteration error")
+		})
+	}
+}
+
+func Test_SSTable_PrefixFilter(t *testing.T) {
+	t.Parallel()
+
+	//GIVEN a table with bloom filter of key prefixes
+	table := newTableBuffers()
+	filter := &closeableWriter{buff: bytes.NewBuffer(nil)}
+	extractor := kv.SeparatorPrefix(0)
+	writer := table.Writer(sstable.WithPrefixExtractor(extractor), sstable.WithFilterWriter(filter))
+	for i := 0; i < 100; i++ {
+		for _, doc := range []string{"doc1", "doc2"} {
+			key := []byte(fmt.Sprintf("term%03d\x00%s", i*2, doc))
+			require.NoError(t, writer.Write(key, setValue(nil)), "write error")
+		}
+	}
+	require.NoError(t, writer.Write([]byte("unprefixed"), setValue(nil)), "write error")
+	require.NoError(t, writer.Close(), "could not close file")
+
+	//WHEN prefixes are looked up
+	reader := table.Reader(sstable.WithReaderPrefixExtractor(extractor), sstable.WithFilterReader(filter.Reader()))
+	mayContain := func(reader *sstable.Reader, prefix string) bool {
+		ok, err := reader.MayContainPrefix([]byte(prefix))
+		require.NoError(t, err, "filter error")
+		return ok
+	}
+
+	//THEN prefixes of table keys may be contained
+	var falsePositives int
+	for i := 0; i < 200; i++ {
+		ok := mayContain(reader, fmt.Sprintf("term%03d\x00", i))
+		if i%2 == 0 {
+			assert.True(t, ok, "prefix of key %d must be contained", i)
+		} else if ok {
+			falsePositives++
+		}
+	}
+	//AND other prefixes are mostly rejected
+	assert.Less(t, falsePositives, 10, "too many false positives")
+	//AND prefixes which are not extracted from themselves may always be contained
+	assert.True(t, mayContain(reader, "term"), "key without prefix")
+	assert.True(t, mayContain(reader, "term001\x00doc"), "key longer than its prefix")
+
+	//AND filter is not checked by a different extractor
+	props, err := reader.Properties()
+	require.NoError(t, err, "could not read properties")
+	assert.Equal(t, extractor.Name(), props.PrefixExtractor, "unexpected extractor")
+	assert.Equal(t, len(filter.Bytes()), props.FilterSize, "unexpected filter size")
+	reader = table.Reader(sstable.WithReaderPrefixExtractor(kv.FixedPrefix(8)), sstable.WithFilterReader(filter.Reader()))
+	assert.True(t, mayContain(reader, "term001\x00"), "filter of different extractor must not be checked")
+}
+
+func Test_SSTable_IndexKeys(t *testing.T) {
+	t.Parallel()
+
+	const keys = 2000
+
+	//GIVEN a table of many blocks
+	table := newTableBuffers()
+	writer := table.Writer(sstable.WithBlockSize(256))
+	for i := 0; i < keys; i++ {
+		err := writer.Write([]byte(fmt.Sprintf("key%05d", i)), setValue([]byte(fmt.Sprintf("value%05d", i))))
+		require.NoError(t, err, "could not write to file")
+	}
+	require.NoError(t, writer.Close(), "could not close file")
+
+	//WHEN index keys are read
+	indexKeys, err := table.Reader().IndexKeys()
+	require.NoError(t, err, "index keys error")
+
+	//THEN there is a key per block, keys are ordered and cover all table keys
+	assert.Greater(t, len(indexKeys), 10, "key per block expected")
+	for i := 1; i < len(indexKeys); i++ {
+		assert.Less(t, string(indexKeys[i-1]), string(indexKeys[i]), "index keys must be ordered")
+	}
+	assert.GreaterOrEqual(t, string(indexKeys[len(indexKeys)-1]), fmt.Sprintf("key%05d", keys-1), "the last key must be covered")
+}
+
+func Test_SSTable_CloseAllFiles(t *testing.T) {
+	t.Parallel()
+
+	//GIVEN reader whose files fail to close
+	dataErr, indexErr := errors.New("data close error"), errors.New("index close error")
+	files := []*closeableReader{
+		{reader: bytes.NewReader(nil), closeErr: dataErr},
+		{reader: bytes.NewReader(nil), closeErr: indexErr},
+		{reader: bytes.NewReader(nil)},
+		{reader: bytes.NewReader(nil)},
+	}
+	reader := sstable.NewReader(files[0], files[1], files[2], files[3])
+
+	//WHEN the reader is closed
+	err := reader.Close()
+
+	//THEN all failures are reported
+	assert.True(t, errors.Is(err, dataErr), "data close error expected")
+	assert.True(t, errors.Is(err, indexErr), "index close error expected")
+	//AND all files are closed
+	for i, f := range files {
+		assert.True(t, f.closed, "file %d must be closed", i)
+	}
+}
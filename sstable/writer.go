@@ -1,63 +1,275 @@
 package sstable
 
 import (
+	"bytes"
+	"challenge-lsm-store/kv"
+	"errors"
 	"fmt"
 	"io"
+	"time"
 )
 
 const (
-	sparseKeyDistance = 5 // TODO move it to config with optionals
+	DefaultSparseKeyDistance = 5
+	DefaultBlockSize         = 4096
 )
 
+var ErrKeysNotSorted = errors.New("keys must be written in ascending order")
+
+// Writer writes sorted key-value pairs into a table. Values are envelopes (see kv.Value).
+// Pairs are grouped into data blocks which are indexed by the last key of each block (index file).
+// Index entries are grouped in the same manner and indexed by the sparse index file.
+// Table is complete once writer is closed, then its properties are recorded in properties file.
 type Writer struct {
 	// writers
 	dataWriter        io.WriteCloser
 	indexWriter       io.WriteCloser
 	sparseIndexWriter io.WriteCloser
+	propertiesWriter  io.WriteCloser
+	rangeDelWriter    io.WriteCloser // optional, see WithRangeDelWriter
+	filterWriter      io.WriteCloser // optional, see WithFilterWriter
+
+	// blocks being built
+	dataBlock         *bytes.Buffer
+	indexBlock        *bytes.Buffer
+	indexBlockEntries int
+	lastKey           []byte
+	lastIndexKey      []byte
+	// written data block is indexed once the first key of the next block is known, so its index key can be shortened
+	pendingIndex  bool
+	pendingHandle blockHandle
 
 	// state
 	dataPos  int
 	indexPos int
 	keys     int
+	props    Properties
+	// range tombstones are written once table is complete
+	rangeDels []RangeTombstone
+	// hashes of distinct key prefixes build bloom filter once table is complete
+	prefixHashes []uint32
+	lastPrefix   []byte
+
+	// settings
+	sparseKeyDistance int
+	blockSize         int
+	compressor        compressor
+	comparer          kv.Comparer
+	prefixExtractor   kv.PrefixExtractor
+
+	// hooks run once table files are closed, i.e. to make them durable
+	commit func() error
+	abort  func() error
+}
+
+// WriterOption changes default settings of the writer
+type WriterOption func(w *Writer)
+
+// WithSparseKeyDistance sets number of data blocks indexed by a single index block, i.e. by a sparse index entry
+func WithSparseKeyDistance(n int) WriterOption {
+	return func(w *Writer) {
+		w.sparseKeyDistance = n
+	}
+}
+
+// WithBlockSize sets size (bytes) which data block reaches before it's written
+func WithBlockSize(n int) WriterOption {
+	return func(w *Writer) {
+		w.blockSize = n
+	}
+}
+
+// WithComparer orders keys of the table using given comparer, its name is recorded in table properties
+func WithComparer(c kv.Comparer) WriterOption {
+	return func(w *Writer) {
+		w.comparer = c
+	}
+}
+
+// WithCompression compresses data blocks, the compression is recorded in table properties
+func WithCompression(c Compression) WriterOption {
+	return func(w *Writer) {
+		w.compressor.compression = c
+	}
 }
 
 func NewWriter(
 	dataWriter io.WriteCloser,
 	indexWriter io.WriteCloser,
 	sparseIndexWriter io.WriteCloser,
+	propertiesWriter io.WriteCloser,
+	opts ...WriterOption,
 ) *Writer {
-	return &Writer{
+	w := &Writer{
 		dataWriter:        dataWriter,
 		indexWriter:       indexWriter,
 		sparseIndexWriter: sparseIndexWriter,
+		propertiesWriter:  propertiesWriter,
+		dataBlock:         bytes.NewBuffer(nil),
+		indexBlock:        bytes.NewBuffer(nil),
+		sparseKeyDistance: DefaultSparseKeyDistance,
+		blockSize:         DefaultBlockSize,
+		comparer:          kv.BytewiseComparer,
+	}
+	for _, opt := range opts {
+		opt(w)
 	}
+	w.props.Compression = w.compressor.compression
+	w.props.ComparerName = w.comparer.Name()
+	return w
 }
 
+// Write adds key-value pair to the table. Keys must be written in ascending order.
 func (w *Writer) Write(key, value []byte) error {
-	dataBytes, err := encode(w.dataWriter, key, value)
+	if w.keys > 0 && w.comparer.Compare(key, w.lastKey) <= 0 {
+		return ErrKeysNotSorted
+	}
+	v, err := kv.DecodeValue(value)
 	if err != nil {
 		return fmt.Errorf("data write error: %w", err)
 	}
+	if w.pendingIndex {
+		if err := w.addIndexEntry(w.comparer.Separator(w.lastKey, key)); err != nil {
+			return err
+		}
+	}
 
-	indexBytes, err := encodeKeyOffset(w.indexWriter, key, w.dataPos)
+	if _, err := encode(w.dataBlock, key, value); err != nil {
+		return fmt.Errorf("data write error: %w", err)
+	}
+	w.lastKey = append(w.lastKey[:0], key...)
+	w.keys += 1
+	w.record(key, v)
+	w.addPrefix(key)
+
+	if w.dataBlock.Len() >= w.blockSize {
+		return w.flushDataBlock()
+	}
+	return nil
+}
+
+func (w *Writer) flushDataBlock() error {
+	if w.dataBlock.Len() == 0 {
+		return nil
+	}
+
+	block, err := w.compressor.compress(w.dataBlock.Bytes())
 	if err != nil {
+		return fmt.Errorf("data compression error: %w", err)
+	}
+	dataBytes, err := w.dataWriter.Write(block)
+	if err != nil {
+		return fmt.Errorf("data write error: %w", err)
+	}
+	w.pendingHandle = blockHandle{offset: w.dataPos, length: dataBytes}
+	w.pendingIndex = true
+	w.dataPos += dataBytes
+	w.dataBlock.Reset()
+	return nil
+}
+
+// addIndexEntry indexes the last written data block. Index key must not be smaller than any key of the block
+// and it must be smaller than any key of the next block.
+func (w *Writer) addIndexEntry(key []byte) error {
+	if _, err := encodeKeyHandle(w.indexBlock, key, w.pendingHandle); err != nil {
 		return fmt.Errorf("index write error: %w", err)
 	}
+	w.pendingIndex = false
+	w.lastIndexKey = append(w.lastIndexKey[:0], key...)
+	w.indexBlockEntries += 1
 
-	if w.keys%sparseKeyDistance == 0 {
-		if _, err := encodeKeyOffset(w.sparseIndexWriter, key, w.indexPos); err != nil {
-			return fmt.Errorf("sparse index write error: %w", err)
-		}
+	if w.indexBlockEntries >= w.sparseKeyDistance {
+		return w.flushIndexBlock()
 	}
+	return nil
+}
 
-	w.dataPos += dataBytes
-	w.indexPos += indexBytes
-	w.keys += 1
+func (w *Writer) flushIndexBlock() error {
+	if w.indexBlock.Len() == 0 {
+		return nil
+	}
 
+	indexBytes, err := w.indexWriter.Write(w.indexBlock.Bytes())
+	if err != nil {
+		return fmt.Errorf("index write error: %w", err)
+	}
+	handle := blockHandle{offset: w.indexPos, length: indexBytes}
+	if _, err := encodeKeyHandle(w.sparseIndexWriter, w.lastIndexKey, handle); err != nil {
+		return fmt.Errorf("sparse index write error: %w", err)
+	}
+	w.indexPos += indexBytes
+	w.indexBlock.Reset()
+	w.indexBlockEntries = 0
 	return nil
 }
 
+// record updates properties of the table with written entry
+func (w *Writer) record(key []byte, v kv.Value) {
+	if w.props.Entries == 0 {
+		w.props.SmallestKey = bytes.Clone(key)
+		w.props.SmallestSeq = v.Seq
+		w.props.LargestSeq = v.Seq
+	}
+	w.props.Entries += 1
+	if v.IsTombstone() {
+		w.props.Tombstones += 1
+	}
+	w.props.RawKeySize += len(key)
+	w.props.RawValueSize += len(v.Payload)
+	w.props.SmallestSeq = min(w.props.SmallestSeq, v.Seq)
+	w.props.LargestSeq = max(w.props.LargestSeq, v.Seq)
+}
+
+// EstimatedSize returns size of data written so far, the pending block is counted before compression
+func (w *Writer) EstimatedSize() int {
+	return w.dataPos + w.dataBlock.Len()
+}
+
+// Properties returns properties of the table. They are complete once writer is closed.
+func (w *Writer) Properties() Properties {
+	return w.props
+}
+
+// Close flushes pending blocks, records properties of the table and closes underlying writers.
+// Table is dropped when it couldn't be completed.
 func (w *Writer) Close() error {
+	if err := w.finish(); err != nil {
+		_ = w.Abort() // TODO log error
+		return err
+	}
+	if w.commit != nil {
+		return w.commit()
+	}
+	return nil
+}
+
+func (w *Writer) finish() error {
+	if err := w.flushDataBlock(); err != nil {
+		return err
+	}
+	if w.pendingIndex {
+		if err := w.addIndexEntry(w.comparer.Successor(w.lastKey)); err != nil {
+			return err
+		}
+	}
+	if err := w.flushIndexBlock(); err != nil {
+		return err
+	}
+
+	w.props.LargestKey = bytes.Clone(w.lastKey)
+	if err := w.finishRangeDels(); err != nil {
+		return err
+	}
+	if err := w.finishFilter(); err != nil {
+		return err
+	}
+	w.props.DataSize = w.dataPos
+	w.props.IndexSize = w.indexPos
+	w.props.CreatedAt = time.Now().Unix()
+	if err := w.props.encode(w.propertiesWriter); err != nil {
+		return fmt.Errorf("properties write error: %w", err)
+	}
+
 	if err := w.dataWriter.Close(); err != nil {
 		return err
 	}
@@ -67,5 +279,36 @@ func (w *Writer) Close() error {
 	if err := w.sparseIndexWriter.Close(); err != nil {
 		return err
 	}
+	if err := w.propertiesWriter.Close(); err != nil {
+		return err
+	}
+	if w.rangeDelWriter != nil {
+		if err := w.rangeDelWriter.Close(); err != nil {
+			return err
+		}
+	}
+	if w.filterWriter != nil {
+		return w.filterWriter.Close()
+	}
 	return nil
 }
+
+// Abort closes underlying writers and drops incomplete table
+func (w *Writer) Abort() error {
+	errs := []error{
+		w.dataWriter.Close(),
+		w.indexWriter.Close(),
+		w.sparseIndexWriter.Close(),
+		w.propertiesWriter.Close(),
+	}
+	if w.rangeDelWriter != nil {
+		errs = append(errs, w.rangeDelWriter.Close())
+	}
+	if w.filterWriter != nil {
+		errs = append(errs, w.filterWriter.Close())
+	}
+	if w.abort != nil {
+		errs = append(errs, w.abort())
+	}
+	return errors.Join(errs...)
+}
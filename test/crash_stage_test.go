@@ -0,0 +1,143 @@
+package test
+
+import (
+	"challenge-lsm-store/lsm"
+	"challenge-lsm-store/vfs"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/rand/v2"
+	"testing"
+)
+
+const (
+	crashDir             = "/db"
+	crashMemoryThreshold = 100 // small threshold to flush memory often
+	crashKeys            = 10
+	crashPuts            = 50 // keys are overwritten many times
+)
+
+type CrashStage struct {
+	t      *testing.T
+	random *rand.Rand
+
+	fs        *vfs.FaultFS
+	store     *lsm.Tree
+	recovered bool
+
+	acknowledged map[string][]byte          // the last acknowledged value of each key
+	allowed      map[string]map[string]bool // values which may be visible, acknowledged or not
+}
+
+func NewCrashStage(t *testing.T, seed uint64) *CrashStage {
+	return &CrashStage{
+		t:            t,
+		random:       rand.New(rand.NewPCG(seed, 1024)),
+		fs:           vfs.NewFaultFS(),
+		acknowledged: make(map[string][]byte),
+		allowed:      make(map[string]map[string]bool),
+	}
+}
+
+func (s *CrashStage) Given() *CrashStage {
+	return s
+}
+
+func (s *CrashStage) When() *CrashStage {
+	return s
+}
+
+func (s *CrashStage) Then() *CrashStage {
+	return s
+}
+
+func (s *CrashStage) And() *CrashStage {
+	return s
+}
+
+func (s *CrashStage) config() lsm.Config {
+	return lsm.Config{
+		MemoryThreshold: crashMemoryThreshold,
+		Dir:             crashDir,
+		FS:              s.fs,
+		FlushAttempts:   1, // file system never recovers from failure
+	}
+}
+
+// open opens the store on the current file system
+func (s *CrashStage) open() error {
+	storage, err := lsm.NewOSStorageProvider(s.config())
+	if err != nil {
+		return err
+	}
+	s.store, err = lsm.New(storage, s.config())
+	return err
+}
+
+func (s *CrashStage) StoreIsUpAndRunning() *CrashStage {
+	require.NoError(s.t, s.open(), "LSM store open error")
+	return s
+}
+
+func (s *CrashStage) FileSystemFailsAt(n int) *CrashStage {
+	s.fs.FailAt(n)
+	return s
+}
+
+func (s *CrashStage) Operations() int {
+	return s.fs.Operations()
+}
+
+func (s *CrashStage) KeysArePut() *CrashStage {
+	for i := 0; i < crashPuts; i++ {
+		key, value := fmt.Sprintf("key%d", i%crashKeys), fmt.Sprintf("value%d", i)
+
+		// value can be visible even if it's not acknowledged (e.g. it's written, but its sync fails)
+		if s.allowed[key] == nil {
+			s.allowed[key] = make(map[string]bool)
+		}
+		s.allowed[key][value] = true
+		if err := s.store.Put([]byte(key), []byte(value)); err == nil {
+			s.acknowledged[key] = []byte(value)
+			// older values must not be visible anymore
+			s.allowed[key] = map[string]bool{value: true}
+		}
+	}
+	return s
+}
+
+// StoreCrashes loses all data which is not durable, unsynced data is torn at random bytes
+func (s *CrashStage) StoreCrashes() *CrashStage {
+	// the store is abandoned, its background work fails on crashed file system
+	s.fs = s.fs.Crash(s.random)
+	s.store = nil
+	return s
+}
+
+func (s *CrashStage) StoreIsReopened() *CrashStage {
+	s.fs.FailAt(0)
+	require.NoError(s.t, s.open(), "LSM store reopen error")
+	return s
+}
+
+// StoreIsReopenedFailingAt tries to reopen the store when file system fails at the Nth operation
+func (s *CrashStage) StoreIsReopenedFailingAt(n int) *CrashStage {
+	s.fs.FailAt(n)
+	s.recovered = s.open() == nil
+	return s
+}
+
+func (s *CrashStage) AcknowledgedWritesArePresent() *CrashStage {
+	for key, allowed := range s.allowed {
+		v, err := s.store.Get([]byte(key))
+		require.NoErrorf(s.t, err, "get value error - key: %s", key)
+
+		if acknowledged, ok := s.acknowledged[key]; ok {
+			assert.NotNilf(s.t, v, "acknowledged value %s of key %s is lost", acknowledged, key)
+		}
+		if v != nil {
+			assert.Truef(s.t, allowed[string(v)], "unexpected value %s of key %s, allowed: %v", v, key, allowed)
+		}
+	}
+	return s
+}
@@ -0,0 +1,74 @@
+/*
+Crash tests for LSM store. File system fails at each operation in turn and then crashes, losing (or tearing)
+all data which is not durable. Store reopened after the crash must keep all acknowledged writes and
+must not expose any partial write.
+*/
+package test
+
+import (
+	"fmt"
+	"testing"
+)
+
+// maxRecoveryOperations bounds the crash loop in case recovery never completes
+const maxRecoveryOperations = 10000
+
+// operationsOfPuts returns number of file system operations done while keys are put without failures
+func operationsOfPuts(t *testing.T) int {
+	stage := NewCrashStage(t, 0)
+	stage.Given().
+		StoreIsUpAndRunning().And().
+		FileSystemFailsAt(0)
+	stage.When().
+		KeysArePut()
+	return stage.Operations()
+}
+
+func Test_LSM_ShouldKeepAcknowledgedWritesWhenCrashedDuringPutsAndFlushes(t *testing.T) {
+	operations := operationsOfPuts(t)
+
+	for failAt := 1; failAt <= operations; failAt++ {
+		t.Run(fmt.Sprintf("fail at %d", failAt), func(t *testing.T) {
+			stage := NewCrashStage(t, uint64(failAt))
+
+			stage.Given().
+				StoreIsUpAndRunning().And().
+				FileSystemFailsAt(failAt)
+
+			stage.When().
+				KeysArePut().And().
+				StoreCrashes()
+
+			stage.Then().
+				StoreIsReopened().And().
+				AcknowledgedWritesArePresent()
+		})
+	}
+}
+
+func Test_LSM_ShouldKeepAcknowledgedWritesWhenCrashedDuringRecovery(t *testing.T) {
+	operations := operationsOfPuts(t)
+
+	recovered := false
+	for failAt := 1; !recovered && failAt <= maxRecoveryOperations; failAt++ {
+		t.Run(fmt.Sprintf("fail at %d", failAt), func(t *testing.T) {
+			stage := NewCrashStage(t, uint64(failAt))
+
+			stage.Given().
+				StoreIsUpAndRunning().And().
+				FileSystemFailsAt(operations / 2).And(). // leave some WAL files to recover
+				KeysArePut().And().
+				StoreCrashes()
+
+			stage.When().
+				StoreIsReopenedFailingAt(failAt).And().
+				StoreCrashes()
+
+			stage.Then().
+				StoreIsReopened().And().
+				AcknowledgedWritesArePresent()
+
+			recovered = stage.recovered
+		})
+	}
+}
@@ -1,9 +1,12 @@
 package test
 
 import (
+	"bytes"
 	"challenge-lsm-store/lsm"
 	"challenge-lsm-store/model"
+	"challenge-lsm-store/sstable"
 	"challenge-lsm-store/storageio"
+	"challenge-lsm-store/vfs"
 	"encoding/json"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -11,6 +14,8 @@ import (
 	"math"
 	"math/rand/v2"
 	"os"
+	"path/filepath"
+	"slices"
 	"sync"
 	"testing"
 	"time"
@@ -107,20 +112,26 @@ func (s *DBStage) SegmentsAreLoadedIntoStore() *DBStage {
 		go func() {
 			defer wg.Done()
 
-			memoryStorage, err := s.storage.NewMemoryStorage()
-			require.Nil(s.t, err, "memory storage error")
-
-			for _, doc := range segment {
+			// the last document of the key wins, as it would be written last
+			docs := slices.Clone(segment)
+			slices.SortStableFunc(docs, func(a, b model.Document) int {
+				return bytes.Compare(a.Key(), b.Key())
+			})
+
+			path := filepath.Join(s.t.TempDir(), "segment")
+			builder, err := sstable.NewBuilder(vfs.Default, path)
+			require.Nil(s.t, err, "table builder error")
+			for i, doc := range docs {
+				if i+1 < len(docs) && bytes.Equal(doc.Key(), docs[i+1].Key()) {
+					continue
+				}
 				docBytes, err := json.Marshal(doc)
 				require.Nil(s.t, err, "marshal document error")
-				memoryStorage.Load(doc.Key(), docBytes)
+				require.Nil(s.t, builder.Set(doc.Key(), docBytes), "table build error")
 			}
+			require.Nil(s.t, builder.Close(), "table build error")
 
-			if si%2 == 0 {
-				// to make only part of data available in memory
-				s.store.LoadIntoMemory(memoryStorage)
-			}
-			err = s.store.WriteToFile(memoryStorage)
+			err = s.store.Ingest(path)
 			require.Nil(s.t, err, "load into store error")
 
 			s.t.Logf("segment loaded: %d (ouf of %d), documents: %d", si+1, len(s.segments.Entries), len(segment))
@@ -10,12 +10,14 @@ import (
 const (
 	// test related settings
 	// TODO could go with env vars
-	maxRetries = 20
-	retryDelay = 50 * time.Millisecond
-
 	longTestsDuration    = 2 * time.Second
 	longTestRoutineCount = 20
 	longTestTickerFreq   = 10 * time.Millisecond
+
+	// present in lsm package, copy-paste for testing on purpose
+	dirWal       = "wal"
+	dirTables    = "tables"
+	fileManifest = "MANIFEST"
 )
 
 type pair struct {
@@ -0,0 +1,110 @@
+/*
+Benchmarks for LSM store checking how it behaves when many clients access it at the same time.
+*/
+package test
+
+import (
+	"challenge-lsm-store/lsm"
+	"challenge-lsm-store/sstable"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+const (
+	benchKeys            = 10000
+	benchMemoryThreshold = 64 * 1024 // to spread keys over many table files
+	benchBlockCacheSize  = 8 * 1024 * 1024
+)
+
+func Benchmark_LSM_ParallelGetFromFiles(b *testing.B) {
+	b.Run("pread", func(b *testing.B) {
+		benchmarkParallelGet(b, lsm.Config{MemoryThreshold: benchMemoryThreshold})
+	})
+	b.Run("mmap", func(b *testing.B) {
+		benchmarkParallelGet(b, lsm.Config{MemoryThreshold: benchMemoryThreshold, ReadMode: sstable.ReadModeMmap})
+	})
+	b.Run("block cache", func(b *testing.B) {
+		benchmarkParallelGet(b, lsm.Config{MemoryThreshold: benchMemoryThreshold, BlockCacheSize: benchBlockCacheSize})
+	})
+}
+
+func benchmarkParallelGet(b *testing.B, cfg lsm.Config) {
+	cfg.Dir = b.TempDir()
+	storage, err := lsm.NewOSStorageProvider(cfg)
+	require.Nil(b, err, "OS storage provider create error")
+	tree, err := lsm.New(storage, cfg)
+	require.Nil(b, err, "LSM store create error")
+	defer func() {
+		require.Nil(b, tree.Close(), "close error")
+	}()
+
+	for i := 0; i < benchKeys; i++ {
+		key := benchKey(i)
+		require.Nil(b, tree.Put(key, key), "put error")
+	}
+	require.Nil(b, tree.Flush(context.Background()), "flush error")
+
+	for _, routines := range []int{1, 2, 4, 8, 16, 32} {
+		b.Run(fmt.Sprintf("goroutines-%d", routines), func(b *testing.B) {
+			var wg sync.WaitGroup
+			b.ResetTimer()
+
+			wg.Add(routines)
+			for r := 0; r < routines; r++ {
+				gets := b.N / routines
+				if r < b.N%routines {
+					gets++
+				}
+
+				go func(seed uint64) {
+					defer wg.Done()
+
+					random := rand.New(rand.NewPCG(seed, 1024))
+					for i := 0; i < gets; i++ {
+						if _, err := tree.Get(benchKey(random.IntN(benchKeys))); err != nil {
+							b.Errorf("get error: %s", err)
+							return
+						}
+					}
+				}(uint64(r))
+			}
+			wg.Wait()
+		})
+	}
+}
+
+// Benchmark_LSM_PartitionedParallelPut shows how write throughput grows with partitions, since each partition
+// syncs its own WAL writes of other partitions don't wait for it
+func Benchmark_LSM_PartitionedParallelPut(b *testing.B) {
+	for _, partitions := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("partitions-%d", partitions), func(b *testing.B) {
+			store, err := lsm.OpenPartitioned(b.TempDir(), lsm.HashPartitioner(partitions), lsm.WithMemtableSize(benchMemoryThreshold))
+			require.Nil(b, err, "partitioned store open error")
+
+			var n atomic.Int64
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					key := benchKey(int(n.Add(1)))
+					if err := store.Put(key, key); err != nil {
+						b.Errorf("put error: %s", err)
+						return
+					}
+				}
+			})
+			b.StopTimer()
+
+			require.Nil(b, store.Close(), "close error")
+		})
+	}
+}
+
+func benchKey(i int) []byte {
+	return []byte(fmt.Sprintf("key-%08d", i))
+}
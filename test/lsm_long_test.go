@@ -60,7 +60,9 @@ func Test_LSM_ShouldSupportManyClientsForFileWrite(t *testing.T) {
 		})
 
 	stage.Then().
-		WaitForClients()
+		WaitForClients().And().
+		MemoryIsFlushed().And().
+		StoreIsClosed() // no files are written in the background anymore
 }
 
 func Test_LSM_ShouldSupportManyClientsForMemoryRead(t *testing.T) {
@@ -109,7 +111,7 @@ func Test_LSM_ShouldSupportManyClientsForFileRead(t *testing.T) {
 			pair{key: []byte("key2"), value: []byte("value2")},
 			pair{key: []byte("key3"), value: []byte("value3")},
 		).And().
-		WaitTillNoWALFilesArePresent()
+		MemoryIsFlushed()
 
 	stage.When().
 		ManyClientsDoWithFreq(ctx, func() {
@@ -2,7 +2,9 @@ package test
 
 import (
 	"challenge-lsm-store/lsm"
+	"challenge-lsm-store/vfs"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -17,10 +19,7 @@ const (
 	inMemoryThreshold   = 1000000 //bigger threshold to make sure no file dump happens quickly
 	fileMemoryThreshold = 1       //min threshold to make sure everything is dumped into a file at once
 
-	// present in lsm package, copy-paste for testing on purpose
-	dirWal               = "wal"
-	dirTables            = "tables"
-	expFilesForEachTable = 3 //files: data, index, sparse index
+	expFilesForEachTable = 4 //files: data, index, sparse index, properties
 )
 
 type LSMStage struct {
@@ -29,6 +28,7 @@ type LSMStage struct {
 
 	store   *lsm.Tree
 	tempDir string
+	fs      *vfs.FaultFS
 
 	errPut error
 }
@@ -44,7 +44,10 @@ func NewLSMStage(t *testing.T) *LSMStage {
 }
 
 func (s *LSMStage) TearDown() {
-	// note: temp dir for test will be deleted automatically
+	// note: temp dir for test will be deleted automatically once nothing is written in the background
+	if s.store != nil {
+		_ = s.store.Close() // store can be closed by the test already
+	}
 }
 
 func (s *LSMStage) Given() *LSMStage {
@@ -67,6 +70,49 @@ func (s *LSMStage) TempDir() string {
 	return s.tempDir
 }
 
+// FileSystem returns in-memory file system with injectable faults, files of the store are checked there once it's used
+func (s *LSMStage) FileSystem() *vfs.FaultFS {
+	if s.fs == nil {
+		s.fs = vfs.NewFaultFS()
+	}
+	return s.fs
+}
+
+// FileSystemFailsToPublishTables fails writing of the manifest, so flushed tables can't be made durable
+func (s *LSMStage) FileSystemFailsToPublishTables() *LSMStage {
+	s.FileSystem().FailCreate(fmt.Sprintf("%s/%s.tmp", s.tempDir, fileManifest))
+	return s
+}
+
+func (s *LSMStage) FileSystemRecovers() *LSMStage {
+	s.FileSystem().FailAt(0)
+	return s
+}
+
+// listFiles returns names of non-empty files in the directory of the OS file system
+// or names of all entries when the store runs on the in-memory file system
+func (s *LSMStage) listFiles(dir string) ([]string, error) {
+	if s.fs != nil {
+		return s.fs.List(dir)
+	}
+	files, err := ListNonEmptyFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	return names, nil
+}
+
+func (s *LSMStage) MemoryFailsToFlush() *LSMStage {
+	ctx, cancel := TestContext()
+	defer cancel()
+	assert.Error(s.t, s.store.Flush(ctx), "flush must fail")
+	return s
+}
+
 func (s *LSMStage) StoreIsUpAndRunning(cfg lsm.Config) *LSMStage {
 	storage, err := lsm.NewOSStorageProvider(cfg)
 	require.Nil(s.t, err, "OS storage provider create error")
@@ -77,6 +123,12 @@ func (s *LSMStage) StoreIsUpAndRunning(cfg lsm.Config) *LSMStage {
 	return s
 }
 
+func (s *LSMStage) StoreCannotBeOpenedAgain(cfg lsm.Config) *LSMStage {
+	_, err := lsm.NewOSStorageProvider(cfg)
+	assert.Truef(s.t, errors.Is(err, lsm.ErrDirLocked), "store directory must be locked, got: %v", err)
+	return s
+}
+
 func (s *LSMStage) KeyValueIsPut(key, value []byte) *LSMStage {
 	s.errPut = s.store.Put(key, value)
 	return s
@@ -106,7 +158,7 @@ func (s *LSMStage) KeyValuesHaveBeenPut(v ...pair) *LSMStage {
 
 func (s *LSMStage) WALFilesArePresent() *LSMStage {
 	walDir := fmt.Sprintf("%s/%s", s.tempDir, dirWal)
-	files, err := ListNonEmptyFiles(walDir)
+	files, err := s.listFiles(walDir)
 	require.Nil(s.t, err, "WAL read dir error")
 	assert.NotEmpty(s.t, files, "no WAL files found in: %s", walDir)
 	return s
@@ -138,26 +190,50 @@ func (s *LSMStage) TableDirectoriesArePresent() *LSMStage {
 	return s
 }
 
+func (s *LSMStage) AtMostTableDirectoriesArePresent(count int) *LSMStage {
+	tablesDir := fmt.Sprintf("%s/%s", s.tempDir, dirTables)
+	files, err := ListNonEmptyFiles(tablesDir)
+	require.Nil(s.t, err, "tables read dir error")
+	assert.LessOrEqualf(s.t, len(files), count, "too many table directories found in %s: %+v", tablesDir, files)
+	return s
+}
+
+func (s *LSMStage) NothingIsWrittenToDisk() *LSMStage {
+	files, err := ListNonEmptyFiles(s.tempDir)
+	require.Nil(s.t, err, "read dir error")
+	assert.Emptyf(s.t, files, "files found in %s: %+v", s.tempDir, files)
+	return s
+}
+
 func (s *LSMStage) TableDirectoriesAreNotPresent() *LSMStage {
 	tablesDir := fmt.Sprintf("%s/%s", s.tempDir, dirTables)
-	files, err := ListNonEmptyFiles(fmt.Sprintf("%s/%s", s.tempDir, dirTables))
+	files, err := s.listFiles(tablesDir)
 	require.Nil(s.t, err, "tables read dir error")
 	assert.Emptyf(s.t, files, "table directories found in %s: %+v", tablesDir, files)
 	return s
 }
 
-func (s *LSMStage) WaitTillNoWALFilesArePresent() *LSMStage {
-	// TODO use some nice lib for re-tries here
-	for i := 0; i < maxRetries; i++ {
-		walDir := fmt.Sprintf("%s/%s", s.tempDir, dirWal)
-		files, err := ListNonEmptyFiles(walDir)
-		require.Nil(s.t, err, "WAL read dir error")
-		if len(files) == 0 {
-			break
-		}
+func (s *LSMStage) StoreIsReadOnly() *LSMStage {
+	err := s.store.Put([]byte("read-only"), []byte("read-only"))
+	assert.Truef(s.t, errors.Is(err, lsm.ErrReadOnly), "store must be read-only, got: %v", err)
+	return s
+}
 
-		time.Sleep(retryDelay)
-	}
+func (s *LSMStage) MemoryIsFlushed() *LSMStage {
+	ctx, cancel := TestContext()
+	defer cancel()
+	require.Nil(s.t, s.store.Flush(ctx), "flush error")
+	return s
+}
+
+func (s *LSMStage) StoreIsClosed() *LSMStage {
+	require.Nil(s.t, s.store.Close(), "close error")
+	s.store = nil
+	return s
+}
+
+func (s *LSMStage) TablesAreCompacted() *LSMStage {
+	require.Nil(s.t, s.store.Compact(), "compaction error")
 	return s
 }
 
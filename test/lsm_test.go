@@ -5,6 +5,8 @@ package test
 
 import (
 	"challenge-lsm-store/lsm"
+	"challenge-lsm-store/sstable"
+	"challenge-lsm-store/vfs"
 	"testing"
 )
 
@@ -83,7 +85,7 @@ func Test_LSM_ShouldDumpKeyValueFromMemoryIntoTableFile(t *testing.T) {
 
 	stage.When().
 		KeyValueIsPut([]byte("key1"), []byte("value1")).And().
-		WaitTillNoWALFilesArePresent() // it should mean that memory has been dumped into file(s)
+		MemoryIsFlushed()
 
 	stage.Then().
 		UpsertIsOK().And().
@@ -91,3 +93,178 @@ func Test_LSM_ShouldDumpKeyValueFromMemoryIntoTableFile(t *testing.T) {
 		WALFilesAreNotPresent().And().
 		TableDirectoriesArePresent()
 }
+
+func Test_LSM_ShouldReadKeyValueFromMemoryMappedTableFile(t *testing.T) {
+	stage := NewLSMStage(t)
+	defer stage.TearDown()
+
+	stage.Given().
+		StoreIsUpAndRunning(lsm.Config{
+			MemoryThreshold: fileMemoryThreshold,
+			Dir:             stage.TempDir(),
+			ReadMode:        sstable.ReadModeMmap,
+		})
+
+	stage.When().
+		KeyValuesHaveBeenPut(
+			pair{key: []byte("key1"), value: []byte("value1")},
+			pair{key: []byte("key2"), value: []byte("value2")},
+		).And().
+		MemoryIsFlushed()
+
+	stage.Then().
+		TableDirectoriesArePresent().And().
+		KeyIsPresentWithValue([]byte("key1"), []byte("value1")).And().
+		KeyIsPresentWithValue([]byte("key2"), []byte("value2"))
+}
+
+func Test_LSM_ShouldReadKeyValueFromTableFileUsingBlockCache(t *testing.T) {
+	stage := NewLSMStage(t)
+	defer stage.TearDown()
+
+	stage.Given().
+		StoreIsUpAndRunning(lsm.Config{
+			MemoryThreshold: fileMemoryThreshold,
+			Dir:             stage.TempDir(),
+			BlockCacheSize:  1024 * 1024,
+		})
+
+	stage.When().
+		KeyValuesHaveBeenPut(
+			pair{key: []byte("key1"), value: []byte("value1")},
+			pair{key: []byte("key2"), value: []byte("value2")},
+		).And().
+		MemoryIsFlushed()
+
+	stage.Then().
+		KeyIsPresentWithValue([]byte("key1"), []byte("value1")).And().
+		KeyIsPresentWithValue([]byte("key2"), []byte("value2")).And().
+		KeyIsPresentWithValue([]byte("key1"), []byte("value1"))
+}
+
+func Test_LSM_ShouldReadKeyValuesFromMoreTablesThanCanBeOpen(t *testing.T) {
+	stage := NewLSMStage(t)
+	defer stage.TearDown()
+
+	stage.Given().
+		StoreIsUpAndRunning(lsm.Config{
+			MemoryThreshold: fileMemoryThreshold,
+			Dir:             stage.TempDir(),
+			MaxOpenTables:   2,
+		})
+
+	stage.When().
+		KeyValuesHaveBeenPut(
+			pair{key: []byte("key1"), value: []byte("value1")},
+			pair{key: []byte("key2"), value: []byte("value2")},
+			pair{key: []byte("key3"), value: []byte("value3")},
+			pair{key: []byte("key4"), value: []byte("value4")},
+		).And().
+		MemoryIsFlushed()
+
+	stage.Then().
+		KeyIsPresentWithValue([]byte("key1"), []byte("value1")).And().
+		KeyIsPresentWithValue([]byte("key4"), []byte("value4")).And().
+		KeyIsPresentWithValue([]byte("key2"), []byte("value2")).And().
+		KeyIsPresentWithValue([]byte("key3"), []byte("value3"))
+}
+
+func Test_LSM_ShouldReadNewestValuesOfKeysAfterCompaction(t *testing.T) {
+	stage := NewLSMStage(t)
+	defer stage.TearDown()
+
+	stage.Given().
+		StoreIsUpAndRunning(lsm.Config{
+			MemoryThreshold:     fileMemoryThreshold,
+			Dir:                 stage.TempDir(),
+			L0CompactionTrigger: 2,
+		})
+
+	stage.When().
+		KeyValuesHaveBeenPut(
+			pair{key: []byte("key1"), value: []byte("value1")},
+			pair{key: []byte("key2"), value: []byte("value2")},
+			pair{key: []byte("key3"), value: []byte("value3")},
+			pair{key: []byte("key4"), value: []byte("value4")},
+			pair{key: []byte("key1"), value: []byte("value1-updated")},
+			pair{key: []byte("key3"), value: []byte("value3-updated")},
+		).And().
+		MemoryIsFlushed().And().
+		TablesAreCompacted()
+
+	stage.Then().
+		AtMostTableDirectoriesArePresent(2).And(). // single L1 table & at most one L0 table
+		TableDirectoriesArePresent().And().
+		KeyIsPresentWithValue([]byte("key1"), []byte("value1-updated")).And().
+		KeyIsPresentWithValue([]byte("key2"), []byte("value2")).And().
+		KeyIsPresentWithValue([]byte("key3"), []byte("value3-updated")).And().
+		KeyIsPresentWithValue([]byte("key4"), []byte("value4"))
+}
+
+func Test_LSM_ShouldKeepWALWhenTableFileCannotBeMadeDurable(t *testing.T) {
+	stage := NewLSMStage(t)
+	defer stage.TearDown()
+
+	stage.Given().
+		StoreIsUpAndRunning(lsm.Config{
+			MemoryThreshold: fileMemoryThreshold,
+			Dir:             stage.TempDir(),
+			FS:              stage.FileSystem(),
+		}).And().
+		FileSystemFailsToPublishTables()
+
+	stage.When().
+		KeyValueIsPut([]byte("key1"), []byte("value1")).And().
+		MemoryFailsToFlush()
+
+	stage.Then().
+		UpsertIsOK().And().
+		KeyIsPresentWithValue([]byte("key1"), []byte("value1")).And().
+		StoreIsReadOnly().And().
+		FileSystemRecovers().And().
+		WALFilesArePresent().And().
+		TableDirectoriesAreNotPresent()
+}
+
+func Test_LSM_ShouldStoreKeyValuesWithoutTouchingDisk(t *testing.T) {
+	stage := NewLSMStage(t)
+	defer stage.TearDown()
+
+	stage.Given().
+		StoreIsUpAndRunning(lsm.Config{
+			MemoryThreshold:     fileMemoryThreshold,
+			Dir:                 "/db",
+			FS:                  vfs.NewMemFS(),
+			L0CompactionTrigger: 2,
+		})
+
+	stage.When().
+		KeyValuesHaveBeenPut(
+			pair{key: []byte("key1"), value: []byte("value1")},
+			pair{key: []byte("key2"), value: []byte("value2")},
+			pair{key: []byte("key3"), value: []byte("value3")},
+		).And().
+		TablesAreCompacted()
+
+	stage.Then().
+		NothingIsWrittenToDisk().And().
+		KeyIsPresentWithValue([]byte("key1"), []byte("value1")).And().
+		KeyIsPresentWithValue([]byte("key2"), []byte("value2")).And().
+		KeyIsPresentWithValue([]byte("key3"), []byte("value3"))
+}
+
+func Test_LSM_ShouldNotOpenStoreUsedByAnotherProcess(t *testing.T) {
+	stage := NewLSMStage(t)
+	defer stage.TearDown()
+
+	cfg := lsm.Config{
+		MemoryThreshold: inMemoryThreshold,
+		Dir:             stage.TempDir(),
+	}
+
+	stage.Given().
+		StoreIsUpAndRunning(cfg)
+
+	stage.Then().
+		StoreCannotBeOpenedAgain(cfg)
+}
@@ -0,0 +1,483 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var ErrInjected = errors.New("injected file system fault")
+
+type (
+	// FaultFS keeps files in memory and simulates faults of a real file system:
+	//   - the Nth operation fails and so does every following one, like when the process dies in the middle of work,
+	//   - a crash loses everything which hasn't been made durable: data not synced by File.Sync and directory
+	//     entries (created, renamed or removed files) not synced by Sync of their directory,
+	//   - unsynced data can be torn on a crash at an arbitrary byte.
+	// To keep the model simple directories are durable once they are created.
+	// FaultFS is thread-safe.
+	FaultFS struct {
+		mu      sync.Mutex
+		root    *faultNode
+		locks   map[string]struct{}
+		ops     int // operations done since failures have been set
+		failAt  int // 0 means no failure
+		crashed bool
+		// failCreate keeps paths of files which can't be created, other operations are not affected
+		failCreate map[string]struct{}
+	}
+
+	// faultNode is a directory or a file
+	faultNode struct {
+		dir     bool
+		entries map[string]*faultNode // visible entries
+		durable map[string]*faultNode // entries which survive a crash
+		data    []byte
+		synced  int // length of data which survives a crash
+	}
+
+	faultHandle struct {
+		fs       *FaultFS
+		node     *faultNode
+		writable bool
+		pos      int64
+		closed   bool
+	}
+
+	faultLock struct {
+		fs   *FaultFS
+		name string
+	}
+)
+
+func NewFaultFS() *FaultFS {
+	return &FaultFS{
+		root:  newFaultDir(),
+		locks: make(map[string]struct{}),
+	}
+}
+
+func newFaultDir() *faultNode {
+	return &faultNode{
+		dir:     true,
+		entries: make(map[string]*faultNode),
+		durable: make(map[string]*faultNode),
+	}
+}
+
+// FailAt makes the Nth operation (counting from now) and all the following ones fail with ErrInjected.
+// Zero turns failures off.
+func (f *FaultFS) FailAt(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ops, f.failAt = 0, n
+	if n == 0 {
+		f.failCreate = nil
+	}
+}
+
+// FailCreate makes creation of the file fail with ErrInjected till failures are turned off by FailAt(0),
+// i.e. to fail a single step of some work while the rest of it (cleanup included) still succeeds
+func (f *FaultFS) FailCreate(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failCreate == nil {
+		f.failCreate = make(map[string]struct{})
+	}
+	f.failCreate[filepath.Clean(name)] = struct{}{}
+}
+
+// Operations returns number of operations done since failures have been set
+func (f *FaultFS) Operations() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ops
+}
+
+// Crash simulates power loss. It returns file system with data which survived the crash,
+// the crashed file system fails all operations from now on.
+// When tear is set each file keeps random part of its unsynced data, otherwise unsynced data is lost.
+func (f *FaultFS) Crash(tear *rand.Rand) *FaultFS {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.crashed = true
+
+	return &FaultFS{
+		root:  f.root.survive(tear),
+		locks: make(map[string]struct{}),
+	}
+}
+
+// survive returns copy of the node as it's seen after a crash
+func (n *faultNode) survive(tear *rand.Rand) *faultNode {
+	if !n.dir {
+		size := n.synced
+		if tear != nil && len(n.data) > n.synced {
+			size += tear.IntN(len(n.data) - n.synced + 1)
+		}
+		data := append([]byte(nil), n.data[:size]...)
+		return &faultNode{data: data, synced: len(data)}
+	}
+
+	dir := newFaultDir()
+	names := make([]string, 0, len(n.durable))
+	for name := range n.durable {
+		names = append(names, name)
+	}
+	sort.Strings(names) // torn data must be deterministic for given random source
+	for _, name := range names {
+		entry := n.durable[name].survive(tear)
+		dir.entries[name], dir.durable[name] = entry, entry
+	}
+	return dir
+}
+
+// op counts the operation and tells whether it fails. FaultFS must be locked.
+func (f *FaultFS) op() error {
+	if f.crashed {
+		return ErrInjected
+	}
+	f.ops++
+	if f.failAt > 0 && f.ops >= f.failAt {
+		return ErrInjected
+	}
+	return nil
+}
+
+// lookup returns parent directory of the path and name of the entry. FaultFS must be locked.
+func (f *FaultFS) lookup(path string) (*faultNode, string, error) {
+	parts := splitPath(path)
+	if len(parts) == 0 {
+		return nil, "", syscall.EINVAL
+	}
+	dir := f.root
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := dir.entries[part]
+		if !ok {
+			return nil, "", fs.ErrNotExist
+		}
+		if !next.dir {
+			return nil, "", syscall.ENOTDIR
+		}
+		dir = next
+	}
+	return dir, parts[len(parts)-1], nil
+}
+
+// node returns the node of the path. FaultFS must be locked.
+func (f *FaultFS) node(path string) (*faultNode, error) {
+	if len(splitPath(path)) == 0 {
+		return f.root, nil
+	}
+	dir, name, err := f.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	n, ok := dir.entries[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return n, nil
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(filepath.Clean(path), string(filepath.Separator))
+	if path == "" || path == "." {
+		return nil
+	}
+	return strings.Split(path, string(filepath.Separator))
+}
+
+func (f *FaultFS) Create(name string) (File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.op(); err != nil {
+		return nil, err
+	}
+	if _, ok := f.failCreate[filepath.Clean(name)]; ok {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: ErrInjected}
+	}
+	dir, base, err := f.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: err}
+	}
+	if n, ok := dir.entries[base]; ok && n.dir {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: syscall.EISDIR}
+	}
+	n := &faultNode{}
+	dir.entries[base] = n
+	return &faultHandle{fs: f, node: n, writable: true}, nil
+}
+
+func (f *FaultFS) Open(name string) (File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.op(); err != nil {
+		return nil, err
+	}
+	n, err := f.node(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if n.dir {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	return &faultHandle{fs: f, node: n}, nil
+}
+
+// Rename moves a file or a directory with its content
+func (f *FaultFS) Rename(oldName, newName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.op(); err != nil {
+		return err
+	}
+	oldDir, oldBase, err := f.lookup(oldName)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: err}
+	}
+	n, ok := oldDir.entries[oldBase]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: fs.ErrNotExist}
+	}
+	newDir, newBase, err := f.lookup(newName)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: err}
+	}
+	if existing, ok := newDir.entries[newBase]; ok && (existing.dir != n.dir || len(existing.entries) > 0) {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: fs.ErrExist}
+	}
+	delete(oldDir.entries, oldBase)
+	newDir.entries[newBase] = n
+	return nil
+}
+
+func (f *FaultFS) Remove(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.op(); err != nil {
+		return err
+	}
+	dir, base, err := f.lookup(name)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	n, ok := dir.entries[base]
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if n.dir && len(n.entries) > 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(dir.entries, base)
+	return nil
+}
+
+func (f *FaultFS) RemoveAll(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.op(); err != nil {
+		return err
+	}
+	dir, base, err := f.lookup(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	delete(dir.entries, base)
+	return nil
+}
+
+func (f *FaultFS) MkdirAll(dir string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.op(); err != nil {
+		return err
+	}
+	return f.mkdirAll(dir)
+}
+
+// mkdirAll creates durable directory with its parents. FaultFS must be locked.
+func (f *FaultFS) mkdirAll(dir string) error {
+	n := f.root
+	for _, part := range splitPath(dir) {
+		next, ok := n.entries[part]
+		if !ok {
+			next = newFaultDir()
+			n.entries[part], n.durable[part] = next, next
+		}
+		if !next.dir {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+		}
+		n = next
+	}
+	return nil
+}
+
+func (f *FaultFS) List(dir string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.op(); err != nil {
+		return nil, err
+	}
+	n, err := f.node(dir)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: dir, Err: err}
+	}
+	if !n.dir {
+		return nil, &fs.PathError{Op: "open", Path: dir, Err: syscall.ENOTDIR}
+	}
+	names := make([]string, 0, len(n.entries))
+	for name := range n.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Sync makes data of the file or entries of the directory durable
+func (f *FaultFS) Sync(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.op(); err != nil {
+		return err
+	}
+	n, err := f.node(name)
+	if err != nil {
+		return &fs.PathError{Op: "sync", Path: name, Err: err}
+	}
+	n.sync()
+	return nil
+}
+
+func (n *faultNode) sync() {
+	if !n.dir {
+		n.synced = len(n.data)
+		return
+	}
+	n.durable = make(map[string]*faultNode, len(n.entries))
+	for name, entry := range n.entries {
+		n.durable[name] = entry
+	}
+}
+
+func (f *FaultFS) Lock(name string) (io.Closer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.op(); err != nil {
+		return nil, err
+	}
+	name = filepath.Clean(name)
+	if _, ok := f.locks[name]; ok {
+		return nil, ErrLocked
+	}
+	if err := f.mkdirAll(filepath.Dir(name)); err != nil {
+		return nil, err
+	}
+	dir, base, err := f.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if _, ok := dir.entries[base]; !ok {
+		dir.entries[base] = &faultNode{}
+	}
+	f.locks[name] = struct{}{}
+	return &faultLock{fs: f, name: name}, nil
+}
+
+func (h *faultHandle) Read(p []byte) (int, error) {
+	n, err := h.ReadAt(p, h.pos)
+	h.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		return n, nil
+	}
+	return n, err
+}
+
+func (h *faultHandle) ReadAt(p []byte, off int64) (int, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	if err := h.fs.op(); err != nil {
+		return 0, err
+	}
+	if h.closed {
+		return 0, os.ErrClosed
+	}
+	if off >= int64(len(h.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, h.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (h *faultHandle) Write(p []byte) (int, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	if err := h.fs.op(); err != nil {
+		return 0, err
+	}
+	if h.closed {
+		return 0, os.ErrClosed
+	}
+	if !h.writable {
+		return 0, os.ErrPermission
+	}
+	h.node.data = append(h.node.data, p...)
+	return len(p), nil
+}
+
+func (h *faultHandle) Sync() error {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	if err := h.fs.op(); err != nil {
+		return err
+	}
+	if h.closed {
+		return os.ErrClosed
+	}
+	h.node.sync()
+	return nil
+}
+
+func (h *faultHandle) Close() error {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	if h.closed {
+		return os.ErrClosed
+	}
+	// file is closed even when the operation fails, like OS does
+	h.closed = true
+	return h.fs.op()
+}
+
+func (l *faultLock) Close() error {
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+	delete(l.fs.locks, l.name)
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !unix || aix || solaris
+
+package vfs
+
+import (
+	"os"
+)
+
+// lockFile fails since flock is not available, store directory can't be protected from other processes
+func lockFile(_ *os.File) error {
+	return ErrLockUnsupported
+}
@@ -0,0 +1,312 @@
+package vfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+type (
+	// MemFS keeps files in memory. It behaves like the OS file system, but nothing is kept once it's gone.
+	// MemFS is thread-safe.
+	MemFS struct {
+		mu    sync.Mutex
+		files map[string]*memFile
+		dirs  map[string]struct{}
+		locks map[string]struct{}
+	}
+
+	memFile struct {
+		mu   sync.RWMutex
+		data []byte
+	}
+
+	// memHandle is an open file, it keeps position of sequential reads
+	memHandle struct {
+		file     *memFile
+		writable bool
+		pos      int64
+		closed   atomic.Bool
+	}
+
+	memLock struct {
+		fs   *MemFS
+		name string
+	}
+)
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memFile),
+		dirs:  map[string]struct{}{"/": {}, ".": {}},
+		locks: make(map[string]struct{}),
+	}
+}
+
+func (m *MemFS) Create(name string) (File, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.dirs[name]; ok {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: syscall.EISDIR}
+	}
+	if _, ok := m.dirs[filepath.Dir(name)]; !ok {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrNotExist}
+	}
+	f := &memFile{}
+	m.files[name] = f
+	return &memHandle{file: f, writable: true}, nil
+}
+
+func (m *MemFS) Open(name string) (File, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memHandle{file: f}, nil
+}
+
+// Rename moves a file or a directory with its content
+func (m *MemFS) Rename(oldName, newName string) error {
+	oldName, newName = filepath.Clean(oldName), filepath.Clean(newName)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.dirs[filepath.Dir(newName)]; !ok {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: fs.ErrNotExist}
+	}
+	if f, ok := m.files[oldName]; ok {
+		if _, ok := m.dirs[newName]; ok {
+			return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: fs.ErrExist}
+		}
+		delete(m.files, oldName)
+		m.files[newName] = f
+		return nil
+	}
+	if _, ok := m.dirs[oldName]; !ok {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: fs.ErrNotExist}
+	}
+	if _, ok := m.files[newName]; ok || len(m.children(newName)) > 0 {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: fs.ErrExist}
+	}
+
+	for name, f := range m.files {
+		if rel, ok := under(oldName, name); ok {
+			delete(m.files, name)
+			m.files[filepath.Join(newName, rel)] = f
+		}
+	}
+	for dir := range m.dirs {
+		if rel, ok := under(oldName, dir); ok {
+			delete(m.dirs, dir)
+			m.dirs[filepath.Join(newName, rel)] = struct{}{}
+		}
+	}
+	delete(m.dirs, oldName)
+	m.dirs[newName] = struct{}{}
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if _, ok := m.dirs[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if len(m.children(name)) > 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(m.dirs, name)
+	return nil
+}
+
+func (m *MemFS) RemoveAll(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.files, name)
+	delete(m.dirs, name)
+	for file := range m.files {
+		if _, ok := under(name, file); ok {
+			delete(m.files, file)
+		}
+	}
+	for dir := range m.dirs {
+		if _, ok := under(name, dir); ok {
+			delete(m.dirs, dir)
+		}
+	}
+	return nil
+}
+
+func (m *MemFS) MkdirAll(dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mkdirAll(filepath.Clean(dir))
+}
+
+// mkdirAll creates directory with its parents. MemFS must be locked.
+func (m *MemFS) mkdirAll(dir string) error {
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, ok := m.files[d]; ok {
+			return &fs.PathError{Op: "mkdir", Path: d, Err: syscall.ENOTDIR}
+		}
+		m.dirs[d] = struct{}{}
+		if parent := filepath.Dir(d); parent == d {
+			return nil
+		}
+	}
+}
+
+func (m *MemFS) List(dir string) ([]string, error) {
+	dir = filepath.Clean(dir)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.dirs[dir]; !ok {
+		return nil, &fs.PathError{Op: "open", Path: dir, Err: fs.ErrNotExist}
+	}
+	names := m.children(dir)
+	sort.Strings(names)
+	return names, nil
+}
+
+// Sync does nothing since memory is never lost
+func (m *MemFS) Sync(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.files[name]; ok {
+		return nil
+	}
+	if _, ok := m.dirs[name]; ok {
+		return nil
+	}
+	return &fs.PathError{Op: "sync", Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *MemFS) Lock(name string) (io.Closer, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.locks[name]; ok {
+		return nil, ErrLocked
+	}
+	if _, ok := m.files[name]; !ok {
+		if err := m.mkdirAll(filepath.Dir(name)); err != nil {
+			return nil, err
+		}
+		m.files[name] = &memFile{}
+	}
+	m.locks[name] = struct{}{}
+	return &memLock{fs: m, name: name}, nil
+}
+
+// children returns names of direct entries of the directory. MemFS must be locked.
+func (m *MemFS) children(dir string) []string {
+	var names []string
+	for name := range m.files {
+		if filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	for name := range m.dirs {
+		if name != dir && filepath.Dir(name) == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	return names
+}
+
+// under tells whether the path is placed (at any depth) in the directory and returns the relative path
+func under(dir, path string) (string, bool) {
+	prefix := dir + string(filepath.Separator)
+	if dir == string(filepath.Separator) {
+		prefix = dir
+	}
+	if !strings.HasPrefix(path, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(path, prefix), true
+}
+
+func (h *memHandle) Read(p []byte) (int, error) {
+	n, err := h.ReadAt(p, h.pos)
+	h.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		return n, nil
+	}
+	return n, err
+}
+
+func (h *memHandle) ReadAt(p []byte, off int64) (int, error) {
+	if h.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	h.file.mu.RLock()
+	defer h.file.mu.RUnlock()
+
+	if off >= int64(len(h.file.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, h.file.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (h *memHandle) Write(p []byte) (int, error) {
+	if h.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	if !h.writable {
+		return 0, os.ErrPermission
+	}
+	h.file.mu.Lock()
+	defer h.file.mu.Unlock()
+
+	h.file.data = append(h.file.data, p...)
+	return len(p), nil
+}
+
+func (h *memHandle) Sync() error {
+	if h.closed.Load() {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (h *memHandle) Close() error {
+	if h.closed.Swap(true) {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (l *memLock) Close() error {
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+	delete(l.fs.locks, l.name)
+	return nil
+}
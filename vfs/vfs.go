@@ -0,0 +1,125 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	fileCreateFlags = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	fileOpenFlags   = os.O_RDONLY
+	fileCreateMode  = 0o666
+	dirMode         = 0o755
+)
+
+var (
+	ErrLocked = errors.New("file is locked by another process")
+	// ErrLockUnsupported is returned by Lock of the OS file system on platforms without flock
+	ErrLockUnsupported = errors.New("file locking is not supported on this platform")
+)
+
+type (
+	// FS is a set of file system operations used by the store to keep its files.
+	// It makes possible to run the store in memory or to inject faults while testing.
+	FS interface {
+		// Create creates (or truncates) a file for writing
+		Create(name string) (File, error)
+		// Open opens a file for reading
+		Open(name string) (File, error)
+		Rename(oldName, newName string) error
+		// Remove removes a file or an empty directory
+		Remove(name string) error
+		// RemoveAll removes a file or a directory with its content
+		RemoveAll(name string) error
+		MkdirAll(dir string) error
+		// List returns sorted names of directory entries
+		List(dir string) ([]string, error)
+		// Sync makes content of the file or the directory (i.e. its entries) durable
+		Sync(name string) error
+		// Lock acquires exclusive lock of the file (creating it when needed). Lock is released once closed.
+		// ErrLocked is returned when the file is locked already.
+		Lock(name string) (io.Closer, error)
+	}
+
+	// File is a file opened for reading or writing. Writes always append data at the end of the file.
+	File interface {
+		io.Reader
+		io.ReaderAt
+		io.WriteCloser
+		Sync() error
+	}
+
+	osFS struct{}
+)
+
+// Default is the OS file system
+var Default FS = osFS{}
+
+func (osFS) Create(name string) (File, error) {
+	return os.OpenFile(name, fileCreateFlags, fileCreateMode)
+}
+
+func (osFS) Open(name string) (File, error) {
+	return os.OpenFile(name, fileOpenFlags, 0)
+}
+
+func (osFS) Rename(oldName, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+func (osFS) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, dirMode)
+}
+
+func (osFS) List(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (osFS) Sync(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close() // TODO log error
+		return err
+	}
+	return f.Close()
+}
+
+// Lock locks the file using flock, ErrLockUnsupported is returned on platforms without it
+func (osFS) Lock(name string) (io.Closer, error) {
+	if err := os.MkdirAll(filepath.Dir(name), dirMode); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, fileCreateMode)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		_ = f.Close() // TODO log error
+		return nil, err
+	}
+	// closing the file releases the lock
+	return f, nil
+}
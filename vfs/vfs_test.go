@@ -0,0 +1,242 @@
+package vfs_test
+
+import (
+	"challenge-lsm-store/vfs"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"math/rand/v2"
+	"path/filepath"
+	"testing"
+)
+
+// fileSystems returns all implementations with a directory which can be used by the test
+func fileSystems(t *testing.T) map[string]func() (vfs.FS, string) {
+	return map[string]func() (vfs.FS, string){
+		"os": func() (vfs.FS, string) {
+			return vfs.Default, t.TempDir()
+		},
+		"memory": func() (vfs.FS, string) {
+			return vfs.NewMemFS(), "/db"
+		},
+		"fault": func() (vfs.FS, string) {
+			return vfs.NewFaultFS(), "/db"
+		},
+	}
+}
+
+func Test_VFS_CreateWriteRead(t *testing.T) {
+	for name, newFS := range fileSystems(t) {
+		t.Run(name, func(t *testing.T) {
+			fs, dir := newFS()
+			require.NoError(t, fs.MkdirAll(filepath.Join(dir, "sub")), "mkdir error")
+			path := filepath.Join(dir, "sub", "file")
+
+			//GIVEN file with content
+			f, err := fs.Create(path)
+			require.NoError(t, err, "create error")
+			_, err = f.Write([]byte("hello "))
+			require.NoError(t, err, "write error")
+			_, err = f.Write([]byte("world"))
+			require.NoError(t, err, "write error")
+			require.NoError(t, f.Sync(), "sync error")
+			require.NoError(t, f.Close(), "close error")
+			require.NoError(t, fs.Sync(filepath.Join(dir, "sub")), "dir sync error")
+
+			//WHEN file is opened
+			f, err = fs.Open(path)
+			require.NoError(t, err, "open error")
+
+			//THEN content can be read sequentially and at given position
+			content, err := io.ReadAll(f)
+			require.NoError(t, err, "read error")
+			assert.Equal(t, []byte("hello world"), content, "unexpected content")
+			part := make([]byte, 5)
+			_, err = f.ReadAt(part, 6)
+			require.NoError(t, err, "read at error")
+			assert.Equal(t, []byte("world"), part, "unexpected part")
+			require.NoError(t, f.Close(), "close error")
+
+			//AND file can't be created in not existing directory
+			_, err = fs.Create(filepath.Join(dir, "missing", "file"))
+			assert.Error(t, err, "missing directory")
+			_, err = fs.Open(filepath.Join(dir, "missing-file"))
+			assert.Error(t, err, "missing file")
+		})
+	}
+}
+
+func Test_VFS_RenameListRemove(t *testing.T) {
+	for name, newFS := range fileSystems(t) {
+		t.Run(name, func(t *testing.T) {
+			fs, dir := newFS()
+
+			//GIVEN directory with files
+			tmp := filepath.Join(dir, "table.tmp")
+			require.NoError(t, fs.MkdirAll(tmp), "mkdir error")
+			for _, file := range []string{"b", "a"} {
+				f, err := fs.Create(filepath.Join(tmp, file))
+				require.NoError(t, err, "create error")
+				require.NoError(t, f.Close(), "close error")
+			}
+
+			//WHEN directory is renamed
+			table := filepath.Join(dir, "table")
+			require.NoError(t, fs.Rename(tmp, table), "rename error")
+
+			//THEN its files are moved
+			names, err := fs.List(dir)
+			require.NoError(t, err, "list error")
+			assert.Equal(t, []string{"table"}, names, "unexpected directory entries")
+			names, err = fs.List(table)
+			require.NoError(t, err, "list error")
+			assert.Equal(t, []string{"a", "b"}, names, "unexpected table entries")
+
+			//AND non-empty directory can't be removed
+			assert.Error(t, fs.Remove(table), "directory is not empty")
+			require.NoError(t, fs.Remove(filepath.Join(table, "a")), "remove file error")
+			require.NoError(t, fs.RemoveAll(table), "remove all error")
+			names, err = fs.List(dir)
+			require.NoError(t, err, "list error")
+			assert.Empty(t, names, "no entries expected")
+		})
+	}
+}
+
+func Test_VFS_Lock(t *testing.T) {
+	for name, newFS := range fileSystems(t) {
+		t.Run(name, func(t *testing.T) {
+			fs, dir := newFS()
+			path := filepath.Join(dir, "LOCK")
+
+			//GIVEN locked file
+			lock, err := fs.Lock(path)
+			require.NoError(t, err, "lock error")
+
+			//WHEN file is locked again
+			_, err = fs.Lock(path)
+
+			//THEN it fails till the lock is released
+			assert.Equal(t, vfs.ErrLocked, err, "file must be locked")
+			require.NoError(t, lock.Close(), "unlock error")
+			lock, err = fs.Lock(path)
+			require.NoError(t, err, "lock error")
+			require.NoError(t, lock.Close(), "unlock error")
+		})
+	}
+}
+
+func Test_VFS_FaultFS_CrashDropsUnsyncedData(t *testing.T) {
+	fs := vfs.NewFaultFS()
+	require.NoError(t, fs.MkdirAll("/db"), "mkdir error")
+
+	//GIVEN synced file with unsynced tail
+	f, err := fs.Create("/db/synced")
+	require.NoError(t, err, "create error")
+	_, err = f.Write([]byte("hello"))
+	require.NoError(t, err, "write error")
+	require.NoError(t, f.Sync(), "sync error")
+	_, err = f.Write([]byte(" world"))
+	require.NoError(t, err, "write error")
+	require.NoError(t, fs.Sync("/db"), "dir sync error")
+	//AND synced file which entry is not synced
+	f, err = fs.Create("/db/unlinked")
+	require.NoError(t, err, "create error")
+	_, err = f.Write([]byte("lost"))
+	require.NoError(t, err, "write error")
+	require.NoError(t, f.Sync(), "sync error")
+	//AND renamed file which new name is not synced
+	require.NoError(t, fs.Rename("/db/synced", "/db/renamed"), "rename error")
+
+	//WHEN file system crashes
+	crashed := fs.Crash(nil)
+
+	//THEN only synced data and entries survive
+	names, err := crashed.List("/db")
+	require.NoError(t, err, "list error")
+	assert.Equal(t, []string{"synced"}, names, "unexpected directory entries")
+	f, err = crashed.Open("/db/synced")
+	require.NoError(t, err, "open error")
+	content, err := io.ReadAll(f)
+	require.NoError(t, err, "read error")
+	assert.Equal(t, []byte("hello"), content, "unsynced data must be lost")
+	//AND crashed file system can't be used anymore
+	_, err = fs.List("/db")
+	assert.Equal(t, vfs.ErrInjected, err, "crashed file system must fail")
+}
+
+func Test_VFS_FaultFS_CrashTearsUnsyncedData(t *testing.T) {
+	fs := vfs.NewFaultFS()
+
+	//GIVEN file with unsynced data
+	f, err := fs.Create("/file")
+	require.NoError(t, err, "create error")
+	require.NoError(t, fs.Sync("/"), "dir sync error")
+	_, err = f.Write([]byte("hello world"))
+	require.NoError(t, err, "write error")
+
+	//WHEN file system crashes many times
+	sizes := make(map[int]struct{})
+	random := rand.New(rand.NewPCG(1, 2))
+	for i := 0; i < 100; i++ {
+		f, err := fs.Crash(random).Open("/file")
+		require.NoError(t, err, "open error")
+		content, err := io.ReadAll(f)
+		require.NoError(t, err, "read error")
+
+		//THEN file keeps prefix of the written data
+		assert.Equal(t, []byte("hello world")[:len(content)], content, "torn data must be a prefix")
+		sizes[len(content)] = struct{}{}
+	}
+	//AND data is torn at different bytes
+	assert.Greater(t, len(sizes), 1, "data must be torn at different bytes")
+}
+
+func Test_VFS_FaultFS_FailAt(t *testing.T) {
+	fs := vfs.NewFaultFS()
+
+	//GIVEN file system which fails the third operation
+	fs.FailAt(3)
+
+	//WHEN operations are done
+	require.NoError(t, fs.MkdirAll("/db"), "first operation must succeed")
+	f, err := fs.Create("/db/file")
+	require.NoError(t, err, "second operation must succeed")
+	_, err = f.Write([]byte("data"))
+
+	//THEN the third one and all the following ones fail
+	assert.Equal(t, vfs.ErrInjected, err, "third operation must fail")
+	assert.Equal(t, vfs.ErrInjected, fs.Sync("/db"), "following operation must fail")
+	assert.Equal(t, 4, fs.Operations(), "unexpected number of operations")
+
+	//WHEN failures are turned off
+	fs.FailAt(0)
+
+	//THEN operations succeed again
+	assert.NoError(t, fs.Sync("/db"), "operation must succeed")
+}
+
+func Test_VFS_FaultFS_FailCreate(t *testing.T) {
+	fs := vfs.NewFaultFS()
+	require.NoError(t, fs.MkdirAll("/db"), "mkdir error")
+
+	//GIVEN file system which fails creation of a file
+	fs.FailCreate("/db/file")
+
+	//THEN the file can't be created
+	_, err := fs.Create("/db/file")
+	assert.True(t, errors.Is(err, vfs.ErrInjected), "creation must fail")
+	//AND other operations succeed
+	f, err := fs.Create("/db/other")
+	require.NoError(t, err, "other file must be created")
+	require.NoError(t, f.Close(), "close error")
+	assert.NoError(t, fs.Rename("/db/other", "/db/renamed"), "rename must succeed")
+
+	//WHEN failures are turned off
+	fs.FailAt(0)
+
+	//THEN the file can be created
+	_, err = fs.Create("/db/file")
+	assert.NoError(t, err, "creation must succeed")
+}
@@ -1,31 +1,25 @@
 package wal
 
-import "os"
+import "challenge-lsm-store/vfs"
 
 const (
-	fileWriteFlags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
-	fileReadFlags  = os.O_RDONLY
-
-	fileWriteOnlyMode = 0o222
-	fileReadOnlyMode  = 0o444
-
 	FileExtension = "wal"
 )
 
-func NewFileReader(path string) (*Reader, error) {
-	file, err := os.OpenFile(path, fileReadFlags, fileReadOnlyMode)
+func NewFileReader(fs vfs.FS, path string) (*Reader, error) {
+	file, err := fs.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	return NewReader(file), nil
 }
 
-func NewFileWriter(path string) (*Writer, error) {
-	file, err := os.OpenFile(path, fileWriteFlags, fileWriteOnlyMode)
+func NewFileWriter(fs vfs.FS, path string, opts ...WriterOption) (*Writer, error) {
+	file, err := fs.Create(path)
 	if err != nil {
 		return nil, err
 	}
 	return NewWriter(file, file.Sync, func() error {
-		return os.Remove(path)
-	}), nil
+		return fs.Remove(path)
+	}, opts...), nil
 }
@@ -12,6 +12,7 @@ type version uint8
 
 const (
 	v1 version = 1
+	v2 version = 2
 )
 
 var ErrInvalidVersion = errors.New("invalid entry version")
@@ -94,3 +95,90 @@ func (e *EntryV1) Validate() error {
 	}
 	return nil
 }
+
+// EntryV2 is a change of a column family
+type EntryV2 struct {
+	Family uint32
+	Key    []byte
+	Value  []byte
+}
+
+// BatchV2 keeps changes of many column families which are applied atomically, it's written as a single record
+type BatchV2 struct {
+	Entries []EntryV2
+}
+
+func (b *BatchV2) Encode(buff *bytes.Buffer) error {
+	for _, e := range b.Entries {
+		if len(e.Key) == 0 {
+			return ErrInvalidEmptyKey
+		}
+	}
+
+	buff.WriteByte(byte(v2))
+	buff.Write(binary.AppendUvarint(nil, uint64(len(b.Entries))))
+	for _, e := range b.Entries {
+		buff.Write(binary.AppendUvarint(nil, uint64(e.Family)))
+		buff.Write(binary.AppendUvarint(nil, uint64(len(e.Key))))
+		buff.Write(e.Key)
+		buff.Write(binary.AppendUvarint(nil, uint64(len(e.Value))))
+		buff.Write(e.Value)
+	}
+	return nil
+}
+
+// Decode reads a batch. Entry written by EntryV1 is read as a batch with a single change of family 0.
+func (b *BatchV2) Decode(buff *bytes.Buffer) error {
+	if buff.Len() > 0 && version(buff.Bytes()[0]) == v1 {
+		var e EntryV1
+		if err := e.Decode(buff); err != nil {
+			return err
+		}
+		b.Entries = []EntryV2{{Key: e.Key, Value: e.Value}}
+		return nil
+	}
+
+	v, err := buff.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version(v) != v2 {
+		return ErrInvalidVersion
+	}
+
+	count, err := binary.ReadUvarint(buff)
+	if err != nil {
+		return err
+	}
+	b.Entries = make([]EntryV2, 0, min(count, uint64(buff.Len())))
+	for i := uint64(0); i < count; i++ {
+		var e EntryV2
+		family, err := binary.ReadUvarint(buff)
+		if err != nil {
+			return err
+		}
+		e.Family = uint32(family)
+		if e.Key, err = readBlock(buff); err != nil {
+			return err
+		}
+		if e.Value, err = readBlock(buff); err != nil {
+			return err
+		}
+		b.Entries = append(b.Entries, e)
+	}
+	return nil
+}
+
+// readBlock reads bytes prefixed by their length
+func readBlock(buff *bytes.Buffer) ([]byte, error) {
+	n, err := binary.ReadUvarint(buff)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(buff.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	block := make([]byte, n)
+	_, err = io.ReadFull(buff, block)
+	return block, err
+}
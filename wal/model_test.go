@@ -69,3 +69,34 @@ func Test_WAL_V1_DecodeWrongEntry(t *testing.T) {
 	err = e.Decode(r)
 	assert.Equal(t, ErrInvalidVersion, err)
 }
+
+func Test_WAL_V2_EncodeDecodeBatch(t *testing.T) {
+	t.Parallel()
+
+	batch := BatchV2{Entries: []EntryV2{
+		{Family: 0, Key: []byte("key1"), Value: []byte("value1")},
+		{Family: 7, Key: []byte("key2"), Value: []byte{}},
+		{Family: 1 << 20, Key: []byte("key3"), Value: []byte("value3")},
+	}}
+	w := bytes.NewBuffer(nil)
+	require.Nil(t, batch.Encode(w), "encode error")
+
+	decoded := BatchV2{}
+	require.Nil(t, decoded.Decode(bytes.NewBuffer(w.Bytes())), "decode error")
+	assert.Equal(t, batch, decoded, "unexpected batch")
+
+	invalid := BatchV2{Entries: []EntryV2{{Family: 1, Value: []byte("value")}}}
+	assert.Equal(t, ErrInvalidEmptyKey, invalid.Encode(bytes.NewBuffer(nil)), "entry without key must be rejected")
+}
+
+func Test_WAL_V2_DecodeV1Entry(t *testing.T) {
+	t.Parallel()
+
+	w := bytes.NewBuffer(nil)
+	entry := EntryV1{Key: []byte("key1"), Value: []byte("value1")}
+	require.Nil(t, entry.Encode(w), "encode error")
+
+	decoded := BatchV2{}
+	require.Nil(t, decoded.Decode(bytes.NewBuffer(w.Bytes())), "decode error")
+	assert.Equal(t, []EntryV2{{Family: 0, Key: entry.Key, Value: entry.Value}}, decoded.Entries, "unexpected entries")
+}
@@ -80,6 +80,30 @@ func Test_WAL_WriteRead(t *testing.T) {
 	}
 }
 
+func Test_WAL_WriteWithoutSync(t *testing.T) {
+	t.Parallel()
+
+	//GIVEN a writer which doesn't sync written entries
+	writer := testWriter{
+		buff: bytes.NewBuffer(nil),
+	}
+	w := wal.NewWriter(&writer, writer.Sync, nil, wal.WithoutSyncOnWrite())
+
+	//WHEN entries are written
+	require.Nil(t, w.Write([]byte("line 1")), "write error")
+	require.Nil(t, w.Write([]byte("line 2")), "write error")
+
+	//THEN entries are not synced
+	assert.Equal(t, 0, writer.sync, "unexpected sync")
+
+	//WHEN writer is synced explicitly
+	require.Nil(t, w.Sync(), "sync error")
+
+	//THEN entries are synced at once
+	assert.Equal(t, 1, writer.sync, "unexpected sync")
+	require.Nil(t, w.Close(), "write close error")
+}
+
 func (m *testWriter) Write(p []byte) (n int, err error) {
 	return m.buff.Write(p)
 }
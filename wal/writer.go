@@ -14,15 +14,31 @@ type Writer struct {
 	checksumWriter *storageio.ChecksumWriter
 	sync           WriterSync
 	delete         WriterDelete
+	syncOnWrite    bool
 }
 
-func NewWriter(w io.WriteCloser, sync WriterSync, delete WriterDelete) *Writer {
-	return &Writer{
+// WriterOption changes default settings of the writer
+type WriterOption func(w *Writer)
+
+// WithoutSyncOnWrite leaves written entries in OS buffers till Sync is called. By default, each entry is synced.
+func WithoutSyncOnWrite() WriterOption {
+	return func(w *Writer) {
+		w.syncOnWrite = false
+	}
+}
+
+func NewWriter(w io.WriteCloser, sync WriterSync, delete WriterDelete, opts ...WriterOption) *Writer {
+	writer := &Writer{
 		writer:         w,
 		checksumWriter: storageio.NewChecksumWriter(w),
 		sync:           sync,
 		delete:         delete,
+		syncOnWrite:    true,
+	}
+	for _, opt := range opts {
+		opt(writer)
 	}
+	return writer
 }
 
 func (w *Writer) Write(bytes []byte) error {
@@ -41,6 +57,14 @@ func (w *Writer) Write(bytes []byte) error {
 		return err
 	}
 
+	if !w.syncOnWrite {
+		return nil
+	}
+	return w.sync()
+}
+
+// Sync makes written entries durable
+func (w *Writer) Sync() error {
 	return w.sync()
 }
 